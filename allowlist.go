@@ -0,0 +1,81 @@
+package git_sync
+
+import (
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrRepoNotAllowed is returned when the repository of a request is not on the RepoAllowlist
+var ErrRepoNotAllowed = errors.New("repository is not allowed")
+
+// RepoAllowlist is the patterns of the repository URLs requests may use. Patterns with glob characters
+// (*, ? or [) are matched with path.Match, e.g. https://github.com/org/*.git. Otherwise the scheme and host
+// must be equal, and the path must be equal or below the path of the pattern, by whole segments,
+// e.g. https://github.com/org. URLs are matched without credentials. An empty list allows any repository
+type RepoAllowlist []string
+
+// Allows reports whether the repository URL matches a pattern
+func (l RepoAllowlist) Allows(repoURL string) bool {
+	if len(l) == 0 {
+		return true
+	}
+	u, err := url.Parse(repoURL)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	// a pattern like https://host/org must not reach https://host/other through dot segments
+	for _, segment := range strings.Split(u.Path, "/") {
+		if segment == "." || segment == ".." {
+			return false
+		}
+	}
+	u.User = nil
+	normalized := u.String()
+
+	for _, pattern := range l {
+		if strings.ContainsAny(pattern, "*?[") {
+			if ok, err := path.Match(pattern, normalized); err == nil && ok {
+				return true
+			}
+			continue
+		}
+		if matchesPrefix(pattern, u) {
+			return true
+		}
+	}
+	return false
+}
+
+// whether the URL has the scheme and host of the pattern, and a path equal to or below its path.
+// A raw string prefix would let https://github.com/org match https://github.com/org-evil and
+// https://github.com.evil.com
+func matchesPrefix(pattern string, u *url.URL) bool {
+	p, err := url.Parse(pattern)
+	if err != nil || p.Host == "" {
+		return false
+	}
+	if !strings.EqualFold(p.Scheme, u.Scheme) || !strings.EqualFold(p.Host, u.Host) {
+		return false
+	}
+	prefix := strings.TrimSuffix(p.Path, "/")
+	return prefix == "" || u.Path == prefix || strings.HasPrefix(u.Path, prefix+"/")
+}
+
+// ValidateRepoAllowlist checks the syntax of the glob patterns, and that the other patterns are URLs with a host
+func ValidateRepoAllowlist(patterns []string) error {
+	for _, pattern := range patterns {
+		if strings.ContainsAny(pattern, "*?[") {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return errors.Wrapf(err, "invalid pattern '%s'", pattern)
+			}
+			continue
+		}
+		if u, err := url.Parse(pattern); err != nil || u.Scheme == "" || u.Host == "" {
+			return errors.Errorf("invalid pattern '%s', expected a URL with scheme and host", pattern)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package git_sync
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestRepoAllowlist(t *testing.T) {
+	allowed := RepoAllowlist{"https://github.com/org/", "https://git.example.com/*/*.git"}
+	tcs := map[string]bool{
+		"https://github.com/org/repo.git":                  true,
+		"https://token@github.com/org/repo.git":            true,
+		"https://git.example.com/team/repo.git":            true,
+		"https://github.com/other/repo.git":                false,
+		"https://github.com/organization/repo.git":         false,
+		"https://github.com/org/../other/repo.git":         false,
+		"https://github.com@evil.example.com/org/repo.git": false,
+		"https://git.example.com/team/sub/repo.git":        false,
+		"http://169.254.169.254/latest/meta-data":          false,
+		"not a url": false,
+	}
+	for repoURL, expected := range tcs {
+		if actual := allowed.Allows(repoURL); actual != expected {
+			t.Errorf("%s: expected allowed %v, got %v", repoURL, expected, actual)
+		}
+	}
+
+	// without a trailing /, the path still matches by whole segments, and the host exactly
+	allowed = RepoAllowlist{"https://github.com/org"}
+	tcs = map[string]bool{
+		"https://github.com/org":                    true,
+		"https://github.com/org/repo.git":           true,
+		"https://GitHub.com/org/repo.git":           true,
+		"https://github.com/org-evil/repo.git":      false,
+		"https://github.com.evil.com/org/repo.git":  false,
+		"https://github.com:8443/org/repo.git":      false,
+		"http://github.com/org/repo.git":            false,
+		"https://evil.com/https://github.com/org/x": false,
+	}
+	for repoURL, expected := range tcs {
+		if actual := allowed.Allows(repoURL); actual != expected {
+			t.Errorf("%s: expected allowed %v, got %v", repoURL, expected, actual)
+		}
+	}
+
+	if !(RepoAllowlist{}).Allows("http://localhost/repo.git") {
+		t.Error("expected an empty allowlist to allow any repository")
+	}
+	if err := ValidateRepoAllowlist([]string{"https://host/["}); err == nil {
+		t.Error("expected an invalid pattern to be rejected")
+	}
+	if err := ValidateRepoAllowlist([]string{"github.com/org"}); err == nil {
+		t.Error("expected a pattern without scheme to be rejected")
+	}
+}
+
+func TestPullRepoNotAllowed(t *testing.T) {
+	server := httptest.NewServer(NewGitPullHandler(t.TempDir(), HandlerOptions{AllowedRepos: RepoAllowlist{"https://github.com/org/"}}))
+	t.Cleanup(server.Close)
+
+	resp, err := server.Client().Get(server.URL + "?" + url.Values{"repository": {"http://localhost/repo.git"}, "branch": {"main"}}.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected status %d, got %d", http.StatusForbidden, resp.StatusCode)
+	}
+}
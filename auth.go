@@ -0,0 +1,238 @@
+package git_sync
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrNoAuth       = errors.New("no supported authentication provided")
+	ErrInvalidToken = errors.New("invalid token")
+)
+
+// AuthMode defines how the token of inbound requests is used
+type AuthMode string
+
+const (
+	// AuthModePassthrough relays the inbound token to the remote repository, which decides
+	// whether it is valid. A token rejected by the remote results in 401.
+	// Note that a remote allowing anonymous reads will accept any token on pull
+	AuthModePassthrough AuthMode = "passthrough"
+
+	// AuthModeServer authenticates to the remote with the configured remote token, ignoring
+	// any inbound token. The inbound token must be validated separately with RequireToken (401 if invalid).
+	// A remote token rejected by the remote is a server misconfiguration and results in 502
+	AuthModeServer AuthMode = "server"
+)
+
+func ParseAuthMode(s string) (AuthMode, error) {
+	switch m := AuthMode(s); m {
+	case AuthModePassthrough, AuthModeServer:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unsupported auth mode '%s', expected %s or %s", s, AuthModePassthrough, AuthModeServer)
+	}
+}
+
+// AuthExtractor extracts the token used to authenticate to the remote repository from a request.
+// Returns ErrNoAuth (possibly wrapped) if the request does not carry a token in the supported scheme
+type AuthExtractor interface {
+	ExtractToken(r *http.Request) (string, error)
+}
+
+// BearerAuth extracts the token from 'Authorization: Bearer <token>'
+type BearerAuth struct{}
+
+func (BearerAuth) ExtractToken(r *http.Request) (string, error) {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		return "", errors.Wrap(ErrNoAuth, "no Authorization header")
+	}
+
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		return "", errors.Wrap(ErrNoAuth, "invalid Authorization header, expected Bearer")
+	}
+
+	token := strings.TrimPrefix(authHeader, "Bearer ")
+	if token == "" {
+		return "", errors.Wrap(ErrNoAuth, "empty Bearer token")
+	}
+	return token, nil
+}
+
+// BasicAuth extracts the token as the password of 'Authorization: Basic ...'. The username is ignored
+type BasicAuth struct{}
+
+func (BasicAuth) ExtractToken(r *http.Request) (string, error) {
+	_, password, ok := r.BasicAuth()
+	if !ok {
+		return "", errors.Wrap(ErrNoAuth, "no or invalid Basic Authorization header")
+	}
+	if password == "" {
+		return "", errors.Wrap(ErrNoAuth, "empty Basic Authorization password")
+	}
+	return password, nil
+}
+
+// HeaderAuth extracts the token from a custom header, e.g. X-Forwarded-Access-Token
+type HeaderAuth struct {
+	Header string
+}
+
+func (a HeaderAuth) ExtractToken(r *http.Request) (string, error) {
+	token := strings.TrimSpace(r.Header.Get(a.Header))
+	if token == "" {
+		return "", errors.Wrapf(ErrNoAuth, "no %s header", a.Header)
+	}
+	return token, nil
+}
+
+// StaticToken ignores the request, and always returns the token
+type StaticToken string
+
+func (t StaticToken) ExtractToken(*http.Request) (string, error) {
+	return string(t), nil
+}
+
+// MultiAuth tries each extractor in order, and returns the first token found
+type MultiAuth []AuthExtractor
+
+func (m MultiAuth) ExtractToken(r *http.Request) (string, error) {
+	var msgs []string
+	for _, a := range m {
+		token, err := a.ExtractToken(r)
+		if err == nil {
+			return token, nil
+		}
+		if !errors.Is(err, ErrNoAuth) {
+			return "", err
+		}
+		msgs = append(msgs, strings.TrimSuffix(err.Error(), ": "+ErrNoAuth.Error()))
+	}
+	return "", errors.Wrap(ErrNoAuth, strings.Join(msgs, ", "))
+}
+
+// NewAuthExtractor creates an extractor from a comma separated list of schemes, tried in order.
+// Supported schemes are 'bearer', 'basic' and 'header:<name>'
+func NewAuthExtractor(schemes string) (AuthExtractor, error) {
+	var m MultiAuth
+	for _, scheme := range strings.Split(schemes, ",") {
+		scheme = strings.TrimSpace(scheme)
+		name, arg, _ := strings.Cut(scheme, ":")
+		switch strings.ToLower(name) {
+		case "bearer":
+			m = append(m, BearerAuth{})
+		case "basic":
+			m = append(m, BasicAuth{})
+		case "header":
+			if arg == "" {
+				return nil, fmt.Errorf("auth scheme 'header' requires a header name, e.g. header:X-Forwarded-Access-Token")
+			}
+			m = append(m, HeaderAuth{Header: arg})
+		default:
+			return nil, fmt.Errorf("unsupported auth scheme '%s'", scheme)
+		}
+	}
+
+	if len(m) == 1 {
+		return m[0], nil
+	}
+	return m, nil
+}
+
+// challenge of the WWW-Authenticate header of 401 responses, so clients know the supported schemes.
+// Empty for extractors without a standard scheme, e.g. HeaderAuth
+func challenge(auth AuthExtractor) string {
+	switch a := auth.(type) {
+	case BearerAuth:
+		return "Bearer"
+	case BasicAuth:
+		return `Basic realm="git_sync"`
+	case MultiAuth:
+		var challenges []string
+		for _, e := range a {
+			if c := challenge(e); c != "" {
+				challenges = append(challenges, c)
+			}
+		}
+		return strings.Join(challenges, ", ")
+	}
+	return ""
+}
+
+// write 401 with the challenge of the extractor
+func writeUnauthorized(w http.ResponseWriter, auth AuthExtractor, msg string) {
+	if c := challenge(auth); c != "" {
+		w.Header().Set("WWW-Authenticate", c)
+	}
+	http.Error(w, msg, http.StatusUnauthorized)
+}
+
+// write response when the remote repository rejected the token (ErrAuthFailed)
+func (opts HandlerOptions) writeRemoteAuthError(w http.ResponseWriter) {
+	if opts.AuthMode == AuthModeServer {
+		http.Error(w, "the server failed to authenticate to the remote repository", http.StatusBadGateway)
+		return
+	}
+	// the extractor of passthrough mode does not depend on the repository
+	writeUnauthorized(w, opts.authExtractor(""), "authentication required")
+}
+
+// RequireToken is middleware rejecting requests with 401, unless auth extracts the token.
+// No further handling is done for rejected requests
+func RequireToken(token string, auth AuthExtractor, next http.Handler) http.Handler {
+	return RequireTokens([]string{token}, auth, next)
+}
+
+// RequireTokens is RequireToken accepting any of the tokens, e.g. both the old and new token while rotating
+func RequireTokens(tokens []string, auth AuthExtractor, next http.Handler) http.Handler {
+	return requireToken(func() []string { return tokens }, auth, next)
+}
+
+// RequireTokenFile is RequireTokens with the comma-separated tokens of the file (see SplitTokens),
+// so rotated tokens are required once reloaded
+func RequireTokenFile(f *TokenFile, auth AuthExtractor, next http.Handler) http.Handler {
+	return requireToken(func() []string { return SplitTokens(f.Token()) }, auth, next)
+}
+
+// SplitTokens splits comma-separated tokens, e.g. the old and new token while rotating, and trims spaces
+func SplitTokens(s string) []string {
+	var tokens []string
+	for _, token := range strings.Split(s, ",") {
+		tokens = append(tokens, strings.TrimSpace(token))
+	}
+	return tokens
+}
+
+func requireToken(tokens func() []string, auth AuthExtractor, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actual, err := auth.ExtractToken(r)
+		if err != nil {
+			writeUnauthorized(w, auth, err.Error())
+			return
+		}
+		index := matchToken(actual, tokens())
+		if index < 0 {
+			writeUnauthorized(w, auth, ErrInvalidToken.Error())
+			return
+		}
+		LoggerFromContext(r.Context()).Debug("request authenticated", "op", "RequireToken", "tokenIndex", index)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// index of the token matching actual, or -1. All tokens are compared, so the time does not reveal which matched
+func matchToken(actual string, tokens []string) int {
+	index := -1
+	for i, token := range tokens {
+		// an empty token, e.g. of a reloaded token file, never matches
+		if token != "" && subtle.ConstantTimeCompare([]byte(actual), []byte(token)) == 1 && index < 0 {
+			index = i
+		}
+	}
+	return index
+}
@@ -0,0 +1,302 @@
+package git_sync
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestAuthExtractors(t *testing.T) {
+	multi, err := NewAuthExtractor("bearer, basic, header:X-Forwarded-Access-Token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tcs := []struct {
+		name     string
+		auth     AuthExtractor
+		header   http.Header
+		expected string // empty for ErrNoAuth
+	}{
+		{"bearer", BearerAuth{}, http.Header{"Authorization": {"Bearer abc"}}, "abc"},
+		{"bearer missing", BearerAuth{}, http.Header{}, ""},
+		{"bearer wrong scheme", BearerAuth{}, http.Header{"Authorization": {"Basic dXNlcjphYmM="}}, ""},
+		{"basic", BasicAuth{}, http.Header{"Authorization": {"Basic dXNlcjphYmM="}}, "abc"},
+		{"basic wrong scheme", BasicAuth{}, http.Header{"Authorization": {"Bearer abc"}}, ""},
+		{"header", HeaderAuth{Header: "X-Forwarded-Access-Token"}, http.Header{"X-Forwarded-Access-Token": {"abc"}}, "abc"},
+		{"header missing", HeaderAuth{Header: "X-Forwarded-Access-Token"}, http.Header{"Authorization": {"Bearer abc"}}, ""},
+		{"multi bearer", multi, http.Header{"Authorization": {"Bearer abc"}}, "abc"},
+		{"multi basic", multi, http.Header{"Authorization": {"Basic dXNlcjphYmM="}}, "abc"},
+		{"multi header", multi, http.Header{"X-Forwarded-Access-Token": {"abc"}}, "abc"},
+		{"multi none", multi, http.Header{}, ""},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodGet, "/pull", nil)
+			r.Header = tc.header
+
+			token, err := tc.auth.ExtractToken(r)
+			if tc.expected == "" {
+				if !errors.Is(err, ErrNoAuth) {
+					t.Fatalf("expected ErrNoAuth, got token '%s', err %v", token, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token != tc.expected {
+				t.Errorf("expected token '%s', got '%s'", tc.expected, token)
+			}
+		})
+	}
+}
+
+func TestNewAuthExtractorInvalid(t *testing.T) {
+	for _, schemes := range []string{"", "digest", "header", "bearer,"} {
+		_, err := NewAuthExtractor(schemes)
+		if err == nil {
+			t.Errorf("expected error for schemes '%s'", schemes)
+		}
+	}
+}
+
+func TestExtractArgsNoAuthIsUnauthorized(t *testing.T) {
+	r, _ := http.NewRequest(http.MethodGet, "/pull?repository=http://localhost/repo.git&branch=main", nil)
+	_, err := extractArgs(r, BearerAuth{}, nil)
+	if !errors.Is(err, ErrNoAuth) {
+		t.Fatalf("expected ErrNoAuth, got %v", err)
+	}
+
+	r, _ = http.NewRequest(http.MethodGet, "/pull?branch=main", nil)
+	r.Header.Set("Authorization", "Bearer abc")
+	_, err = extractArgs(r, BearerAuth{}, nil)
+	if err == nil || errors.Is(err, ErrNoAuth) {
+		t.Fatalf("expected bad request error, got %v", err)
+	}
+}
+
+func TestPushArgsErrors(t *testing.T) {
+	h := NewGitPushHandler(t.TempDir(), HandlerOptions{})
+	tcs := map[string]struct {
+		query         string
+		authorization string
+		status        int
+		challenge     string
+	}{
+		"no Authorization header": {"repository=http://localhost:1/repo.git&branch=main", "", http.StatusUnauthorized, "Bearer"},
+		"other scheme":            {"repository=http://localhost:1/repo.git&branch=main", "Basic YTpi", http.StatusUnauthorized, "Bearer"},
+		"empty token":             {"repository=http://localhost:1/repo.git&branch=main", "Bearer ", http.StatusUnauthorized, "Bearer"},
+		"no repository":           {"branch=main", "Bearer abc", http.StatusBadRequest, ""},
+		"no repository nor token": {"branch=main", "", http.StatusBadRequest, ""},
+		"invalid branch":          {"repository=http://localhost:1/repo.git&branch=a..b", "Bearer abc", http.StatusBadRequest, ""},
+	}
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/push?"+tc.query, nil)
+			if tc.authorization != "" {
+				r.Header.Set("Authorization", tc.authorization)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != tc.status {
+				t.Errorf("expected status %d, got %d: %s", tc.status, w.Code, w.Body)
+			}
+			if actual := w.Header().Get("WWW-Authenticate"); actual != tc.challenge {
+				t.Errorf("expected WWW-Authenticate '%s', got '%s'", tc.challenge, actual)
+			}
+		})
+	}
+}
+
+func TestChallenge(t *testing.T) {
+	tcs := map[string]struct {
+		auth     AuthExtractor
+		expected string
+	}{
+		"bearer":   {BearerAuth{}, "Bearer"},
+		"basic":    {BasicAuth{}, `Basic realm="git_sync"`},
+		"header":   {HeaderAuth{Header: "X-Forwarded-Access-Token"}, ""},
+		"multiple": {MultiAuth{HeaderAuth{Header: "X-Token"}, BearerAuth{}, BasicAuth{}}, `Bearer, Basic realm="git_sync"`},
+	}
+	for name, tc := range tcs {
+		if actual := challenge(tc.auth); actual != tc.expected {
+			t.Errorf("%s: expected '%s', got '%s'", name, tc.expected, actual)
+		}
+	}
+
+	// also for an invalid server token
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer incorrect")
+	w := httptest.NewRecorder()
+	RequireToken("secret", BearerAuth{}, http.NotFoundHandler()).ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != "Bearer" {
+		t.Errorf("expected 401 with challenge, got %d '%s'", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+}
+
+func TestRequireTokenRejectsBeforeGit(t *testing.T) {
+	opts := HandlerOptions{AuthMode: AuthModeServer, RemoteToken: "remote"}
+
+	for _, token := range []string{"", "incorrect", "remote"} {
+		tempDir := t.TempDir()
+		for _, h := range []http.Handler{NewGitPullHandler(tempDir, opts), NewGitPushHandler(tempDir, opts)} {
+			r := httptest.NewRequest(http.MethodGet, "/?repository=http://localhost:1/repo.git&branch=main", nil)
+			if token != "" {
+				r.Header.Set("Authorization", "Bearer "+token)
+			}
+			w := httptest.NewRecorder()
+			RequireToken("secret", BearerAuth{}, h).ServeHTTP(w, r)
+
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("expected status %d for token '%s', got %d", http.StatusUnauthorized, token, w.Code)
+			}
+		}
+
+		entries, err := os.ReadDir(tempDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 0 {
+			t.Errorf("expected no git operations, but temp dir has %d entries", len(entries))
+		}
+	}
+}
+
+func TestRequireTokenAccepts(t *testing.T) {
+	called := false
+	h := RequireToken("secret", BearerAuth{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if !called || w.Code != http.StatusOK {
+		t.Errorf("expected request to pass, got status %d", w.Code)
+	}
+}
+
+func TestExtractArgsInvalidBranch(t *testing.T) {
+	for _, branch := range []string{"--upload-pack=touch /tmp/pwned", "-x", "../../etc", "a/../b", "a..b", "a\x00b",
+		"a b", "a:b", "a~1", "a^", "a?", "a[", "a\\b", "a.lock", ".hidden", "a/", "/a", "a//b", "a@{1}", "@", "HEAD", "a."} {
+		q := url.Values{"repository": {"http://localhost/repo.git"}, "branch": {branch}}
+		r := httptest.NewRequest(http.MethodGet, "/pull?"+q.Encode(), nil)
+		r.Header.Set("Authorization", "Bearer abc")
+		if _, err := extractArgs(r, BearerAuth{}, nil); !errors.Is(err, ErrInvalidBranch) {
+			t.Errorf("%q: expected ErrInvalidBranch, got %v", branch, err)
+		}
+	}
+
+	for _, branch := range []string{"main", "feature/x", "release-1.0", "a-b/c_d", AllBranches} {
+		q := url.Values{"repository": {"http://localhost/repo.git"}, "branch": {branch}}
+		r := httptest.NewRequest(http.MethodGet, "/pull?"+q.Encode(), nil)
+		r.Header.Set("Authorization", "Bearer abc")
+		if _, err := extractArgs(r, BearerAuth{}, nil); err != nil {
+			t.Errorf("%q: expected valid branch, got %v", branch, err)
+		}
+	}
+}
+
+// validateBranch agrees with git
+func TestValidateBranchLikeGit(t *testing.T) {
+	for _, branch := range []string{"main", "feature/x", "-x", "a/-x", "a..b", "a.lock", "HEAD", "a b", "a@{1}", "a/", "a."} {
+		err := exec.Command("git", "check-ref-format", "--branch", branch).Run()
+		if actual := validateBranch(branch); (actual == nil) != (err == nil) {
+			t.Errorf("%q: expected valid %v like git, got %v", branch, err == nil, actual)
+		}
+	}
+}
+
+func TestAuthModeServerUsesRemoteToken(t *testing.T) {
+	// the inbound (server) token must not be relayed to the remote
+	r := httptest.NewRequest(http.MethodGet, "/pull?repository=http://localhost/repo.git&branch=main", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+
+	server := HandlerOptions{AuthMode: AuthModeServer, RemoteToken: "remote"}
+	repo, err := extractArgs(r, server.authExtractor("http://localhost/repo.git"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repo.Token != "remote" {
+		t.Errorf("expected remote token, got '%s'", repo.Token)
+	}
+
+	passthrough := HandlerOptions{}
+	repo, err = extractArgs(r, passthrough.authExtractor("http://localhost/repo.git"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repo.Token != "secret" {
+		t.Errorf("expected inbound token to be relayed, got '%s'", repo.Token)
+	}
+}
+
+func TestAuthModeServerUsesRegisteredRepoToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("first\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewTokenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := HandlerOptions{AuthMode: AuthModeServer, RemoteToken: "remote", Repos: NewRepoRegistry([]RegisteredRepo{
+		{URL: "http://localhost/file.git", Branch: "main", TokenFile: f},
+		{URL: "http://localhost/static.git", Branch: "main", Token: "static"},
+		{URL: "http://localhost/none.git", Branch: "main"}})}
+
+	extract := func(repoURL string) string {
+		r := httptest.NewRequest(http.MethodGet, "/pull?repository="+repoURL+"&branch=main", nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		repo, err := extractArgs(r, opts.authExtractor(repoURL), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return repo.Token
+	}
+	for repoURL, expected := range map[string]string{
+		"http://localhost/file.git":   "first",
+		"http://localhost/static.git": "static",
+		"http://localhost/none.git":   "remote",
+		"http://localhost/other.git":  "remote"} {
+		if actual := extract(repoURL); actual != expected {
+			t.Errorf("%s: expected token '%s', got '%s'", repoURL, expected, actual)
+		}
+	}
+
+	// the rotated token of the file is used
+	if err := os.WriteFile(path, []byte("second\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if actual := extract("http://localhost/file.git"); actual != "second" {
+		t.Errorf("expected rotated token 'second', got '%s'", actual)
+	}
+}
+
+func TestRequireTokens(t *testing.T) {
+	h := RequireTokens([]string{"old", "new"}, BearerAuth{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for token, expected := range map[string]int{"old": http.StatusOK, "new": http.StatusOK, "other": http.StatusUnauthorized, "old,new": http.StatusUnauthorized} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != expected {
+			t.Errorf("expected status %d for token '%s', got %d", expected, token, w.Code)
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package git_sync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	"github.com/pkg/errors"
+)
+
+// AllBranches as the branch of a RemoteRepo syncs all branches of the repository in a single bundle.
+// It is not a valid branch name, so it cannot clash with a real branch
+const AllBranches = "*"
+
+// ErrAllBranchesUnsupported is returned for operations that need a single branch, e.g. bundle options or force push
+var ErrAllBranchesUnsupported = errors.New("not supported when syncing all branches")
+
+// all branches of the remote, overwriting the local branches
+const allBranchesRefSpec = "+refs/heads/*:refs/heads/*"
+
+// fetch all branches of the remote into a bare local repository. Local branches are overwritten and
+// pruned, so the local repository always mirrors the remote, also after a rewrite or a failed push.
+// Returns ErrRepositoryNotFound if the remote does not exist
+func (g *GIT) syncAllBranchesToLocal() (SyncMode, error) {
+	exists, err := g.ExistsLocal()
+	if err != nil {
+		return "", err
+	}
+
+	var local *git.Repository
+	mode := SyncModePull
+	if exists {
+		local, err = git.PlainOpen(g.workDir)
+		if err != nil {
+			return mode, errors.Wrapf(err, "failed to open local repository %s for all branches", g.remoteRepo.URL)
+		}
+	} else {
+		mode = SyncModeClone
+		local, err = git.PlainInit(g.workDir, true)
+		if err != nil {
+			return mode, errors.Wrapf(err, "failed to init local repository %s for all branches", g.remoteRepo.URL)
+		}
+		_, err = local.CreateRemote(&config.RemoteConfig{
+			Name:  remoteName,
+			URLs:  []string{g.remoteRepo.URL},
+			Fetch: []config.RefSpec{allBranchesRefSpec}})
+		if err != nil {
+			return mode, errors.Wrapf(err, "failed to create remote for local repository %s", g.remoteRepo.URL)
+		}
+	}
+
+	err = local.Fetch(&git.FetchOptions{
+		RemoteName:   remoteName,
+		RemoteURL:    g.remoteRepo.URL,
+		RefSpecs:     []config.RefSpec{allBranchesRefSpec},
+		Tags:         git.NoTags,
+		Prune:        true,
+		Auth:         g.getAuth(),
+		ProxyOptions: g.proxyOptions()})
+	if err != nil {
+		if errors.Is(err, git.NoErrAlreadyUpToDate) || errors.Is(err, transport.ErrEmptyRemoteRepository) {
+			return mode, nil
+		}
+		if errors.Is(err, transport.ErrRepositoryNotFound) {
+			if rmErr := g.RemoveLocal(); rmErr != nil {
+				return mode, rmErr
+			}
+			return mode, errors.Wrapf(ErrRepositoryNotFound, "repository %s", g.remoteRepo.URL)
+		}
+		if errors.Is(err, transport.ErrAuthenticationRequired) || errors.Is(err, transport.ErrAuthorizationFailed) {
+			return mode, ErrAuthFailed
+		}
+		return mode, errors.Wrapf(err, "failed to fetch all branches of repository %s", g.remoteRepo.URL)
+	}
+	return mode, nil
+}
+
+// heads of the local branches, sorted by ref
+func (g *GIT) localBranchHeads() ([]Head, error) {
+	local, err := git.PlainOpen(g.workDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open local repository %s for all branches", g.remoteRepo.URL)
+	}
+
+	iter, err := local.Branches()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list local branches")
+	}
+	var heads []Head
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		heads = append(heads, Head{CommitID: ref.Hash().String(), Ref: ref.Name().String()})
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list local branches")
+	}
+	slices.SortFunc(heads, func(a, b Head) int { return strings.Compare(a.Ref, b.Ref) })
+	return heads, nil
+}
+
+// bundle of all local branches. Tags are not included. Returns ErrNoCommits if there are no branches
+func (g *GIT) createAllBranchesBundle(ctx context.Context) ([]byte, error) {
+	bundle, err := runCommandContext(ctx, g.command("-C", g.workDir, "bundle", "create", "-", "--branches"), g.commandTimeout,
+		fmt.Sprintf("failed to bundle all branches of repository %s", g.remoteRepo.URL))
+	if err != nil {
+		cmdErr := err.(*CommandError)
+		if strings.Contains(cmdErr.StdErr, "Refusing to create empty bundle") {
+			return nil, ErrNoCommits
+		}
+		if ctx.Err() == nil {
+			metricBundleCreateFailures.WithLabelValues(bundleFailureCause(cmdErr)).Inc()
+		}
+		return nil, cmdErr
+	}
+
+	if g.deterministicBundles {
+		return g.repackBundle(ctx, g.workDir, bundle)
+	}
+	return bundle, nil
+}
+
+// fetch all branches of the bundle into the local repository. Unlike ApplyBundleToLocal, branches are
+// only fast-forwarded, returning ErrNotFastForward if any branch has diverged. Branches not in the bundle are kept
+func (g *GIT) applyAllBranchesBundle(r io.Reader) error {
+	dir, err := g.getRandomTempDir()
+	if err != nil {
+		return errors.Wrap(err, "failed to create temp dir")
+	}
+	defer os.RemoveAll(dir)
+	tmpFile := filepath.Join(dir, "bundle")
+	if err := writeFile(tmpFile, r); err != nil {
+		return err
+	}
+
+	_, err = g.runGit(fmt.Sprintf("failed to apply bundle of all branches for repository %s", g.remoteRepo.URL),
+		"-C", g.workDir, "fetch", "--no-tags", tmpFile, "refs/heads/*:refs/heads/*")
+	if err != nil {
+		if cmdErr := err.(*CommandError); strings.Contains(cmdErr.StdErr, "(non-fast-forward)") {
+			return fmt.Errorf("%w: %w", ErrNotFastForward, cmdErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// push all local branches to the remote atomically, so either all branches are updated or none.
+// Fails with ErrAtomicPushUnsupported when the remote does not support atomic pushes, since go-git would
+// silently push the branches one by one. Remote branches that do not exist locally are kept
+func (g *GIT) pushAllBranchesToRemote() error {
+	atomic, err := g.remoteSupportsAtomicPush()
+	if err != nil {
+		return err
+	}
+	if !atomic {
+		return errors.Wrapf(ErrAtomicPushUnsupported, "repository %s", g.remoteRepo.URL)
+	}
+
+	local, err := git.PlainOpen(g.workDir)
+	if err != nil {
+		return err
+	}
+
+	err = local.Push(&git.PushOptions{
+		RemoteName:   remoteName,
+		RemoteURL:    g.remoteRepo.URL,
+		RefSpecs:     []config.RefSpec{"refs/heads/*:refs/heads/*"},
+		Atomic:       true,
+		Auth:         g.getAuth(),
+		ProxyOptions: g.proxyOptions()})
+	if err != nil {
+		if errors.Is(err, git.NoErrAlreadyUpToDate) {
+			return nil
+		}
+		if errors.Is(err, transport.ErrAuthorizationFailed) || errors.Is(err, transport.ErrAuthenticationRequired) {
+			return ErrAuthFailed
+		}
+		if errors.Is(err, git.ErrNonFastForwardUpdate) {
+			return fmt.Errorf("%w: %w", ErrNotFastForward, err)
+		}
+		// go-git reports the status of a rejected ref as an untyped error, not a *CommandError of the git binary
+		if strings.HasPrefix(err.Error(), "command error on ") {
+			return fmt.Errorf("%w, no branch was updated: %w", ErrPushRejected, err)
+		}
+		return errors.Wrapf(err, "failed to push all branches of local repository %s", g.remoteRepo.URL)
+	}
+	return nil
+}
+
+// whether the remote advertises the atomic capability for pushes
+func (g *GIT) remoteSupportsAtomicPush() (bool, error) {
+	ep, err := transport.NewEndpoint(g.remoteRepo.URL)
+	if err != nil {
+		return false, errors.Wrapf(err, "invalid url of repository %s", g.remoteRepo.URL)
+	}
+	ep.Proxy = g.proxyOptions()
+	c, err := client.NewClient(ep)
+	if err != nil {
+		return false, err
+	}
+	session, err := c.NewReceivePackSession(ep, g.getAuth())
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to connect to repository %s", g.remoteRepo.URL)
+	}
+	defer session.Close()
+	refs, err := session.AdvertisedReferences()
+	if err != nil {
+		if errors.Is(err, transport.ErrAuthorizationFailed) || errors.Is(err, transport.ErrAuthenticationRequired) {
+			return false, ErrAuthFailed
+		}
+		if errors.Is(err, transport.ErrRepositoryNotFound) {
+			return false, ErrRepositoryNotFound
+		}
+		return false, errors.Wrapf(err, "failed to list references of repository %s", g.remoteRepo.URL)
+	}
+	return refs.Capabilities.Supports(capability.Atomic), nil
+}
+
+// number of commits on the local branches, that are not reachable from the old heads
+func (g *GIT) countCommitsSince(oldHeads []Head) (int, error) {
+	args := []string{"-C", g.workDir, "rev-list", "--count", "--branches", "--not"}
+	for _, head := range oldHeads {
+		args = append(args, head.CommitID)
+	}
+	out, err := g.runGit(fmt.Sprintf("failed to count commits of repository %s", g.remoteRepo.URL), args...)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(out)))
+}
+
+// sync all branches of the remote repository to the local clone, retrying transient errors
+func (s Syncer) syncAllBranches(ctx context.Context, repo RemoteRepo) (*GIT, SyncMode, error) {
+	log := LoggerFromContext(ctx).With("op", "Syncer.syncAllBranches", "repo.url", repo.URL)
+
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	git, err := s.newGIT(repo)
+	if err != nil {
+		return nil, "", err
+	}
+	var mode SyncMode
+	err = retry(ctx, log, "sync", s.MaxRetries, s.RetryBackoff, func() error {
+		var err error
+		mode, err = git.syncAllBranchesToLocal()
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, ErrAuthFailed) || errors.Is(err, ErrRepositoryNotFound) {
+			return nil, "", err
+		}
+		return nil, "", errors.Wrap(err, "failed to sync repository")
+	}
+	workDirRepos.register(git.workDir, git.remoteRepo)
+	log.Debug("synced local repository", "syncMode", mode)
+	return git, mode, nil
+}
+
+// pull a bundle with a head for each branch of the repository. Bundle options are not supported
+func (s Syncer) pullAllBranches(ctx context.Context, repo RemoteRepo, opt BundleOptions) (PullResult, error) {
+	if opt.HasAny() || opt.To != "" {
+		return PullResult{}, errors.Wrap(ErrAllBranchesUnsupported, "bundle options")
+	}
+
+	git, mode, err := s.syncAllBranches(ctx, repo)
+	if err != nil {
+		return PullResult{}, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return PullResult{}, err
+	}
+
+	bundleData, err := git.createAllBranchesBundle(ctx)
+	if err != nil {
+		if errors.Is(err, ErrNoCommits) {
+			return PullResult{}, err
+		}
+		return PullResult{}, errors.Wrap(err, "failed to create bundle")
+	}
+
+	info, err := ParseBundleHeader(bundleData)
+	if err != nil {
+		return PullResult{}, errors.Wrap(err, "failed to get bundle info")
+	}
+	if err := checkBundleHeads(info, AllBranches); err != nil {
+		return PullResult{}, err
+	}
+	if !s.AllowLFSPointers {
+		for _, head := range info.Heads {
+			lfs, err := git.UsesLFS(plumbing.NewHash(head.CommitID))
+			if err != nil {
+				return PullResult{}, err
+			}
+			if lfs {
+				return PullResult{}, errors.Wrapf(ErrLFSPointers, "branch %s in repository %s", plumbing.ReferenceName(head.Ref).Short(), repo.URL)
+			}
+		}
+	}
+	commits, err := git.CountBundledCommits(info)
+	if err != nil {
+		return PullResult{}, errors.Wrap(err, "failed to count commits of bundle")
+	}
+	return PullResult{Info: info, Bundle: bundleData, Commits: commits, SyncMode: mode}, nil
+}
+
+// apply a bundle of any number of branches, and push them to the remote. Every branch must fast-forward.
+// The remote history is always mirrored by the sync, so rewrites are not reported
+func (s Syncer) pushAllBranches(ctx context.Context, repo RemoteRepo, bundleData []byte) (PushResult, error) {
+	log := LoggerFromContext(ctx).With("op", "Syncer.pushAllBranches", "repo.url", repo.URL)
+
+	git, _, err := s.syncAllBranches(ctx, repo)
+	if err != nil {
+		return PushResult{}, err
+	}
+
+	if err := checkHashAlgorithm(git, bundleData); err != nil {
+		return PushResult{}, err
+	}
+	if err := s.checkNewestBundleHeadAge(git, bundleData); err != nil {
+		return PushResult{}, err
+	}
+
+	oldHeads, err := git.localBranchHeads()
+	if err != nil {
+		return PushResult{}, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return PushResult{}, err
+	}
+
+	// a failed apply or push leaves the local repository partially updated, until the next sync
+	err = git.applyAllBranchesBundle(bytes.NewReader(bundleData))
+	if err != nil {
+		return PushResult{}, errors.Wrap(mapPrerequisitesError(err), "failed to apply bundle")
+	}
+
+	err = retry(ctx, log, "push", s.MaxRetries, s.RetryBackoff, git.pushAllBranchesToRemote)
+	if err != nil {
+		return PushResult{}, err
+	}
+
+	newHeads, err := git.localBranchHeads()
+	if err != nil {
+		return PushResult{}, err
+	}
+	added, err := git.countCommitsSince(oldHeads)
+	if err != nil {
+		return PushResult{}, errors.Wrap(err, "failed to count commits added")
+	}
+	return PushResult{Heads: newHeads, CommitsAdded: added}, nil
+}
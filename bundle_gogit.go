@@ -0,0 +1,207 @@
+package git_sync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/revlist"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/pkg/errors"
+)
+
+// BundleBackend is how bundles and packfiles of pulls are created
+type BundleBackend string
+
+const (
+	// BundleBackendCLI runs the git binary, which must be on PATH
+	BundleBackendCLI BundleBackend = "cli"
+
+	// BundleBackendGoGit creates bundles (full history, or with from/to) and packfiles, counts the commits
+	// and checks for Git LFS with go-git, without the git binary. Bundles with since, after or max-commits,
+	// deterministic bundles, sha256 repositories, pushes and verify still run the git binary
+	BundleBackendGoGit BundleBackend = "go-git"
+)
+
+func ParseBundleBackend(s string) (BundleBackend, error) {
+	switch b := BundleBackend(s); b {
+	case BundleBackendCLI, BundleBackendGoGit:
+		return b, nil
+	default:
+		return "", fmt.Errorf("unsupported bundle backend '%s', expected %s or %s", s, BundleBackendCLI, BundleBackendGoGit)
+	}
+}
+
+// SetBundleBackend sets how bundles and packfiles are created. Empty for BundleBackendCLI
+func (g *GIT) SetBundleBackend(b BundleBackend) {
+	g.bundleBackend = b
+}
+
+// open the local repository for go-git, when the go-git backend is set. Not ok for sha256 repositories,
+// which go-git cannot read, so the git binary is used instead
+func (g *GIT) goGitRepo() (*git.Repository, bool, error) {
+	if g.bundleBackend != BundleBackendGoGit {
+		return nil, false, nil
+	}
+	repo, err := git.PlainOpen(g.workDir)
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "failed to open local repository %s for branch %s", g.remoteRepo.URL, g.remoteRepo.Branch)
+	}
+	cfg, err := repo.Config()
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "failed to read config of local repository %s", g.remoteRepo.URL)
+	}
+	if cfg.Extensions.ObjectFormat != "" && string(cfg.Extensions.ObjectFormat) != "sha1" {
+		return nil, false, nil
+	}
+	return repo, true, nil
+}
+
+// whether go-git can create the bundle with the options
+func (g *GIT) goGitBundle(opt BundleOptions) bool {
+	return opt.Since == 0 && opt.After.IsZero() && opt.MaxCommits == 0 && !g.deterministicBundles
+}
+
+// create a v2 bundle of the branch at tip, with from (if set) as the prerequisite. Returns ErrEmptyBundle if
+// no commits are reachable from tip but not from from
+func (g *GIT) createBundleGoGit(ctx context.Context, repo *git.Repository, tip plumbing.Hash, from string) ([]byte, error) {
+	var prerequisites []plumbing.Hash
+	if from != "" {
+		prerequisites = append(prerequisites, plumbing.NewHash(from))
+	}
+	commits, err := countCommitsGoGit(repo, []plumbing.Hash{tip}, prerequisites)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list commits of repository %s and branch %s", g.remoteRepo.URL, g.remoteRepo.Branch)
+	}
+	if commits == 0 {
+		return nil, errors.Wrapf(ErrEmptyBundle, "from %s to %s", from, tip)
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("# v2 git bundle\n")
+	for _, id := range prerequisites {
+		fmt.Fprintf(buf, "-%s\n", id)
+	}
+	fmt.Fprintf(buf, "%s %s\n\n", tip, plumbing.NewBranchReferenceName(g.remoteRepo.Branch))
+	if err := g.writePackGoGit(ctx, buf, repo, []plumbing.Hash{tip}, prerequisites); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// write a packfile of the objects reachable from heads, but not from prerequisites, to w. The pack is
+// not thin. Aborted when ctx is done or after the command timeout, like git commands
+func (g *GIT) writePackGoGit(ctx context.Context, w io.Writer, repo *git.Repository, heads, prerequisites []plumbing.Hash) error {
+	ctx, cancel := context.WithTimeout(ctx, g.commandTimeout)
+	defer cancel()
+
+	objects, err := revlist.Objects(repo.Storer, heads, prerequisites)
+	if err != nil {
+		return errors.Wrapf(err, "failed to list objects of repository %s and branch %s", g.remoteRepo.URL, g.remoteRepo.Branch)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, err = packfile.NewEncoder(&contextWriter{ctx: ctx, w: w}, repo.Storer, false).Encode(objects, packWindow)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create pack for repository %s and branch %s", g.remoteRepo.URL, g.remoteRepo.Branch)
+	}
+	return nil
+}
+
+// objects compared for deltas when packing, like the default of git pack-objects
+const packWindow = 10
+
+// the number of commits reachable from heads, but not from prerequisites
+func countCommitsGoGit(repo *git.Repository, heads, prerequisites []plumbing.Hash) (int, error) {
+	excluded := make(map[plumbing.Hash]bool)
+	for _, id := range prerequisites {
+		c, err := repo.CommitObject(id)
+		if err != nil {
+			return 0, err
+		}
+		err = object.NewCommitPreorderIter(c, excluded, nil).ForEach(func(c *object.Commit) error {
+			excluded[c.Hash] = true
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	count := 0
+	for _, id := range heads {
+		c, err := repo.CommitObject(id)
+		if err != nil {
+			return 0, err
+		}
+		err = object.NewCommitPreorderIter(c, excluded, nil).ForEach(func(c *object.Commit) error {
+			excluded[c.Hash] = true
+			count++
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return count, nil
+}
+
+// whether any .gitattributes of the tree of head has filter=lfs, like UsesLFS
+func usesLFSGoGit(repo *git.Repository, head plumbing.Hash) (bool, error) {
+	c, err := repo.CommitObject(head)
+	if err != nil {
+		return false, err
+	}
+	tree, err := c.Tree()
+	if err != nil {
+		return false, err
+	}
+	found := false
+	err = tree.Files().ForEach(func(f *object.File) error {
+		if path.Base(f.Name) != ".gitattributes" {
+			return nil
+		}
+		content, err := f.Contents()
+		if err != nil {
+			return err
+		}
+		if strings.Contains(content, "filter=lfs") {
+			found = true
+			return storer.ErrStop
+		}
+		return nil
+	})
+	return found, err
+}
+
+// writer failing once ctx is done, to abort encoding
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (w *contextWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
+// the commits of the heads and prerequisites of the bundle
+func bundleHashes(info BundleInfo) (heads, prerequisites []plumbing.Hash) {
+	for _, head := range info.Heads {
+		heads = append(heads, plumbing.NewHash(head.CommitID))
+	}
+	for _, id := range info.Prerequisites {
+		prerequisites = append(prerequisites, plumbing.NewHash(id))
+	}
+	return heads, prerequisites
+}
@@ -0,0 +1,137 @@
+package git_sync
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestParseBundleBackend(t *testing.T) {
+	for _, s := range []string{"cli", "go-git"} {
+		if _, err := ParseBundleBackend(s); err != nil {
+			t.Errorf("expected %s to be valid, got %v", s, err)
+		}
+	}
+	if _, err := ParseBundleBackend("libgit2"); err == nil {
+		t.Error("expected an unsupported backend to be rejected")
+	}
+}
+
+func TestCreateBundleGoGit(t *testing.T) {
+	g := newLocalGIT(t, "main")
+	g.SetBundleBackend(BundleBackendGoGit)
+	worktree, err := g.initLocal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2025, 2, 13, 0, 0, 0, 0, time.UTC)
+	first := commitAt(t, g, worktree, base)
+	second := commitAt(t, g, worktree, base.Add(time.Hour))
+	head := commitAt(t, g, worktree, base.Add(2*time.Hour))
+	ctx := context.Background()
+
+	// a full bundle can be unbundled by git
+	full, err := g.CreateBundleAt(ctx, head, BundleOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyBundle(t.TempDir(), full); err != nil {
+		t.Fatal(err)
+	}
+	info, err := ParseBundleHeader(full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Heads) != 1 || info.Heads[0] != (Head{CommitID: head.String(), Ref: "refs/heads/main"}) || !info.IsComplete {
+		t.Errorf("expected a complete bundle with head %s, got %+v", head, info)
+	}
+	if commits, err := g.CountBundledCommits(info); err != nil || commits != 3 {
+		t.Errorf("expected 3 commits, got %d, %v", commits, err)
+	}
+
+	// from/to, without a scratch clone
+	partial, err := g.CreateBundleAt(ctx, head, BundleOptions{From: first.String(), To: second.String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.VerifyBundleAgainstLocal(partial); err != nil {
+		t.Fatal(err)
+	}
+	if info, err = ParseBundleHeader(partial); err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Heads) != 1 || info.Heads[0].CommitID != second.String() || len(info.Prerequisites) != 1 || info.Prerequisites[0] != first.String() {
+		t.Errorf("expected a bundle of %s..%s, got %+v", first, second, info)
+	}
+	if commits, err := g.CountBundledCommits(info); err != nil || commits != 1 {
+		t.Errorf("expected 1 commit, got %d, %v", commits, err)
+	}
+	pack, err := g.CreatePack(ctx, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(pack, []byte("PACK")) {
+		t.Errorf("expected a packfile, got %q", pack[:min(len(pack), 4)])
+	}
+
+	if _, err := g.CreateBundleAt(ctx, head, BundleOptions{From: head.String()}); !errors.Is(err, ErrEmptyBundle) {
+		t.Errorf("expected ErrEmptyBundle, got %v", err)
+	}
+}
+
+func TestUsesLFSGoGit(t *testing.T) {
+	g := newLocalGIT(t, "main")
+	g.SetBundleBackend(BundleBackendGoGit)
+	worktree, err := g.initLocal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := commitAt(t, g, worktree, time.Date(2025, 2, 13, 0, 0, 0, 0, time.UTC))
+	if lfs, err := g.UsesLFS(head); err != nil || lfs {
+		t.Errorf("expected no LFS, got %v, %v", lfs, err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(g.workDir, "assets"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(g.workDir, "assets", ".gitattributes"), []byte("*.bin filter=lfs diff=lfs merge=lfs -text\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := worktree.Add("assets/.gitattributes"); err != nil {
+		t.Fatal(err)
+	}
+	head = commitAt(t, g, worktree, time.Date(2025, 2, 13, 1, 0, 0, 0, time.UTC))
+	if lfs, err := g.UsesLFS(head); err != nil || !lfs {
+		t.Errorf("expected LFS, got %v, %v", lfs, err)
+	}
+}
+
+// after the local clone is synced, pulls with go-git do not need the git binary. The remote is served over
+// http, since go-git runs git-upload-pack for file:// remotes
+func TestPullGoGitWithoutGitBinary(t *testing.T) {
+	repoURL, head := createPublicRepo(t, "main")
+	repo := RemoteRepo{URL: repoURL, Branch: "main"}
+	ctx := context.Background()
+	s := Syncer{TempDir: t.TempDir(), BundleBackend: BundleBackendGoGit}
+	if _, err := s.Pull(ctx, repo, BundleOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("PATH", "")
+	result, err := s.Pull(ctx, repo, BundleOptions{})
+	if err != nil {
+		t.Fatalf("expected a pull without the git binary, got %v", err)
+	}
+	info, err := ParseBundleHeader(result.Bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Heads) != 1 || info.Heads[0].CommitID != head.String() || result.Commits != 1 {
+		t.Errorf("expected a bundle of the single commit %s, got %+v with %d commits", head, info, result.Commits)
+	}
+}
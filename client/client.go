@@ -0,0 +1,225 @@
+// Package client is a Go client for the /pull and /push endpoints of git_sync
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrUnauthorized is returned for 401, when the token is rejected by git_sync or the remote repository
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrNotFound is returned for 404, e.g. when the remote repository does not exist
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned for 409, e.g. when a pushed bundle does not fast-forward the branch
+	// or its prerequisites are missing
+	ErrConflict = errors.New("conflict")
+	// ErrNoCommits is returned by Pull for 204, when there are no commits to bundle
+	ErrNoCommits = errors.New("no commits to bundle")
+)
+
+// StatusError is an unexpected status of a response. Unwraps to ErrUnauthorized, ErrNotFound or
+// ErrConflict for the respective status codes
+type StatusError struct {
+	StatusCode int
+	// Message is the body of the response
+	Message string
+	// MissingPrerequisites are the commit IDs the pushed bundle requires, but the repository lacks. Only for 409
+	MissingPrerequisites []string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d: %s", e.StatusCode, e.Message)
+}
+
+func (e *StatusError) Unwrap() error {
+	switch e.StatusCode {
+	case http.StatusUnauthorized:
+		return ErrUnauthorized
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusConflict:
+		return ErrConflict
+	}
+	return nil
+}
+
+// Client of a git_sync server
+type Client struct {
+	// BaseURL of the server, e.g. https://git-sync.example.com
+	BaseURL string
+	// Token is sent as bearer token, relayed to the remote repository or checked by the server (see auth-mode)
+	Token string
+	// HTTPClient to use. http.DefaultClient if nil
+	HTTPClient *http.Client
+}
+
+func New(baseURL, token string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/"), Token: token}
+}
+
+// PullOptions limits the commits of a pulled bundle. The zero value is a full bundle
+type PullOptions struct {
+	// Since is the lookback duration, at least 1 second
+	Since time.Duration
+	After time.Time
+	// From and To are commit IDs (or refs) of a range From..To
+	From, To string
+	// MaxCommits limits the bundle to the newest commits. 0 for no limit
+	MaxCommits int
+}
+
+// PullMeta describes a pulled bundle, from the X-Git-* headers of the response
+type PullMeta struct {
+	// Head is the commit ID of the head of the branch
+	Head string
+	// Oldest is the oldest commit ID in a partial bundle. Empty if not known
+	Oldest    string
+	IsPartial bool
+	// Rewritten is whether the history of the branch was rewritten (force-pushed) since the last sync.
+	// Clients holding the old history must start over from a full bundle
+	Rewritten bool
+	// SyncMode is how the server synced its local clone, e.g. clone or pull
+	SyncMode string
+	// HashAlgorithm of the repository, e.g. sha1 or sha256
+	HashAlgorithm string
+	// Filename of the bundle, from Content-Disposition
+	Filename string
+}
+
+// PushResult is the summary of a successful push
+type PushResult struct {
+	// OldHead is the head of the branch before the push. Empty if the branch had no commits
+	OldHead string `json:"old_head,omitempty"`
+	// NewHead is the head of the branch after the push
+	NewHead string `json:"new_head,omitempty"`
+	// CommitsAdded is the number of commits added by the push. Zero if already up to date
+	CommitsAdded int `json:"commits_added"`
+	// Rewritten is whether the history of the branch was rewritten (force-pushed) since the last sync
+	Rewritten bool `json:"-"`
+}
+
+// Pull a bundle of the branch of the repository. The caller must close the returned bundle.
+// Returns ErrNoCommits if there are no commits to bundle, otherwise a *StatusError for other statuses than 200
+func (c *Client) Pull(ctx context.Context, repo, branch string, opts PullOptions) (io.ReadCloser, PullMeta, error) {
+	q := url.Values{"repository": {repo}, "branch": {branch}}
+	if opts.Since > 0 {
+		q.Set("since", opts.Since.String())
+	}
+	if !opts.After.IsZero() {
+		q.Set("after", opts.After.UTC().Format(time.RFC3339))
+	}
+	if opts.From != "" {
+		q.Set("from", opts.From)
+	}
+	if opts.To != "" {
+		q.Set("to", opts.To)
+	}
+	if opts.MaxCommits > 0 {
+		q.Set("max-commits", strconv.Itoa(opts.MaxCommits))
+	}
+
+	req, err := c.newRequest(ctx, http.MethodGet, "/pull", q, nil)
+	if err != nil {
+		return nil, PullMeta{}, err
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, PullMeta{}, errors.Wrap(err, "failed to pull")
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNoContent:
+		resp.Body.Close()
+		return nil, PullMeta{}, ErrNoCommits
+	default:
+		defer resp.Body.Close()
+		return nil, PullMeta{}, statusError(resp)
+	}
+
+	meta := PullMeta{
+		Head:          resp.Header.Get("X-Git-Head"),
+		Oldest:        resp.Header.Get("X-Git-Oldest"),
+		IsPartial:     resp.Header.Get("X-Git-IsPartial") == "true",
+		Rewritten:     resp.Header.Get("X-Git-Rewritten") == "true",
+		SyncMode:      resp.Header.Get("X-Git-Sync-Mode"),
+		HashAlgorithm: resp.Header.Get("X-Git-Hash-Algorithm")}
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil {
+		meta.Filename = params["filename"]
+	}
+	return resp.Body, meta, nil
+}
+
+// Push the bundle to the branch of the repository. An empty branch is the branch of the single head of
+// the bundle, if the server allows it (branch-from-bundle). Returns a *StatusError for other statuses than 200
+func (c *Client) Push(ctx context.Context, repo, branch string, bundle io.Reader) (PushResult, error) {
+	q := url.Values{"repository": {repo}}
+	if branch != "" {
+		q.Set("branch", branch)
+	}
+	req, err := c.newRequest(ctx, http.MethodPost, "/push", q, bundle)
+	if err != nil {
+		return PushResult{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-git-bundle")
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return PushResult{}, errors.Wrap(err, "failed to push")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return PushResult{}, statusError(resp)
+	}
+
+	var result PushResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return PushResult{}, errors.Wrap(err, "failed to decode push summary")
+	}
+	result.Rewritten = resp.Header.Get("X-Git-Rewritten") == "true"
+	return result, nil
+}
+
+func (c *Client) newRequest(ctx context.Context, method, path string, q url.Values, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path+"?"+q.Encode(), body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create request")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	return req, nil
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// read the response of an unexpected status. The missing prerequisites of a 409 push response are parsed
+func statusError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	e := &StatusError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+	if resp.StatusCode == http.StatusConflict && strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		var missing struct {
+			Error                string   `json:"error"`
+			MissingPrerequisites []string `json:"missing_prerequisites"`
+		}
+		if err := json.Unmarshal(body, &missing); err == nil {
+			e.Message = missing.Error
+			e.MissingPrerequisites = missing.MissingPrerequisites
+		}
+	}
+	return e
+}
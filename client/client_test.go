@@ -0,0 +1,97 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestPull(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.URL.Path != "/pull" || q.Get("repository") != "https://host/owner/repo.git" || q.Get("branch") != "main" ||
+			q.Get("since") != "1h0m0s" || q.Get("max-commits") != "5" || r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unexpected request "+r.URL.String(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("X-Git-Head", "f8be008f3733c1a9b7962c1f5a50679266565e31")
+		w.Header().Set("X-Git-IsPartial", "true")
+		w.Header().Set("X-Git-Sync-Mode", "pull")
+		w.Header().Set("Content-Disposition", "attachment; filename=repo_main.bundle")
+		io.WriteString(w, "bundle")
+	}))
+	t.Cleanup(server.Close)
+
+	c := New(server.URL, "secret")
+	bundle, meta, err := c.Pull(context.Background(), "https://host/owner/repo.git", "main", PullOptions{Since: time.Hour, MaxCommits: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bundle.Close()
+	data, err := io.ReadAll(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "bundle" {
+		t.Errorf("unexpected bundle %q", data)
+	}
+	expected := PullMeta{Head: "f8be008f3733c1a9b7962c1f5a50679266565e31", IsPartial: true, SyncMode: "pull", Filename: "repo_main.bundle"}
+	if meta != expected {
+		t.Errorf("expected %+v, got %+v", expected, meta)
+	}
+}
+
+func TestPullErrors(t *testing.T) {
+	tcs := map[int]error{
+		http.StatusNoContent:    ErrNoCommits,
+		http.StatusUnauthorized: ErrUnauthorized,
+		http.StatusNotFound:     ErrNotFound,
+		http.StatusConflict:     ErrConflict,
+	}
+	for status, expected := range tcs {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(status)
+			}))
+			t.Cleanup(server.Close)
+
+			_, _, err := New(server.URL, "").Pull(context.Background(), "https://host/owner/repo.git", "main", PullOptions{})
+			if !errors.Is(err, expected) {
+				t.Errorf("expected %v, got %v", expected, err)
+			}
+		})
+	}
+}
+
+func TestPushMissingPrerequisites(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.URL.Path != "/push" || r.URL.Query().Get("branch") != "main" || string(body) != "bundle" {
+			http.Error(w, "unexpected request "+r.URL.String(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		io.WriteString(w, `{"error": "missing", "missing_prerequisites": ["c742658e66c59876c004355a1f28f41a216e7564"]}`)
+	}))
+	t.Cleanup(server.Close)
+
+	_, err := New(server.URL, "").Push(context.Background(), "https://host/owner/repo.git", "main", strings.NewReader("bundle"))
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		t.Fatalf("expected StatusError, got %v", err)
+	}
+	if !reflect.DeepEqual(statusErr.MissingPrerequisites, []string{"c742658e66c59876c004355a1f28f41a216e7564"}) {
+		t.Errorf("unexpected missing prerequisites %v", statusErr.MissingPrerequisites)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/bredtape/git_sync"
+	"github.com/peterbourgon/ff/v3"
+)
+
+// RepoRole is whether a configured repository is pulled from, pushed to, or both
+type RepoRole string
+
+const (
+	RoleSource RepoRole = "source"
+	RoleSink   RepoRole = "sink"
+	RoleBoth   RepoRole = "both"
+)
+
+// RepoConfig is a repository in a multi-repo setup
+type RepoConfig struct {
+	URL    string `json:"url"`
+	Branch string `json:"branch"`
+	// Token for the remote repository in auth-mode server and for prewarming. Optional, defaults to remote-token
+	Token string `json:"token,omitempty"`
+	// TokenFile with the token, instead of Token. Reloaded like remote-token-file
+	TokenFile string   `json:"token_file,omitempty"`
+	Role      RepoRole `json:"role"`
+	// TempDir for the local clones of the repository, e.g. on another disk. Optional, defaults to temp-dir
+	TempDir string `json:"temp_dir,omitempty"`
+}
+
+func (c RepoConfig) Validate() error {
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url '%s' must be an http/https URL", c.URL)
+	}
+	if c.Branch == "" {
+		return fmt.Errorf("branch must be set for %s", c.URL)
+	}
+	switch c.Role {
+	case RoleSource, RoleSink, RoleBoth:
+	default:
+		return fmt.Errorf("role '%s' of %s must be one of %s, %s or %s", c.Role, c.URL, RoleSource, RoleSink, RoleBoth)
+	}
+	if c.Token != "" && c.TokenFile != "" {
+		return fmt.Errorf("token and token_file of %s must not both be set", c.URL)
+	}
+	if c.TokenFile != "" {
+		if _, err := git_sync.NewTokenFile(c.TokenFile); err != nil {
+			return fmt.Errorf("token_file of %s: %w", c.URL, err)
+		}
+	}
+	if c.TempDir != "" {
+		if err := checkWritableDir(c.TempDir); err != nil {
+			return fmt.Errorf("temp_dir of %s: %w", c.URL, err)
+		}
+	}
+	return nil
+}
+
+// the configured repositories to prewarm: those pulled from. The tokens are set by the prewarmer when synced
+func (c Config) prewarmRepos() []git_sync.RemoteRepo {
+	var repos []git_sync.RemoteRepo
+	for _, repo := range c.Repos {
+		if repo.Role != RoleSource && repo.Role != RoleBoth {
+			continue
+		}
+		repos = append(repos, git_sync.RemoteRepo{URL: repo.URL, Branch: repo.Branch, TempDir: repo.TempDir})
+	}
+	return repos
+}
+
+// the proxy for the remote repositories. Zero, to use the environment, if no proxy flag is set
+func (c Config) proxy() git_sync.Proxy {
+	return git_sync.Proxy{HTTPProxy: c.HTTPProxy, HTTPSProxy: c.HTTPSProxy, NoProxy: c.NoProxy}
+}
+
+// the comma-separated server auth tokens, so the old and new token are both accepted while rotating
+func (c Config) serverAuthTokens() []string {
+	return git_sync.SplitTokens(c.ServerAuthToken)
+}
+
+// check that the directory exists and files can be created in it
+func checkWritableDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	f, err := os.CreateTemp(dir, ".git_sync-check-*")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %w", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// repoList is a flag with a JSON list of repositories
+type repoList []RepoConfig
+
+func (l *repoList) String() string {
+	if l == nil || len(*l) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(*l)
+	return string(data)
+}
+
+func (l *repoList) Set(value string) error {
+	dec := json.NewDecoder(bytes.NewReader([]byte(value)))
+	dec.DisallowUnknownFields()
+	var repos []RepoConfig
+	if err := dec.Decode(&repos); err != nil {
+		return fmt.Errorf("invalid list of repositories: %w", err)
+	}
+	*l = repos
+	return nil
+}
+
+// stringList is a repeatable flag. In the config file, it may be given as a list
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// parse a JSON config file. Keys are flag names. The list of repositories is passed to the repos flag as JSON,
+// the other keys are parsed like ff.JSONParser
+func configFileParser(r io.Reader, set func(name, value string) error) error {
+	var m map[string]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return ff.JSONParseError{Inner: err}
+	}
+
+	if repos, ok := m["repos"]; ok {
+		if err := set("repos", string(repos)); err != nil {
+			return err
+		}
+		delete(m, "repos")
+	}
+
+	rest, err := json.Marshal(m)
+	if err != nil {
+		return ff.JSONParseError{Inner: err}
+	}
+	return ff.JSONParser(bytes.NewReader(rest), set)
+}
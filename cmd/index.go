@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+var indexTemplate = template.Must(template.New("index").Parse(string(indexHTML)))
+
+// Endpoint is a registered route, with its documentation
+type Endpoint struct {
+	Path        string   `json:"path"`
+	Methods     []string `json:"methods"`
+	Description string   `json:"description"`
+	Query       []Param  `json:"query,omitempty"`
+	Headers     []Param  `json:"headers,omitempty"`
+	Example     string   `json:"example,omitempty"`
+}
+
+// Param is a query parameter or header of an endpoint
+type Param struct {
+	Name        string `json:"name"`
+	Required    bool   `json:"required,omitempty"`
+	Description string `json:"description"`
+}
+
+// Link to the endpoint, when the path has no variables
+func (e Endpoint) Link() string {
+	if strings.Contains(e.Path, "{") {
+		return ""
+	}
+	return e.Path
+}
+
+// documentation of the routes, by path template. Methods are used when the route does not restrict them.
+// The example is a curl command, where {base} is replaced with the URL of the server
+var endpointDocs = map[string]Endpoint{
+	"/pull": {
+		Methods:     []string{http.MethodGet},
+		Description: "Pull a bundle of the branch from the repository",
+		Query: []Param{
+			{Name: "repository", Required: true, Description: "URL of the repository (http/https)"},
+			{Name: "branch", Required: true, Description: "Branch to pull, or * for all branches"},
+			{Name: "since", Description: "Only commits since the duration, e.g. 1h30m"},
+			{Name: "after", Description: "Only commits after the timestamp (RFC3339), at least 1 second in the past"},
+			{Name: "from", Description: "Only commits after the commit ID. Cannot be combined with since/after"},
+			{Name: "to", Description: "Commits up to (and including) the commit ID instead of the head"},
+			{Name: "max-commits", Description: "Only the newest commits, at most the number. The oldest commit in the bundle is returned in X-Git-Oldest. Cannot be combined with from/to"},
+			{Name: "chunk-by", Description: "Respond with a JSON manifest of partial bundles, each spanning at most the duration"},
+			{Name: "chunk-size", Description: "Respond with the bundle of the next (at most) N first-parent commits after cursor. The next cursor is returned in X-Git-Next-Cursor, empty when complete"},
+			{Name: "cursor", Description: "Commit ID the chunk of chunk-size starts after. Omit for the first chunk"},
+			{Name: "format", Description: "bundle (default) or packfile. Overrides the Accept header"},
+			{Name: "incremental", Description: "true to continue from the last head served to the client, or a full bundle the first time. Cannot be combined with since, after, from, to, max-commits, chunk-by or chunk-size"},
+			{Name: "client-id", Description: "Tells apart clients of incremental pulls sharing a token. Incremental pulls require a token"}},
+		Headers: []Param{
+			{Name: "Authorization", Description: "Token for the repository, e.g. Bearer <token>. Omit for anonymous access to public repositories"},
+			{Name: "Accept", Description: "application/x-git-bundle (default) or application/x-git-packfile. 406 if neither is acceptable"},
+			{Name: "Accept-Encoding", Description: "gzip or zstd to compress the bundle"}},
+		Example: `curl -H "Authorization: Bearer $TOKEN" -o main.bundle "{base}/pull?repository=https://host/owner/repo.git&branch=main"`},
+	"/pull/{branch}": {
+		Methods:     []string{http.MethodGet, http.MethodPost},
+		Description: "Pull a bundle of the branch. With POST, the bundle options are a JSON body instead of query parameters, e.g. {\"since\": \"1h30m\"} or {\"max-commits\": 100}. Only the options of the query parameters of /pull are supported. Unknown options, and until, excludes, filter, tags and paths, are rejected with 400",
+		Query: []Param{
+			{Name: "repository", Required: true, Description: "URL of the repository (http/https)"}},
+		Headers: []Param{
+			{Name: "Authorization", Description: "Token for the repository, e.g. Bearer <token>. Omit for anonymous access to public repositories"},
+			{Name: "Content-Type", Description: "application/json for POST"}},
+		Example: `curl -H "Authorization: Bearer $TOKEN" -H "Content-Type: application/json" -d '{"since": "1h30m"}' -o main.bundle "{base}/pull/main?repository=https://host/owner/repo.git"`},
+	"/push": {
+		Methods:     []string{http.MethodPost},
+		Description: "Push a bundle to the branch of the repository. Responds with a JSON summary",
+		Query: []Param{
+			{Name: "repository", Required: true, Description: "URL of the repository (http/https)"},
+			{Name: "branch", Required: true, Description: "Branch to push, or * for all branches. May be omitted with branch-from-bundle"},
+			{Name: "dry-run", Description: "true to verify the bundle without pushing"},
+			{Name: "ref", Description: "Head of the bundle to push to the branch, when the names differ, e.g. feature or refs/heads/feature"},
+			{Name: "force", Description: "true to overwrite the history of the branch, when allowed"}},
+		Headers: []Param{
+			{Name: "Authorization", Required: true, Description: "Token for the repository, e.g. Bearer <token>"},
+			{Name: "Content-Type", Description: "application/octet-stream or application/x-git-bundle"},
+			{Name: "Content-Encoding", Description: "gzip or zstd, if the bundle is compressed"},
+			{Name: "X-Git-Expected-Head", Description: "Current head of the branch, or the zero ID if the branch has no commits. Required with force=true"}},
+		Example: `curl -H "Authorization: Bearer $TOKEN" -H "Content-Type: application/x-git-bundle" --data-binary @main.bundle "{base}/push?repository=https://host/owner/repo.git&branch=main"`},
+	"/verify": {
+		Methods:     []string{http.MethodPost},
+		Description: "Verify a bundle without applying it. No remote repository is involved. Responds with a JSON summary of the bundle, or 400 if invalid",
+		Query: []Param{
+			{Name: "branch", Description: "Also verify that a push to the branch would accept the bundle"}},
+		Headers: []Param{
+			{Name: "Content-Type", Description: "application/octet-stream or application/x-git-bundle"},
+			{Name: "Content-Encoding", Description: "gzip or zstd, if the bundle is compressed"}},
+		Example: `curl -H "Content-Type: application/x-git-bundle" --data-binary @main.bundle "{base}/verify?branch=main"`},
+	"/repos": {
+		Methods:     []string{http.MethodGet},
+		Description: "List the configured repositories as JSON, with name, url (without credentials), branch, whether pull and push are enabled by the role, last_sync (the last successful pull, push or mirror since start), and last_pull and last_push. Only available when server-auth-token is set",
+		Headers: []Param{
+			{Name: "Authorization", Required: true, Description: "The server auth token, e.g. Bearer <token>"}},
+		Example: `curl -H "Authorization: Bearer $SERVER_TOKEN" "{base}/repos"`},
+	"/mirror/{branch}": {
+		Methods:     []string{http.MethodPost},
+		Description: "Pull the branch from the mirror source and push it to the mirror sink. Responds with a JSON summary",
+		Headers: []Param{
+			{Name: "Authorization", Required: true, Description: "Token for both repositories, e.g. Bearer <token>"}},
+		Example: `curl -X POST -H "Authorization: Bearer $TOKEN" "{base}/mirror/main"`},
+	"/readyz": {
+		Methods:     []string{http.MethodGet},
+		Description: "Readiness as JSON. 503 until each prewarmed repository was synced once, with the number pending",
+		Example:     `curl "{base}/readyz"`},
+	"/version": {
+		Methods:     []string{http.MethodGet},
+		Description: "Version, commit and build date of the running build as JSON, e.g. to correlate behavior changes with deploys",
+		Example:     `curl "{base}/version"`},
+	"/metrics": {
+		Methods:     []string{http.MethodGet},
+		Description: "Prometheus metrics",
+		Example:     `curl "{base}/metrics"`},
+}
+
+// list the routes registered in the router, except the index itself
+func registeredEndpoints(router *mux.Router, base string) []Endpoint {
+	var endpoints []Endpoint
+	_ = router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil || path == "/" {
+			return nil
+		}
+
+		e := endpointDocs[path]
+		e.Path = path
+		if methods, err := route.GetMethods(); err == nil {
+			e.Methods = methods
+		}
+		e.Example = strings.ReplaceAll(e.Example, "{base}", base)
+		endpoints = append(endpoints, e)
+		return nil
+	})
+	return endpoints
+}
+
+// index lists the registered endpoints, as HTML or as JSON when preferred by the client
+func indexHandler(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		endpoints := registeredEndpoints(router, scheme+"://"+r.Host)
+
+		if prefersJSON(r.Header.Get("Accept")) {
+			w.Header().Set("Content-Type", "application/json")
+			enc := json.NewEncoder(w)
+			enc.SetEscapeHTML(false)
+			if err := enc.Encode(map[string][]Endpoint{"endpoints": endpoints}); err != nil {
+				slog.Error("failed to write index", "err", err)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		if err := indexTemplate.Execute(w, map[string]any{"Endpoints": endpoints}); err != nil {
+			slog.Error("failed to write index", "err", err)
+		}
+	})
+}
+
+// whether the Accept header lists application/json before text/html
+func prefersJSON(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "application/json":
+			return true
+		case "text/html":
+			return false
+		}
+	}
+	return false
+}
@@ -2,15 +2,18 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	_ "embed"
 	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
-	"strings"
+	"path/filepath"
+	"slices"
 	"syscall"
 	"time"
 
@@ -29,12 +32,198 @@ type Config struct {
 	TempDir                     string
 	EnableHTTPS                 bool
 	CertFile, CertServerKeyFile string
+	TLSMinVersion               string
+	TLSCipherSuites             string
+	TLSClientCAFile             string
+	EnableHTTP2                 bool
+	ReadHeaderTimeout           time.Duration
+	ReadTimeout, WriteTimeout   time.Duration
+	IdleTimeout                 time.Duration
+	ShutdownTimeout             time.Duration
+	OpsShutdownTimeout          time.Duration
+	StreamTimeout               time.Duration
+	EnableCompression           bool
+	AuditProvenance             bool
+	AuditMaxCommits             int
+	MaxRetries                  int
+	RetryBackoff                time.Duration
+	AuthScheme                  string
+	AuthMode                    string
+	ServerAuthToken             string
+	ServerAuthTokenFile         string
+	RemoteToken                 string
+	RemoteTokenFile             string
+	TokenFileReloadInterval     time.Duration
+	ResetOnRewrite              bool
+	BranchFromBundle            bool
+	AllowForcePush              bool
+	MirrorSource, MirrorSink    string
+	GitUserName, GitUserEmail   string
+	HTTPProxy, HTTPSProxy       string
+	NoProxy                     string
+	SingleBranch                bool
+	AllowLFSPointers            bool
+	GitCommandTimeout           time.Duration
+	MaxCloneAge                 time.Duration
+	BundleBackend               string
+	MetricRepoLabel             string
+	MaxBundleAge                time.Duration
+	MaxPushSize                 int64
+	TagConflict                 string
+	MergeMode, MergeMessage     string
+	AllowRefMismatch            bool
+	DeterministicBundles        bool
+	Repos                       []RepoConfig
+	MaxConcurrentOps            int
+	MaxConcurrentOpsPerRepo     int
+	OpsQueueTimeout             time.Duration
+	WebhookURL, WebhookSecret   string
+	BundleFilenameTemplate      string
+	EnableTracing               bool
+	PrewarmInterval             time.Duration
+	SyncConcurrency             int
+	DiskUsageInterval           time.Duration
+	ReadinessRequirePrewarm     bool
+	RateLimit                   float64
+	RateBurst                   int
+	AllowedRepos                []string
 }
 
 func (c Config) Validate() error {
 	if c.TempDir == "" {
 		return fmt.Errorf("temp-dir must be set")
 	}
+	if err := checkWritableDir(c.TempDir); err != nil {
+		return fmt.Errorf("temp-dir: %w", err)
+	}
+	if c.AuditMaxCommits < 1 {
+		return fmt.Errorf("audit-max-commits must be at least 1")
+	}
+	if c.MaxRetries < 0 {
+		return fmt.Errorf("max-retries must not be negative")
+	}
+	if c.MaxRetries > 0 && c.RetryBackoff <= 0 {
+		return fmt.Errorf("retry-backoff must be positive")
+	}
+	if _, err := git_sync.NewAuthExtractor(c.AuthScheme); err != nil {
+		return fmt.Errorf("auth-scheme: %w", err)
+	}
+	mode, err := git_sync.ParseAuthMode(c.AuthMode)
+	if err != nil {
+		return fmt.Errorf("auth-mode: %w", err)
+	}
+	if c.ServerAuthToken != "" && c.ServerAuthTokenFile != "" {
+		return fmt.Errorf("server-auth-token and server-auth-token-file must not both be set")
+	}
+	if mode == git_sync.AuthModeServer && c.ServerAuthToken == "" && c.ServerAuthTokenFile == "" {
+		return fmt.Errorf("server-auth-token or server-auth-token-file must be set when auth-mode is %s", mode)
+	}
+	if c.ServerAuthToken != "" && slices.Contains(c.serverAuthTokens(), "") {
+		return fmt.Errorf("server-auth-token must not have empty tokens")
+	}
+	if c.RemoteToken != "" && c.RemoteTokenFile != "" {
+		return fmt.Errorf("remote-token and remote-token-file must not both be set")
+	}
+	for name, path := range map[string]string{"server-auth-token-file": c.ServerAuthTokenFile, "remote-token-file": c.RemoteTokenFile} {
+		if path == "" {
+			continue
+		}
+		f, err := git_sync.NewTokenFile(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if name == "server-auth-token-file" && slices.Contains(git_sync.SplitTokens(f.Token()), "") {
+			return fmt.Errorf("%s must not have empty tokens", name)
+		}
+	}
+	if c.TokenFileReloadInterval < 0 {
+		return fmt.Errorf("token-file-reload-interval must not be negative")
+	}
+	if c.MaxBundleAge < 0 {
+		return fmt.Errorf("max-bundle-age must not be negative")
+	}
+	if c.MaxPushSize < 0 {
+		return fmt.Errorf("max-push-size must not be negative")
+	}
+	if _, err := git_sync.ParseTagConflict(c.TagConflict); err != nil {
+		return fmt.Errorf("tag-conflict: %w", err)
+	}
+	if _, err := git_sync.ParseMergeMode(c.MergeMode); err != nil {
+		return fmt.Errorf("merge-mode: %w", err)
+	}
+	if c.GitUserName == "" || c.GitUserEmail == "" {
+		return fmt.Errorf("git-user-name and git-user-email must be set")
+	}
+	if err := c.proxy().Validate(); err != nil {
+		return err
+	}
+	if (c.MirrorSource == "") != (c.MirrorSink == "") {
+		return fmt.Errorf("mirror-source and mirror-sink must be set together")
+	}
+	if c.MaxConcurrentOps < 0 || c.MaxConcurrentOpsPerRepo < 0 {
+		return fmt.Errorf("max-concurrent-ops and max-concurrent-ops-per-repo must not be negative")
+	}
+	if c.OpsQueueTimeout < 0 {
+		return fmt.Errorf("ops-queue-timeout must not be negative")
+	}
+	if c.ReadHeaderTimeout < 0 || c.ReadTimeout < 0 || c.WriteTimeout < 0 || c.IdleTimeout < 0 || c.StreamTimeout < 0 {
+		return fmt.Errorf("read-header-timeout, read-timeout, write-timeout, idle-timeout and stream-timeout must not be negative")
+	}
+	if c.ShutdownTimeout < 0 || c.OpsShutdownTimeout < 0 {
+		return fmt.Errorf("shutdown-timeout and ops-shutdown-timeout must not be negative")
+	}
+	seen := make(map[RepoConfig]bool, len(c.Repos))
+	for i, repo := range c.Repos {
+		if err := repo.Validate(); err != nil {
+			return fmt.Errorf("repos[%d]: %w", i, err)
+		}
+		key := RepoConfig{URL: repo.URL, Branch: repo.Branch}
+		if seen[key] {
+			return fmt.Errorf("repos[%d]: %s branch %s is configured more than once", i, repo.URL, repo.Branch)
+		}
+		seen[key] = true
+	}
+	if c.PrewarmInterval < 0 {
+		return fmt.Errorf("prewarm-interval must not be negative")
+	}
+	if c.SyncConcurrency < 1 {
+		return fmt.Errorf("sync-concurrency must be at least 1")
+	}
+	if c.DiskUsageInterval < 0 {
+		return fmt.Errorf("disk-usage-interval must not be negative")
+	}
+	if c.GitCommandTimeout <= 0 {
+		return fmt.Errorf("git-command-timeout must be positive")
+	}
+	if _, err := git_sync.ParseMetricRepoLabel(c.MetricRepoLabel); err != nil {
+		return fmt.Errorf("metric-repo-label: %w", err)
+	}
+	if _, err := git_sync.ParseBundleBackend(c.BundleBackend); err != nil {
+		return fmt.Errorf("bundle-backend: %w", err)
+	}
+	if c.MaxCloneAge < 0 {
+		return fmt.Errorf("max-clone-age must not be negative")
+	}
+	if c.PrewarmInterval > 0 && len(c.prewarmRepos()) == 0 {
+		return fmt.Errorf("prewarm-interval requires repos with role %s or %s", RoleSource, RoleBoth)
+	}
+	if err := git_sync.ValidateRepoAllowlist(c.AllowedRepos); err != nil {
+		return fmt.Errorf("allowed-repo: %w", err)
+	}
+	if c.RateLimit < 0 || c.RateBurst < 0 {
+		return fmt.Errorf("rate-limit and rate-burst must not be negative")
+	}
+	if c.WebhookURL != "" {
+		u, err := url.Parse(c.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhook-url '%s' must be an http/https URL", c.WebhookURL)
+		}
+	} else if c.WebhookSecret != "" {
+		return fmt.Errorf("webhook-secret requires webhook-url")
+	}
+	if _, err := git_sync.ParseBundleFilenameTemplate(c.BundleFilenameTemplate); err != nil {
+		return fmt.Errorf("bundle-filename-template: %w", err)
+	}
 	if c.EnableHTTPS {
 		if c.CertFile == "" {
 			return fmt.Errorf("cert-file must be set")
@@ -42,6 +231,11 @@ func (c Config) Validate() error {
 		if c.CertServerKeyFile == "" {
 			return fmt.Errorf("cert-server-key-file must be set")
 		}
+		if _, err := c.tlsConfig(); err != nil {
+			return err
+		}
+	} else if c.TLSCipherSuites != "" || c.TLSClientCAFile != "" {
+		return fmt.Errorf("tls-cipher-suites and tls-client-ca-file require enable-https")
 	}
 	return nil
 }
@@ -61,6 +255,69 @@ func readArgs() Config {
 	fs.BoolVar(&config.EnableHTTPS, "enable-https", false, "Enable HTTPS")
 	fs.StringVar(&config.CertFile, "cert-file", "", "Certificate file. Required if enable-https is set")
 	fs.StringVar(&config.CertServerKeyFile, "cert-server-key-file", "", "Certificate server key file. Required if enable-https is set")
+	fs.StringVar(&config.TLSMinVersion, "tls-min-version", "1.2", "Minimum TLS version (1.0, 1.1, 1.2 or 1.3), if enable-https is set")
+	fs.StringVar(&config.TLSCipherSuites, "tls-cipher-suites", "", "Comma separated list of allowed cipher suites for TLS 1.2 and below, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. The TLS 1.3 suites are not configurable. Go defaults if not set")
+	fs.StringVar(&config.TLSClientCAFile, "tls-client-ca-file", "", "PEM file with the CA certificates client certificates must be signed by. If set, clients must present a valid certificate (mutual TLS), otherwise the TLS handshake fails")
+	fs.BoolVar(&config.EnableHTTP2, "enable-http2", true, "Serve HTTP/2 to clients that support it, if enable-https is set")
+	fs.DurationVar(&config.ReadHeaderTimeout, "read-header-timeout", 10*time.Second, "Maximum time to read the headers of a request. 0 for no limit")
+	fs.DurationVar(&config.ReadTimeout, "read-timeout", 10*time.Minute, "Maximum time to read a request, including the body. Must be large enough to upload the largest pushed bundle. 0 for no limit")
+	fs.DurationVar(&config.WriteTimeout, "write-timeout", 10*time.Minute, "Maximum time from the end of reading a request to the end of the response, including git operations. Pulled bundles are written with their own deadline, see stream-timeout. 0 for no limit")
+	fs.DurationVar(&config.IdleTimeout, "idle-timeout", 2*time.Minute, "Maximum time to wait for the next request on a keep-alive connection. 0 for no limit")
+	fs.DurationVar(&config.ShutdownTimeout, "shutdown-timeout", 10*time.Second, "Maximum time to wait for requests to complete on shutdown, before closing their connections")
+	fs.DurationVar(&config.OpsShutdownTimeout, "ops-shutdown-timeout", 30*time.Second, "Maximum time to wait for git operations and webhook deliveries to complete on shutdown, after shutdown-timeout, before they are cancelled. Cancelled operations get a few seconds more to clean up")
+	fs.DurationVar(&config.StreamTimeout, "stream-timeout", time.Hour, "Maximum time to write a pulled bundle, replacing write-timeout once the bundle is ready, so large bundles are not cut off. 0 for no limit")
+	fs.BoolVar(&config.EnableCompression, "enable-compression", true, "Compress pulled bundles (gzip/zstd) when accepted by the client, and decompress pushed bundles with Content-Encoding gzip/zstd. Pushes with other encodings are rejected with 415")
+
+	fs.BoolVar(&config.AuditProvenance, "audit-provenance", false, "Include the commits introduced by each push (id, author, subject) in the push audit log entry")
+	fs.IntVar(&config.AuditMaxCommits, "audit-max-commits", 100, "Maximum number of commits to include in the push audit log entry")
+	fs.IntVar(&config.MaxRetries, "max-retries", 2, "Number of retries when syncing with or pushing to the remote fails with a transient error, i.e. the remote could not be reached, the connection broke or the remote responded 5xx or 429")
+	fs.DurationVar(&config.RetryBackoff, "retry-backoff", time.Second, "Wait before the first retry. Doubled for each subsequent retry")
+	fs.StringVar(&config.AuthScheme, "auth-scheme", "bearer", "Comma separated list of schemes to extract the repository token from requests, tried in order. Supported: bearer, basic (token as password), header:<name> (e.g. header:X-Forwarded-Access-Token)")
+	fs.StringVar(&config.AuthMode, "auth-mode", string(git_sync.AuthModePassthrough), "How the token of requests is used. 'passthrough': relayed to the remote repository, which validates it (401 when rejected). 'server': validated against server-auth-token (401 when invalid), and the separate remote-token is used for the remote repository (502 when rejected by the remote)")
+	fs.StringVar(&config.ServerAuthToken, "server-auth-token", "", "Token requests to /pull and /push must provide (in the auth-scheme), checked before any git work. Comma-separated to accept any of several tokens, e.g. both the old and new token while rotating. Required if auth-mode is server")
+	fs.StringVar(&config.RemoteToken, "remote-token", "", "Token to authenticate to remote repositories in auth-mode server. Empty for anonymous access, e.g. to public repositories")
+	fs.StringVar(&config.ServerAuthTokenFile, "server-auth-token-file", "", "File with the server-auth-token, e.g. a mounted secret, so the token is not exposed on the command line or in the environment. Comma-separated like server-auth-token, and trailing newlines are trimmed. Instead of server-auth-token")
+	fs.StringVar(&config.RemoteTokenFile, "remote-token-file", "", "File with the remote-token. Trailing newlines are trimmed. Instead of remote-token")
+	fs.DurationVar(&config.TokenFileReloadInterval, "token-file-reload-interval", 30*time.Second, "How often server-auth-token-file, remote-token-file and the token_file of repos are checked for changes, and reloaded, so rotated tokens take effect without a restart. 0 to only read them at startup")
+	fs.BoolVar(&config.BranchFromBundle, "branch-from-bundle", false, "Allow pushes without the 'branch' query parameter, routed to the branch of the single head of the pushed bundle")
+	fs.BoolVar(&config.AllowForcePush, "allow-force-push", false, "Allow pushes with 'force=true' that overwrite the history of the remote branch. The 'X-Git-Expected-Head' header must match the remote head, otherwise 409 is returned")
+	fs.StringVar(&config.MirrorSource, "mirror-source", "", "Source repository URL for POST /mirror/{branch}, which pulls the branch from the source and pushes it to mirror-sink. Disabled if not set")
+	fs.StringVar(&config.MirrorSink, "mirror-sink", "", "Sink repository URL for POST /mirror/{branch}. Required if mirror-source is set")
+	fs.StringVar(&config.GitUserName, "git-user-name", git_sync.DefaultIdentity.Name, "Name of the author/committer of commits created by git, e.g. merges when applying bundles")
+	fs.StringVar(&config.GitUserEmail, "git-user-email", git_sync.DefaultIdentity.Email, "Email of the author/committer of commits created by git")
+	fs.StringVar(&config.HTTPSProxy, "https-proxy", "", "Proxy for https remote repositories, e.g. http://proxy:3128, for both git and go-git (clone, pull and push). Without it, clones behind a proxy hang until they time out. Defaults to the HTTPS_PROXY environment variable, if none of the proxy flags are set")
+	fs.StringVar(&config.HTTPProxy, "http-proxy", "", "Proxy for http remote repositories, like https-proxy")
+	fs.StringVar(&config.NoProxy, "no-proxy", "", "Comma-separated hosts, domains (e.g. .example.com) and CIDRs of remote repositories to access without https-proxy or http-proxy")
+	fs.BoolVar(&config.SingleBranch, "single-branch", true, "Clone only the requested branch of remote repositories. With false, all branches are cloned, so a pull with 'from' may start from a commit of another branch, at the cost of more disk and slower syncs")
+	fs.BoolVar(&config.AllowLFSPointers, "allow-lfs-pointers", false, "Allow pulls of branches using Git LFS (filter=lfs in .gitattributes). Bundles only have the pointer files, so the LFS objects must be transferred separately. Otherwise such pulls are rejected with 422")
+	fs.DurationVar(&config.GitCommandTimeout, "git-command-timeout", git_sync.DefaultCommandTimeout, "Maximum duration of each git command, e.g. creating, applying or verifying a bundle. A command exceeding it is killed, so a hanging git does not block the repository")
+	fs.StringVar(&config.MetricRepoLabel, "metric-repo-label", string(git_sync.MetricRepoLabelURL), "The repository_url label of the operation, last success and work dir size metrics. 'url': the repository URL, or 'other' for URLs not matching allowed-repo. 'name': the name of a repo configured in repos (with a hash of the URL when names collide), or 'other', so ad-hoc repositories do not create new series. 'none': empty. The branch label is bounded the same way, 'other' for repositories labelled 'other' and with 'name' for branches not configured in repos")
+	fs.StringVar(&config.BundleBackend, "bundle-backend", string(git_sync.BundleBackendCLI), "How pulled bundles and packfiles are created. 'cli': with the git binary. 'go-git': without the git binary for full bundles and bundles with from/to, packfiles, counting commits and checking for Git LFS. Pulls with since, after or max-commits, deterministic-bundles, sha256 repositories, pushes and /verify still require the git binary")
+	fs.DurationVar(&config.MaxCloneAge, "max-clone-age", 0, "Maximum age of local clones. An older clone is removed and cloned again on the next sync, so objects of rewritten or deleted history do not accumulate. 0 for no limit")
+	fs.DurationVar(&config.MaxBundleAge, "max-bundle-age", 0, "Reject pushed bundles with 422, when the commit time of the head of the bundle is older, e.g. to prevent replay of old bundles. 0 for no limit")
+	fs.Int64Var(&config.MaxPushSize, "max-push-size", 1<<30, "Maximum size in bytes of pushed bundles, after decompression. Larger pushes are rejected with 413. 0 for no limit")
+	fs.StringVar(&config.MergeMode, "merge-mode", string(git_sync.MergeModeFastForward), "How pushed bundles are applied to the branch. 'ff-only': only fast-forward, and reject bundles diverging from the branch with 409. 'merge': merge diverging bundles with a merge commit by git-user-name and git-user-email, and reject conflicting bundles with 409")
+	fs.StringVar(&config.MergeMessage, "merge-message", "", "Message of merge commits with merge-mode merge. Defaults to 'Merge bundle into <branch>'")
+	fs.StringVar(&config.TagConflict, "tag-conflict", string(git_sync.TagConflictFail), "How tags of pushed bundles are handled, that exist in the remote repository with another target. 'fail': reject the push with 409, before anything is pushed. 'skip': push the branch and the other tags, and keep the tags of the remote. 'force': overwrite the tags of the remote")
+	fs.BoolVar(&config.AllowRefMismatch, "allow-ref-mismatch", false, "Allow pushes of bundles with a single head of another ref than the requested branch, which is then applied to the branch. Otherwise such pushes are rejected with 400")
+	fs.BoolVar(&config.DeterministicBundles, "deterministic-bundles", false, "Repack pulled bundles, so the same content yields the same bytes (for the same git version), and respond with a strong ETag. Costs CPU, since all objects of each bundle are recompressed without reusing existing deltas")
+	fs.IntVar(&config.MaxConcurrentOps, "max-concurrent-ops", 0, "Maximum number of concurrent git operations (pull, push, mirror). Requests over the limit wait up to ops-queue-timeout, then get 503 with Retry-After. 0 for no limit")
+	fs.IntVar(&config.MaxConcurrentOpsPerRepo, "max-concurrent-ops-per-repo", 0, "Maximum number of concurrent git operations per repository, e.g. for pulls of different branches. 0 for no limit")
+	fs.DurationVar(&config.OpsQueueTimeout, "ops-queue-timeout", 5*time.Second, "How long requests over max-concurrent-ops or max-concurrent-ops-per-repo wait for another operation to complete. 0 to reject immediately")
+	fs.StringVar(&config.WebhookURL, "webhook-url", "", `URL to POST a JSON event {"op", "repository", "branch", "head", "commits", "timestamp"} to after each successful pull, push and mirror. Delivery failures are logged and counted, but do not fail the operation. Disabled if not set`)
+	fs.StringVar(&config.WebhookSecret, "webhook-secret", "", "Shared secret to sign webhook events with. The HMAC-SHA256 of the body is sent in the X-Git-Sync-Signature header as sha256=<hex>")
+	fs.StringVar(&config.BundleFilenameTemplate, "bundle-filename-template", git_sync.DefaultBundleFilenameTemplate, "Filename of pulled bundles (Content-Disposition), as a Go text/template with the fields {{.Repo}} (name), {{.Branch}}, {{.Commit}} (head), {{.Hash}} (of head and options) and {{.Timestamp}} (of the pull, e.g. 20250213T080000Z). Characters other than letters, digits, '.', '-' and '_' are replaced with '_'. Not used when pulling all branches")
+	fs.Var((*repoList)(&config.Repos), "repos", `Repositories of a multi-repo setup, as a JSON list of {"url", "branch", "token", "token_file", "role", "temp_dir"} where role is source, sink or both, token is used for the repository instead of remote-token in auth-mode server and for prewarming, token_file is a file with the token (reloaded like remote-token-file) instead of token, and temp_dir optionally overrides temp-dir for the local clones of the repository (must exist and be writable). Usually set in the config file`)
+	fs.BoolVar(&config.EnableTracing, "enable-tracing", false, "Export OpenTelemetry spans of requests and git operations with OTLP over HTTP, configured with the standard OTEL_EXPORTER_OTLP_* environment variables (e.g. OTEL_EXPORTER_OTLP_ENDPOINT). The trace context of incoming 'traceparent' headers is continued")
+	fs.DurationVar(&config.PrewarmInterval, "prewarm-interval", 0, "Sync the local clones of the repos with role source or both in the background at this interval, so pulls are incremental rather than full clones. Uses the token of the repo, otherwise remote-token. 0 to disable")
+	fs.IntVar(&config.SyncConcurrency, "sync-concurrency", 4, "Maximum repos synced at a time by prewarm-interval. The rest are queued")
+	fs.BoolVar(&config.ReadinessRequirePrewarm, "readiness-require-prewarm", true, "With prewarm-interval, GET /readyz responds with 503 until each prewarmed repo was synced successfully once, so no traffic is sent before the first clones. With false, the server is ready immediately")
+	fs.DurationVar(&config.DiskUsageInterval, "disk-usage-interval", 5*time.Minute, "How often the size of temp-dir and of each local clone is measured, exposed as git_sync_tempdir_bytes and git_sync_workdir_bytes. 0 to disable")
+	fs.Float64Var(&config.RateLimit, "rate-limit", 0, "Maximum sustained requests per second of each client to /pull, /push, /verify, /mirror and /repos, identified by the server auth token of the request (see auth-scheme) in auth-mode server, otherwise by IP. Requests over the limit get 429 with Retry-After. 0 for no limit")
+	fs.IntVar(&config.RateBurst, "rate-burst", 10, "Maximum burst of requests of each client above rate-limit")
+	fs.Var((*stringList)(&config.AllowedRepos), "allowed-repo", "Repository URL (without credentials) that requests may pull from or push to. Repeatable. With a glob (*, ? or [) it is matched with Go's path.Match, e.g. https://github.com/org/*.git, otherwise the scheme and host must be equal, and the path equal to or below the path of the pattern by whole segments, e.g. https://github.com/org. Other repositories are rejected with 403. Any repository is allowed if not set")
+	fs.String("config", "", "JSON config file with the options, keyed by flag name. Repos may be given as a list")
+	fs.BoolVar(&config.ResetOnRewrite, "reset-on-rewrite", true, "When the history of a remote branch was rewritten (force-pushed), reset the local clone and mark the response with 'X-Git-Rewritten: true'. Otherwise respond with 409")
 
 	var logLevel slog.Level
 	fs.TextVar(&logLevel, "log-level", slog.LevelDebug-3, "Log level")
@@ -68,8 +325,11 @@ func readArgs() Config {
 	fs.BoolVar(&logJSON, "log-json", false, "Log in JSON format")
 	var help bool
 	fs.BoolVar(&help, "help", false, "Show help")
+	var version bool
+	fs.BoolVar(&version, "version", false, "Print the version, commit and build date, and exit")
 
-	err := ff.Parse(fs, os.Args[1:], ff.WithEnvVarPrefix(envPrefix))
+	err := ff.Parse(fs, os.Args[1:], ff.WithEnvVarPrefix(envPrefix),
+		ff.WithConfigFileFlag("config"), ff.WithConfigFileParser(configFileParser))
 	if err != nil {
 		bail(fs, "parse error: "+err.Error())
 		os.Exit(2)
@@ -79,6 +339,11 @@ func readArgs() Config {
 		fs.Usage()
 		os.Exit(0)
 	}
+	if version {
+		info := git_sync.GetBuildInfo()
+		fmt.Printf("git_sync %s (commit %s, committed %s, built %s)\n", info.Version, info.Commit, info.CommitDate, info.BuildDate)
+		os.Exit(0)
+	}
 	slogging.SetDefault(logLevel, false, logJSON)
 
 	if config.TempDir == "" {
@@ -95,22 +360,211 @@ func readArgs() Config {
 func main() {
 	ctx := context.Background()
 	config := readArgs()
-	log := slog.With("op", "main", "listenAddress", config.ListenAddress, "tempDir", config.TempDir, "enableHTTPS", config.EnableHTTPS)
+	log := slog.With("op", "main", "version", git_sync.Version, "listenAddress", config.ListenAddress, "tempDir", config.TempDir, "enableHTTPS", config.EnableHTTPS, "repos", len(config.Repos))
 
 	mux := mux.NewRouter()
-	mux.Handle("/pull", git_sync.NewGitPullHandler(config.TempDir))
-	mux.Handle("/push", git_sync.NewGitPushHandler(config.TempDir))
+	auth, _ := git_sync.NewAuthExtractor(config.AuthScheme) // validated
+	ops := git_sync.NewOperations()
+	handlerOpts := git_sync.HandlerOptions{
+		EnableCompression:    config.EnableCompression,
+		AuditProvenance:      config.AuditProvenance,
+		AuditMaxCommits:      config.AuditMaxCommits,
+		MaxRetries:           config.MaxRetries,
+		RetryBackoff:         config.RetryBackoff,
+		Auth:                 auth,
+		AuthMode:             git_sync.AuthMode(config.AuthMode),
+		RemoteToken:          config.RemoteToken,
+		ResetOnRewrite:       config.ResetOnRewrite,
+		BranchFromBundle:     config.BranchFromBundle,
+		AllowForcePush:       config.AllowForcePush,
+		Identity:             git_sync.Identity{Name: config.GitUserName, Email: config.GitUserEmail},
+		Proxy:                config.proxy(),
+		CloneAllBranches:     !config.SingleBranch,
+		AllowLFSPointers:     config.AllowLFSPointers,
+		CommandTimeout:       config.GitCommandTimeout,
+		MaxCloneAge:          config.MaxCloneAge,
+		BundleBackend:        git_sync.BundleBackend(config.BundleBackend),
+		MetricRepoLabel:      git_sync.MetricRepoLabel(config.MetricRepoLabel),
+		MaxBundleAge:         config.MaxBundleAge,
+		MaxPushSize:          config.MaxPushSize,
+		TagConflict:          git_sync.TagConflict(config.TagConflict),
+		MergeMode:            git_sync.MergeMode(config.MergeMode),
+		MergeMessage:         config.MergeMessage,
+		AllowRefMismatch:     config.AllowRefMismatch,
+		DeterministicBundles: config.DeterministicBundles,
+		Operations:           ops,
+		Limiter:              git_sync.NewLimiter(config.MaxConcurrentOps, config.MaxConcurrentOpsPerRepo, config.OpsQueueTimeout),
+		StreamTimeout:        config.StreamTimeout,
+		AllowedRepos:         config.AllowedRepos}
+	handlerOpts.BundleFilename, _ = git_sync.ParseBundleFilenameTemplate(config.BundleFilenameTemplate) // validated
+	cursors, err := git_sync.NewCursorStore(filepath.Join(config.TempDir, "cursors.json"))
+	if err != nil {
+		log.Error("failed to load cursors of incremental pulls", "err", err)
+		os.Exit(1)
+	}
+	handlerOpts.Cursors = cursors
+	if config.WebhookURL != "" {
+		handlerOpts.Webhook = git_sync.NewWebhook(config.WebhookURL, config.WebhookSecret)
+	}
+
+	watchCtx, stopWatch := context.WithCancel(ctx)
+	defer stopWatch()
+	var serverTokenFile *git_sync.TokenFile
+	if config.ServerAuthTokenFile != "" {
+		if serverTokenFile, err = git_sync.NewTokenFile(config.ServerAuthTokenFile); err != nil {
+			log.Error("failed to read server auth token", "err", err)
+			os.Exit(1)
+		}
+	}
+	if config.RemoteTokenFile != "" {
+		if handlerOpts.RemoteTokenFile, err = git_sync.NewTokenFile(config.RemoteTokenFile); err != nil {
+			log.Error("failed to read remote token", "err", err)
+			os.Exit(1)
+		}
+	}
+	tokenFiles := []*git_sync.TokenFile{serverTokenFile, handlerOpts.RemoteTokenFile}
+	registered := make([]git_sync.RegisteredRepo, 0, len(config.Repos))
+	for _, repo := range config.Repos {
+		var repoTokenFile *git_sync.TokenFile
+		if repo.TokenFile != "" {
+			if repoTokenFile, err = git_sync.NewTokenFile(repo.TokenFile); err != nil {
+				log.Error("failed to read token of repository", "repo.url", repo.URL, "err", err)
+				os.Exit(1)
+			}
+			tokenFiles = append(tokenFiles, repoTokenFile)
+		}
+		registered = append(registered, git_sync.RegisteredRepo{
+			URL:       repo.URL,
+			Branch:    repo.Branch,
+			Pull:      repo.Role == RoleSource || repo.Role == RoleBoth,
+			Push:      repo.Role == RoleSink || repo.Role == RoleBoth,
+			TempDir:   repo.TempDir,
+			Token:     repo.Token,
+			TokenFile: repoTokenFile})
+	}
+	handlerOpts.Repos = git_sync.NewRepoRegistry(registered)
+	if config.TokenFileReloadInterval > 0 {
+		for _, f := range tokenFiles {
+			if f != nil {
+				go f.Watch(watchCtx, config.TokenFileReloadInterval)
+			}
+		}
+	}
+
+	requireServerToken := func(h http.Handler) http.Handler {
+		if serverTokenFile != nil {
+			return git_sync.RequireTokenFile(serverTokenFile, auth, h)
+		}
+		return git_sync.RequireTokens(config.serverAuthTokens(), auth, h)
+	}
+	// in server auth mode, requests must provide the server auth token before any git work is done.
+	// The token for the remote repository is configured separately
+	requireAuth := func(h http.Handler) http.Handler {
+		if handlerOpts.AuthMode == git_sync.AuthModeServer {
+			return requireServerToken(h)
+		}
+		return h
+	}
+	// rate limit per client by token once the server auth token is validated, so unknown tokens cannot add
+	// buckets. In passthrough auth mode the token is only validated by the remote, so clients are limited by IP
+	var rateLimiter *git_sync.RateLimiter
+	if config.RateLimit > 0 {
+		rateLimiter = git_sync.NewRateLimiter(config.RateLimit, config.RateBurst)
+	}
+	protect := func(h http.Handler) http.Handler {
+		if handlerOpts.AuthMode == git_sync.AuthModeServer {
+			return requireAuth(git_sync.RateLimit(rateLimiter, auth, h))
+		}
+		return git_sync.RateLimit(rateLimiter, nil, h)
+	}
+
+	pullHandler := protect(git_sync.NewGitPullHandler(config.TempDir, handlerOpts))
+	mux.Handle("/pull", pullHandler)
+	mux.Handle("/pull/{branch}", pullHandler)
+	mux.Handle("/push", protect(git_sync.NewGitPushHandler(config.TempDir, handlerOpts)))
+	mux.Handle("/verify", protect(git_sync.NewGitVerifyHandler(config.TempDir, handlerOpts))).Methods(http.MethodPost)
+	if config.MirrorSource != "" {
+		mux.Handle("/mirror/{branch}", protect(git_sync.NewGitMirrorHandler(config.TempDir, handlerOpts, config.MirrorSource, config.MirrorSink))).
+			Methods(http.MethodPost)
+	}
+	if config.ServerAuthToken != "" || serverTokenFile != nil {
+		// lists the configured repositories, so only with the server auth token regardless of the auth mode
+		mux.Handle("/repos", requireServerToken(git_sync.RateLimit(rateLimiter, auth, handlerOpts.Repos))).Methods(http.MethodGet)
+	}
+	var prewarmer *git_sync.Prewarmer
+	if config.PrewarmInterval > 0 {
+		syncer := git_sync.Syncer{
+			TempDir:          config.TempDir,
+			MaxRetries:       config.MaxRetries,
+			RetryBackoff:     config.RetryBackoff,
+			ResetOnRewrite:   config.ResetOnRewrite,
+			Identity:         handlerOpts.Identity,
+			Proxy:            handlerOpts.Proxy,
+			CloneAllBranches: handlerOpts.CloneAllBranches,
+			CommandTimeout:   handlerOpts.CommandTimeout,
+			MaxCloneAge:      handlerOpts.MaxCloneAge}
+		prewarmer = git_sync.NewPrewarmer(syncer, config.prewarmRepos(), config.PrewarmInterval, config.SyncConcurrency)
+		prewarmer.SetTokens(func(repoURL string) string {
+			if token, ok := handlerOpts.Repos.Token(repoURL); ok {
+				return token
+			}
+			if handlerOpts.RemoteTokenFile != nil {
+				return handlerOpts.RemoteTokenFile.Token()
+			}
+			return config.RemoteToken
+		})
+	}
+	// ready immediately, unless waiting for the first prewarm
+	readiness := prewarmer
+	if !config.ReadinessRequirePrewarm {
+		readiness = nil
+	}
+	mux.Handle("/readyz", git_sync.ReadinessHandler(readiness)).Methods(http.MethodGet)
+	mux.Handle("/version", git_sync.VersionHandler()).Methods(http.MethodGet)
+	git_sync.ExposeBuildInfo()
 	mux.Handle("/metrics", promhttp.Handler())
 
-	// TODO: Add page at / to explain the endpoints
-	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Add("Content-Type", "text/html")
-		body := strings.Builder{}
-		body.Write(indexHTML)
-		w.Write([]byte(body.String()))
-	}))
+	mux.Handle("/", indexHandler(mux))
+
+	prewarmCtx, stopPrewarm := context.WithCancel(ctx)
+	defer stopPrewarm()
+	if prewarmer != nil {
+		go prewarmer.Run(prewarmCtx)
+	}
+	if config.DiskUsageInterval > 0 {
+		go git_sync.NewDiskUsage(config.TempDir, config.DiskUsageInterval, handlerOpts).Run(prewarmCtx)
+	}
+
+	if config.EnableTracing {
+		tp, err := newTracerProvider(ctx)
+		if err != nil {
+			log.Error("failed to set up tracing", "err", err)
+			os.Exit(1)
+		}
+		defer func() {
+			if err := tp.Shutdown(context.Background()); err != nil {
+				log.Error("failed to flush spans", "err", err)
+			}
+		}()
+		// after routing, so spans are named after the route
+		mux.Use(git_sync.Trace(tp))
+	}
 
-	server := &http.Server{Handler: mux, Addr: config.ListenAddress}
+	// assign request IDs and log each request. Handlers log with the request-scoped logger
+	server := &http.Server{
+		Handler:           git_sync.AccessLog(mux),
+		Addr:              config.ListenAddress,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		ReadTimeout:       config.ReadTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout}
+	if config.EnableHTTPS {
+		server.TLSConfig, _ = config.tlsConfig() // validated
+	}
+	if !config.EnableHTTP2 {
+		// a non-nil, empty map disables HTTP/2
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
 
 	go func() {
 		log.Info("starting server")
@@ -134,16 +588,35 @@ func main() {
 	<-sigChan
 
 	log.Debug("shutting down server")
-	shutdownCtx, shutdownRelease := context.WithTimeout(ctx, 10*time.Second)
+	stopPrewarm()
+	shutdownCtx, shutdownRelease := context.WithTimeout(ctx, config.ShutdownTimeout)
 	defer shutdownRelease()
 
 	if err := server.Shutdown(shutdownCtx); err != nil {
 		log.Error("HTTP shutdown error", "err", err)
+	}
+
+	// handlers may still be running git operations, if the HTTP shutdown timed out, and webhook events may
+	// still be delivered
+	log.Debug("waiting for git operations", "running", ops.Active())
+	opsCtx, opsRelease := context.WithTimeout(ctx, config.OpsShutdownTimeout)
+	defer opsRelease()
+	if running := ops.Shutdown(opsCtx); running > 0 {
+		log.Error("git operations still running at shutdown were cancelled", "running", running)
+		// let the cancelled operations clean up, e.g. remove lock files of killed git processes
+		cleanupCtx, cleanupRelease := context.WithTimeout(ctx, opsCleanupTimeout)
+		defer cleanupRelease()
+		if !ops.Wait(cleanupCtx) {
+			log.Error("cancelled git operations did not complete", "running", ops.Active())
+		}
 		os.Exit(2)
 	}
 	log.Info("server stopped")
 }
 
+// how long cancelled git operations get to clean up on shutdown
+const opsCleanupTimeout = 5 * time.Second
+
 func bail(fs *flag.FlagSet, format string, args ...interface{}) {
 	fmt.Fprintf(os.Stderr, format+"\n", args...)
 	fs.Usage()
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13}
+
+// build the TLS config of the server from the tls-* options.
+// When a client CA file is set, connections without a client certificate signed by it fail the handshake
+func (c Config) tlsConfig() (*tls.Config, error) {
+	minVersion, ok := tlsVersions[c.TLSMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("tls-min-version '%s' must be one of 1.0, 1.1, 1.2 or 1.3", c.TLSMinVersion)
+	}
+	cfg := &tls.Config{MinVersion: minVersion}
+
+	if c.TLSCipherSuites != "" {
+		suites, err := parseCipherSuites(c.TLSCipherSuites)
+		if err != nil {
+			return nil, fmt.Errorf("tls-cipher-suites: %w", err)
+		}
+		if c.EnableHTTP2 && minVersion < tls.VersionTLS13 && !hasHTTP2CipherSuite(suites) {
+			return nil, fmt.Errorf("tls-cipher-suites must include TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, required by HTTP/2. Or disable enable-http2")
+		}
+		cfg.CipherSuites = suites
+	}
+
+	if c.TLSClientCAFile != "" {
+		data, err := os.ReadFile(c.TLSClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls-client-ca-file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("tls-client-ca-file '%s' contains no PEM certificates", c.TLSClientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// HTTP/2 requires one of these for TLS 1.2 (RFC 7540, section 9.2.2)
+func hasHTTP2CipherSuite(suites []uint16) bool {
+	for _, id := range suites {
+		if id == tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 || id == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+			return true
+		}
+	}
+	return false
+}
+
+// comma separated names of secure cipher suites, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256.
+// Only applies to TLS 1.2 and below, since the TLS 1.3 suites are not configurable
+func parseCipherSuites(names string) ([]uint16, error) {
+	byName := make(map[string]uint16)
+	for _, s := range tls.CipherSuites() {
+		byName[s.Name] = s.ID
+	}
+
+	var ids []uint16
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		id, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite '%s'", name)
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no cipher suites in '%s'", names)
+	}
+	return ids, nil
+}
@@ -15,8 +15,11 @@ type CommandError struct {
 	// ExitCode represents the exit status or error code of the command
 	ExitCode int
 
-	// StdErr contains the error output from the command execution
+	// StdErr contains the error output from the command execution, truncated to 1 MiB
 	StdErr string
+
+	// Timeout is whether the command was killed, since it did not complete within its timeout
+	Timeout bool
 }
 
 // Implement the error interface
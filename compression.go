@@ -0,0 +1,115 @@
+package git_sync
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+const (
+	encodingGzip     = "gzip"
+	encodingZstd     = "zstd"
+	encodingIdentity = "identity"
+)
+
+var ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// ErrBundleTooLarge is returned when a pushed bundle exceeds HandlerOptions.MaxPushSize, after decompression
+var ErrBundleTooLarge = errors.New("bundle exceeds the maximum push size")
+
+// selectEncoding picks the preferred supported encoding from an Accept-Encoding header.
+// Returns empty string if no compression should be applied
+func selectEncoding(acceptEncoding string) string {
+	var gzipOK, zstdOK bool
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+
+		// an explicit q=0 means "not acceptable"
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				continue
+			}
+		}
+
+		switch name {
+		case encodingGzip:
+			gzipOK = true
+		case encodingZstd:
+			zstdOK = true
+		}
+	}
+
+	if zstdOK {
+		return encodingZstd
+	}
+	if gzipOK {
+		return encodingGzip
+	}
+	return ""
+}
+
+// writeCompressed writes data to w, compressed with the encoding. Headers must not have been written yet.
+// Without compression, Content-Length is set, so clients can show progress
+func writeCompressed(w http.ResponseWriter, encoding string, data []byte) error {
+	var cw io.WriteCloser
+	switch encoding {
+	case encodingGzip:
+		cw = gzip.NewWriter(w)
+	case encodingZstd:
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			return errors.Wrap(err, "failed to create zstd writer")
+		}
+		cw = zw
+	default:
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		_, err := w.Write(data)
+		return err
+	}
+
+	w.Header().Set("Content-Encoding", encoding)
+	w.Header().Add("Vary", "Accept-Encoding")
+	if _, err := cw.Write(data); err != nil {
+		cw.Close()
+		return errors.Wrapf(err, "failed to write %s compressed data", encoding)
+	}
+	return cw.Close()
+}
+
+// whether the Content-Encoding means no encoding
+func isIdentityEncoding(contentEncoding string) bool {
+	encoding := strings.ToLower(strings.TrimSpace(contentEncoding))
+	return encoding == "" || encoding == encodingIdentity
+}
+
+// decompressBody wraps body in a decompressor matching the Content-Encoding.
+// Bodies without Content-Encoding (or identity) are returned as is.
+// Returns ErrUnsupportedEncoding for other encodings
+func decompressBody(contentEncoding string, body io.Reader) (io.ReadCloser, error) {
+	if isIdentityEncoding(contentEncoding) {
+		return io.NopCloser(body), nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(contentEncoding)) {
+	case encodingGzip:
+		gr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read gzip body")
+		}
+		return gr, nil
+	case encodingZstd:
+		zr, err := zstd.NewReader(body)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read zstd body")
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return nil, errors.Wrapf(ErrUnsupportedEncoding, "'%s', expected %s or %s", contentEncoding, encodingGzip, encodingZstd)
+	}
+}
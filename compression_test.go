@@ -0,0 +1,120 @@
+package git_sync
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bredtape/git_sync/testdata"
+	"github.com/pkg/errors"
+)
+
+func TestSelectEncoding(t *testing.T) {
+	tcs := map[string]string{
+		"":                   "",
+		"identity":           "",
+		"gzip":               encodingGzip,
+		"deflate, gzip":      encodingGzip,
+		"gzip;q=0":           "",
+		"gzip, zstd":         encodingZstd,
+		"gzip, zstd;q=0":     encodingGzip,
+		" GZIP ; q=0.5, br ": encodingGzip,
+	}
+
+	for header, expected := range tcs {
+		actual := selectEncoding(header)
+		if actual != expected {
+			t.Errorf("Accept-Encoding '%s': expected '%s', got '%s'", header, expected, actual)
+		}
+	}
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	for _, encoding := range []string{encodingGzip, encodingZstd} {
+		t.Run(encoding, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			err := writeCompressed(rec, encoding, testdata.FullBundle)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if rec.Header().Get("Content-Encoding") != encoding {
+				t.Fatalf("expected Content-Encoding %s, got '%s'", encoding, rec.Header().Get("Content-Encoding"))
+			}
+
+			// as decompressed on push
+			body, err := decompressBody(encoding, rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer body.Close()
+
+			actual, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(actual, testdata.FullBundle) {
+				t.Fatal("bundle differs after round trip")
+			}
+		})
+	}
+}
+
+func TestDecompressBodyInvalidGzip(t *testing.T) {
+	_, err := decompressBody(encodingGzip, bytes.NewReader(testdata.FullBundle))
+	if err == nil {
+		t.Fatal("expected error for body that is not gzip")
+	}
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write(testdata.FullBundle)
+	gw.Close()
+	_, err = decompressBody("GZIP", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDecompressBodyUnsupported(t *testing.T) {
+	for _, encoding := range []string{"br", "deflate", "gzip, zstd"} {
+		_, err := decompressBody(encoding, bytes.NewReader(testdata.FullBundle))
+		if !errors.Is(err, ErrUnsupportedEncoding) {
+			t.Errorf("encoding '%s': expected ErrUnsupportedEncoding, got %v", encoding, err)
+		}
+	}
+
+	for _, encoding := range []string{"", "identity", " Identity "} {
+		_, err := decompressBody(encoding, bytes.NewReader(testdata.FullBundle))
+		if err != nil {
+			t.Errorf("encoding '%s': %v", encoding, err)
+		}
+	}
+}
+
+func TestPushUnsupportedEncodingRejectedBeforeGit(t *testing.T) {
+	tcs := map[string]struct {
+		enableCompression bool
+		encoding          string
+	}{
+		"unsupported":          {true, "br"},
+		"compression disabled": {false, encodingGzip},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			repo := unusedRemote("main")
+			req := createPushHTTPRequest(t, "/push", repo, testdata.FullBundle)
+			req.Header.Set("Content-Encoding", tc.encoding)
+
+			rec := httptest.NewRecorder()
+			NewGitPushHandler(t.TempDir(), HandlerOptions{EnableCompression: tc.enableCompression}).ServeHTTP(rec, req)
+			if rec.Code != http.StatusUnsupportedMediaType {
+				t.Fatalf("expected status %d, got %d, body %s", http.StatusUnsupportedMediaType, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
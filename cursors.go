@@ -0,0 +1,121 @@
+package git_sync
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// CursorStore remembers the last head served to each client by incremental pulls, per repository and branch.
+// The cursors are persisted as a JSON file, rewritten on each update. A nil *CursorStore remembers nothing
+type CursorStore struct {
+	path string
+
+	mu      sync.Mutex
+	cursors map[cursorKey]string
+}
+
+type cursorKey struct {
+	Repository string `json:"repository"`
+	Branch     string `json:"branch"`
+	Client     string `json:"client"`
+}
+
+// entry of the JSON file
+type cursorEntry struct {
+	cursorKey
+	Head string `json:"head"`
+}
+
+// NewCursorStore loads the cursors from the file at path, if it exists
+func NewCursorStore(path string) (*CursorStore, error) {
+	s := &CursorStore{path: path, cursors: make(map[cursorKey]string)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read cursors %s", path)
+	}
+
+	var entries []cursorEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse cursors %s", path)
+	}
+	for _, e := range entries {
+		s.cursors[e.cursorKey] = e.Head
+	}
+	return s, nil
+}
+
+// Get returns the last head served to the client. Empty if none
+func (s *CursorStore) Get(repo RemoteRepo, client string) string {
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cursors[cursorKey{Repository: repo.URL, Branch: repo.Branch, Client: client}]
+}
+
+// Set records the head served to the client, and persists the cursors
+func (s *CursorStore) Set(repo RemoteRepo, client, head string) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cursors[cursorKey{Repository: repo.URL, Branch: repo.Branch, Client: client}] = head
+	return s.save()
+}
+
+// identifies the client of an incremental pull by a hash of the token of the request (which is never stored),
+// and the 'client-id' query parameter if given, so clients sharing a token have separate cursors. Empty
+// without a token, so the cursor of another client cannot be read or advanced by knowing its client-id
+func (opts HandlerOptions) clientID(r *http.Request) string {
+	auth := opts.Auth
+	if auth == nil {
+		auth = BearerAuth{}
+	}
+	token, err := auth.ExtractToken(r)
+	if err != nil || token == "" {
+		return ""
+	}
+	if id := r.URL.Query().Get("client-id"); id != "" {
+		return "id:" + tokenFingerprint(token) + ":" + id
+	}
+	return "token:" + tokenFingerprint(token)
+}
+
+// write the cursors to a temp file and rename it, so a crash does not leave a partial file
+func (s *CursorStore) save() error {
+	entries := make([]cursorEntry, 0, len(s.cursors))
+	for k, head := range s.cursors {
+		entries = append(entries, cursorEntry{cursorKey: k, Head: head})
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal cursors")
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temp file for cursors")
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return errors.Wrap(err, "failed to write cursors")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "failed to write cursors")
+	}
+	if err := os.Rename(f.Name(), s.path); err != nil {
+		return errors.Wrapf(err, "failed to replace cursors %s", s.path)
+	}
+	return nil
+}
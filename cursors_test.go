@@ -0,0 +1,212 @@
+package git_sync
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestCursorStorePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cursors.json")
+	repo := RemoteRepo{URL: "https://host/owner/repo.git", Branch: "main"}
+
+	s, err := NewCursorStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := s.Get(repo, "a"); actual != "" {
+		t.Errorf("expected no cursor, got %s", actual)
+	}
+	if err := s.Set(repo, "a", "c1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set(repo, "b", "c2"); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = NewCursorStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := s.Get(repo, "a"); actual != "c1" {
+		t.Errorf("expected cursor c1 of client a, got %s", actual)
+	}
+	if actual := s.Get(repo, "b"); actual != "c2" {
+		t.Errorf("expected cursor c2 of client b, got %s", actual)
+	}
+	if actual := s.Get(RemoteRepo{URL: repo.URL, Branch: "dev"}, "a"); actual != "" {
+		t.Errorf("expected no cursor for another branch, got %s", actual)
+	}
+}
+
+func TestPullIncremental(t *testing.T) {
+	branch := "main"
+	g := newLocalGIT(t, branch)
+	worktree, err := g.initLocal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2025, 2, 13, 0, 0, 0, 0, time.UTC)
+	first := commitAt(t, g, worktree, base)
+	repoURL, bare := servePublicRepo(t, g)
+
+	cursorsPath := filepath.Join(t.TempDir(), "cursors.json")
+	cursors, err := NewCursorStore(cursorsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the remote is public, so the server authenticates anonymously and the token only identifies the client
+	handler := NewGitPullHandler(t.TempDir(), HandlerOptions{AuthMode: AuthModeServer, Cursors: cursors})
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	pull := func(token, client string) (*http.Response, []byte) {
+		t.Helper()
+		q := url.Values{"repository": {repoURL}, "branch": {branch}, "incremental": {"true"}, "client-id": {client}}
+		req, err := http.NewRequest(http.MethodGet, server.URL+"?"+q.Encode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, body
+	}
+
+	// no prior state, full bundle
+	resp, body := pull("t1", "a")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, resp.StatusCode, body)
+	}
+	if actual := resp.Header.Get("X-Git-IsPartial"); actual != "false" {
+		t.Errorf("expected full bundle, got X-Git-IsPartial %s", actual)
+	}
+
+	resp, body = pull("t1", "a")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status %d without new commits, got %d: %s", http.StatusNoContent, resp.StatusCode, body)
+	}
+
+	second := commitAt(t, g, worktree, base.Add(time.Hour))
+	if out, err := exec.Command("git", "-C", g.workDir, "push", bare, branch).CombinedOutput(); err != nil {
+		t.Fatalf("failed to push: %v: %s", err, out)
+	}
+
+	resp, body = pull("t1", "a")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, resp.StatusCode, body)
+	}
+	info, err := ParseBundleHeader(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(info.Prerequisites, []string{first.String()}) {
+		t.Errorf("expected bundle from %s, got prerequisites %v", first, info.Prerequisites)
+	}
+	if info.Heads[0].CommitID != second.String() {
+		t.Errorf("expected head %s, got %s", second, info.Heads[0].CommitID)
+	}
+
+	// another client starts over, also with the client-id of another token
+	for name, p := range map[string][2]string{"client": {"t1", "b"}, "token": {"t2", "a"}} {
+		resp, body = pull(p[0], p[1])
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status %d for another %s, got %d: %s", http.StatusOK, name, resp.StatusCode, body)
+		}
+		if actual := resp.Header.Get("X-Git-IsPartial"); actual != "false" {
+			t.Errorf("expected full bundle for another %s, got X-Git-IsPartial %s", name, actual)
+		}
+	}
+
+	// the bundle may not have reached the client, when it could not be flushed
+	q := url.Values{"repository": {repoURL}, "branch": {branch}, "incremental": {"true"}, "client-id": {"c"}}
+	req := httptest.NewRequest(http.MethodGet, "/?"+q.Encode(), nil)
+	req.Header.Set("Authorization", "Bearer t1")
+	w := failingFlushWriter{httptest.NewRecorder()}
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	if actual := cursors.Get(RemoteRepo{URL: repoURL, Branch: branch}, "id:"+tokenFingerprint("t1")+":c"); actual != "" {
+		t.Errorf("expected no cursor when the bundle was not flushed, got %s", actual)
+	}
+
+	reloaded, err := NewCursorStore(cursorsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := reloaded.Get(RemoteRepo{URL: repoURL, Branch: branch}, "id:"+tokenFingerprint("t1")+":a"); actual != second.String() {
+		t.Errorf("expected persisted cursor %s, got %s", second, actual)
+	}
+}
+
+func TestPullIncrementalRejected(t *testing.T) {
+	cursors, err := NewCursorStore(filepath.Join(t.TempDir(), "cursors.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcs := map[string]struct {
+		opts  HandlerOptions
+		token string
+		query url.Values
+	}{
+		"not enabled":        {HandlerOptions{}, "t", url.Values{"client-id": {"a"}}},
+		"with since":         {HandlerOptions{Cursors: cursors}, "t", url.Values{"client-id": {"a"}, "since": {"1h"}}},
+		"no client":          {HandlerOptions{Cursors: cursors}, "", url.Values{}},
+		"client-id no token": {HandlerOptions{Cursors: cursors}, "", url.Values{"client-id": {"a"}}},
+		"invalid id":         {HandlerOptions{Cursors: cursors}, "t", url.Values{"client-id": {"a b"}}},
+		"all branches":       {HandlerOptions{Cursors: cursors}, "t", url.Values{"client-id": {"a"}, "branch": {AllBranches}}},
+	}
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(NewGitPullHandler(t.TempDir(), tc.opts))
+			t.Cleanup(server.Close)
+
+			q := tc.query
+			q.Set("repository", "https://localhost/not_used.git")
+			q.Set("incremental", "true")
+			if q.Get("branch") == "" {
+				q.Set("branch", "main")
+			}
+			req, err := http.NewRequest(http.MethodGet, server.URL+"?"+q.Encode(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			resp, err := server.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+			}
+		})
+	}
+}
+
+// failingFlushWriter fails to flush, like a client that disconnected
+type failingFlushWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w failingFlushWriter) FlushError() error {
+	return errors.New("connection reset")
+}
@@ -0,0 +1,167 @@
+package git_sync
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metricWorkDirBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "git_sync_workdir_bytes",
+		Help: "Size in bytes of the local clone of the repository and branch"}, []string{"repository_url", "branch"})
+	metricTempDirBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "git_sync_tempdir_bytes",
+		Help: "Size in bytes of the temp dir, with all local clones and temporary files"})
+)
+
+// the repositories and branches of the local clones by work dir, for the disk usage metrics
+var workDirRepos = &workDirRegistry{repos: make(map[string]RemoteRepo)}
+
+type workDirRegistry struct {
+	mu    sync.Mutex
+	repos map[string]RemoteRepo
+}
+
+// register the repository of the work dir. The token is not kept
+func (r *workDirRegistry) register(workDir string, repo RemoteRepo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.repos[workDir] = RemoteRepo{URL: repo.URL, Branch: repo.Branch}
+}
+
+func (r *workDirRegistry) snapshot() map[string]RemoteRepo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	repos := make(map[string]RemoteRepo, len(r.repos))
+	for dir, repo := range r.repos {
+		repos[dir] = repo
+	}
+	return repos
+}
+
+func (r *workDirRegistry) unregister(workDir string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.repos, workDir)
+}
+
+// DiskUsage measures the size of the local clones and the temp dir in the background,
+// exposed as git_sync_workdir_bytes and git_sync_tempdir_bytes
+type DiskUsage struct {
+	tempDir  string
+	interval time.Duration
+	opts     HandlerOptions
+
+	// labels of git_sync_workdir_bytes set by the last measure
+	reported map[workDirLabels]bool
+}
+
+type workDirLabels struct {
+	repo, branch string
+}
+
+// NewDiskUsage measures the disk usage of the temp dir every interval. The labels of the local clones are
+// bounded as the operation metrics, by the MetricRepoLabel of opts
+func NewDiskUsage(tempDir string, interval time.Duration, opts HandlerOptions) *DiskUsage {
+	return &DiskUsage{tempDir: tempDir, interval: interval, opts: opts, reported: make(map[workDirLabels]bool)}
+}
+
+// Run measures the disk usage, starting immediately, until ctx is done
+func (d *DiskUsage) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	d.measure(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.measure(ctx)
+		}
+	}
+}
+
+// measure the temp dir and each local clone synced since startup. Clones with the same labels (e.g. "other")
+// are summed. Removed clones are no longer reported, until synced again
+func (d *DiskUsage) measure(ctx context.Context) {
+	log := LoggerFromContext(ctx).With("op", "DiskUsage.measure")
+
+	size, err := dirSize(d.tempDir)
+	if err != nil {
+		log.Warn("failed to measure temp dir", "err", err, "dir", d.tempDir)
+	} else {
+		metricTempDirBytes.Set(float64(size))
+	}
+
+	sizes := make(map[workDirLabels]int64)
+	failed := make(map[workDirLabels]bool)
+	for workDir, repo := range workDirRepos.snapshot() {
+		if ctx.Err() != nil {
+			return
+		}
+		labels := workDirLabels{repo: d.opts.metricRepo(repo.URL), branch: d.opts.metricBranch(repo.URL, repo.Branch)}
+		size, err := dirSize(workDir)
+		if os.IsNotExist(err) {
+			workDirRepos.unregister(workDir)
+			continue
+		}
+		if err != nil {
+			log.Warn("failed to measure local clone", "err", err, "repo.url", repo.URL, "repo.branch", repo.Branch)
+			failed[labels] = true
+			continue
+		}
+		sizes[labels] += size
+	}
+
+	// the labels of a clone that failed to be measured keep their last size, since the sum would be partial
+	for labels := range d.reported {
+		if _, ok := sizes[labels]; !ok && !failed[labels] {
+			metricWorkDirBytes.DeleteLabelValues(labels.repo, labels.branch)
+			delete(d.reported, labels)
+		}
+	}
+	for labels, size := range sizes {
+		if failed[labels] {
+			continue
+		}
+		metricWorkDirBytes.WithLabelValues(labels.repo, labels.branch).Set(float64(size))
+		d.reported[labels] = true
+	}
+}
+
+// sum of the sizes of the regular files in dir. Files removed while walking (e.g. temporary files) are skipped
+func dirSize(dir string) (int64, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return 0, err
+	}
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,88 @@
+package git_sync
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bredtape/git_sync/testdata"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDiskUsageMeasure(t *testing.T) {
+	repo := setupLocalBareRemote(t)
+	ctx := context.Background()
+	s := Syncer{TempDir: t.TempDir()}
+	if _, err := s.Push(ctx, repo, bytes.NewReader(testdata.FullBundle)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(s.TempDir, "cursors.json"), []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDiskUsage(s.TempDir, 0, HandlerOptions{})
+	d.measure(ctx)
+	workDirBytes := testutil.ToFloat64(metricWorkDirBytes.WithLabelValues(repo.URL, repo.Branch))
+	if workDirBytes == 0 {
+		t.Fatal("expected the size of the local clone")
+	}
+	if actual := testutil.ToFloat64(metricTempDirBytes); actual != workDirBytes+2 {
+		t.Errorf("expected the temp dir to be the local clone and cursors, %v bytes, got %v", workDirBytes+2, actual)
+	}
+
+	// removed clones are no longer reported
+	if err := os.RemoveAll(s.workDir(repo)); err != nil {
+		t.Fatal(err)
+	}
+	d.measure(ctx)
+	if _, ok := workDirRepos.snapshot()[s.workDir(repo)]; ok {
+		t.Error("expected the removed clone to be unregistered")
+	}
+	if actual := testutil.ToFloat64(metricTempDirBytes); actual != 2 {
+		t.Errorf("expected only the cursors in the temp dir, got %v bytes", actual)
+	}
+}
+
+func TestDiskUsageMeasureOther(t *testing.T) {
+	ctx := context.Background()
+	s := Syncer{TempDir: t.TempDir()}
+	repos := []RemoteRepo{setupLocalBareRemote(t), setupLocalBareRemote(t)}
+	for _, repo := range repos {
+		if _, err := s.Push(ctx, repo, bytes.NewReader(testdata.FullBundle)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		for _, repo := range repos {
+			workDirRepos.unregister(s.workDir(repo))
+		}
+	})
+
+	// none of the repositories are allowed, so both are labelled other
+	d := NewDiskUsage(s.TempDir, 0, HandlerOptions{AllowedRepos: RepoAllowlist{"https://host/"}})
+	d.measure(ctx)
+	var expected int64
+	for _, repo := range repos {
+		size, err := dirSize(s.workDir(repo))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected += size
+	}
+	if actual := testutil.ToFloat64(metricWorkDirBytes.WithLabelValues("other", "other")); actual != float64(expected) {
+		t.Errorf("expected the clones to be summed as other, %d bytes, got %v", expected, actual)
+	}
+
+	// removed clones are no longer reported
+	for _, repo := range repos {
+		if err := os.RemoveAll(s.workDir(repo)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.measure(ctx)
+	if _, ok := d.reported[workDirLabels{repo: "other", branch: "other"}]; ok {
+		t.Error("expected the labels of the removed clones to be deleted")
+	}
+}
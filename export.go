@@ -0,0 +1,124 @@
+package git_sync
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// sidecarSuffix is appended to the bundle path, e.g. repo.bundle -> repo.bundle.json
+const sidecarSuffix = ".json"
+
+var ErrSidecarMismatch = errors.New("bundle does not match its sidecar metadata")
+
+// BundleMetadata describes an exported bundle. It is written next to the bundle as a sidecar file,
+// so an importer (e.g. on the other side of an air gap) can validate and route the bundle
+type BundleMetadata struct {
+	// Head is the commit ID of the head of the bundle
+	Head string `json:"head"`
+
+	// Hash is the hex encoded SHA-256 of the bundle file
+	Hash string `json:"hash"`
+
+	// IsPartial is true if the bundle requires prerequisite commits
+	IsPartial bool `json:"isPartial"`
+
+	Refs      []Head    `json:"refs"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ExportBundle writes the pulled bundle to path, and its metadata to the sidecar file <path>.json
+func ExportBundle(path string, result PullResult) (BundleMetadata, error) {
+	if len(result.Info.Heads) == 0 {
+		return BundleMetadata{}, errors.New("bundle has no heads")
+	}
+
+	hash := sha256.Sum256(result.Bundle)
+	meta := BundleMetadata{
+		Head:      result.Info.Heads[0].CommitID,
+		Hash:      hex.EncodeToString(hash[:]),
+		IsPartial: !result.Info.IsComplete,
+		Refs:      result.Info.Heads,
+		CreatedAt: time.Now().UTC()}
+
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return BundleMetadata{}, errors.Wrap(err, "failed to marshal bundle metadata")
+	}
+
+	if err := os.WriteFile(path, result.Bundle, 0644); err != nil {
+		return BundleMetadata{}, errors.Wrapf(err, "failed to write bundle %s", path)
+	}
+	if err := os.WriteFile(path+sidecarSuffix, data, 0644); err != nil {
+		return BundleMetadata{}, errors.Wrapf(err, "failed to write bundle metadata %s", path+sidecarSuffix)
+	}
+	return meta, nil
+}
+
+// ReadBundle reads the bundle at path. If the sidecar file <path>.json exists, the bundle is validated against it
+// (ErrSidecarMismatch if the hash or head differs). Otherwise the metadata is derived from the bundle header,
+// with zero CreatedAt
+func ReadBundle(path string) (BundleMetadata, []byte, error) {
+	bundleData, err := os.ReadFile(path)
+	if err != nil {
+		return BundleMetadata{}, nil, errors.Wrapf(err, "failed to read bundle %s", path)
+	}
+
+	info, err := ParseBundleHeader(bundleData)
+	if err != nil {
+		return BundleMetadata{}, nil, errors.Wrapf(err, "failed to parse bundle %s", path)
+	}
+	if len(info.Heads) == 0 {
+		return BundleMetadata{}, nil, fmt.Errorf("bundle %s has no heads", path)
+	}
+	hash := sha256.Sum256(bundleData)
+
+	data, err := os.ReadFile(path + sidecarSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return BundleMetadata{
+			Head:      info.Heads[0].CommitID,
+			Hash:      hex.EncodeToString(hash[:]),
+			IsPartial: !info.IsComplete,
+			Refs:      info.Heads}, bundleData, nil
+	}
+	if err != nil {
+		return BundleMetadata{}, nil, errors.Wrapf(err, "failed to read bundle metadata %s", path+sidecarSuffix)
+	}
+
+	var meta BundleMetadata
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return BundleMetadata{}, nil, errors.Wrapf(err, "failed to parse bundle metadata %s", path+sidecarSuffix)
+	}
+	if meta.Hash != hex.EncodeToString(hash[:]) {
+		return BundleMetadata{}, nil, errors.Wrapf(ErrSidecarMismatch, "hash of %s", path)
+	}
+	if meta.Head != info.Heads[0].CommitID {
+		return BundleMetadata{}, nil, errors.Wrapf(ErrSidecarMismatch, "head of %s, expected %s, got %s", path, meta.Head, info.Heads[0].CommitID)
+	}
+	return meta, bundleData, nil
+}
+
+// ImportBundle reads the bundle at path (see ReadBundle), and pushes it to the remote repository.
+// If repo.Branch is empty, the branch is taken from the ref of the bundle
+func ImportBundle(ctx context.Context, s Syncer, repo RemoteRepo, path string) (PushResult, error) {
+	meta, bundleData, err := ReadBundle(path)
+	if err != nil {
+		return PushResult{}, err
+	}
+
+	if repo.Branch == "" {
+		if len(meta.Refs) != 1 || !strings.HasPrefix(meta.Refs[0].Ref, "refs/heads/") {
+			return PushResult{}, fmt.Errorf("cannot derive branch from refs %v of bundle %s", meta.Refs, path)
+		}
+		repo.Branch = strings.TrimPrefix(meta.Refs[0].Ref, "refs/heads/")
+	}
+	return s.Push(ctx, repo, bytes.NewReader(bundleData))
+}
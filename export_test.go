@@ -0,0 +1,104 @@
+package git_sync
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bredtape/git_sync/testdata"
+	"github.com/pkg/errors"
+)
+
+func exportTestBundle(t *testing.T, bundleData []byte) (string, BundleMetadata) {
+	t.Helper()
+
+	info, err := ParseBundleHeader(bundleData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "repo.bundle")
+	meta, err := ExportBundle(path, PullResult{Info: info, Bundle: bundleData})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, meta
+}
+
+func TestExportBundleWritesSidecar(t *testing.T) {
+	path, meta := exportTestBundle(t, testdata.LastBundle)
+
+	data, err := os.ReadFile(path + ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sidecar map[string]any
+	if err := json.Unmarshal(data, &sidecar); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"head", "hash", "isPartial", "refs", "createdAt"} {
+		if _, ok := sidecar[key]; !ok {
+			t.Errorf("expected '%s' in sidecar %s", key, string(data))
+		}
+	}
+	if meta.Head != "f8be008f3733c1a9b7962c1f5a50679266565e31" || !meta.IsPartial || meta.CreatedAt.IsZero() {
+		t.Errorf("unexpected metadata %+v", meta)
+	}
+
+	actual, bundleData, err := ReadBundle(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bundleData) != string(testdata.LastBundle) {
+		t.Error("bundle differs")
+	}
+	if actual.Hash != meta.Hash || actual.Head != meta.Head || !actual.CreatedAt.Equal(meta.CreatedAt) {
+		t.Errorf("expected metadata %+v, got %+v", meta, actual)
+	}
+}
+
+func TestReadBundleSidecarMismatch(t *testing.T) {
+	path, _ := exportTestBundle(t, testdata.LastBundle)
+
+	// replace the bundle, but keep the sidecar
+	err := os.WriteFile(path, testdata.FullBundle, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = ReadBundle(path)
+	if !errors.Is(err, ErrSidecarMismatch) {
+		t.Fatalf("expected ErrSidecarMismatch, got %v", err)
+	}
+
+	// without sidecar, the metadata is derived from the bundle
+	err = os.Remove(path + ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, _, err := ReadBundle(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.IsPartial || len(meta.Refs) != 1 || meta.Refs[0].Ref != "refs/heads/main" {
+		t.Errorf("unexpected metadata %+v", meta)
+	}
+}
+
+func TestImportBundleUsesSidecarRef(t *testing.T) {
+	slog.SetLogLoggerLevel(slog.LevelDebug)
+
+	repo := setupLocalBareRemote(t)
+	path, meta := exportTestBundle(t, testdata.FullBundle)
+
+	// the branch is routed from the sidecar
+	repo.Branch = ""
+	result, err := ImportBundle(context.Background(), Syncer{TempDir: t.TempDir()}, repo, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.NewHead.String() != meta.Head {
+		t.Errorf("expected head %s, got %s", meta.Head, result.NewHead)
+	}
+}
@@ -0,0 +1,84 @@
+package git_sync
+
+import (
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultBundleFilenameTemplate is the filename of pulled bundles, unless configured
+const DefaultBundleFilenameTemplate = "git_{{.Commit}}_{{.Hash}}.bundle"
+
+// filename friendly timestamp, in UTC
+const filenameTimeFormat = "20060102T150405Z"
+
+var defaultBundleFilename = template.Must(ParseBundleFilenameTemplate(DefaultBundleFilenameTemplate))
+
+// BundleFilename is the data of the filename template of pulled bundles
+type BundleFilename struct {
+	// Repo is the name of the repository, e.g. "repo" for https://host/owner/repo.git
+	Repo   string
+	Branch string
+	// Commit is the head of the bundle
+	Commit string
+	// Hash identifies the head and the bundle options
+	Hash string
+	// Timestamp is the time of the pull, e.g. 20250213T080000Z
+	Timestamp string
+}
+
+// ParseBundleFilenameTemplate parses a text/template for the filename of pulled bundles, with the fields of
+// BundleFilename. The template is executed with example values, so unknown fields are rejected up front
+func ParseBundleFilenameTemplate(text string) (*template.Template, error) {
+	t, err := template.New("bundle-filename").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	example := BundleFilename{
+		Repo:      "repo",
+		Branch:    "main",
+		Commit:    strings.Repeat("0", 40),
+		Hash:      strings.Repeat("0", 64),
+		Timestamp: time.Date(2025, 2, 13, 8, 0, 0, 0, time.UTC).Format(filenameTimeFormat)}
+	if _, err := example.render(t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// execute the template. Characters other than letters, digits, '.', '-' and '_' are replaced with '_'
+func (f BundleFilename) render(t *template.Template) (string, error) {
+	var sb strings.Builder
+	if err := t.Execute(&sb, f); err != nil {
+		return "", err
+	}
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, strings.TrimSpace(sb.String()))
+	if name == "" {
+		return "", errors.New("bundle filename is empty")
+	}
+	return name, nil
+}
+
+// filename of a pulled bundle of a single branch
+func (opts HandlerOptions) bundleFilename(repo RemoteRepo, head Head, hash string, now time.Time) (string, error) {
+	t := opts.BundleFilename
+	if t == nil {
+		t = defaultBundleFilename
+	}
+	f := BundleFilename{
+		Repo:      repoName(repo.URL),
+		Branch:    repo.Branch,
+		Commit:    head.CommitID,
+		Hash:      hash,
+		Timestamp: now.UTC().Format(filenameTimeFormat)}
+	return f.render(t)
+}
@@ -0,0 +1,72 @@
+package git_sync
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseBundleFilenameTemplateInvalid(t *testing.T) {
+	for _, text := range []string{"{{.Repo", "{{.Unknown}}.bundle", " ", "{{.Repo.Name}}"} {
+		if _, err := ParseBundleFilenameTemplate(text); err == nil {
+			t.Errorf("expected error for template '%s'", text)
+		}
+	}
+}
+
+func TestBundleFilename(t *testing.T) {
+	repo := RemoteRepo{URL: "https://host/owner/repo.git", Branch: "feature/x"}
+	head := Head{CommitID: "f8be008f3733c1a9b7962c1f5a50679266565e31", Ref: "refs/heads/feature/x"}
+	now := time.Date(2025, 2, 13, 10, 0, 0, 0, time.FixedZone("CET", 3600))
+
+	tcs := map[string]struct {
+		template string
+		expected string
+	}{
+		"default":   {DefaultBundleFilenameTemplate, "git_f8be008f3733c1a9b7962c1f5a50679266565e31_abc.bundle"},
+		"timestamp": {"{{.Repo}}-{{.Branch}}-{{.Timestamp}}.bundle", "repo-feature_x-20250213T090000Z.bundle"},
+		"unsafe":    {`{{.Repo}} "{{.Commit}}";.bundle`, "repo__f8be008f3733c1a9b7962c1f5a50679266565e31__.bundle"},
+	}
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			tmpl, err := ParseBundleFilenameTemplate(tc.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual, err := HandlerOptions{BundleFilename: tmpl}.bundleFilename(repo, head, "abc", now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual != tc.expected {
+				t.Errorf("expected '%s', got '%s'", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestPullBundleFilenameTemplate(t *testing.T) {
+	branch := "main"
+	repoURL, head := createPublicRepo(t, branch)
+
+	tmpl, err := ParseBundleFilenameTemplate("{{.Repo}}-{{.Branch}}-{{.Commit}}.bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(NewGitPullHandler(t.TempDir(), HandlerOptions{BundleFilename: tmpl}))
+	t.Cleanup(server.Close)
+
+	resp, err := http.Get(server.URL + "?" + url.Values{"repository": {repoURL}, "branch": {branch}}.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	expected := "attachment; filename=public-main-" + head.String() + ".bundle"
+	if actual := resp.Header.Get("Content-Disposition"); actual != expected {
+		t.Errorf("expected Content-Disposition '%s', got '%s'", expected, actual)
+	}
+}
@@ -0,0 +1,74 @@
+package git_sync
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// formats of pulled content
+const (
+	formatBundle   = "bundle"
+	formatPackfile = "packfile"
+
+	contentTypeGitPackfile = "application/x-git-packfile"
+)
+
+var errUnsupportedFormat = errors.New("unsupported format")
+
+// selectFormat picks the format of a pull, from the 'format' query parameter if set, otherwise from the
+// Accept header. Returns the format and the Content-Type of the response, or errUnsupportedFormat.
+// A bundle is the default, served as application/octet-stream unless application/x-git-bundle is requested
+func selectFormat(format, accept string) (string, string, error) {
+	switch format {
+	case "":
+	case formatBundle:
+		return formatBundle, contentTypeGitBundle, nil
+	case formatPackfile:
+		return formatPackfile, contentTypeGitPackfile, nil
+	default:
+		return "", "", errUnsupportedFormat
+	}
+
+	if strings.TrimSpace(accept) == "" {
+		return formatBundle, contentTypeOctetStream, nil
+	}
+
+	// the acceptable media type with the highest quality, the first on ties
+	var selected, contentType string
+	best := 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+		// an explicit q=0 means "not acceptable"
+		if q <= best {
+			continue
+		}
+
+		switch mediaType {
+		case contentTypeGitBundle:
+			selected, contentType = formatBundle, contentTypeGitBundle
+		case contentTypeGitPackfile:
+			selected, contentType = formatPackfile, contentTypeGitPackfile
+		case contentTypeOctetStream, "application/*", "*/*":
+			selected, contentType = formatBundle, contentTypeOctetStream
+		default:
+			continue
+		}
+		best = q
+	}
+	if selected == "" {
+		return "", "", errUnsupportedFormat
+	}
+	return selected, contentType, nil
+}
@@ -0,0 +1,163 @@
+package git_sync
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSelectFormat(t *testing.T) {
+	tcs := []struct {
+		name, format, accept string
+		expected             string
+		contentType          string
+	}{
+		{"default", "", "", formatBundle, contentTypeOctetStream},
+		{"any", "", "*/*", formatBundle, contentTypeOctetStream},
+		{"octet-stream", "", "application/octet-stream", formatBundle, contentTypeOctetStream},
+		{"bundle", "", "application/x-git-bundle", formatBundle, contentTypeGitBundle},
+		{"packfile", "", "application/x-git-packfile", formatPackfile, contentTypeGitPackfile},
+		{"packfile preferred", "", "application/x-git-bundle;q=0.5, application/x-git-packfile", formatPackfile, contentTypeGitPackfile},
+		{"browser", "", "text/html,application/xhtml+xml,*/*;q=0.8", formatBundle, contentTypeOctetStream},
+		{"query packfile", "packfile", "application/x-git-bundle", formatPackfile, contentTypeGitPackfile},
+		{"query bundle", "bundle", "", formatBundle, contentTypeGitBundle},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			format, contentType, err := selectFormat(tc.format, tc.accept)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if format != tc.expected || contentType != tc.contentType {
+				t.Errorf("expected %s (%s), got %s (%s)", tc.expected, tc.contentType, format, contentType)
+			}
+		})
+	}
+
+	for name, args := range map[string][2]string{
+		"unknown query":  {"zip", ""},
+		"unknown accept": {"", "text/html"},
+		"not acceptable": {"", "application/x-git-packfile;q=0"}} {
+		t.Run(name, func(t *testing.T) {
+			if _, _, err := selectFormat(args[0], args[1]); err != errUnsupportedFormat {
+				t.Errorf("expected errUnsupportedFormat, got %v", err)
+			}
+		})
+	}
+}
+
+// a partial pack is not thin, so it can be indexed without the prerequisites
+func TestCreatePackPartial(t *testing.T) {
+	g := newLocalGIT(t, "main")
+	worktree, err := g.initLocal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2025, 2, 13, 0, 0, 0, 0, time.UTC)
+	commitAt(t, g, worktree, base)
+	commitAt(t, g, worktree, base.Add(time.Hour))
+
+	bundle, err := g.CreateBundleFromLocal(BundleOptions{MaxCommits: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := ParseBundleHeader(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pack, err := g.CreatePack(context.Background(), info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertIndexablePack(t, pack)
+}
+
+func TestPullPackfile(t *testing.T) {
+	branch := "main"
+	repoURL, head := createPublicRepo(t, branch)
+	client, serverURL := createTestServerWithPullHandler(t)
+
+	for name, setFormat := range map[string]func(*http.Request){
+		"query":  func(r *http.Request) { r.URL.RawQuery += "&format=packfile" },
+		"accept": func(r *http.Request) { r.Header.Set("Accept", contentTypeGitPackfile) }} {
+		t.Run(name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, serverURL+"?"+url.Values{"repository": {repoURL}, "branch": {branch}}.Encode(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			setFormat(req)
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status %d, got %d: %s", http.StatusOK, resp.StatusCode, body)
+			}
+			if actual := resp.Header.Get("Content-Type"); actual != contentTypeGitPackfile {
+				t.Errorf("expected Content-Type %s, got %s", contentTypeGitPackfile, actual)
+			}
+			if actual := resp.Header.Get("X-Git-Head"); actual != head.String() {
+				t.Errorf("expected head %s, got %s", head, actual)
+			}
+			if actual := resp.Header.Get("Content-Disposition"); !strings.HasSuffix(actual, ".pack") {
+				t.Errorf("expected filename with .pack, got %s", actual)
+			}
+			assertIndexablePack(t, body)
+		})
+	}
+}
+
+func TestPullUnsupportedFormat(t *testing.T) {
+	client, serverURL := createTestServerWithPullHandler(t)
+
+	for name, setFormat := range map[string]func(*http.Request){
+		"query":  func(r *http.Request) { r.URL.RawQuery += "&format=zip" },
+		"accept": func(r *http.Request) { r.Header.Set("Accept", "text/html") }} {
+		t.Run(name, func(t *testing.T) {
+			// rejected before the remote is contacted
+			req, err := http.NewRequest(http.MethodGet, serverURL+"?"+url.Values{"repository": {"https://localhost/not_used.git"}, "branch": {"main"}}.Encode(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			setFormat(req)
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusNotAcceptable {
+				t.Errorf("expected status %d, got %d", http.StatusNotAcceptable, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func assertIndexablePack(t *testing.T, pack []byte) {
+	t.Helper()
+	if !bytes.HasPrefix(pack, []byte("PACK")) {
+		t.Fatalf("expected a packfile, got %q", pack[:min(len(pack), 16)])
+	}
+
+	dir := t.TempDir()
+	if out, err := exec.Command("git", "init", "--bare", "--quiet", dir).CombinedOutput(); err != nil {
+		t.Fatalf("failed to init repository: %v: %s", err, out)
+	}
+	cmd := exec.Command("git", "-C", dir, "index-pack", "--stdin")
+	cmd.Stdin = bytes.NewReader(pack)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("failed to index pack: %v: %s", err, out)
+	}
+}
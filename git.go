@@ -3,21 +3,28 @@ package git_sync
 import (
 	"bufio"
 	"bytes"
-	"encoding/base64"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/storage/memory"
 	"github.com/pkg/errors"
 )
 
@@ -27,15 +34,76 @@ const (
 )
 
 var (
-	ErrAuthFailed = errors.New("authentication failed")
+	ErrAuthFailed     = errors.New("authentication failed")
+	ErrNotFastForward = errors.New("bundle does not fast-forward the branch")
+
+	// ErrRewritten is returned when the remote branch no longer contains the local head,
+	// i.e. the history was rewritten by a force-push
+	ErrRewritten = errors.New("remote branch history was rewritten")
+
+	// ErrBranchNotCommit is returned when the branch points to another type of object, e.g. a tag or tree
+	ErrBranchNotCommit = errors.New("branch does not point to a commit")
+
+	// ErrLeaseMismatch is returned by a force push, when the remote branch is not at the expected head
+	ErrLeaseMismatch = errors.New("remote branch is not at the expected head")
+
+	// ErrPushRejected is returned when the remote rejects the update of a branch, e.g. by a hook.
+	// Pushes of all branches are atomic, so then no branch was updated
+	ErrPushRejected = errors.New("push rejected by the remote repository")
+
+	// ErrAtomicPushUnsupported is returned when pushing all branches to a remote that does not support atomic pushes
+	ErrAtomicPushUnsupported = errors.New("remote repository does not support atomic pushes")
 )
 
 type GIT struct {
 	workDir, tempDir string
 	remoteRepo       RemoteRepo
+
+	// identity for commits created by git, e.g. merges
+	identity Identity
+
+	// ref of pushed bundles applied to the branch. Empty for the branch itself
+	bundleRefOverride string
+
+	// repack created bundles, so the same content yields the same bytes
+	deterministicBundles bool
+
+	// proxy for the remote repository. Zero to use the environment
+	proxy Proxy
+
+	// clone and pull all branches of the remote, not only the branch
+	cloneAllBranches bool
+
+	// maximum duration of git commands, see SetCommandTimeout
+	commandTimeout time.Duration
+
+	// re-clone the local clone when older. Zero for no limit, see SetMaxCloneAge
+	maxCloneAge time.Duration
+
+	// how bundles and packfiles are created, see SetBundleBackend
+	bundleBackend BundleBackend
+
+	// how bundles are applied to the branch, and the message of merge commits. See SetMergeMode
+	mergeMode    MergeMode
+	mergeMessage string
+}
+
+// Identity is the author/committer of commits created by git operations.
+// Hosts without a global git config otherwise fail with "empty ident"
+type Identity struct {
+	Name, Email string
+}
+
+// DefaultIdentity is used when no identity is configured
+var DefaultIdentity = Identity{Name: "git-sync", Email: "git-sync@localhost"}
+
+// Signature for go-git commit options
+func (id Identity) Signature(when time.Time) *object.Signature {
+	return &object.Signature{Name: id.Name, Email: id.Email, When: when}
 }
 
 func NewGIT(tempDir string, remoteRepo RemoteRepo) (*GIT, error) {
+	tempDir = repoTempDir(tempDir, remoteRepo)
 	if tempDir == "" {
 		return nil, errors.New("tempDir not set")
 	}
@@ -45,14 +113,77 @@ func NewGIT(tempDir string, remoteRepo RemoteRepo) (*GIT, error) {
 	if remoteRepo.Branch == "" {
 		return nil, errors.New("branch not set")
 	}
-	if remoteRepo.Token == "" {
-		return nil, errors.New("remoteRepo.Token not set")
-	}
 
 	return &GIT{
-		workDir:    getWorkDir(tempDir, remoteRepo.URL, remoteRepo.Branch),
-		tempDir:    tempDir,
-		remoteRepo: remoteRepo}, nil
+		workDir:        getWorkDir(tempDir, remoteRepo.URL, remoteRepo.Branch),
+		tempDir:        tempDir,
+		remoteRepo:     remoteRepo,
+		identity:       DefaultIdentity,
+		commandTimeout: DefaultCommandTimeout}, nil
+}
+
+// SetIdentity sets the identity for commits created by git. Ignored if empty
+func (g *GIT) SetIdentity(id Identity) {
+	if id.Name != "" && id.Email != "" {
+		g.identity = id
+	}
+}
+
+// SetDeterministicBundles sets whether created bundles are repacked, so the same content yields the same bytes
+// (for the same git version). This recompresses all objects of the bundle, at a significant CPU cost
+func (g *GIT) SetDeterministicBundles(enabled bool) {
+	g.deterministicBundles = enabled
+}
+
+// SetProxy sets the proxy for git commands and go-git to access the remote repository
+func (g *GIT) SetProxy(p Proxy) {
+	g.proxy = p
+}
+
+// SetCloneAllBranches sets whether the local clone has all branches of the remote, so commits of other
+// branches are available, e.g. as 'from' of a bundle. Costs disk and time to fetch the other branches
+func (g *GIT) SetCloneAllBranches(enabled bool) {
+	g.cloneAllBranches = enabled
+}
+
+// DefaultCommandTimeout is the maximum duration of git commands, when no timeout is configured
+const DefaultCommandTimeout = 30 * time.Minute
+
+// SetCommandTimeout sets the maximum duration of git commands (e.g. bundle, apply and verify). A command
+// exceeding it is killed, and fails with a CommandError with Timeout set. Ignored if 0
+func (g *GIT) SetCommandTimeout(timeout time.Duration) {
+	if timeout > 0 {
+		g.commandTimeout = timeout
+	}
+}
+
+// SetMaxCloneAge sets the maximum age of the local clone. An older clone is removed and cloned again on the
+// next sync, e.g. to drop objects of rewritten history. Zero for no limit
+func (g *GIT) SetMaxCloneAge(age time.Duration) {
+	g.maxCloneAge = age
+}
+
+// SetBundleRef sets the ref of pushed bundles, that is applied to the branch, e.g. refs/heads/feature-x.
+// Empty for the branch itself
+func (g *GIT) SetBundleRef(ref string) {
+	g.bundleRefOverride = ref
+}
+
+// the ref to fetch from pushed bundles
+func (g *GIT) bundleRef() string {
+	if g.bundleRefOverride != "" {
+		return g.bundleRefOverride
+	}
+	return g.remoteRepo.Branch
+}
+
+// git command with the identity configured
+func (g *GIT) command(args ...string) *exec.Cmd {
+	cmd := exec.Command("git", append([]string{"-c", "user.name=" + g.identity.Name, "-c", "user.email=" + g.identity.Email}, args...)...)
+	if env := g.proxy.env(); env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	return cmd
 }
 
 func (g GIT) ExistsLocal() (bool, error) {
@@ -66,27 +197,87 @@ func (g GIT) ExistsLocal() (bool, error) {
 	return true, nil
 }
 
+// SyncMode is how the local clone was synced with the remote
+type SyncMode string
+
+const (
+	// SyncModeClone is a full clone, e.g. on a cold cache or after the remote history was rewritten
+	SyncModeClone SyncMode = "clone"
+	// SyncModePull is an incremental pull into an existing clone
+	SyncModePull SyncMode = "pull"
+	// SyncModeRemote is when the head was read from the remote, without syncing the local clone. See GIT.RemoteHead
+	SyncModeRemote SyncMode = "remote"
+)
+
 // clones repo from remoteURL if not exists, otherwise pulls the latest changes
 // Returns nil worktree if remote does not exist
-func (g *GIT) SyncRepoToLocalTemp() (*git.Worktree, error) {
+func (g *GIT) SyncRepoToLocalTemp() (*git.Worktree, SyncMode, error) {
 	exists, err := g.ExistsLocal()
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	if exists {
-		return g.pullRepoToLocalTemp()
+		expired, err := g.cloneExpired()
+		if err != nil {
+			return nil, "", err
+		}
+		if !expired {
+			w, err := g.pullRepoToLocalTemp()
+			return w, SyncModePull, err
+		}
+		slog.Info("local clone exceeds max age, cloning again", "op", "SyncRepoToLocalTemp",
+			"repository_url", g.remoteRepo.URL, "branch", g.remoteRepo.Branch, "maxCloneAge", g.maxCloneAge)
+		if err := g.RemoveLocal(); err != nil {
+			return nil, "", err
+		}
 	}
-	return g.cloneRepoToLocalTemp()
+	w, err := g.cloneRepoToLocalTemp()
+	return w, SyncModeClone, err
+}
+
+// file in the git dir of the local clone, with the time of the clone as modification time
+const clonedAtFile = "git_sync_cloned_at"
+
+// whether the local clone is older than maxCloneAge. A clone without the time of the clone, e.g. cloned by
+// an earlier version, is marked as cloned now
+func (g *GIT) cloneExpired() (bool, error) {
+	if g.maxCloneAge <= 0 {
+		return false, nil
+	}
+	info, err := os.Stat(filepath.Join(g.workDir, ".git", clonedAtFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, g.markCloned()
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "failed to read time of clone")
+	}
+	return time.Since(info.ModTime()) > g.maxCloneAge, nil
+}
+
+func (g *GIT) markCloned() error {
+	if err := os.WriteFile(filepath.Join(g.workDir, ".git", clonedAtFile), nil, 0600); err != nil {
+		return errors.Wrap(err, "failed to record time of clone")
+	}
+	return nil
 }
 
 func (g *GIT) cloneRepoToLocalTemp() (*git.Worktree, error) {
+	w, err := g.cloneRepo()
+	if err != nil || w == nil {
+		return w, err
+	}
+	return w, g.markCloned()
+}
+
+func (g *GIT) cloneRepo() (*git.Worktree, error) {
 	local, err := git.PlainClone(g.workDir, false, &git.CloneOptions{
 		RemoteName:    remoteName,
 		URL:           g.remoteRepo.URL,
 		ReferenceName: plumbing.NewBranchReferenceName(g.remoteRepo.Branch),
-		SingleBranch:  true,
-		Auth:          g.getAuth()})
+		SingleBranch:  !g.cloneAllBranches,
+		Auth:          g.getAuth(),
+		ProxyOptions:  g.proxyOptions()})
 	if err != nil {
 		if errors.Is(err, transport.ErrEmptyRemoteRepository) {
 			return g.initLocal()
@@ -97,6 +288,13 @@ func (g *GIT) cloneRepoToLocalTemp() (*git.Worktree, error) {
 		if errors.Is(err, transport.ErrAuthenticationRequired) {
 			return nil, ErrAuthFailed
 		}
+		// the remote has other branches, but not this one
+		if errors.As(err, &git.NoMatchingRefSpecError{}) || errors.Is(err, plumbing.ErrReferenceNotFound) {
+			if err := g.RemoveLocal(); err != nil {
+				return nil, err
+			}
+			return nil, errors.Wrapf(ErrBranchNotFound, "branch %s in repository %s", g.remoteRepo.Branch, g.remoteRepo.URL)
+		}
 		slog.Warn("error type", "type", fmt.Sprintf("%T", err))
 		return nil, errors.Wrapf(err, "failed to clone repository %s for branch %s", g.remoteRepo.URL, g.remoteRepo.Branch)
 	}
@@ -136,6 +334,11 @@ func (g *GIT) hasLocalCommits() (bool, error) {
 	commit, err := localRepo.CommitObject(ref.Hash())
 	if err != nil {
 		if errors.Is(err, plumbing.ErrObjectNotFound) {
+			// CommitObject also reports objects of other types as not found
+			obj, err := localRepo.Storer.EncodedObject(plumbing.AnyObject, ref.Hash())
+			if err == nil {
+				return false, errors.Wrapf(ErrBranchNotCommit, "branch '%s' points to %s %s", g.remoteRepo.Branch, obj.Type(), ref.Hash())
+			}
 			return false, nil
 		}
 		return false, err
@@ -168,47 +371,18 @@ func (g *GIT) initLocal() (*git.Worktree, error) {
 		return nil, errors.Wrapf(err, "failed to create branch '%s' for repository %s", g.remoteRepo.Branch, g.remoteRepo.URL)
 	}
 
-	// here I swapped HEAD and the branch name
-	symRef := plumbing.NewSymbolicReference(plumbing.ReferenceName("HEAD"), branchRefName)
+	// HEAD points to the branch, which is unborn until the first commit or fetch
+	symRef := plumbing.NewSymbolicReference(plumbing.HEAD, branchRefName)
 	err = repo.Storer.SetReference(symRef)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to set HEAD for repository %s", g.remoteRepo.URL)
 	}
 
-	// printing the references to make sure it's there
-	// it should look like this: "ref: refs/heads/test-orphan-branch HEAD"
-	refs, _ := repo.Storer.IterReferences()
-	refs.ForEach(func(ref *plumbing.Reference) error {
-		fmt.Println(ref)
-		return nil
-	})
-
-	// headRef, err := repo.Head()
-	// if err != nil {
-	// 	if errors.Is(err, plumbing.ErrReferenceNotFound) {
-	// 		headRef = plumbing.NewHashReference(branchRefName, plumbing.ZeroHash)
-	// 		// fall through
-	// 	} else {
-	// 		return nil, errors.Wrapf(err, "failed to get head for repository %s", g.remoteRepo.URL)
-	// 	}
-	// }
-	// log = log.With("head", headRef.Hash())
-
 	worktree, err := repo.Worktree()
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to get worktree for repository %s", g.remoteRepo.URL)
 	}
 
-	// log.Debug("git checkout branch")
-	// err = worktree.Checkout(&git.CheckoutOptions{
-	// 	Hash:   headRef.Hash(),
-	// 	Branch: branchRefName,
-	// 	Force:  true,
-	// 	Create: true})
-	// if err != nil {
-	// 	return nil, errors.Wrapf(err, "failed to checkout branch '%s' for repository %s", g.branch, g.remoteRepo.URL)
-	// }
-
 	return worktree, nil
 }
 
@@ -217,36 +391,85 @@ func (g *GIT) pullRepoToLocalTemp() (*git.Worktree, error) {
 	if err != nil {
 		return nil, err
 	}
+	if g.cloneAllBranches {
+		if err := g.fetchAllBranches(); err != nil {
+			return nil, err
+		}
+	}
 
 	err = w.Pull(&git.PullOptions{
 		RemoteName:    remoteName,
 		ReferenceName: plumbing.NewBranchReferenceName(g.remoteRepo.Branch),
-		SingleBranch:  true,
+		SingleBranch:  !g.cloneAllBranches,
 		RemoteURL:     g.remoteRepo.URL,
-		Auth:          g.getAuth()})
+		Auth:          g.getAuth(),
+		ProxyOptions:  g.proxyOptions()})
 
 	if err != nil {
 		if errors.Is(err, git.NoErrAlreadyUpToDate) {
 			return w, nil
 		}
+		// still empty, e.g. after a dry-run push to an empty remote
+		if errors.Is(err, transport.ErrEmptyRemoteRepository) {
+			return w, nil
+		}
 		if errors.Is(err, transport.ErrAuthorizationFailed) {
 			return nil, ErrAuthFailed
 		}
+		if errors.Is(err, git.ErrNonFastForwardUpdate) {
+			return nil, errors.Wrapf(ErrRewritten, "repository %s branch %s", g.remoteRepo.URL, g.remoteRepo.Branch)
+		}
 		return nil, errors.Wrapf(err, "failed to pull repository %s for branch %s", g.remoteRepo.URL, g.remoteRepo.Branch)
 	}
 	return w, nil
 }
 
+// configure the remote to fetch all branches on pulls, also for a local clone made with a single branch
+func (g *GIT) fetchAllBranches() error {
+	localRepo, err := git.PlainOpen(g.workDir)
+	if err != nil {
+		return err
+	}
+	cfg, err := localRepo.Config()
+	if err != nil {
+		return errors.Wrapf(err, "failed to read config of repository %s", g.remoteRepo.URL)
+	}
+	remote, ok := cfg.Remotes[remoteName]
+	all := []config.RefSpec{config.RefSpec(fmt.Sprintf(config.DefaultFetchRefSpec, remoteName))}
+	if !ok || slices.Equal(remote.Fetch, all) {
+		return nil
+	}
+	remote.Fetch = all
+	if err := localRepo.SetConfig(cfg); err != nil {
+		return errors.Wrapf(err, "failed to fetch all branches of repository %s", g.remoteRepo.URL)
+	}
+	return nil
+}
+
+// discards the local repository and clones it again, e.g. after the remote history was rewritten.
+// Returns nil worktree if remote does not exist
+func (g *GIT) ResetLocalToRemote() (*git.Worktree, error) {
+	if err := g.RemoveLocal(); err != nil {
+		return nil, err
+	}
+	return g.cloneRepoToLocalTemp()
+}
+
+// PushLocalToRemote pushes the local branch to the branch of the remote
 func (g *GIT) PushLocalToRemote() error {
 	localRepo, err := git.PlainOpen(g.workDir)
 	if err != nil {
 		return err
 	}
 
+	// only the branch, which the bundle was applied to whatever the name of its head
+	ref := plumbing.NewBranchReferenceName(g.remoteRepo.Branch)
 	err = localRepo.Push(&git.PushOptions{
-		RemoteName: remoteName,
-		RemoteURL:  g.remoteRepo.URL,
-		Auth:       g.getAuth()})
+		RemoteName:   remoteName,
+		RemoteURL:    g.remoteRepo.URL,
+		RefSpecs:     []config.RefSpec{config.RefSpec(fmt.Sprintf("%s:%s", ref, ref))},
+		Auth:         g.getAuth(),
+		ProxyOptions: g.proxyOptions()})
 
 	if err != nil {
 		if errors.Is(err, git.NoErrAlreadyUpToDate) {
@@ -261,227 +484,1307 @@ func (g *GIT) PushLocalToRemote() error {
 
 }
 
-// apply bundle to local repo with "git fetch"
-func (g *GIT) ApplyBundleToLocal(r io.Reader) error {
-	// "git pull" requires that the bundle is stored on disk
-	dir, err := g.getRandomTempDir()
-	if err != nil {
-		return errors.Wrap(err, "failed to create temp dir")
-	}
-	defer os.RemoveAll(dir)
-	tmpFile := filepath.Join(dir, "bundle")
-	f, err := os.OpenFile(tmpFile, os.O_CREATE|os.O_WRONLY, os.ModePerm)
-	if err != nil {
-		return errors.Wrap(err, "failed to create temp file for bundle")
-	}
-	defer f.Close()
-	_, err = io.Copy(f, r)
+// ForcePushLocalToRemote pushes the local branch to the remote, overwriting the history of the remote branch.
+// The push is rejected with ErrLeaseMismatch if the remote branch is not at expectedHead. A zero expectedHead
+// only creates the branch, so a branch created in the remote meanwhile is not overwritten
+func (g *GIT) ForcePushLocalToRemote(expectedHead plumbing.Hash) error {
+	localRepo, err := git.PlainOpen(g.workDir)
 	if err != nil {
-		return errors.Wrap(err, "failed to write bundle to temp file")
+		return err
 	}
 
-	cmd := exec.Command("git", "-C", g.workDir, "pull", tmpFile, g.remoteRepo.Branch)
-	cmd.Stdin = r
-	stderr := &bytes.Buffer{}
-	cmd.Stderr = stderr
-	stdout := &bytes.Buffer{}
-	cmd.Stdout = stdout
+	ref := plumbing.NewBranchReferenceName(g.remoteRepo.Branch)
+	opts := &git.PushOptions{
+		RemoteName:   remoteName,
+		RemoteURL:    g.remoteRepo.URL,
+		RefSpecs:     []config.RefSpec{config.RefSpec(fmt.Sprintf("%s:%s", ref, ref))},
+		Auth:         g.getAuth(),
+		ProxyOptions: g.proxyOptions()}
+	if expectedHead != plumbing.ZeroHash {
+		opts.RefSpecs = []config.RefSpec{config.RefSpec(fmt.Sprintf("+%s:%s", ref, ref))}
+		opts.ForceWithLease = &git.ForceWithLease{RefName: ref, Hash: expectedHead}
+	}
 
-	err = cmd.Run()
+	err = localRepo.Push(opts)
 	if err != nil {
-		return &CommandError{
-			Message:  fmt.Sprintf("failed to apply bundle for repository %s and branch %s", g.remoteRepo.URL, g.remoteRepo.Branch),
-			Err:      err,
-			StdErr:   stderr.String(),
-			ExitCode: cmd.ProcessState.ExitCode()}
+		if errors.Is(err, git.NoErrAlreadyUpToDate) {
+			return nil
+		}
+		if errors.Is(err, transport.ErrAuthorizationFailed) || errors.Is(err, transport.ErrAuthenticationRequired) {
+			return ErrAuthFailed
+		}
+		// go-git reports a failed lease without a sentinel error
+		if strings.HasPrefix(err.Error(), git.ErrNonFastForwardUpdate.Error()) {
+			return errors.Wrapf(ErrLeaseMismatch, "expected %s", expectedHead)
+		}
+		return errors.Wrapf(err, "failed to force push local repository %s for branch %s", g.remoteRepo.URL, g.remoteRepo.Branch)
 	}
-
 	return nil
 }
 
-type BundleOptions struct {
-	// since, is the lookback duration for the bundle. Optional.
-	Since time.Duration
+// ResetLocalToBundle fetches the bundle into the local repo, and resets the branch to the head of the bundle.
+// Local commits not in the bundle are discarded
+func (g *GIT) ResetLocalToBundle(r io.Reader) error {
+	dir, err := g.getRandomTempDir()
+	if err != nil {
+		return errors.Wrap(err, "failed to create temp dir")
+	}
+	defer os.RemoveAll(dir)
+	tmpFile := filepath.Join(dir, "bundle")
+	if err := writeFile(tmpFile, r); err != nil {
+		return err
+	}
 
-	// after timestamp, optional
-	After time.Time
-}
+	_, err = g.runGit(fmt.Sprintf("failed to apply bundle for repository %s and branch %s", g.remoteRepo.URL, g.remoteRepo.Branch),
+		"-C", g.workDir, "fetch", "--quiet", tmpFile, g.bundleRef())
+	if err != nil {
+		return err
+	}
 
-func (opt BundleOptions) HasAny() bool {
-	return opt.Since != 0 || !opt.After.IsZero()
+	_, err = g.runGit(fmt.Sprintf("failed to reset branch %s to bundle for repository %s", g.remoteRepo.Branch, g.remoteRepo.URL),
+		"-C", g.workDir, "reset", "--quiet", "--hard", "FETCH_HEAD")
+	return err
 }
 
-func (g *GIT) CreateBundleFromLocal(opt BundleOptions) ([]byte, error) {
-	log := slog.With("op", "CreateBundleFromLocal", "repo.url", g.remoteRepo.URL, "repo.branch", g.remoteRepo.Branch)
-	cmd := exec.Command("git", "-C", g.workDir, "bundle", "create", "-", g.remoteRepo.Branch)
-	if opt.Since != 0 {
-		cmd = exec.Command("git", "-C", g.workDir, "bundle", "create", "-", fmt.Sprintf("--since=%d.seconds.ago", int64(opt.Since.Seconds())), g.remoteRepo.Branch)
-	} else if !opt.After.IsZero() {
-		cmd = exec.Command("git", "-C", g.workDir, "bundle", "create", "-", fmt.Sprintf("--after=%s", opt.After.Format(afterTimeFormat)), g.remoteRepo.Branch)
-	}
-	log.Debug("running command", "cmd", cmd.String())
-
-	stdout := &bytes.Buffer{}
-	stderr := &bytes.Buffer{}
-	cmd.Stdout = stdout
-	cmd.Stderr = stderr
-	if err := cmd.Run(); err != nil {
-		return nil, &CommandError{
-			Message:  fmt.Sprintf("failed to bundle repository %s for branch %s", g.remoteRepo.URL, g.remoteRepo.Branch),
-			Err:      err,
-			StdErr:   stderr.String(),
-			ExitCode: cmd.ProcessState.ExitCode()}
+// RemoveLocal removes the local repository. It is cloned again on the next sync
+func (g *GIT) RemoveLocal() error {
+	if err := os.RemoveAll(g.workDir); err != nil {
+		return errors.Wrapf(err, "failed to remove local repository %s", g.workDir)
 	}
-	return stdout.Bytes(), nil
+	return nil
 }
 
-type BundleInfo struct {
-	IsComplete    bool
-	ContainsRef   string
-	RequiresRef   string
-	HashAlgorithm string
-	IsOkay        bool
-}
+// staleLockAge is the age after which a leftover index.lock of the local clone is considered stale
+const staleLockAge = time.Minute
 
-func (b BundleInfo) Validate() error {
-	if !b.IsOkay {
-		return errors.New("bundle is not okay")
+// RemoveStaleIndexLock removes the index.lock of the local clone, when older than staleLockAge, e.g. left by
+// a crashed or killed git command. Otherwise every later git command fails. Must only be called by the holder
+// of the lock of the work dir, so the index.lock is not held by a concurrent operation. Returns whether removed
+func (g *GIT) RemoveStaleIndexLock() (bool, error) {
+	path := filepath.Join(g.workDir, ".git", "index.lock")
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
 	}
-	if b.ContainsRef == "" {
-		return errors.New("bundle does not contain ref")
+	if err != nil {
+		return false, errors.Wrap(err, "failed to stat index.lock")
 	}
-	if !b.IsComplete && b.RequiresRef != "" {
-		return errors.New("bundle does not specify required ref, but is partial")
+	if time.Since(info.ModTime()) < staleLockAge {
+		return false, nil
 	}
-	if b.HashAlgorithm == "" {
-		return errors.New("bundle does not specify hash algorithm")
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, errors.Wrap(err, "failed to remove stale index.lock")
 	}
-	return nil
+	return true, nil
 }
 
-func ParseBundleVerifyOutput(output string) BundleInfo {
-	scanner := bufio.NewScanner(strings.NewReader(output))
-	var bundle BundleInfo
+// apply bundle to local repo with "git fetch" and a fast-forward of the branch, so no merge commit is created.
+// Returns ErrNotFastForward if the branch has diverged from the bundle, unless merged by MergeModeMerge. Nothing is changed if already up to date,
+// or if the branch already contains the head of the bundle (a stale bundle).
+// Only the branch is applied. Tags in the bundle are fetched separately, see Syncer.TagConflict
+func (g *GIT) ApplyBundleToLocal(r io.Reader) error {
+	// "git fetch" requires that the bundle is stored on disk
+	dir, err := g.getRandomTempDir()
+	if err != nil {
+		return errors.Wrap(err, "failed to create temp dir")
+	}
+	defer os.RemoveAll(dir)
+	tmpFile := filepath.Join(dir, "bundle")
+	if err := writeFile(tmpFile, r); err != nil {
+		return err
+	}
 
-	for scanner.Scan() {
-		line := scanner.Text()
+	msg := fmt.Sprintf("failed to apply bundle for repository %s and branch %s", g.remoteRepo.URL, g.remoteRepo.Branch)
+	// the bundle is passed by file path. r is drained, so git must not read stdin
+	_, err = g.runGit(msg, "-C", g.workDir, "fetch", "--quiet", tmpFile, g.bundleRef())
+	if err != nil {
+		return err
+	}
 
-		// Check for complete history
-		if line == "The bundle records a complete history." {
-			bundle.IsComplete = true
+	oldHead, err := g.getLocalHead()
+	if err != nil {
+		return err
+	}
+	if oldHead != plumbing.ZeroHash {
+		stale, err := g.checkFastForward(g.workDir, oldHead)
+		if errors.Is(err, ErrNotFastForward) && g.mergeMode == MergeModeMerge {
+			return g.mergeFetchHead()
 		}
-
-		// Check for hash algorithm
-		const hashPrefix = "The bundle uses this hash algorithm: "
-		if strings.HasPrefix(line, hashPrefix) {
-			bundle.HashAlgorithm = strings.TrimPrefix(line, hashPrefix)
+		if err != nil {
+			return err
 		}
-
-		// Check for contained ref
-		if strings.HasPrefix(line, "The bundle contains this ref:") {
-			scanner.Scan() // Move to next line which contains the ref
-			bundle.ContainsRef = scanner.Text()
-		} else if strings.HasPrefix(line, "The bundle requires this ref:") {
-			scanner.Scan() // Move to next line which contains the ref
-			bundle.RequiresRef = scanner.Text()
-		} else if strings.HasPrefix(line, "The bundle records a complete history.") {
-			bundle.IsComplete = true
-		} else if strings.HasSuffix(line, " is okay") {
-			// Ignore final verification message
-			bundle.IsOkay = true
+		if stale {
+			// the branch already contains the bundle, e.g. a bundle pushed twice
+			return nil
 		}
 	}
 
-	return bundle
+	_, err = g.runGit(msg, "-C", g.workDir, "merge", "--quiet", "--ff-only", "FETCH_HEAD")
+	return err
 }
 
-func (g *GIT) GetBundleInfo(bundleData []byte) (BundleInfo, error) {
-	cmd := exec.Command("git", "bundle", "verify", "-")
-	cmd.Stdin = bytes.NewReader(bundleData)
-	stdout := &bytes.Buffer{}
-	stderr := &bytes.Buffer{}
-	cmd.Stdout = stdout
-	cmd.Stderr = stderr
-	if err := cmd.Run(); err != nil {
-		return BundleInfo{}, &CommandError{
-			Message:  fmt.Sprintf("failed to verify bundle for repository %s and branch %s", g.remoteRepo.URL, g.remoteRepo.Branch),
-			Err:      err,
-			StdErr:   stderr.String(),
-			ExitCode: cmd.ProcessState.ExitCode()}
+// checks that FETCH_HEAD of the repository in dir fast-forwards oldHead. Returns stale if oldHead already contains
+// FETCH_HEAD, otherwise ErrNotFastForward when the history of FETCH_HEAD and oldHead diverged
+func (g *GIT) checkFastForward(dir string, oldHead plumbing.Hash) (stale bool, err error) {
+	isAncestor := func(a, b string) (bool, error) {
+		_, err := g.runGit(fmt.Sprintf("failed to check whether %s is an ancestor of %s for repository %s", a, b, g.remoteRepo.URL),
+			"-C", dir, "merge-base", "--is-ancestor", a, b)
+		if err != nil {
+			if cmdErr, ok := err.(*CommandError); ok && cmdErr.ExitCode == 1 {
+				return false, nil
+			}
+			return false, err
+		}
+		return true, nil
 	}
 
-	info := ParseBundleVerifyOutput(stdout.String())
-	if ve := info.Validate(); ve != nil {
-		return info, ve
+	ff, err := isAncestor(oldHead.String(), "FETCH_HEAD")
+	if err != nil || ff {
+		return false, err
 	}
-	return info, nil
-}
-
-type Head struct {
-	CommitID string
-	Ref      string
-}
-
-func ParseBundleListHeadsOutput(output string) ([]Head, error) {
-	scanner := bufio.NewScanner(strings.NewReader(output))
-	var heads []Head
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.Split(line, " ")
-		if len(parts) != 2 {
-			return nil, fmt.Errorf("invalid line in bundle list-heads output: %s", line)
-		}
-		heads = append(heads, Head{CommitID: parts[0], Ref: parts[1]})
+	stale, err = isAncestor("FETCH_HEAD", oldHead.String())
+	if err != nil {
+		return false, err
 	}
-	return heads, nil
-}
-
-func (g *GIT) GetBundleListHeads(bundleData []byte) ([]Head, error) {
-	cmd := exec.Command("git", "bundle", "list-heads", "-")
-	cmd.Stdin = bytes.NewReader(bundleData)
-	stdout := &bytes.Buffer{}
-	stderr := &bytes.Buffer{}
-	cmd.Stdout = stdout
-	cmd.Stderr = stderr
-	if err := cmd.Run(); err != nil {
-		return nil, &CommandError{
-			Message:  fmt.Sprintf("failed to verify bundle for repository %s and branch %s", g.remoteRepo.URL, g.remoteRepo.Branch),
-			Err:      err,
-			StdErr:   stderr.String(),
-			ExitCode: cmd.ProcessState.ExitCode()}
+	if !stale {
+		return false, ErrNotFastForward
 	}
+	return true, nil
+}
 
-	return ParseBundleListHeadsOutput(stdout.String())
+// VerifyBundleInScratch fetches the bundle into a scratch clone of the local repo
+// and checks that it fast-forwards the branch. The local repo is not modified
+func (g *GIT) VerifyBundleInScratch(r io.Reader) error {
+	_, err := g.InspectBundleInScratch(r, 0)
+	return err
 }
 
-func getWorkDir(tempDir, remoteURL, branch string) string {
-	return filepath.Join(tempDir, base64.URLEncoding.EncodeToString([]byte(remoteURL+branch)))
+// BundleInspection describes what a bundle adds to the branch
+type BundleInspection struct {
+	Head plumbing.Hash
+	// HeadTime is the commit time of the head
+	HeadTime time.Time
+	// at most maxCommits of the commits added (newest first)
+	Commits []CommitInfo
 }
 
-// creates a random temp dir. Must be cleaned up by caller
-func (g *GIT) getRandomTempDir() (string, error) {
-	if g.tempDir == "" {
-		return "", errors.New("tempDir not set")
+// InspectBundleInScratch verifies the bundle like VerifyBundleInScratch, and returns the head of the bundle
+// and at most maxCommits of the commits it adds to the branch (newest first). For a stale bundle, the head is
+// the unchanged head of the branch and no commits are added. For a bundle merged by MergeModeMerge, the head is
+// the head of the bundle, and the commits exclude the merge commit. The local repo is not modified
+func (g *GIT) InspectBundleInScratch(r io.Reader, maxCommits int) (BundleInspection, error) {
+	dir, err := g.getRandomTempDir()
+	if err != nil {
+		return BundleInspection{}, errors.Wrap(err, "failed to create temp dir")
+	}
+	defer os.RemoveAll(dir)
+	tmpFile := filepath.Join(dir, "bundle")
+	if err := writeFile(tmpFile, r); err != nil {
+		return BundleInspection{}, err
 	}
-	dir := filepath.Join(g.tempDir, generateRandomString())
-	return dir, os.Mkdir(dir, os.ModePerm)
-}
 
-func (g *GIT) getWorktree() (*git.Worktree, error) {
-	localRepo, err := git.PlainOpen(g.workDir)
+	oldHead, err := g.getLocalHead()
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to open local repository %s for branch %s", g.remoteRepo.URL, g.remoteRepo.Branch)
+		return BundleInspection{}, err
 	}
 
-	w, err := localRepo.Worktree()
+	// --shared borrows the objects of the local repo, so new objects
+	// from the bundle only end up in the scratch clone
+	scratchDir := filepath.Join(dir, "scratch")
+	_, err = g.runGit(fmt.Sprintf("failed to create scratch clone for repository %s and branch %s", g.remoteRepo.URL, g.remoteRepo.Branch),
+		"clone", "--quiet", "--shared", "--no-checkout", g.workDir, scratchDir)
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to get worktree for local repository %s for branch %s", g.remoteRepo.URL, g.remoteRepo.Branch)
+		return BundleInspection{}, err
 	}
-	return w, nil
-}
 
+	_, err = g.runGit(fmt.Sprintf("failed to apply bundle for repository %s and branch %s", g.remoteRepo.URL, g.remoteRepo.Branch),
+		"-C", scratchDir, "fetch", "--quiet", tmpFile, g.bundleRef())
+	if err != nil {
+		return BundleInspection{}, err
+	}
+
+	stale := false
+	if oldHead != plumbing.ZeroHash {
+		stale, err = g.checkFastForward(scratchDir, oldHead)
+		if errors.Is(err, ErrNotFastForward) && g.mergeMode == MergeModeMerge {
+			// merged when applied
+			err = nil
+		}
+		if err != nil {
+			return BundleInspection{}, err
+		}
+	}
+
+	stdout, err := g.runGit("failed to resolve head of bundle", "-C", scratchDir, "log", "-1", "--format=%H %ct", "FETCH_HEAD")
+	if err != nil {
+		return BundleInspection{}, err
+	}
+	id, unix, _ := strings.Cut(strings.TrimSpace(string(stdout)), " ")
+	seconds, err := strconv.ParseInt(unix, 10, 64)
+	if err != nil {
+		return BundleInspection{}, errors.Wrapf(err, "failed to parse commit time of bundle head '%s'", stdout)
+	}
+	result := BundleInspection{Head: plumbing.NewHash(id), HeadTime: time.Unix(seconds, 0)}
+	if stale {
+		// the branch is kept at its head, and nothing is added
+		result.Head = oldHead
+		return result, nil
+	}
+
+	if maxCommits <= 0 {
+		return result, nil
+	}
+	result.Commits, err = g.listCommits(scratchDir, oldHead, result.Head, maxCommits)
+	if err != nil {
+		return BundleInspection{}, err
+	}
+	return result, nil
+}
+
+// InspectNewestBundleHead fetches the branches of the bundle into a scratch clone of the local repo, and returns
+// the newest of their heads by commit time. Unlike InspectBundleInScratch, the branches need not fast-forward,
+// e.g. for force pushes. The local repo is not modified
+func (g *GIT) InspectNewestBundleHead(r io.Reader) (BundleInspection, error) {
+	dir, err := g.getRandomTempDir()
+	if err != nil {
+		return BundleInspection{}, errors.Wrap(err, "failed to create temp dir")
+	}
+	defer os.RemoveAll(dir)
+	tmpFile := filepath.Join(dir, "bundle")
+	if err := writeFile(tmpFile, r); err != nil {
+		return BundleInspection{}, err
+	}
+
+	scratchDir := filepath.Join(dir, "scratch")
+	_, err = g.runGit(fmt.Sprintf("failed to create scratch clone for repository %s", g.remoteRepo.URL),
+		"clone", "--quiet", "--shared", "--no-checkout", g.workDir, scratchDir)
+	if err != nil {
+		return BundleInspection{}, err
+	}
+	_, err = g.runGit(fmt.Sprintf("failed to fetch bundle for repository %s", g.remoteRepo.URL),
+		"-C", scratchDir, "fetch", "--quiet", "--no-tags", tmpFile, "+refs/heads/*:refs/bundle/*")
+	if err != nil {
+		return BundleInspection{}, err
+	}
+
+	stdout, err := g.runGit("failed to resolve heads of bundle", "-C", scratchDir, "for-each-ref", "--sort=-committerdate", "--count=1",
+		"--format=%(objectname) %(committerdate:unix)", "refs/bundle/")
+	if err != nil {
+		return BundleInspection{}, err
+	}
+	if len(bytes.TrimSpace(stdout)) == 0 {
+		return BundleInspection{}, ErrNoBundleHeads
+	}
+	id, unix, _ := strings.Cut(strings.TrimSpace(string(stdout)), " ")
+	seconds, err := strconv.ParseInt(unix, 10, 64)
+	if err != nil {
+		return BundleInspection{}, errors.Wrapf(err, "failed to parse commit time of bundle head '%s'", stdout)
+	}
+	return BundleInspection{Head: plumbing.NewHash(id), HeadTime: time.Unix(seconds, 0)}, nil
+}
+
+// CommitInfo describes a single commit
+type CommitInfo struct {
+	ID      string `json:"id"`
+	Author  string `json:"author"`
+	Subject string `json:"subject"`
+}
+
+// GetLocalCommits lists at most max commits in the local repo that are reachable from newHead,
+// but not from oldHead (newest first). A zero oldHead lists the history of newHead
+func (g *GIT) GetLocalCommits(oldHead, newHead plumbing.Hash, max int) ([]CommitInfo, error) {
+	return g.listCommits(g.workDir, oldHead, newHead, max)
+}
+
+// CountLocalCommits counts the commits in the local repo that are reachable from newHead, but not from oldHead.
+// A zero oldHead counts the history of newHead
+func (g *GIT) CountLocalCommits(oldHead, newHead plumbing.Hash) (int, error) {
+	if newHead == plumbing.ZeroHash || oldHead == newHead {
+		return 0, nil
+	}
+
+	rev := newHead.String()
+	if oldHead != plumbing.ZeroHash {
+		rev = oldHead.String() + ".." + rev
+	}
+
+	stdout, err := g.runGit(fmt.Sprintf("failed to count commits for repository %s and branch %s", g.remoteRepo.URL, g.remoteRepo.Branch),
+		"-C", g.workDir, "rev-list", "--count", rev)
+	if err != nil {
+		return 0, err
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(string(stdout)))
+	if err != nil {
+		return 0, errors.Wrap(err, "invalid output of git rev-list --count")
+	}
+	return count, nil
+}
+
+// list commits in the repo at dir. See GetLocalCommits
+func (g *GIT) listCommits(dir string, oldHead, newHead plumbing.Hash, max int) ([]CommitInfo, error) {
+	if newHead == plumbing.ZeroHash || oldHead == newHead {
+		return nil, nil
+	}
+
+	rev := newHead.String()
+	if oldHead != plumbing.ZeroHash {
+		rev = oldHead.String() + ".." + rev
+	}
+
+	stdout, err := g.runGit(fmt.Sprintf("failed to list commits for repository %s and branch %s", g.remoteRepo.URL, g.remoteRepo.Branch),
+		"-C", dir, "log", fmt.Sprintf("--max-count=%d", max), "--format=%H%x00%an <%ae>%x00%s", rev)
+	if err != nil {
+		return nil, err
+	}
+
+	var commits []CommitInfo
+	scanner := bufio.NewScanner(bytes.NewReader(stdout))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "\x00", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid line in git log output: %s", scanner.Text())
+		}
+		commits = append(commits, CommitInfo{ID: parts[0], Author: parts[1], Subject: parts[2]})
+	}
+	return commits, nil
+}
+
+type BundleOptions struct {
+	// since, is the lookback duration for the bundle. Optional.
+	Since time.Duration
+
+	// after timestamp, optional
+	After time.Time
+
+	// From is the commit ID to bundle from (exclusive). Optional
+	From string
+
+	// To is the commit ID to bundle to (inclusive). Optional, defaults to the head of the branch
+	To string
+
+	// MaxCommits limits the bundle to the newest commits. Optional, 0 for no limit
+	MaxCommits int
+}
+
+// HasAny returns whether any option is set, that makes the bundle partial
+func (opt BundleOptions) HasAny() bool {
+	return opt.Since != 0 || !opt.After.IsZero() || opt.From != "" || opt.MaxCommits != 0
+}
+
+func (opt BundleOptions) Validate() error {
+	if opt.From != "" && !isCommitID(opt.From) {
+		return fmt.Errorf("from '%s' is not a commit ID", opt.From)
+	}
+	if opt.To != "" && !isCommitID(opt.To) {
+		return fmt.Errorf("to '%s' is not a commit ID", opt.To)
+	}
+	if opt.Since != 0 && !opt.After.IsZero() {
+		return errors.New("since and after are mutually exclusive")
+	}
+	if (opt.From != "" || opt.To != "") && (opt.Since != 0 || !opt.After.IsZero()) {
+		return errors.New("from/to cannot be combined with since/after")
+	}
+	if opt.MaxCommits < 0 {
+		return errors.New("max-commits must not be negative")
+	}
+	if opt.MaxCommits != 0 && (opt.From != "" || opt.To != "") {
+		return errors.New("max-commits cannot be combined with from/to")
+	}
+	return nil
+}
+
+// CreateBundleFromLocal creates a bundle of the branch with the options, as of the current head of the local branch
+func (g *GIT) CreateBundleFromLocal(opt BundleOptions) ([]byte, error) {
+	head, err := g.getLocalHead()
+	if err != nil {
+		return nil, err
+	}
+	return g.CreateBundleAt(context.Background(), head, opt)
+}
+
+// CreateBundleAt creates a bundle of the branch with the options, as of head (or 'to' if set), e.g. a snapshot
+// of the head taken after syncing the local clone. If the local branch has moved since (e.g. by a concurrent
+// refresh), the bundle is created in a scratch clone with the branch pointed at head, so the head of the bundle
+// is always head. The git commands are killed when ctx is done, e.g. when the client disconnected
+func (g *GIT) CreateBundleAt(ctx context.Context, head plumbing.Hash, opt BundleOptions) ([]byte, error) {
+	repo, ok, err := g.goGitRepo()
+	if err != nil {
+		return nil, err
+	}
+	if ok && g.goGitBundle(opt) {
+		// the header is written directly, so no scratch clone is needed for a tip other than the branch
+		tip := head
+		if opt.To != "" {
+			tip = plumbing.NewHash(opt.To)
+		} else if tip.IsZero() {
+			if tip, err = g.getLocalHead(); err != nil {
+				return nil, err
+			}
+		}
+		return g.createBundleGoGit(ctx, repo, tip, opt.From)
+	}
+
+	if opt.To == "" {
+		current, err := g.getLocalHead()
+		if err != nil {
+			return nil, err
+		}
+		if head.IsZero() || current == head {
+			data, err := g.createBundleIn(ctx, g.workDir, opt)
+			if err != nil || head.IsZero() {
+				return data, err
+			}
+			// the branch may have moved while bundling
+			if info, err := ParseBundleHeader(data); err == nil && len(info.Heads) == 1 && info.Heads[0].CommitID == head.String() {
+				return data, nil
+			}
+		}
+	}
+
+	tip := opt.To
+	if tip == "" {
+		tip = head.String()
+	}
+	// bundles only contain named refs, so point the branch at the tip in a scratch clone
+	scratchDir, err := g.getRandomTempDir()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create temp dir")
+	}
+	defer os.RemoveAll(scratchDir)
+
+	dir := filepath.Join(scratchDir, "scratch")
+	_, err = g.runGit(fmt.Sprintf("failed to create scratch clone for repository %s and branch %s", g.remoteRepo.URL, g.remoteRepo.Branch),
+		"clone", "--quiet", "--bare", "--shared", g.workDir, dir)
+	if err != nil {
+		return nil, err
+	}
+	_, err = g.runGit(fmt.Sprintf("failed to point branch %s at %s for repository %s", g.remoteRepo.Branch, tip, g.remoteRepo.URL),
+		"-C", dir, "update-ref", plumbing.NewBranchReferenceName(g.remoteRepo.Branch).String(), tip)
+	if err != nil {
+		return nil, err
+	}
+	return g.createBundleIn(ctx, dir, opt)
+}
+
+// create a bundle of the branch with the options in the repository at dir
+func (g *GIT) createBundleIn(ctx context.Context, dir string, opt BundleOptions) ([]byte, error) {
+	log := slog.With("op", "createBundleIn", "repo.url", g.remoteRepo.URL, "repo.branch", g.remoteRepo.Branch)
+
+	args := append([]string{"-C", dir, "bundle", "create", "-"}, g.revListArgs(opt, g.remoteRepo.Branch)...)
+	cmd := g.command(args...)
+	log.Debug("running command", "cmd", cmd.String())
+
+	stdout, err := runCommandContext(ctx, cmd, g.commandTimeout, fmt.Sprintf("failed to bundle repository %s for branch %s", g.remoteRepo.URL, g.remoteRepo.Branch))
+	if err != nil {
+		if cmdErr, ok := err.(*CommandError); ok && ctx.Err() == nil {
+			metricBundleCreateFailures.WithLabelValues(bundleFailureCause(cmdErr)).Inc()
+		}
+		return nil, err
+	}
+
+	if g.deterministicBundles {
+		return g.repackBundle(ctx, dir, stdout)
+	}
+	return stdout, nil
+}
+
+// rev-list arguments selecting the commits of the bundle with the options, up to tip (a branch or commit ID)
+func (g *GIT) revListArgs(opt BundleOptions, tip string) []string {
+	var args []string
+	if opt.MaxCommits != 0 {
+		args = append(args, fmt.Sprintf("-%d", opt.MaxCommits))
+	}
+	if opt.Since != 0 {
+		args = append(args, fmt.Sprintf("--since=%d.seconds.ago", int64(opt.Since.Seconds())))
+	} else if !opt.After.IsZero() {
+		// afterTimeFormat is in UTC
+		args = append(args, fmt.Sprintf("--after=%s", opt.After.UTC().Format(afterTimeFormat)))
+	}
+	if opt.From != "" {
+		args = append(args, fmt.Sprintf("%s..%s", opt.From, tip))
+	} else {
+		args = append(args, tip)
+	}
+	return args
+}
+
+// OldestBundledCommit returns the oldest commit a bundle with the options up to head contains. Empty if none
+func (g *GIT) OldestBundledCommit(head plumbing.Hash, opt BundleOptions) (string, error) {
+	args := append([]string{"-C", g.workDir, "rev-list"}, g.revListArgs(opt, head.String())...)
+	out, err := g.runGit(fmt.Sprintf("failed to list commits of repository %s and branch %s", g.remoteRepo.URL, g.remoteRepo.Branch), args...)
+	if err != nil {
+		return "", err
+	}
+	ids := strings.Fields(string(out))
+	if len(ids) == 0 {
+		return "", nil
+	}
+	return ids[len(ids)-1], nil
+}
+
+// CountBundledCommits returns the number of commits in the bundle, i.e. reachable from its heads,
+// but not from its prerequisites. The commits must exist in the local repository
+func (g *GIT) CountBundledCommits(info BundleInfo) (int, error) {
+	repo, ok, err := g.goGitRepo()
+	if err != nil {
+		return 0, err
+	}
+	if ok {
+		heads, prerequisites := bundleHashes(info)
+		return countCommitsGoGit(repo, heads, prerequisites)
+	}
+
+	args := []string{"-C", g.workDir, "rev-list", "--count"}
+	for _, head := range info.Heads {
+		args = append(args, head.CommitID)
+	}
+	args = append(args, "--not")
+	args = append(args, info.Prerequisites...)
+	out, err := g.runGit(fmt.Sprintf("failed to count commits of repository %s", g.remoteRepo.URL), args...)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(out)))
+}
+
+// CreatePack returns a packfile of the objects of the bundle, i.e. reachable from its heads, but not from its
+// prerequisites. Unlike the pack of a partial bundle it is not thin, so it can be indexed without the prerequisites
+func (g *GIT) CreatePack(ctx context.Context, info BundleInfo) ([]byte, error) {
+	repo, ok, err := g.goGitRepo()
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		heads, prerequisites := bundleHashes(info)
+		pack := &bytes.Buffer{}
+		if err := g.writePackGoGit(ctx, pack, repo, heads, prerequisites); err != nil {
+			return nil, err
+		}
+		return pack.Bytes(), nil
+	}
+
+	revs := &bytes.Buffer{}
+	for _, head := range info.Heads {
+		fmt.Fprintf(revs, "%s\n", head.CommitID)
+	}
+	for _, id := range info.Prerequisites {
+		fmt.Fprintf(revs, "^%s\n", id)
+	}
+
+	cmd := g.command("-C", g.workDir, "pack-objects", "--stdout", "--delta-base-offset", "--revs", "--quiet")
+	cmd.Stdin = revs
+	return runCommandContext(ctx, cmd, g.commandTimeout, fmt.Sprintf("failed to create pack for repository %s and branch %s", g.remoteRepo.URL, g.remoteRepo.Branch))
+}
+
+// replace the pack of the bundle with one built without reusing existing deltas or compressed objects,
+// in a single thread. The pack written by "git bundle create" depends on how the objects are stored locally
+// (loose, or packed by clone/fetch/gc), and delta search with multiple threads is not deterministic
+func (g *GIT) repackBundle(ctx context.Context, dir string, bundle []byte) ([]byte, error) {
+	header, _, ok := bytes.Cut(bundle, []byte("\n\n"))
+	if !ok {
+		return nil, errors.New("bundle header is incomplete")
+	}
+
+	// the same revisions "git bundle create" packs: the heads, excluding the prerequisites
+	revs := &bytes.Buffer{}
+	for _, line := range strings.Split(string(header), "\n")[1:] {
+		if strings.HasPrefix(line, "@") {
+			continue
+		}
+		if prerequisite, ok := strings.CutPrefix(line, "-"); ok {
+			id, _, _ := strings.Cut(prerequisite, " ")
+			fmt.Fprintf(revs, "^%s\n", id)
+			continue
+		}
+		id, _, _ := strings.Cut(line, " ")
+		fmt.Fprintf(revs, "%s\n", id)
+	}
+
+	cmd := g.command("-C", dir, "pack-objects", "--stdout", "--thin", "--delta-base-offset", "--revs", "--quiet",
+		"--threads=1", "--no-reuse-delta", "--no-reuse-object")
+	cmd.Stdin = revs
+	pack, err := runCommandContext(ctx, cmd, g.commandTimeout, fmt.Sprintf("failed to repack bundle for repository %s and branch %s", g.remoteRepo.URL, g.remoteRepo.Branch))
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]byte, 0, len(header)+2+len(pack))
+	result = append(result, header...)
+	result = append(result, "\n\n"...)
+	return append(result, pack...), nil
+}
+
+// causes of bundle creation failures
+const (
+	bundleFailureEmpty      = "empty"
+	bundleFailureGitMissing = "git_missing"
+	bundleFailureDisk       = "disk"
+	bundleFailureKilled     = "killed"
+	bundleFailureOther      = "other"
+)
+
+// categorize a failed "git bundle create". An empty bundle is refused when no commits match the options
+func bundleFailureCause(cmdErr *CommandError) string {
+	var exitErr *exec.ExitError
+	switch {
+	case strings.Contains(cmdErr.StdErr, "Refusing to create empty bundle"):
+		return bundleFailureEmpty
+	case errors.Is(cmdErr.Err, exec.ErrNotFound):
+		return bundleFailureGitMissing
+	case strings.Contains(cmdErr.StdErr, "No space left on device"),
+		strings.Contains(cmdErr.StdErr, "Read-only file system"),
+		strings.Contains(cmdErr.StdErr, "Input/output error"):
+		return bundleFailureDisk
+	case errors.As(cmdErr.Err, &exitErr) && cmdErr.ExitCode == -1:
+		// terminated by a signal
+		return bundleFailureKilled
+	default:
+		return bundleFailureOther
+	}
+}
+
+// GetChunks splits the (first-parent) history of the local branch into windows of commits,
+// each spanning at most the window duration of commit time. Returns the options for the
+// sequence of partial bundles, that applied in order reconstructs the full history
+func (g *GIT) GetChunks(window time.Duration) ([]BundleOptions, error) {
+	if window <= 0 {
+		return nil, errors.New("window must be positive")
+	}
+
+	commits, err := g.firstParentHistory()
+	if err != nil || len(commits) == 0 {
+		return nil, err
+	}
+
+	var chunks []BundleOptions
+	from := ""
+	windowEnd := commits[0].when.Add(window)
+	for i, c := range commits {
+		last := i == len(commits)-1
+		if !last && commits[i+1].when.Before(windowEnd) {
+			continue
+		}
+
+		chunks = append(chunks, BundleOptions{From: from, To: c.id})
+		from = c.id
+		// skip windows without commits
+		for !last && !commits[i+1].when.Before(windowEnd) {
+			windowEnd = windowEnd.Add(window)
+		}
+	}
+	return chunks, nil
+}
+
+// GetChunkAfter returns the options of the bundle of the next (at most) size commits of the first-parent
+// history of the local branch after cursor (empty to start with the oldest commit), and whether more
+// commits follow. Returns ErrCommitNotFound if cursor is not in the first-parent history, and
+// ErrEmptyBundle if no commits follow it
+func (g *GIT) GetChunkAfter(cursor string, size int) (BundleOptions, bool, error) {
+	if size <= 0 {
+		return BundleOptions{}, false, errors.New("size must be positive")
+	}
+	commits, err := g.firstParentHistory()
+	if err != nil {
+		return BundleOptions{}, false, err
+	}
+
+	start := 0
+	if cursor != "" {
+		i := slices.IndexFunc(commits, func(c historyCommit) bool { return c.id == cursor })
+		if i < 0 {
+			return BundleOptions{}, false, errors.Wrapf(ErrCommitNotFound, "cursor %s is not in the history of branch %s", cursor, g.remoteRepo.Branch)
+		}
+		start = i + 1
+	}
+	if start == len(commits) {
+		return BundleOptions{}, false, errors.Wrapf(ErrEmptyBundle, "no commits after cursor %s", cursor)
+	}
+	end := min(start+size, len(commits))
+	return BundleOptions{From: cursor, To: commits[end-1].id}, end < len(commits), nil
+}
+
+// a commit of the first-parent history of a branch
+type historyCommit struct {
+	id   string
+	when time.Time
+}
+
+// the first-parent history of the local branch, oldest first. Empty if the branch has no commits
+func (g *GIT) firstParentHistory() ([]historyCommit, error) {
+	head, err := g.getLocalHead()
+	if err != nil {
+		return nil, err
+	}
+	if head == plumbing.ZeroHash {
+		return nil, nil
+	}
+
+	stdout, err := g.runGit(fmt.Sprintf("failed to list commits for repository %s and branch %s", g.remoteRepo.URL, g.remoteRepo.Branch),
+		"-C", g.workDir, "log", "--first-parent", "--reverse", "--format=%H %ct", head.String())
+	if err != nil {
+		return nil, err
+	}
+
+	var commits []historyCommit
+	scanner := bufio.NewScanner(bytes.NewReader(stdout))
+	for scanner.Scan() {
+		id, ts, ok := strings.Cut(scanner.Text(), " ")
+		unix, err := strconv.ParseInt(ts, 10, 64)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("invalid line in git log output: %s", scanner.Text())
+		}
+		commits = append(commits, historyCommit{id: id, when: time.Unix(unix, 0)})
+	}
+	return commits, nil
+}
+
+// HasLocalCommit returns whether the commit exists in the local repo
+func (g *GIT) HasLocalCommit(id string) (bool, error) {
+	localRepo, err := git.PlainOpen(g.workDir)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to open local repository %s for branch %s", g.remoteRepo.URL, g.remoteRepo.Branch)
+	}
+
+	_, err = localRepo.CommitObject(plumbing.NewHash(id))
+	if err != nil {
+		if errors.Is(err, plumbing.ErrObjectNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func isCommitID(s string) bool {
+	if len(s) != 40 && len(s) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+type BundleInfo struct {
+	IsComplete    bool
+	ContainsRef   string
+	RequiresRef   string
+	HashAlgorithm string
+	IsOkay        bool
+	Heads         []Head
+	// Prerequisites are the commits the bundle requires. Empty for a complete bundle
+	Prerequisites []string
+}
+
+func (b BundleInfo) Validate() error {
+	if !b.IsOkay {
+		return errors.New("bundle is not okay")
+	}
+	if b.ContainsRef == "" {
+		return errors.New("bundle does not contain ref")
+	}
+	if !b.IsComplete && b.RequiresRef == "" {
+		return errors.New("bundle does not specify required ref, but is partial")
+	}
+	if b.HashAlgorithm == "" {
+		return errors.New("bundle does not specify hash algorithm")
+	}
+	return nil
+}
+
+// ParseBundleVerifyOutput parses the output of 'git bundle verify'. The refs are listed after
+// "The bundle contains this ref:" or "The bundle contains these 2 refs:" (likewise for requires).
+// IsOkay is only set if the output includes stderr. Lines are trimmed and matched case insensitively
+func ParseBundleVerifyOutput(output string) BundleInfo {
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	var bundle BundleInfo
+
+	// the ref list being parsed, if any
+	var refs *string
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		// case insensitive, in case the wording changes slightly
+		lower := strings.ToLower(line)
+
+		const hashPrefix = "the bundle uses this hash algorithm:"
+		switch {
+		case line == "":
+		case strings.HasPrefix(lower, "the bundle contains "):
+			refs = &bundle.ContainsRef
+		case strings.HasPrefix(lower, "the bundle requires "):
+			refs = &bundle.RequiresRef
+		case strings.HasPrefix(lower, "the bundle records a complete history"):
+			bundle.IsComplete = true
+			refs = nil
+		case strings.HasPrefix(lower, hashPrefix):
+			bundle.HashAlgorithm = strings.TrimSpace(line[len(hashPrefix):])
+			refs = nil
+		case strings.HasSuffix(lower, " is okay"):
+			// final verification message on stderr
+			bundle.IsOkay = true
+			refs = nil
+		case refs != nil && *refs == "":
+			// the first ref of the list
+			*refs = line
+		}
+	}
+
+	return bundle
+}
+
+// ParseMissingPrerequisites parses the commit IDs from the stderr of git, when applying a bundle
+// fails with "Repository lacks these prerequisite commits"
+func ParseMissingPrerequisites(stderr string) []string {
+	var ids []string
+	scanner := bufio.NewScanner(strings.NewReader(stderr))
+	found := false
+	for scanner.Scan() {
+		line := strings.TrimPrefix(scanner.Text(), "error: ")
+		if strings.HasPrefix(line, "Repository lacks these prerequisite commits") {
+			found = true
+			continue
+		}
+		if !found {
+			continue
+		}
+		// each commit is listed as "<id> <subject>"
+		id, _, _ := strings.Cut(line, " ")
+		if !isCommitID(id) {
+			break
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// ParseBundleHeader parses the header of a v2 or v3 bundle, without invoking git.
+// ContainsRef and RequiresRef are the first head and prerequisite, respectively
+func ParseBundleHeader(bundleData []byte) (BundleInfo, error) {
+	r := bufio.NewReader(bytes.NewReader(bundleData))
+	signature, err := r.ReadString('\n')
+	if err != nil {
+		return BundleInfo{}, errors.New("bundle header is incomplete")
+	}
+
+	info := BundleInfo{HashAlgorithm: "sha1", IsComplete: true}
+	switch strings.TrimSpace(signature) {
+	case "# v2 git bundle", "# v3 git bundle":
+	default:
+		return BundleInfo{}, fmt.Errorf("invalid bundle signature '%s'", strings.TrimSpace(signature))
+	}
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return BundleInfo{}, errors.New("bundle header is incomplete")
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			// end of header, the pack follows
+			break
+		}
+
+		switch {
+		case strings.HasPrefix(line, "@"):
+			// capability (v3)
+			if algo, ok := strings.CutPrefix(line, "@object-format="); ok {
+				info.HashAlgorithm = algo
+			}
+		case strings.HasPrefix(line, "-"):
+			// prerequisite, with optional comment
+			id, _, _ := strings.Cut(strings.TrimPrefix(line, "-"), " ")
+			info.IsComplete = false
+			info.Prerequisites = append(info.Prerequisites, id)
+			if info.RequiresRef == "" {
+				info.RequiresRef = id
+			}
+		default:
+			id, ref, ok := strings.Cut(line, " ")
+			if !ok {
+				return BundleInfo{}, fmt.Errorf("invalid ref line in bundle header: %s", line)
+			}
+			info.Heads = append(info.Heads, Head{CommitID: id, Ref: ref})
+			if info.ContainsRef == "" {
+				info.ContainsRef = line
+			}
+		}
+	}
+
+	info.IsOkay = true
+	return info, nil
+}
+
+// GetBundleInfo verifies the bundle, see VerifyBundle
+func (g *GIT) GetBundleInfo(bundleData []byte) (BundleInfo, error) {
+	return verifyBundle(g.tempDir, bundleData, g.commandTimeout)
+}
+
+// ObjectFormat returns the hash algorithm of the local repo, e.g. sha1 or sha256
+func (g *GIT) ObjectFormat() (string, error) {
+	out, err := g.runGit("failed to get object format of local repository", "-C", g.workDir, "rev-parse", "--show-object-format")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// UsesLFS returns whether the commit head of the local branch tracks files with Git LFS (filter=lfs in any
+// .gitattributes). Bundles of such branches only have the pointer files, not the content of the files
+func (g *GIT) UsesLFS(head plumbing.Hash) (bool, error) {
+	repo, ok, err := g.goGitRepo()
+	if err != nil {
+		return false, err
+	}
+	if ok {
+		lfs, err := usesLFSGoGit(repo, head)
+		return lfs, errors.Wrapf(err, "failed to check for Git LFS in repository %s", g.remoteRepo.URL)
+	}
+	_, err = g.runGit(fmt.Sprintf("failed to check for Git LFS in repository %s", g.remoteRepo.URL),
+		"-C", g.workDir, "grep", "--quiet", "-e", "filter=lfs", head.String(),
+		"--", ".gitattributes", "*/.gitattributes")
+	if err != nil {
+		// no match
+		if cmdErr, ok := err.(*CommandError); ok && cmdErr.ExitCode == 1 {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// VerifyBundleAgainstLocal verifies the bundle with git in the local repo, so a bundle whose prerequisites
+// the local repo lacks fails with ErrMissingPrerequisites (the missing commits are listed in the stderr of the
+// CommandError, see ParseMissingPrerequisites). Cheaper than a scratch clone, but the pack is not unpacked
+func (g *GIT) VerifyBundleAgainstLocal(bundleData []byte) (BundleInfo, error) {
+	dir, err := g.getRandomTempDir()
+	if err != nil {
+		return BundleInfo{}, errors.Wrap(err, "failed to create temp dir")
+	}
+	defer os.RemoveAll(dir)
+	tmpFile := filepath.Join(dir, "bundle")
+	if err := writeFile(tmpFile, bytes.NewReader(bundleData)); err != nil {
+		return BundleInfo{}, err
+	}
+
+	out, err := g.runGit(fmt.Sprintf("failed to verify bundle for repository %s and branch %s", g.remoteRepo.URL, g.remoteRepo.Branch),
+		"-C", g.workDir, "bundle", "verify", tmpFile)
+	if err != nil {
+		return BundleInfo{}, mapPrerequisitesError(err)
+	}
+	info := ParseBundleVerifyOutput(string(out))
+	info.IsOkay = true
+	return info, nil
+}
+
+// VerifyBundle verifies the bundle with git in an empty scratch repository in tempDir, without any remote.
+// The objects are unpacked, so a corrupt pack is detected. A partial bundle fails with ErrMissingPrerequisites,
+// since the prerequisites are not available
+func VerifyBundle(tempDir string, bundleData []byte) (BundleInfo, error) {
+	return verifyBundle(tempDir, bundleData, DefaultCommandTimeout)
+}
+
+// VerifyBundle, with git commands killed after timeout (0 for DefaultCommandTimeout)
+func verifyBundle(tempDir string, bundleData []byte, timeout time.Duration) (BundleInfo, error) {
+	if timeout == 0 {
+		timeout = DefaultCommandTimeout
+	}
+	if tempDir == "" {
+		return BundleInfo{}, errors.New("tempDir not set")
+	}
+	dir := filepath.Join(tempDir, generateRandomString())
+	if err := os.Mkdir(dir, tempDirPerm); err != nil {
+		return BundleInfo{}, errors.Wrap(err, "failed to create temp dir")
+	}
+	defer os.RemoveAll(dir)
+
+	tmpFile := filepath.Join(dir, "bundle")
+	if err := writeFile(tmpFile, bytes.NewReader(bundleData)); err != nil {
+		return BundleInfo{}, err
+	}
+	repoDir := filepath.Join(dir, "repo")
+	if _, err := runCommand(exec.Command("git", "init", "--bare", "--quiet", repoDir), timeout, "failed to init scratch repository"); err != nil {
+		return BundleInfo{}, err
+	}
+
+	// stdout does not include the final "is okay", which is only printed on success
+	out, err := runCommand(exec.Command("git", "-C", repoDir, "bundle", "verify", tmpFile), timeout, "failed to verify bundle")
+	if err != nil {
+		return BundleInfo{}, mapPrerequisitesError(err)
+	}
+	// verify only checks the header and prerequisites
+	if _, err := runCommand(exec.Command("git", "-C", repoDir, "bundle", "unbundle", tmpFile), timeout, "failed to unpack bundle"); err != nil {
+		return BundleInfo{}, err
+	}
+	info := ParseBundleVerifyOutput(string(out))
+	info.IsOkay = true
+	if err := info.Validate(); err != nil {
+		return info, err
+	}
+	return info, nil
+}
+
+type Head struct {
+	CommitID string `json:"commitId"`
+	Ref      string `json:"ref"`
+}
+
+// ParseBundleListHeadsOutput parses the lines of 'git bundle list-heads' as '<commit ID> <ref>'.
+// The commit ID ends at the first run of whitespace (spaces or tabs), the rest is the ref. Blank lines are skipped
+func ParseBundleListHeadsOutput(output string) ([]Head, error) {
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	var heads []Head
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		i := strings.IndexAny(line, " \t")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid line in bundle list-heads output: %s", line)
+		}
+		heads = append(heads, Head{CommitID: line[:i], Ref: strings.TrimLeft(line[i:], " \t")})
+	}
+	return heads, nil
+}
+
+// GetBundleListHeads returns the heads of the bundle, like 'git bundle list-heads'
+func (g *GIT) GetBundleListHeads(bundleData []byte) ([]Head, error) {
+	info, err := ParseBundleHeader(bundleData)
+	if err != nil {
+		return nil, err
+	}
+	return info.Heads, nil
+}
+
+// get the commit the local branch points to. Returns the zero hash if the branch has no commits
+func (g *GIT) getLocalHead() (plumbing.Hash, error) {
+	localRepo, err := git.PlainOpen(g.workDir)
+	if err != nil {
+		return plumbing.ZeroHash, errors.Wrapf(err, "failed to open local repository %s for branch %s", g.remoteRepo.URL, g.remoteRepo.Branch)
+	}
+
+	ref, err := localRepo.Reference(plumbing.NewBranchReferenceName(g.remoteRepo.Branch), true)
+	if err != nil {
+		if errors.Is(err, plumbing.ErrReferenceNotFound) {
+			return plumbing.ZeroHash, nil
+		}
+		return plumbing.ZeroHash, errors.Wrapf(err, "failed to resolve branch %s for repository %s", g.remoteRepo.Branch, g.remoteRepo.URL)
+	}
+	return ref.Hash(), nil
+}
+
+// RemoteHead reads the head of the branch from the remote (like git ls-remote), without syncing the local clone.
+// Only for sha1 repositories, since go-git does not read sha256 refs.
+//
+// Returns ErrAuthFailed, ErrRepositoryNotFound, ErrBranchNotFound or ErrNoCommits for the respective conditions
+func (g *GIT) RemoteHead(ctx context.Context) (plumbing.Hash, error) {
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{Name: remoteName, URLs: []string{g.remoteRepo.URL}})
+	refs, err := remote.ListContext(ctx, &git.ListOptions{
+		Auth:          g.getAuth(),
+		ProxyOptions:  g.proxyOptions(),
+		PeelingOption: git.IgnorePeeled})
+	if err != nil {
+		switch {
+		case errors.Is(err, transport.ErrEmptyRemoteRepository):
+			return plumbing.ZeroHash, ErrNoCommits
+		case errors.Is(err, transport.ErrRepositoryNotFound):
+			return plumbing.ZeroHash, ErrRepositoryNotFound
+		case errors.Is(err, transport.ErrAuthenticationRequired), errors.Is(err, transport.ErrAuthorizationFailed):
+			return plumbing.ZeroHash, ErrAuthFailed
+		}
+		return plumbing.ZeroHash, errors.Wrapf(err, "failed to list refs of repository %s", g.remoteRepo.URL)
+	}
+
+	branch := plumbing.NewBranchReferenceName(g.remoteRepo.Branch)
+	for _, ref := range refs {
+		if ref.Name() == branch && ref.Type() == plumbing.HashReference {
+			return ref.Hash(), nil
+		}
+	}
+	return plumbing.ZeroHash, errors.Wrapf(ErrBranchNotFound, "branch %s in repository %s", g.remoteRepo.Branch, g.remoteRepo.URL)
+}
+
+// runs git with the given args. Returns stdout, or a CommandError with msg on failure
+func (g *GIT) runGit(msg string, args ...string) ([]byte, error) {
+	return runCommand(g.command(args...), g.commandTimeout, msg)
+}
+
+// maximum stderr of a command kept for diagnostics. The rest is discarded
+const maxStdErrBytes = 1 << 20
+
+// how long to wait for the output of a killed command to be closed, e.g. by its child processes
+const killWaitDelay = 5 * time.Second
+
+// runs the command in the C locale, so the output parsed is in English. The command is killed if it does not
+// complete within timeout (0 for no limit). Returns stdout, or a CommandError with msg on failure
+func runCommand(cmd *exec.Cmd, timeout time.Duration, msg string) ([]byte, error) {
+	return runCommandContext(context.Background(), cmd, timeout, msg)
+}
+
+// runCommand, also killing the command when ctx is done. The CommandError then wraps the error of ctx
+func runCommandContext(ctx context.Context, cmd *exec.Cmd, timeout time.Duration, msg string) ([]byte, error) {
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	// later entries take precedence
+	cmd.Env = append(cmd.Env, "LC_ALL=C", "LANG=C")
+	stdout := &bytes.Buffer{}
+	stderr := &limitedBuffer{max: maxStdErrBytes}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.WaitDelay = killWaitDelay
+	if err := cmd.Start(); err != nil {
+		return nil, &CommandError{Message: msg, Err: err, ExitCode: -1}
+	}
+
+	var timedOut atomic.Bool
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			timedOut.Store(true)
+			_ = cmd.Process.Kill()
+		})
+		defer timer.Stop()
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = cmd.Process.Kill()
+	})
+	defer stop()
+	if err := cmd.Wait(); err != nil {
+		exitCode := -1
+		if cmd.ProcessState != nil {
+			exitCode = cmd.ProcessState.ExitCode()
+		}
+		cmdErr := &CommandError{
+			Message:  msg,
+			Err:      err,
+			StdErr:   stderr.String(),
+			ExitCode: exitCode}
+		if timedOut.Load() {
+			cmdErr.Timeout = true
+			cmdErr.Err = fmt.Errorf("killed after %s: %w", timeout, err)
+		} else if ctx.Err() != nil {
+			cmdErr.Err = fmt.Errorf("%w: %w", ctx.Err(), err)
+		}
+		return nil, cmdErr
+	}
+	return stdout.Bytes(), nil
+}
+
+// buffer keeping at most max bytes. Writes beyond are discarded, without failing the writer
+type limitedBuffer struct {
+	buf bytes.Buffer
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.buf.Len(); room < len(p) {
+		b.buf.Write(p[:max(room, 0)])
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (b *limitedBuffer) String() string {
+	return b.buf.String()
+}
+
+// permissions of temp dirs and bundle files, only accessible by the user running git_sync (and git)
+const (
+	tempDirPerm  = 0700
+	tempFilePerm = 0600
+)
+
+func writeFile(name string, r io.Reader) error {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY, tempFilePerm)
+	if err != nil {
+		return errors.Wrap(err, "failed to create temp file for bundle")
+	}
+	defer f.Close()
+	_, err = io.Copy(f, r)
+	if err != nil {
+		return errors.Wrap(err, "failed to write bundle to temp file")
+	}
+	return nil
+}
+
+// the temp dir of the repository, if set, otherwise tempDir
+func repoTempDir(tempDir string, repo RemoteRepo) string {
+	if repo.TempDir != "" {
+		return repo.TempDir
+	}
+	return tempDir
+}
+
+// work dir of the local clone, named by the repository (for readability) and a hash of the URL and branch.
+// The separator is not allowed in URLs nor branches, so distinct pairs get distinct hashes
+func getWorkDir(tempDir, remoteURL, branch string) string {
+	sum := sha256.Sum256([]byte(remoteURL + "\x00" + branch))
+	hash := hex.EncodeToString(sum[:16])
+	if name := workDirName(remoteURL); name != "" {
+		return filepath.Join(tempDir, name+"-"+hash)
+	}
+	return filepath.Join(tempDir, hash)
+}
+
+// max length of the repository name in work dirs
+const workDirNameMaxLength = 32
+
+// the repository name of the URL, e.g. "repo" for "https://host/owner/repo.git", restricted to safe characters
+func repoName(remoteURL string) string {
+	name := strings.TrimSuffix(strings.TrimRight(remoteURL, "/"), ".git")
+	if i := strings.LastIndexAny(name, "/:"); i >= 0 {
+		name = name[i+1:]
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
+
+// the repository name of the URL, truncated
+func workDirName(remoteURL string) string {
+	name := repoName(remoteURL)
+	if len(name) > workDirNameMaxLength {
+		name = name[:workDirNameMaxLength]
+	}
+	return name
+}
+
+// creates a random temp dir. Must be cleaned up by caller
+func (g *GIT) getRandomTempDir() (string, error) {
+	if g.tempDir == "" {
+		return "", errors.New("tempDir not set")
+	}
+	dir := filepath.Join(g.tempDir, generateRandomString())
+	return dir, os.Mkdir(dir, tempDirPerm)
+}
+
+func (g *GIT) getWorktree() (*git.Worktree, error) {
+	localRepo, err := git.PlainOpen(g.workDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open local repository %s for branch %s", g.remoteRepo.URL, g.remoteRepo.Branch)
+	}
+
+	w, err := localRepo.Worktree()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get worktree for local repository %s for branch %s", g.remoteRepo.URL, g.remoteRepo.Branch)
+	}
+	return w, nil
+}
+
+// proxy for the remote. Empty for a direct connection
+func (g *GIT) proxyOptions() transport.ProxyOptions {
+	return g.proxy.options(g.remoteRepo.URL)
+}
+
+// auth for the remote. Anonymous (nil) when no token is set, e.g. for public repositories
 func (g *GIT) getAuth() http.AuthMethod {
+	if g.remoteRepo.Token == "" {
+		return nil
+	}
 	return &http.BasicAuth{
 		Username: "not_used", // must not be empty
 		Password: g.remoteRepo.Token}
@@ -1,57 +1,1204 @@
 package git_sync
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/bredtape/git_sync/testdata"
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
-const user = "sync"
-const password = "computer"
-const baseURL = "http://localhost:3000"
+// create an empty bare repository in a temp dir, as a file:// remote with branch main.
+// Exercises clone, pull and push like a hosted remote, without any server running
+func setupLocalBareRemote(t *testing.T) RemoteRepo {
+	t.Helper()
 
-func TestCreateRepoAndPushSomeCommits(t *testing.T) {
-	branch := "main"
+	dir := filepath.Join(t.TempDir(), "remote.git")
+	out, err := exec.Command("git", "init", "--bare", "--quiet", "--initial-branch=main", dir).CombinedOutput()
+	if err != nil {
+		t.Fatalf("failed to create bare repository: %v: %s", err, out)
+	}
+	return RemoteRepo{URL: "file://" + filepath.ToSlash(dir), Branch: "main"}
+}
+
+// a remote that is never contacted, for tests that only use the local repository or are rejected
+// before any git work. Connections are refused, if it is contacted anyway
+func unusedRemote(branch string) RemoteRepo {
+	return RemoteRepo{URL: "http://localhost:1/not_used", Branch: branch, Token: "not_used"}
+}
+
+// GIT of a local repository in a temp dir, without a remote (see unusedRemote)
+func newLocalGIT(t *testing.T, branch string) *GIT {
+	t.Helper()
 
-	gogsAdmin := NewGogsAdmin(user, password, baseURL)
-	repo, err := gogsAdmin.CreateRandomRepo(branch)
+	g, err := NewGIT(t.TempDir(), unusedRemote(branch))
 	if err != nil {
 		t.Fatal(err)
 	}
+	return g
+}
 
-	t.Logf("Created repository, cloneURL=%s, branch=%s", repo.URL, repo.Branch)
+func TestCreateRepoAndPushSomeCommits(t *testing.T) {
+	repo := setupLocalBareRemote(t)
 
 	g, err := NewGIT(t.TempDir(), repo)
 	if err != nil {
 		t.Fatal(err)
 	}
-	worktree, err := g.SyncRepoToLocalTemp()
+	worktree, mode, err := g.SyncRepoToLocalTemp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode != SyncModeClone {
+		t.Errorf("expected sync mode %s for a new local clone, got %s", SyncModeClone, mode)
+	}
+
+	head := commitAt(t, g, worktree, time.Date(2025, 2, 13, 0, 0, 0, 0, time.UTC))
+	err = g.PushLocalToRemote()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// another clone sees the pushed commit
+	other, err := NewGIT(t.TempDir(), repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := other.SyncRepoToLocalTemp(); err != nil {
+		t.Fatal(err)
+	}
+	actual, err := other.getLocalHead()
 	if err != nil {
 		t.Fatal(err)
 	}
+	if actual != head {
+		t.Errorf("expected pushed head %s, got %s", head, actual)
+	}
+}
 
-	filename := filepath.Join(g.workDir, "example.txt")
-	err = os.WriteFile(filename, []byte("hello world!"), 0644)
+func TestGetLocalCommitsMatchesBundle(t *testing.T) {
+	g := newLocalGIT(t, "main")
+	_, err := g.initLocal()
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	err = g.ApplyBundleToLocal(bytes.NewReader(testdata.FullBundle))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	head, err := g.getLocalHead()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// commits in testdata/full.bundle, newest first
+	expected := []string{"f8be008f3733c1a9b7962c1f5a50679266565e31", "ea29764e79de2eaaddbeabd9ee967852912cb52e"}
+	if head.String() != expected[0] {
+		t.Fatalf("expected head %s, got %s", expected[0], head)
+	}
+
+	commits, err := g.GetLocalCommits(plumbing.ZeroHash, head, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) != len(expected) {
+		t.Fatalf("expected %d commits, got %v", len(expected), commits)
+	}
+	for i, c := range commits {
+		if c.ID != expected[i] {
+			t.Errorf("expected commit %d to be %s, got %s", i, expected[i], c.ID)
+		}
+	}
+	if commits[0].Subject != "another.txt" || commits[0].Author != "sync <sync@domain.com>" {
+		t.Errorf("unexpected subject/author of commit %v", commits[0])
+	}
+
+	// as introduced by testdata/last.bundle
+	commits, err = g.GetLocalCommits(plumbing.NewHash(expected[1]), head, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) != 1 || commits[0].ID != expected[0] {
+		t.Errorf("expected only commit %s, got %v", expected[0], commits)
+	}
+
+	count, err := g.CountLocalCommits(plumbing.NewHash(expected[1]), head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("expected 1 commit added, got %d", count)
+	}
+	count, err = g.CountLocalCommits(plumbing.ZeroHash, head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(expected) {
+		t.Errorf("expected %d commits, got %d", len(expected), count)
+	}
+
+	// capped
+	commits, err = g.GetLocalCommits(plumbing.ZeroHash, head, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) != 1 {
+		t.Errorf("expected 1 commit, got %v", commits)
+	}
+}
+
+func TestGetChunksReconstructsHistory(t *testing.T) {
+	g := newLocalGIT(t, "main")
+	worktree, err := g.initLocal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2 commits on day 1, none on day 2, 1 on day 3 and 2 on day 4
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, offset := range []time.Duration{0, time.Hour, 48 * time.Hour, 72 * time.Hour, 73 * time.Hour} {
+		commitAt(t, g, worktree, start.Add(offset))
+	}
+
+	chunks, err := g.GetChunks(24 * time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 3 {
+		t.Fatalf("expected 3 chunks, got %v", chunks)
+	}
+	if chunks[0].From != "" {
+		t.Errorf("expected first chunk to be complete, got from %s", chunks[0].From)
+	}
+
+	// apply chunks in order to an empty repo
+	target := newLocalGIT(t, "main")
+	_, err = target.initLocal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, chunk := range chunks {
+		if i > 0 && chunk.From != chunks[i-1].To {
+			t.Errorf("chunk %d does not continue from the previous chunk", i)
+		}
+		data, err := g.CreateBundleFromLocal(chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = target.ApplyBundleToLocal(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("failed to apply chunk %d: %v", i, err)
+		}
+	}
+
+	head, err := g.getLocalHead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	targetHead, err := target.getLocalHead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head != targetHead {
+		t.Fatalf("expected head %s after applying chunks, got %s", head, targetHead)
+	}
+
+	commits, err := target.GetLocalCommits(plumbing.ZeroHash, targetHead, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) != 5 {
+		t.Errorf("expected 5 commits, got %d", len(commits))
+	}
+}
+
+func TestApplyBundleToLocal(t *testing.T) {
+	source := newLocalGIT(t, "main")
+	worktree, err := source.initLocal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := newLocalGIT(t, "main")
+	targetWorktree, err := target.initLocal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// apply the full bundle of the source to the target, and return the head of the target
+	apply := func(t *testing.T) (plumbing.Hash, error) {
+		t.Helper()
+		data, err := source.CreateBundleFromLocal(BundleOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = target.ApplyBundleToLocal(bytes.NewReader(data))
+		head, headErr := target.getLocalHead()
+		if headErr != nil {
+			t.Fatal(headErr)
+		}
+		return head, err
+	}
+
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	commitAt(t, source, worktree, start)
+	sourceHead := commitAt(t, source, worktree, start.Add(time.Hour))
+
+	t.Run("fast-forward", func(t *testing.T) {
+		head, err := apply(t)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if head != sourceHead {
+			t.Errorf("expected head %s, got %s", sourceHead, head)
+		}
+	})
+
+	t.Run("up to date", func(t *testing.T) {
+		head, err := apply(t)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if head != sourceHead {
+			t.Errorf("expected head %s, got %s", sourceHead, head)
+		}
+	})
+
+	t.Run("stale", func(t *testing.T) {
+		stale, err := source.CreateBundleFromLocal(BundleOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		newer := commitAt(t, source, worktree, start.Add(90*time.Minute))
+		if head, err := apply(t); err != nil || head != newer {
+			t.Fatalf("expected head %s, got %s: %v", newer, head, err)
+		}
+
+		inspection, err := target.InspectBundleInScratch(bytes.NewReader(stale), 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inspection.Head != newer || len(inspection.Commits) != 0 {
+			t.Errorf("expected head %s without commits, got %s with %d commits", newer, inspection.Head, len(inspection.Commits))
+		}
+		if err := target.ApplyBundleToLocal(bytes.NewReader(stale)); err != nil {
+			t.Fatalf("expected stale bundle to be a no-op, got %v", err)
+		}
+		head, err := target.getLocalHead()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if head != newer {
+			t.Errorf("expected head %s to be kept, got %s", newer, head)
+		}
+	})
+
+	t.Run("not fast-forward", func(t *testing.T) {
+		diverged := commitAt(t, target, targetWorktree, start.Add(2*time.Hour))
+		commitAt(t, source, worktree, start.Add(3*time.Hour))
+
+		head, err := apply(t)
+		if !errors.Is(err, ErrNotFastForward) {
+			t.Fatalf("expected ErrNotFastForward, got %v", err)
+		}
+		if head != diverged {
+			t.Errorf("expected head %s to be kept, got %s", diverged, head)
+		}
+	})
+}
+
+func TestApplyBundleToLocalMerge(t *testing.T) {
+	source := newLocalGIT(t, "main")
+	worktree, err := source.initLocal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := newLocalGIT(t, "main")
+	targetWorktree, err := target.initLocal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	target.SetIdentity(Identity{Name: "Sync Bot", Email: "bot@example.com"})
+	target.SetMergeMode(MergeModeMerge, "Merge from the field")
+
+	apply := func(t *testing.T) error {
+		t.Helper()
+		data, err := source.CreateBundleFromLocal(BundleOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return target.ApplyBundleToLocal(bytes.NewReader(data))
+	}
+	head := func(t *testing.T) plumbing.Hash {
+		t.Helper()
+		head, err := target.getLocalHead()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return head
+	}
+
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	commitAt(t, source, worktree, start)
+	if err := apply(t); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("merge commit", func(t *testing.T) {
+		// diverged, by another file than the bundle
+		err := os.WriteFile(filepath.Join(target.workDir, "other.txt"), []byte("other"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := targetWorktree.Add("other.txt"); err != nil {
+			t.Fatal(err)
+		}
+		sig := &object.Signature{Name: "test", Email: "test@localhost", When: start.Add(time.Hour)}
+		local, err := targetWorktree.Commit("other", &git.CommitOptions{Author: sig, Committer: sig})
+		if err != nil {
+			t.Fatal(err)
+		}
+		bundled := commitAt(t, source, worktree, start.Add(2*time.Hour))
+
+		if err := apply(t); err != nil {
+			t.Fatal(err)
+		}
+		out, err := exec.Command("git", "-C", target.workDir, "log", "-1", "--format=%P|%an <%ae>|%s").Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := fmt.Sprintf("%s %s|Sync Bot <bot@example.com>|Merge from the field", local, bundled)
+		if actual := strings.TrimSpace(string(out)); actual != expected {
+			t.Errorf("expected merge commit '%s', got '%s'", expected, actual)
+		}
+	})
+
+	t.Run("conflict", func(t *testing.T) {
+		before := commitAt(t, target, targetWorktree, start.Add(3*time.Hour))
+		commitAt(t, source, worktree, start.Add(4*time.Hour))
+
+		if err := apply(t); !errors.Is(err, ErrMergeConflict) {
+			t.Fatalf("expected ErrMergeConflict, got %v", err)
+		}
+		if actual := head(t); actual != before {
+			t.Errorf("expected head %s to be kept, got %s", before, actual)
+		}
+		out, err := exec.Command("git", "-C", target.workDir, "status", "--porcelain").Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out) != 0 {
+			t.Errorf("expected the merge to be aborted, got status %s", out)
+		}
+	})
+}
+
+func commitAt(t *testing.T, g *GIT, worktree *git.Worktree, when time.Time) plumbing.Hash {
+	t.Helper()
+
+	err := os.WriteFile(filepath.Join(g.workDir, "example.txt"), []byte(when.String()), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
 	_, err = worktree.Add("example.txt")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	_, err = worktree.Commit("Initial commit", &git.CommitOptions{})
+	sig := &object.Signature{Name: "test", Email: "test@localhost", When: when}
+	hash, err := worktree.Commit("commit at "+when.String(), &git.CommitOptions{Author: sig, Committer: sig})
 	if err != nil {
 		t.Fatal(err)
 	}
+	return hash
+}
 
-	err = g.PushLocalToRemote()
+func TestInspectBundleInScratchLeavesLocalUntouched(t *testing.T) {
+	g := newLocalGIT(t, "main")
+	_, err := g.initLocal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inspection, err := g.InspectBundleInScratch(bytes.NewReader(testdata.FullBundle), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inspection.Head.String() != "f8be008f3733c1a9b7962c1f5a50679266565e31" {
+		t.Errorf("unexpected head %s", inspection.Head)
+	}
+	if inspection.HeadTime.IsZero() || inspection.HeadTime.After(time.Now()) {
+		t.Errorf("unexpected head time %s", inspection.HeadTime)
+	}
+	if len(inspection.Commits) != 2 || inspection.Commits[0].ID != inspection.Head.String() {
+		t.Errorf("unexpected commits %v", inspection.Commits)
+	}
+
+	hasCommits, err := g.hasLocalCommits()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hasCommits {
+		t.Fatal("expected local repo to be untouched")
+	}
+
+	// the partial bundle requires the commits of the full bundle
+	_, err = g.InspectBundleInScratch(bytes.NewReader(testdata.LastBundle), 10)
+	if !errors.Is(mapPrerequisitesError(err), ErrMissingPrerequisites) {
+		t.Fatalf("expected missing prerequisites, got %v", err)
+	}
+}
+
+func TestVerifyBundleAgainstLocal(t *testing.T) {
+	g := newLocalGIT(t, "main")
+	_, err := g.initLocal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = g.VerifyBundleAgainstLocal(testdata.LastBundle)
+	if !errors.Is(err, ErrMissingPrerequisites) {
+		t.Fatalf("expected ErrMissingPrerequisites, got %v", err)
+	}
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) {
+		t.Fatalf("expected CommandError, got %v", err)
+	}
+	header, err := ParseBundleHeader(testdata.LastBundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := ParseMissingPrerequisites(cmdErr.StdErr); !reflect.DeepEqual(actual, header.Prerequisites) {
+		t.Errorf("expected missing prerequisites %v, got %v", header.Prerequisites, actual)
+	}
+
+	if err := g.ApplyBundleToLocal(bytes.NewReader(testdata.FullBundle)); err != nil {
+		t.Fatal(err)
+	}
+	info, err := g.VerifyBundleAgainstLocal(testdata.LastBundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsOkay || info.IsComplete {
+		t.Errorf("expected a verified partial bundle, got %+v", info)
+	}
+}
+
+func TestHasLocalCommitsBranchPointsToTree(t *testing.T) {
+	g := newLocalGIT(t, "main")
+	_, err := g.initLocal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = g.ApplyBundleToLocal(bytes.NewReader(testdata.FullBundle))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err := git.PlainOpen(g.workDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := g.getLocalHead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := repo.CommitObject(head)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// point the branch at the tree of the head commit
+	err = repo.Storer.SetReference(plumbing.NewHashReference(plumbing.NewBranchReferenceName("main"), commit.TreeHash))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = g.hasLocalCommits()
+	if !errors.Is(err, ErrBranchNotCommit) {
+		t.Fatalf("expected ErrBranchNotCommit, got %v", err)
+	}
+}
+
+func TestCreateBundleAfterWithOffset(t *testing.T) {
+	g := newLocalGIT(t, "main")
+	worktree, err := g.initLocal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Date(2025, 2, 13, 0, 0, 0, 0, time.UTC)
+	first := commitAt(t, g, worktree, base.Add(8*time.Hour))
+	second := commitAt(t, g, worktree, base.Add(10*time.Hour))
+
+	// 11:00+02:00 is 09:00Z, between the two commits
+	after, err := time.Parse(time.RFC3339, "2025-02-13T11:00:00+02:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bundleData, err := g.CreateBundleFromLocal(BundleOptions{After: after})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := ParseBundleHeader(bundleData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.RequiresRef != first.String() || info.Heads[0].CommitID != second.String() {
+		t.Errorf("expected bundle of %s with prerequisite %s, got %+v", second, first, info)
+	}
+}
+
+func TestCreateBundleEmptyFailureMetric(t *testing.T) {
+	g := newLocalGIT(t, "main")
+	worktree, err := g.initLocal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitAt(t, g, worktree, time.Date(2025, 2, 13, 0, 0, 0, 0, time.UTC))
+
+	empty := metricBundleCreateFailures.WithLabelValues(bundleFailureEmpty)
+	other := metricBundleCreateFailures.WithLabelValues(bundleFailureOther)
+	emptyBefore, otherBefore := testutil.ToFloat64(empty), testutil.ToFloat64(other)
+
+	_, err = g.CreateBundleFromLocal(BundleOptions{After: time.Date(2025, 2, 14, 0, 0, 0, 0, time.UTC)})
+	if err == nil {
+		t.Fatal("expected empty bundle to be refused")
+	}
+	if delta := testutil.ToFloat64(empty) - emptyBefore; delta != 1 {
+		t.Errorf("expected %s failures to increment by 1, got %v", bundleFailureEmpty, delta)
+	}
+	if delta := testutil.ToFloat64(other) - otherBefore; delta != 0 {
+		t.Errorf("expected %s failures to be unchanged, got %v", bundleFailureOther, delta)
+	}
+}
+
+func TestBundleFailureCause(t *testing.T) {
+	tcs := map[string]struct {
+		err      *CommandError
+		expected string
+	}{
+		"empty":       {&CommandError{Err: errors.New("exit status 128"), StdErr: "fatal: Refusing to create empty bundle.\n", ExitCode: 128}, bundleFailureEmpty},
+		"git missing": {&CommandError{Err: &exec.Error{Name: "git", Err: exec.ErrNotFound}, ExitCode: -1}, bundleFailureGitMissing},
+		"disk":        {&CommandError{Err: errors.New("exit status 128"), StdErr: "fatal: sha1 file '<stdout>' write error: No space left on device\n", ExitCode: 128}, bundleFailureDisk},
+		"other":       {&CommandError{Err: errors.New("exit status 128"), StdErr: "fatal: bad revision\n", ExitCode: 128}, bundleFailureOther},
+	}
+	for name, tc := range tcs {
+		if actual := bundleFailureCause(tc.err); actual != tc.expected {
+			t.Errorf("%s: expected cause %s, got %s", name, tc.expected, actual)
+		}
+	}
+}
+
+func TestGitCommandsUseIdentity(t *testing.T) {
+	// no global git config
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+
+	tcs := map[string]struct {
+		identity Identity
+		expected string
+	}{
+		"default":    {Identity{}, "git-sync <git-sync@localhost>"},
+		"configured": {Identity{Name: "Sync Bot", Email: "bot@example.com"}, "Sync Bot <bot@example.com>"},
+	}
+	for name, tc := range tcs {
+		g := newLocalGIT(t, "main")
+		g.SetIdentity(tc.identity)
+		out, err := g.runGit("failed to get committer ident", "var", "GIT_COMMITTER_IDENT")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !strings.HasPrefix(string(out), tc.expected) {
+			t.Errorf("%s: expected committer '%s', got '%s'", name, tc.expected, out)
+		}
+	}
+}
+
+func TestCreateBundleDeterministic(t *testing.T) {
+	g := newLocalGIT(t, "main")
+	g.SetDeterministicBundles(true)
+	worktree, err := g.initLocal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Date(2025, 2, 13, 0, 0, 0, 0, time.UTC)
+	first := commitAt(t, g, worktree, base)
+	for i := 1; i < 10; i++ {
+		commitAt(t, g, worktree, base.Add(time.Duration(i)*time.Hour))
+	}
+
+	opts := map[string]BundleOptions{"full": {}, "partial": {From: first.String()}}
+	before := map[string][]byte{}
+	for name, opt := range opts {
+		before[name], err = g.CreateBundleFromLocal(opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// store the same objects differently
+	_, err = g.runGit("failed to repack", "-C", g.workDir, "repack", "-a", "-d", "-f", "--depth=3", "--window=5")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	t.Log("Pushed to remote repository")
+	for name, opt := range opts {
+		after, err := g.CreateBundleFromLocal(opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(before[name], after) {
+			t.Errorf("%s: expected identical bundles, got %d and %d bytes", name, len(before[name]), len(after))
+		}
+	}
+
+	// the repacked bundle applies
+	other := newLocalGIT(t, "main")
+	if _, err = other.initLocal(); err != nil {
+		t.Fatal(err)
+	}
+	inspection, err := other.InspectBundleInScratch(bytes.NewReader(before["full"]), 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inspection.Commits) != 10 {
+		t.Errorf("expected 10 commits in bundle, got %d", len(inspection.Commits))
+	}
+}
+
+func TestParseMissingPrerequisites(t *testing.T) {
+	stderr := "error: Repository lacks these prerequisite commits:\n" +
+		"error: ea29764e79de2eaaddbeabd9ee967852912cb52e \n" +
+		"error: f8be008f3733c1a9b7962c1f5a50679266565e31 second commit\n"
+	ids := ParseMissingPrerequisites(stderr)
+	if len(ids) != 2 || ids[0] != "ea29764e79de2eaaddbeabd9ee967852912cb52e" || ids[1] != "f8be008f3733c1a9b7962c1f5a50679266565e31" {
+		t.Errorf("unexpected prerequisites: %v", ids)
+	}
+
+	if ids := ParseMissingPrerequisites("fatal: not a bundle\n"); len(ids) != 0 {
+		t.Errorf("expected no prerequisites, got %v", ids)
+	}
+}
+
+func TestTempBundlePermissions(t *testing.T) {
+	g := newLocalGIT(t, "main")
+	dir, err := g.getRandomTempDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "bundle")
+	if err := writeFile(name, bytes.NewReader(testdata.FullBundle)); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, expected := range map[string]os.FileMode{dir: 0700 | os.ModeDir, name: 0600} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != expected {
+			t.Errorf("expected mode %s of %s, got %s", expected, path, info.Mode())
+		}
+	}
+
+	// git runs as the same user, and can still read the bundle
+	if out, err := exec.Command("git", "bundle", "list-heads", name).CombinedOutput(); err != nil {
+		t.Errorf("expected git to read the bundle: %v: %s", err, out)
+	}
+}
+
+func TestGetWorkDirDistinct(t *testing.T) {
+	pairs := [][2]string{
+		{"a", "bc"},
+		{"ab", "c"},
+		{"https://host/owner/repo.git", "main"},
+		{"https://host/owner/repo.git", "dev"},
+		{"https://host/other/repo.git", "main"},
+		{"https://host/owner/repo.git", AllBranches},
+		{"https://host/owner/repo.git" + strings.Repeat("x", 500), "main"},
+	}
+	seen := map[string][2]string{}
+	for _, p := range pairs {
+		dir := getWorkDir("/tmp", p[0], p[1])
+		if other, ok := seen[dir]; ok {
+			t.Errorf("work dir %s of %v collides with %v", dir, p, other)
+		}
+		seen[dir] = p
+		if name := filepath.Base(dir); len(name) > 100 {
+			t.Errorf("work dir name of %v is too long: %s", p, name)
+		}
+	}
+
+	if dir := getWorkDir("/tmp", "https://host/owner/repo.git", "main"); !strings.HasPrefix(filepath.Base(dir), "repo-") {
+		t.Errorf("expected work dir prefixed with the repository name, got %s", dir)
+	}
+}
+
+// put a fake git with the script first on PATH
+func fakeGit(t *testing.T, script string) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "git"), []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestRunGitTimeout(t *testing.T) {
+	fakeGit(t, "exec sleep 30")
+	g := newLocalGIT(t, "main")
+	g.SetCommandTimeout(100 * time.Millisecond)
+
+	start := time.Now()
+	_, err := g.ObjectFormat()
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) || !cmdErr.Timeout {
+		t.Fatalf("expected CommandError with timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the hanging git to be killed, took %s", elapsed)
+	}
+}
+
+func TestCreateBundleCancelled(t *testing.T) {
+	fakeGit(t, "exec sleep 30")
+	g := newLocalGIT(t, "main")
+	if _, err := g.initLocal(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := g.CreateBundleAt(ctx, plumbing.ZeroHash, BundleOptions{})
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected CommandError with context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the git command to be killed, took %s", elapsed)
+	}
+}
+
+func TestRunGitStdErrLimit(t *testing.T) {
+	fakeGit(t, "head -c 3000000 /dev/zero | tr '\\0' x >&2; exit 1")
+	g := newLocalGIT(t, "main")
+
+	_, err := g.ObjectFormat()
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) || cmdErr.Timeout || cmdErr.ExitCode != 1 {
+		t.Fatalf("expected CommandError with exit code 1, got %v", err)
+	}
+	if len(cmdErr.StdErr) != maxStdErrBytes {
+		t.Errorf("expected stderr truncated to %d bytes, got %d", maxStdErrBytes, len(cmdErr.StdErr))
+	}
+}
+
+func TestCreateBundleAtSnapshot(t *testing.T) {
+	g := newLocalGIT(t, "main")
+	worktree, err := g.initLocal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Date(2025, 2, 13, 0, 0, 0, 0, time.UTC)
+	first := commitAt(t, g, worktree, base.Add(8*time.Hour))
+	snapshot := commitAt(t, g, worktree, base.Add(9*time.Hour))
+	// a concurrent refresh moves the branch after the snapshot was taken
+	commitAt(t, g, worktree, base.Add(10*time.Hour))
+
+	for name, opt := range map[string]BundleOptions{"full": {}, "from": {From: first.String()}} {
+		t.Run(name, func(t *testing.T) {
+			bundleData, err := g.CreateBundleAt(context.Background(), snapshot, opt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			info, err := ParseBundleHeader(bundleData)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := Head{CommitID: snapshot.String(), Ref: "refs/heads/main"}
+			if len(info.Heads) != 1 || info.Heads[0] != expected {
+				t.Fatalf("expected head %+v, got %+v", expected, info.Heads)
+			}
+			commits, err := g.CountBundledCommits(info)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected := map[string]int{"full": 2, "from": 1}[name]; commits != expected {
+				t.Errorf("expected %d commits in bundle, got %d", expected, commits)
+			}
+		})
+	}
+}
+
+func TestCreateBundleMaxCommits(t *testing.T) {
+	g := newLocalGIT(t, "main")
+	worktree, err := g.initLocal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Date(2025, 2, 13, 0, 0, 0, 0, time.UTC)
+	first := commitAt(t, g, worktree, base.Add(8*time.Hour))
+	second := commitAt(t, g, worktree, base.Add(9*time.Hour))
+	third := commitAt(t, g, worktree, base.Add(10*time.Hour))
+
+	opt := BundleOptions{MaxCommits: 2}
+	bundleData, err := g.CreateBundleFromLocal(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := ParseBundleHeader(bundleData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.RequiresRef != first.String() || info.Heads[0].CommitID != third.String() {
+		t.Errorf("expected bundle of %s with prerequisite %s, got %+v", third, first, info)
+	}
+	commits, err := g.CountBundledCommits(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commits != 2 {
+		t.Errorf("expected 2 commits in bundle, got %d", commits)
+	}
+
+	oldest, err := g.OldestBundledCommit(third, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oldest != second.String() {
+		t.Errorf("expected oldest commit %s, got %s", second, oldest)
+	}
+}
+
+func TestInitLocalHeadIsUnbornBranch(t *testing.T) {
+	g := newLocalGIT(t, "feature")
+	worktree, err := g.initLocal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err := git.PlainOpen(g.workDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := repo.Storer.Reference(plumbing.HEAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Type() != plumbing.SymbolicReference || head.Target() != plumbing.NewBranchReferenceName("feature") {
+		t.Errorf("expected HEAD to point to refs/heads/feature, got %s", head)
+	}
+
+	// the first commit is on the branch
+	hash := commitAt(t, g, worktree, time.Date(2025, 2, 13, 0, 0, 0, 0, time.UTC))
+	ref, err := repo.Reference(plumbing.NewBranchReferenceName("feature"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.Hash() != hash {
+		t.Errorf("expected branch at %s, got %s", hash, ref.Hash())
+	}
+}
+
+func TestParseBundleVerifyOutputTolerant(t *testing.T) {
+	output := "  the bundle contains this ref:\r\n" +
+		"f8be008f3733c1a9b7962c1f5a50679266565e31 refs/heads/main  \n" +
+		"\n" +
+		"The Bundle Records A Complete History\n" +
+		"The bundle uses this hash algorithm:  sha1 \n" +
+		"/tmp/bundle is OKAY\n"
+	info := ParseBundleVerifyOutput(output)
+	expected := BundleInfo{
+		ContainsRef:   "f8be008f3733c1a9b7962c1f5a50679266565e31 refs/heads/main",
+		IsComplete:    true,
+		HashAlgorithm: "sha1",
+		IsOkay:        true}
+	if !reflect.DeepEqual(info, expected) {
+		t.Errorf("expected %+v, got %+v", expected, info)
+	}
+}
+
+// git output is parsed, so it must not be translated
+func TestVerifyBundleIgnoresLocale(t *testing.T) {
+	t.Setenv("LC_ALL", "de_DE.UTF-8")
+	t.Setenv("LANG", "de_DE.UTF-8")
+	t.Setenv("LANGUAGE", "de")
+
+	out, err := runCommand(exec.Command("sh", "-c", "echo $LC_ALL $LANG"), 0, "failed to print locale")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := strings.TrimSpace(string(out)); actual != "C C" {
+		t.Errorf("expected C locale, got '%s'", actual)
+	}
+
+	full, _ := createTestBundles(t)
+	info, err := VerifyBundle(t.TempDir(), full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsComplete || !info.IsOkay || info.HashAlgorithm != "sha1" || info.ContainsRef == "" {
+		t.Errorf("expected complete, okay bundle, got %+v", info)
+	}
+}
+
+func TestParseBundleListHeadsOutput(t *testing.T) {
+	expected := []Head{
+		{CommitID: "f8be008f3733c1a9b7962c1f5a50679266565e31", Ref: "refs/heads/dev"},
+		{CommitID: "ea29764e79de2eaaddbeabd9ee967852912cb52e", Ref: "refs/heads/main"}}
+
+	cases := map[string]string{
+		"space separated":  "f8be008f3733c1a9b7962c1f5a50679266565e31 refs/heads/dev\nea29764e79de2eaaddbeabd9ee967852912cb52e refs/heads/main",
+		"tab separated":    "f8be008f3733c1a9b7962c1f5a50679266565e31\trefs/heads/dev\nea29764e79de2eaaddbeabd9ee967852912cb52e\trefs/heads/main",
+		"trailing newline": "f8be008f3733c1a9b7962c1f5a50679266565e31 refs/heads/dev\nea29764e79de2eaaddbeabd9ee967852912cb52e refs/heads/main\n",
+		"extra whitespace": "f8be008f3733c1a9b7962c1f5a50679266565e31  \t refs/heads/dev  \n\n  ea29764e79de2eaaddbeabd9ee967852912cb52e refs/heads/main\t\n\n"}
+	for name, output := range cases {
+		t.Run(name, func(t *testing.T) {
+			heads, err := ParseBundleListHeadsOutput(output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(heads, expected) {
+				t.Errorf("expected %+v, got %+v", expected, heads)
+			}
+		})
+	}
+
+	t.Run("ref with space", func(t *testing.T) {
+		heads, err := ParseBundleListHeadsOutput("f8be008f3733c1a9b7962c1f5a50679266565e31 refs/heads/a b\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(heads) != 1 || heads[0].Ref != "refs/heads/a b" {
+			t.Errorf("expected ref 'refs/heads/a b', got %+v", heads)
+		}
+	})
+
+	t.Run("missing ref", func(t *testing.T) {
+		if _, err := ParseBundleListHeadsOutput("f8be008f3733c1a9b7962c1f5a50679266565e31\n"); err == nil {
+			t.Error("expected error for line without ref")
+		}
+	})
+}
+
+func TestParseBundleVerifyOutput(t *testing.T) {
+	tcs := map[string]struct {
+		output   string
+		expected BundleInfo
+	}{
+		"single refs": {
+			output: `The bundle contains this ref:
+ea29764e79de2eaaddbeabd9ee967852912cb52e refs/heads/main
+The bundle requires this ref:
+a0eb92d5290aa86a74ba96e6dfe0663b604e8386
+The bundle uses this hash algorithm: sha1`,
+			expected: BundleInfo{
+				ContainsRef:   "ea29764e79de2eaaddbeabd9ee967852912cb52e refs/heads/main",
+				RequiresRef:   "a0eb92d5290aa86a74ba96e6dfe0663b604e8386",
+				HashAlgorithm: "sha1"}},
+		"ref lists": {
+			output: `The bundle contains these 2 refs:
+f8be008f3733c1a9b7962c1f5a50679266565e31 refs/heads/dev
+ea29764e79de2eaaddbeabd9ee967852912cb52e refs/heads/main
+The bundle requires these 2 refs:
+a0eb92d5290aa86a74ba96e6dfe0663b604e8386
+b1fc03e6301bb97b85cb07f7f0674c715f9497a7
+The bundle uses this hash algorithm: sha1
+bundle is okay`,
+			// the first ref of each list
+			expected: BundleInfo{
+				ContainsRef:   "f8be008f3733c1a9b7962c1f5a50679266565e31 refs/heads/dev",
+				RequiresRef:   "a0eb92d5290aa86a74ba96e6dfe0663b604e8386",
+				HashAlgorithm: "sha1",
+				IsOkay:        true}},
+		"complete": {
+			output: `The bundle contains this ref:
+ea29764e79de2eaaddbeabd9ee967852912cb52e refs/heads/main
+The bundle records a complete history.
+The bundle uses this hash algorithm: sha256`,
+			expected: BundleInfo{
+				ContainsRef:   "ea29764e79de2eaaddbeabd9ee967852912cb52e refs/heads/main",
+				IsComplete:    true,
+				HashAlgorithm: "sha256"}},
+	}
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			info := ParseBundleVerifyOutput(tc.output)
+			if !reflect.DeepEqual(info, tc.expected) {
+				t.Errorf("expected %+v, got %+v", tc.expected, info)
+			}
+		})
+	}
+}
+
+func TestBundleInfoValidate(t *testing.T) {
+	const ref = "f8be008f3733c1a9b7962c1f5a50679266565e31 refs/heads/main"
+	const required = "a0eb92d5290aa86a74ba96e6dfe0663b604e8386"
+	tcs := map[string]struct {
+		info  BundleInfo
+		valid bool
+	}{
+		"complete":               {BundleInfo{IsOkay: true, ContainsRef: ref, IsComplete: true, HashAlgorithm: "sha1"}, true},
+		"partial with required":  {BundleInfo{IsOkay: true, ContainsRef: ref, RequiresRef: required, HashAlgorithm: "sha1"}, true},
+		"partial, none required": {BundleInfo{IsOkay: true, ContainsRef: ref, HashAlgorithm: "sha1"}, false},
+		"not okay":               {BundleInfo{ContainsRef: ref, IsComplete: true, HashAlgorithm: "sha1"}, false},
+		"no ref":                 {BundleInfo{IsOkay: true, IsComplete: true, HashAlgorithm: "sha1"}, false},
+		"no hash algorithm":      {BundleInfo{IsOkay: true, ContainsRef: ref, IsComplete: true}, false},
+	}
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			err := tc.info.Validate()
+			if tc.valid && err != nil {
+				t.Errorf("expected valid, got %v", err)
+			}
+			if !tc.valid && err == nil {
+				t.Error("expected invalid")
+			}
+		})
+	}
+}
+
+func TestRemoteHead(t *testing.T) {
+	repo := setupLocalBareRemote(t)
+	ctx := context.Background()
+
+	g, err := NewGIT(t.TempDir(), repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.RemoteHead(ctx); !errors.Is(err, ErrNoCommits) {
+		t.Fatalf("expected ErrNoCommits for an empty remote, got %v", err)
+	}
+
+	if _, err := Push(ctx, t.TempDir(), repo, bytes.NewReader(testdata.FullBundle)); err != nil {
+		t.Fatal(err)
+	}
+	head, err := g.RemoteHead(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.String() != "f8be008f3733c1a9b7962c1f5a50679266565e31" {
+		t.Errorf("unexpected head %s", head)
+	}
+	if exists, err := g.ExistsLocal(); err != nil || exists {
+		t.Errorf("expected no local clone, got %v", err)
+	}
+
+	other, err := NewGIT(t.TempDir(), RemoteRepo{URL: repo.URL, Branch: "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.RemoteHead(ctx); !errors.Is(err, ErrBranchNotFound) {
+		t.Errorf("expected ErrBranchNotFound, got %v", err)
+	}
+}
+
+func TestMaxCloneAge(t *testing.T) {
+	repo := setupLocalBareRemote(t)
+	g, err := NewGIT(t.TempDir(), repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	worktree, _, err := g.SyncRepoToLocalTemp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitAt(t, g, worktree, time.Date(2025, 2, 13, 0, 0, 0, 0, time.UTC))
+	if err := g.PushLocalToRemote(); err != nil {
+		t.Fatal(err)
+	}
+	g.SetMaxCloneAge(time.Hour)
+
+	sync := func(expected SyncMode) {
+		t.Helper()
+		_, mode, err := g.SyncRepoToLocalTemp()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode != expected {
+			t.Errorf("expected sync mode %s, got %s", expected, mode)
+		}
+	}
+	sync(SyncModePull)
+
+	marker := filepath.Join(g.workDir, ".git", clonedAtFile)
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(marker, old, old); err != nil {
+		t.Fatal(err)
+	}
+	sync(SyncModeClone)
+	sync(SyncModePull)
+
+	// a clone without the time of the clone is not re-cloned, but marked
+	if err := os.Remove(marker); err != nil {
+		t.Fatal(err)
+	}
+	sync(SyncModePull)
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("expected the time of the clone to be recorded: %v", err)
+	}
+}
+
+// a force push to a branch without commits only creates the branch, so a branch created in the remote after
+// the sync is not overwritten
+func TestForcePushLocalToRemoteCreateOnly(t *testing.T) {
+	repo := setupLocalBareRemote(t)
+	g, err := NewGIT(t.TempDir(), repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := g.SyncRepoToLocalTemp(); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.ResetLocalToBundle(bytes.NewReader(testdata.FullBundle)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the branch is created in the remote meanwhile
+	work := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "--quiet", "--initial-branch=main", work},
+		{"-C", work, "-c", "user.name=test", "-c", "user.email=test@localhost", "commit", "--quiet", "--allow-empty", "-m", "concurrent"},
+		{"-C", work, "push", "--quiet", repo.URL, "main"},
+	} {
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+	}
+	concurrent, err := exec.Command("git", "-C", work, "rev-parse", "main").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := g.ForcePushLocalToRemote(plumbing.ZeroHash); !errors.Is(err, ErrLeaseMismatch) {
+		t.Fatalf("expected ErrLeaseMismatch, got %v", err)
+	}
+	out, err := exec.Command("git", "-C", strings.TrimPrefix(repo.URL, "file://"), "rev-parse", "main").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != string(concurrent) {
+		t.Errorf("expected the remote branch to be kept at %s, got %s", concurrent, out)
+	}
 }
@@ -7,49 +7,71 @@ import (
 	"github.com/pkg/errors"
 )
 
+// GogsAdmin is the Provider of a Gogs instance, authenticated with the user and password
 type GogsAdmin struct {
 	user, password, baseURL string
 }
 
+var _ Provider = (*GogsAdmin)(nil)
+
 func NewGogsAdmin(user, password, baseURL string) *GogsAdmin {
 	return &GogsAdmin{user, password, baseURL}
 }
 
-func (g *GogsAdmin) getGogsAPIClient() (string, *api.Client, error) {
-	client := api.NewClient(g.baseURL, "")
-	token, err := client.CreateAccessToken(g.user, g.password,
+// CreateAccessToken creates a new access token of the user
+func (g *GogsAdmin) CreateAccessToken() (string, error) {
+	token, err := api.NewClient(g.baseURL, "").CreateAccessToken(g.user, g.password,
 		api.CreateAccessTokenOption{Name: generateRandomString()})
 	if err != nil {
-		return "", nil, errors.Wrap(err, "failed to create access token")
+		return "", errors.Wrap(err, "failed to create access token")
 	}
-	return token.Sha1, api.NewClient(g.baseURL, token.Sha1), nil
+	return token.Sha1, nil
 }
 
-type RemoteRepo struct {
-	URL    string
-	Branch string
-	Token  string
+func (g *GogsAdmin) getGogsAPIClient() (*api.Client, error) {
+	token, err := g.CreateAccessToken()
+	if err != nil {
+		return nil, err
+	}
+	return api.NewClient(g.baseURL, token), nil
 }
 
-func (g *GogsAdmin) CreateRandomRepo(branch string) (RemoteRepo, error) {
-	token, client, err := g.getGogsAPIClient()
+// CreateRepo creates an empty repository of the user, and returns its clone URL
+func (g *GogsAdmin) CreateRepo(name string) (string, error) {
+	client, err := g.getGogsAPIClient()
 	if err != nil {
-		return RemoteRepo{}, errors.Wrap(err, "failed to create client with access token")
+		return "", errors.Wrap(err, "failed to create client with access token")
 	}
+	repo, err := client.CreateRepo(api.CreateRepoOption{Name: name, Description: "Test repository"})
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create repo")
+	}
+	return repo.CloneURL, nil
+}
 
-	repoOpts := api.CreateRepoOption{
-		Name:        generateRandomString(),
-		Description: "Test repository"}
-
-	repo, err := client.CreateRepo(repoOpts)
+// RepoExists returns whether the repository of the user exists
+func (g *GogsAdmin) RepoExists(name string) (bool, error) {
+	client, err := g.getGogsAPIClient()
 	if err != nil {
-		return RemoteRepo{}, errors.Wrap(err, "failed to create repo")
+		return false, errors.Wrap(err, "failed to create client with access token")
+	}
+	if _, err := client.GetRepo(g.user, name); err != nil {
+		// the client does not expose the status otherwise
+		if err.Error() == "404 Not Found" {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "failed to get repo")
 	}
+	return true, nil
+}
+
+type RemoteRepo struct {
+	URL    string
+	Branch string
+	Token  string
 
-	return RemoteRepo{
-		URL:    repo.CloneURL,
-		Branch: branch,
-		Token:  token}, nil
+	// TempDir overrides the temp dir of the local clone, e.g. to spread repositories across disks. Optional
+	TempDir string
 }
 
 func generateRandomString() string {
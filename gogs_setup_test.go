@@ -1,3 +1,5 @@
+//go:build integration
+
 package git_sync
 
 import (
@@ -9,6 +11,16 @@ import (
 	"time"
 )
 
+// user of integrationtest/gogs-dev
+const user = "sync"
+const password = "computer"
+const baseURL = "http://localhost:3000"
+
+// provider of the repositories of the integration tests
+func newTestProvider() Provider {
+	return NewGogsAdmin(user, password, baseURL)
+}
+
 // CreateAccessTokenForUser generates an access token for an existing Gogs user
 func CreateAccessTokenForUser(baseURL, username, password, tokenName string) (string, error) {
 	// Prepare the token creation request
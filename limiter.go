@@ -0,0 +1,155 @@
+package git_sync
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var metricOpsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "git_sync_ops_in_flight",
+	Help: "Number of git operations in flight"})
+
+// ErrTooManyOperations is returned when the concurrency limit is reached,
+// and no operation completed within the queue timeout
+var ErrTooManyOperations = errors.New("too many concurrent git operations")
+
+// Limiter limits the number of concurrent git operations, in total and per repository.
+// A nil *Limiter does not limit
+type Limiter struct {
+	// nil when unlimited
+	global       chan struct{}
+	perRepo      int
+	queueTimeout time.Duration
+
+	mu sync.Mutex
+	// semaphores by repository URL, removed when no operation uses them
+	repos map[string]*repoSlots
+}
+
+type repoSlots struct {
+	sem   chan struct{}
+	users int
+}
+
+// NewLimiter limits the operations to global in total and perRepo for each repository. Zero is no limit.
+// When the limit is reached, operations wait at most queueTimeout for another to complete
+func NewLimiter(global, perRepo int, queueTimeout time.Duration) *Limiter {
+	l := &Limiter{perRepo: perRepo, queueTimeout: queueTimeout, repos: make(map[string]*repoSlots)}
+	if global > 0 {
+		l.global = make(chan struct{}, global)
+	}
+	return l
+}
+
+// Acquire waits for a slot for an operation on the repository. Returns ErrTooManyOperations
+// if none is free within the queue timeout. release must be called when the operation completes
+func (l *Limiter) Acquire(ctx context.Context, repoURL string) (release func(), err error) {
+	if l == nil {
+		metricOpsInFlight.Inc()
+		return metricOpsInFlight.Dec, nil
+	}
+
+	var timeout <-chan time.Time
+	if l.queueTimeout > 0 {
+		timer := time.NewTimer(l.queueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	// the repository slot first, so a queued operation does not hold a global slot
+	var repo *repoSlots
+	if l.perRepo > 0 {
+		repo = l.repoSlots(repoURL)
+		if err := wait(ctx, repo.sem, timeout); err != nil {
+			l.releaseRepo(repoURL, repo, false)
+			return nil, err
+		}
+	}
+	if l.global != nil {
+		if err := wait(ctx, l.global, timeout); err != nil {
+			if repo != nil {
+				l.releaseRepo(repoURL, repo, true)
+			}
+			return nil, err
+		}
+	}
+
+	metricOpsInFlight.Inc()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			metricOpsInFlight.Dec()
+			if l.global != nil {
+				<-l.global
+			}
+			if repo != nil {
+				l.releaseRepo(repoURL, repo, true)
+			}
+		})
+	}, nil
+}
+
+// semaphore of the repository, registering a user
+func (l *Limiter) repoSlots(repoURL string) *repoSlots {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	repo, ok := l.repos[repoURL]
+	if !ok {
+		repo = &repoSlots{sem: make(chan struct{}, l.perRepo)}
+		l.repos[repoURL] = repo
+	}
+	repo.users++
+	return repo
+}
+
+// unregister a user of the semaphore of the repository, and free the slot if acquired
+func (l *Limiter) releaseRepo(repoURL string, repo *repoSlots, acquired bool) {
+	if acquired {
+		<-repo.sem
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	repo.users--
+	if repo.users == 0 {
+		delete(l.repos, repoURL)
+	}
+}
+
+// take a slot of the semaphore, waiting until timeout. A nil timeout does not wait
+func wait(ctx context.Context, sem chan struct{}, timeout <-chan time.Time) error {
+	select {
+	case sem <- struct{}{}:
+		return nil
+	default:
+	}
+	if timeout == nil {
+		return ErrTooManyOperations
+	}
+
+	select {
+	case sem <- struct{}{}:
+		return nil
+	case <-timeout:
+		return ErrTooManyOperations
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// respond 503 to a request that did not get a slot, with a hint to retry after the queue timeout
+func (l *Limiter) writeError(w http.ResponseWriter, err error) {
+	retryAfter := 1
+	if l != nil {
+		retryAfter = max(retryAfter, int(math.Ceil(l.queueTimeout.Seconds())))
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	http.Error(w, err.Error(), http.StatusServiceUnavailable)
+}
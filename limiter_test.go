@@ -0,0 +1,78 @@
+package git_sync
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestLimiterGlobal(t *testing.T) {
+	l := NewLimiter(1, 0, 0)
+	release, err := l.Acquire(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := l.Acquire(context.Background(), "b"); !errors.Is(err, ErrTooManyOperations) {
+		t.Fatalf("expected ErrTooManyOperations, got %v", err)
+	}
+
+	release()
+	release() // idempotent
+	release, err = l.Acquire(context.Background(), "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
+
+func TestLimiterPerRepo(t *testing.T) {
+	l := NewLimiter(0, 1, 0)
+	release, err := l.Acquire(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := l.Acquire(context.Background(), "a"); !errors.Is(err, ErrTooManyOperations) {
+		t.Fatalf("expected ErrTooManyOperations for the same repository, got %v", err)
+	}
+	other, err := l.Acquire(context.Background(), "b")
+	if err != nil {
+		t.Fatalf("expected another repository not to be limited, got %v", err)
+	}
+
+	release()
+	other()
+	if len(l.repos) != 0 {
+		t.Errorf("expected unused repository semaphores to be removed, got %d", len(l.repos))
+	}
+}
+
+func TestLimiterQueues(t *testing.T) {
+	l := NewLimiter(1, 0, time.Second)
+	release, err := l.Acquire(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		release()
+	}()
+
+	queued, err := l.Acquire(context.Background(), "b")
+	if err != nil {
+		t.Fatalf("expected the queued operation to get a slot, got %v", err)
+	}
+	queued()
+}
+
+func TestLimiterWriteError(t *testing.T) {
+	w := httptest.NewRecorder()
+	NewLimiter(1, 0, 2500*time.Millisecond).writeError(w, ErrTooManyOperations)
+	if w.Code != 503 || w.Header().Get("Retry-After") != "3" {
+		t.Errorf("expected 503 with Retry-After 3, got %d with %q", w.Code, w.Header().Get("Retry-After"))
+	}
+}
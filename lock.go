@@ -0,0 +1,60 @@
+package git_sync
+
+import "sync"
+
+// locks of the local clones by work dir, so operations on the same clone do not interleave
+var workDirLocks = &keyedMutex{locks: make(map[string]*keyedLock)}
+
+// keyedMutex is a mutex per key. Locks are removed when not in use
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	mu    sync.Mutex
+	users int
+}
+
+// Lock the key, waiting for other holders. The returned func unlocks it
+func (k *keyedMutex) Lock(key string) (unlock func()) {
+	l := k.register(key)
+	l.mu.Lock()
+	return func() { k.unlock(key, l) }
+}
+
+// TryLock locks the key if not held by another. The returned func unlocks it, when ok
+func (k *keyedMutex) TryLock(key string) (unlock func(), ok bool) {
+	l := k.register(key)
+	if !l.mu.TryLock() {
+		k.unregister(key, l)
+		return nil, false
+	}
+	return func() { k.unlock(key, l) }, true
+}
+
+func (k *keyedMutex) register(key string) *keyedLock {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		k.locks[key] = l
+	}
+	l.users++
+	return l
+}
+
+func (k *keyedMutex) unlock(key string, l *keyedLock) {
+	l.mu.Unlock()
+	k.unregister(key, l)
+}
+
+func (k *keyedMutex) unregister(key string, l *keyedLock) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	l.users--
+	if l.users == 0 {
+		delete(k.locks, key)
+	}
+}
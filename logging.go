@@ -0,0 +1,111 @@
+package git_sync
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const headerRequestID = "X-Request-ID"
+
+type ctxKey int
+
+const (
+	ctxKeyRequestID ctxKey = iota
+	ctxKeyLogger
+)
+
+// RequestIDFromContext returns the request ID assigned by AccessLog, or empty string if none
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(ctxKeyRequestID).(string)
+	return id
+}
+
+// LoggerFromContext returns the request-scoped logger assigned by AccessLog, or slog.Default() if none
+func LoggerFromContext(ctx context.Context) *slog.Logger {
+	if log, ok := ctx.Value(ctxKeyLogger).(*slog.Logger); ok {
+		return log
+	}
+	return slog.Default()
+}
+
+// AccessLog is middleware assigning a request ID to each request, and logging method, path, status and duration.
+// The request ID is returned in the X-Request-ID header, and a logger with the ID is available from LoggerFromContext.
+// A valid X-Request-ID from the client (e.g. set by a proxy) is reused
+func AccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get(headerRequestID)
+		if !isValidRequestID(id) {
+			id = newRequestID()
+		}
+		log := slog.Default().With("request_id", id)
+
+		ctx := context.WithValue(r.Context(), ctxKeyRequestID, id)
+		ctx = context.WithValue(ctx, ctxKeyLogger, log)
+
+		w.Header().Set(headerRequestID, id)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		log.Info("request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"duration", time.Since(start))
+	})
+}
+
+// captures the status code and number of bytes written
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer, e.g. to set deadlines
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// accept IDs of reasonable length with only alphanumeric, '-' and '_', to keep logs clean
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
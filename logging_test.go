@@ -0,0 +1,73 @@
+package git_sync
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAccessLogAssignsRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	defer slog.SetDefault(defaultLogger)
+
+	var idInHandler string
+	h := AccessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idInHandler = RequestIDFromContext(r.Context())
+		LoggerFromContext(r.Context()).Info("in handler")
+		http.Error(w, "conflict", http.StatusConflict)
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/push?repository=x", nil))
+
+	id := rec.Header().Get("X-Request-ID")
+	if id == "" || id != idInHandler {
+		t.Fatalf("expected request ID in response header '%s' to match context '%s'", id, idInHandler)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 log lines, got %v", lines)
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, "request_id="+id) {
+			t.Errorf("expected request ID in log line: %s", line)
+		}
+	}
+	for _, s := range []string{"method=POST", "path=/push", "status=409", "duration="} {
+		if !strings.Contains(lines[1], s) {
+			t.Errorf("expected '%s' in access log line: %s", s, lines[1])
+		}
+	}
+}
+
+func TestAccessLogReusesValidRequestID(t *testing.T) {
+	h := AccessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tcs := map[string]bool{
+		"abc-123_DEF":           true,
+		"":                      false,
+		"with space":            false,
+		"new\nline":             false,
+		strings.Repeat("a", 65): false,
+	}
+	for id, reused := range tcs {
+		r := httptest.NewRequest(http.MethodGet, "/pull", nil)
+		r.Header.Set("X-Request-ID", id)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+
+		actual := rec.Header().Get("X-Request-ID")
+		if (actual == id) != reused {
+			t.Errorf("request ID '%s': expected reused=%t, got '%s'", id, reused, actual)
+		}
+		if actual == "" {
+			t.Errorf("request ID '%s': expected some request ID", id)
+		}
+	}
+}
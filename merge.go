@@ -0,0 +1,64 @@
+package git_sync
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// MergeMode is how pushed bundles are applied to the branch
+type MergeMode string
+
+const (
+	// MergeModeFastForward only fast-forwards the branch, so no merge commit is ever created.
+	// A bundle that diverges from the branch is rejected with ErrNotFastForward
+	MergeModeFastForward MergeMode = "ff-only"
+
+	// MergeModeMerge fast-forwards the branch when possible, and otherwise merges the bundle into the branch
+	// with a merge commit, by the identity and the merge message. A conflicting merge fails with ErrMergeConflict
+	MergeModeMerge MergeMode = "merge"
+)
+
+// ErrMergeConflict is returned when a bundle that diverges from the branch cannot be merged without conflicts
+var ErrMergeConflict = errors.New("bundle conflicts with the branch")
+
+func ParseMergeMode(s string) (MergeMode, error) {
+	switch m := MergeMode(s); m {
+	case MergeModeFastForward, MergeModeMerge:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unsupported merge mode '%s', expected %s or %s", s, MergeModeFastForward, MergeModeMerge)
+	}
+}
+
+// SetMergeMode sets how bundles are applied to the branch, and the message of merge commits.
+// Empty for MergeModeFastForward and the default message of DefaultMergeMessage
+func (g *GIT) SetMergeMode(mode MergeMode, message string) {
+	g.mergeMode = mode
+	g.mergeMessage = message
+}
+
+// DefaultMergeMessage is the message of merge commits, when none is set
+func DefaultMergeMessage(branch string) string {
+	return fmt.Sprintf("Merge bundle into %s", branch)
+}
+
+// merge FETCH_HEAD into the branch of the local repository with a merge commit. A conflicting merge is aborted,
+// leaving the branch unchanged, and fails with ErrMergeConflict
+func (g *GIT) mergeFetchHead() error {
+	message := g.mergeMessage
+	if message == "" {
+		message = DefaultMergeMessage(g.remoteRepo.Branch)
+	}
+	_, err := g.runGit(fmt.Sprintf("failed to merge bundle for repository %s and branch %s", g.remoteRepo.URL, g.remoteRepo.Branch),
+		"-C", g.workDir, "merge", "--quiet", "--no-ff", "--no-edit", "-m", message, "FETCH_HEAD")
+	if err == nil {
+		return nil
+	}
+	if _, abortErr := g.runGit(fmt.Sprintf("failed to abort merge for repository %s", g.remoteRepo.URL),
+		"-C", g.workDir, "merge", "--abort"); abortErr != nil {
+		// nothing to abort, e.g. the merge did not start
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrMergeConflict, err)
+}
@@ -0,0 +1,77 @@
+package git_sync
+
+import (
+	"fmt"
+	"time"
+)
+
+// MetricRepoLabel is how the repository_url and branch labels of the metrics are set. Repository URLs and
+// branches of requests are not bounded, so labelling by URL may create too many series
+type MetricRepoLabel string
+
+const (
+	// MetricRepoLabelURL labels by the repository URL, or "other" if not allowed by the RepoAllowlist
+	MetricRepoLabelURL MetricRepoLabel = "url"
+
+	// MetricRepoLabelName labels by the name of a registered repository (see RepoRegistry.Name), or "other"
+	MetricRepoLabelName MetricRepoLabel = "name"
+
+	// MetricRepoLabelNone leaves the label empty
+	MetricRepoLabelNone MetricRepoLabel = "none"
+)
+
+// label of repositories without their own series
+const metricRepoOther = "other"
+
+func ParseMetricRepoLabel(s string) (MetricRepoLabel, error) {
+	switch l := MetricRepoLabel(s); l {
+	case MetricRepoLabelURL, MetricRepoLabelName, MetricRepoLabelNone:
+		return l, nil
+	default:
+		return "", fmt.Errorf("unsupported metric repo label '%s', expected %s, %s or %s", s, MetricRepoLabelURL, MetricRepoLabelName, MetricRepoLabelNone)
+	}
+}
+
+// the repository_url label of the repository by MetricRepoLabel
+func (opts HandlerOptions) metricRepo(repoURL string) string {
+	switch opts.MetricRepoLabel {
+	case MetricRepoLabelNone:
+		return ""
+	case MetricRepoLabelName:
+		if name := opts.Repos.Name(repoURL); name != "" {
+			return name
+		}
+		return metricRepoOther
+	default:
+		if !opts.AllowedRepos.Allows(repoURL) {
+			return metricRepoOther
+		}
+		return repoURL
+	}
+}
+
+// the branch label of the repository by MetricRepoLabel. Branches of requests are not bounded either, so
+// branches of repositories labelled "other" are "other" too, and by name only the registered branches get a series
+func (opts HandlerOptions) metricBranch(repoURL, branch string) string {
+	switch opts.MetricRepoLabel {
+	case MetricRepoLabelNone:
+		return ""
+	case MetricRepoLabelName:
+		if opts.Repos.RegisteredBranch(repoURL, branch) {
+			return branch
+		}
+		return metricRepoOther
+	default:
+		if !opts.AllowedRepos.Allows(repoURL) {
+			return metricRepoOther
+		}
+		return branch
+	}
+}
+
+// record a successful operation on the branch in the git_sync_last_success_timestamp_seconds metric and
+// in the registry, see RepoRegistry.MarkSynced
+func (opts HandlerOptions) markSynced(op, repoURL, branch string, t time.Time) {
+	metricLastSuccess.WithLabelValues(op, opts.metricRepo(repoURL), opts.metricBranch(repoURL, branch)).Set(float64(t.Unix()))
+	opts.Repos.MarkSynced(op, repoURL, branch, t)
+}
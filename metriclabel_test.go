@@ -0,0 +1,87 @@
+package git_sync
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricRepo(t *testing.T) {
+	repos := NewRepoRegistry([]RegisteredRepo{{URL: "https://host/owner/a.git", Branch: "main", Pull: true}})
+	allowed := RepoAllowlist{"https://host/owner/"}
+
+	tcs := map[MetricRepoLabel]map[string]string{
+		"": {
+			"https://host/owner/a.git": "https://host/owner/a.git",
+			"https://host/owner/b.git": "https://host/owner/b.git",
+			"https://other/x.git":      "other"},
+		MetricRepoLabelName: {
+			"https://host/owner/a.git": "a",
+			"https://host/owner/b.git": "other"},
+		MetricRepoLabelNone: {
+			"https://host/owner/a.git": ""}}
+	for label, expected := range tcs {
+		opts := HandlerOptions{MetricRepoLabel: label, Repos: repos, AllowedRepos: allowed}
+		for repoURL, expected := range expected {
+			if actual := opts.metricRepo(repoURL); actual != expected {
+				t.Errorf("%s: expected label '%s' for %s, got '%s'", label, expected, repoURL, actual)
+			}
+		}
+	}
+
+	// branches of requests are bounded like the repositories
+	branches := map[MetricRepoLabel]map[[2]string]string{
+		"": {
+			{"https://host/owner/b.git", "feature"}: "feature",
+			{"https://other/x.git", "feature"}:      "other"},
+		MetricRepoLabelName: {
+			{"https://host/owner/a.git", "main"}:    "main",
+			{"https://host/owner/a.git", "*"}:       "*",
+			{"https://host/owner/a.git", "feature"}: "other",
+			{"https://host/owner/b.git", "main"}:    "other"},
+		MetricRepoLabelNone: {
+			{"https://host/owner/a.git", "main"}: ""}}
+	for label, expected := range branches {
+		opts := HandlerOptions{MetricRepoLabel: label, Repos: repos, AllowedRepos: allowed}
+		for args, expected := range expected {
+			if actual := opts.metricBranch(args[0], args[1]); actual != expected {
+				t.Errorf("%s: expected branch label '%s' for %s %s, got '%s'", label, expected, args[0], args[1], actual)
+			}
+		}
+	}
+
+	if _, err := ParseMetricRepoLabel("host"); err == nil {
+		t.Error("expected an unsupported label to be rejected")
+	}
+
+	opts := HandlerOptions{MetricRepoLabel: MetricRepoLabelName, Repos: repos}
+	synced := time.Date(2025, 2, 13, 8, 0, 0, 0, time.UTC)
+	opts.markSynced("pull", "https://host/owner/a.git", "main", synced)
+	if value := testutil.ToFloat64(metricLastSuccess.WithLabelValues("pull", "a", "main")); value != float64(synced.Unix()) {
+		t.Errorf("expected last success metric %d by name, got %v", synced.Unix(), value)
+	}
+	if status := repos.List()[0]; status.LastPull == nil || !status.LastPull.Equal(synced) {
+		t.Errorf("expected the registry to be marked, got %+v", status)
+	}
+}
+
+func TestMetricRepoNameCollision(t *testing.T) {
+	repos := NewRepoRegistry([]RegisteredRepo{
+		{URL: "https://host/a/foo.git", Branch: "main"},
+		{URL: "https://host/b/foo.git", Branch: "main"},
+		{URL: "https://host/a/bar.git", Branch: "main"}})
+	opts := HandlerOptions{MetricRepoLabel: MetricRepoLabelName, Repos: repos}
+
+	a, b := opts.metricRepo("https://host/a/foo.git"), opts.metricRepo("https://host/b/foo.git")
+	if a == b || !strings.HasPrefix(a, "foo-") || !strings.HasPrefix(b, "foo-") {
+		t.Errorf("expected distinct labels of the repositories named foo, got '%s' and '%s'", a, b)
+	}
+	if actual := opts.metricRepo("https://host/a/bar.git"); actual != "bar" {
+		t.Errorf("expected label 'bar' without collision, got '%s'", actual)
+	}
+	if status := repos.List(); status[0].Name != a || status[1].Name != b {
+		t.Errorf("expected /repos to list the names of the labels, got %+v", status)
+	}
+}
@@ -0,0 +1,142 @@
+package git_sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// GitMirrorHandler mirrors a branch from the configured source repository to the configured sink repository.
+// The branch is the {branch} route variable
+type GitMirrorHandler struct {
+	tempDir      string
+	opts         HandlerOptions
+	source, sink string
+}
+
+func NewGitMirrorHandler(tempDir string, opts HandlerOptions, sourceURL, sinkURL string) *GitMirrorHandler {
+	return &GitMirrorHandler{tempDir: tempDir, opts: opts, source: sourceURL, sink: sinkURL}
+}
+
+// MirrorSummary is the response of a successful mirror
+type MirrorSummary struct {
+	// OldHead is the head of the sink branch before the mirror. Empty if the branch had no commits
+	OldHead string `json:"old_head,omitempty"`
+	// NewHead is the head of the sink branch after the mirror. Empty when mirroring all branches
+	NewHead string `json:"new_head,omitempty"`
+	// CommitsTransferred is the number of commits added to the sink. Zero if already up to date
+	CommitsTransferred int `json:"commits_transferred"`
+	// Heads of all sink branches after the mirror. Only when mirroring all branches
+	Heads []Head `json:"heads,omitempty"`
+}
+
+func (h *GitMirrorHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	branch := mux.Vars(r)["branch"]
+	if branch == "" {
+		http.Error(w, "no branch specified", http.StatusBadRequest)
+		return
+	}
+	if err := validateBranch(branch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// in passthrough auth mode the same token is used for both repositories
+	sourceAuth := h.opts.authExtractor(h.source)
+	sourceToken, err := sourceAuth.ExtractToken(r)
+	if err != nil {
+		writeArgsError(w, sourceAuth, err)
+		return
+	}
+	sinkAuth := h.opts.authExtractor(h.sink)
+	sinkToken, err := sinkAuth.ExtractToken(r)
+	if err != nil {
+		writeArgsError(w, sinkAuth, err)
+		return
+	}
+	source := RemoteRepo{URL: h.source, Branch: branch, Token: sourceToken, TempDir: h.opts.Repos.TempDir(h.source)}
+	sink := RemoteRepo{URL: h.sink, Branch: branch, Token: sinkToken, TempDir: h.opts.Repos.TempDir(h.sink)}
+	log := LoggerFromContext(r.Context()).With("op", "GitMirrorHandler.ServeHTTP", "source.url", source.URL, "sink.url", sink.URL, "branch", branch)
+
+	repoLabel := h.opts.metricRepo(sink.URL)
+	metricOps.WithLabelValues("mirror", repoLabel).Inc()
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	w = rec
+	mErr := &opsError{op: "mirror", repoURL: repoLabel, rec: rec}
+	defer mErr.record()
+
+	// a single operation, counted for the source, which is synced first
+	release, err := h.opts.Limiter.Acquire(r.Context(), source.URL)
+	if err != nil {
+		log.Warn("mirror rejected", "err", err)
+		mErr.Inc()
+		h.opts.Limiter.writeError(w, err)
+		return
+	}
+	defer release()
+
+	ctx, done := h.opts.Operations.Start(r.Context())
+	defer done()
+
+	result, err := h.opts.syncer(h.tempDir).Mirror(ctx, source, sink)
+	if err != nil {
+		mErr.Inc()
+		h.writeError(log, w, err)
+		return
+	}
+
+	log.Info("mirror audit", "old_head", result.OldHead.String(), "new_head", result.NewHead.String(), "commits_added", result.CommitsAdded)
+
+	summary := MirrorSummary{CommitsTransferred: result.CommitsAdded, Heads: result.Heads}
+	if branch != AllBranches {
+		summary.NewHead = result.NewHead.String()
+	}
+	if result.OldHead != plumbing.ZeroHash {
+		summary.OldHead = result.OldHead.String()
+	}
+
+	if result.Rewritten || result.SourceRewritten {
+		w.Header().Set("X-Git-Rewritten", "true")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(summary); err != nil {
+		log.Error("failed to write mirror summary", "err", err)
+	}
+
+	now := time.Now()
+	h.opts.markSynced("pull", source.URL, branch, now)
+	h.opts.markSynced("push", sink.URL, branch, now)
+	h.opts.Webhook.Send(h.opts.Operations, log, Event{Op: "mirror", Repository: sink.URL, Branch: branch, Head: summary.NewHead,
+		Commits: result.CommitsAdded, Timestamp: time.Now().UTC()})
+}
+
+// write error response for a failed mirror. The error tells whether the source or sink failed
+func (h *GitMirrorHandler) writeError(log *slog.Logger, w http.ResponseWriter, err error) {
+	var cmdErr *CommandError
+	if errors.As(err, &cmdErr) {
+		log.Error("mirror failed", "err", err, "stderr", cmdErr.StdErr)
+	} else {
+		log.Error("mirror failed", "err", err)
+	}
+
+	switch {
+	case errors.Is(err, ErrAuthFailed):
+		h.opts.writeRemoteAuthError(w)
+	case errors.Is(err, ErrRepositoryNotFound), errors.Is(err, ErrBranchNotFound), errors.Is(err, ErrNoCommits):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrRewritten), errors.Is(err, ErrNotFastForward), errors.Is(err, ErrMissingPrerequisites):
+		http.Error(w, fmt.Sprintf("failed to mirror, the sink branch has diverged from the source: %v", err), http.StatusConflict)
+	case isRemoteUnavailable(err):
+		writeRemoteUnavailableError(w, err)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,92 @@
+package git_sync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/bredtape/git_sync/testdata"
+	"github.com/gorilla/mux"
+)
+
+func createTestServerWithMirrorHandler(t *testing.T, source, sink RemoteRepo) *httptest.Server {
+	router := mux.NewRouter()
+	router.Handle("/mirror/{branch}", NewGitMirrorHandler(t.TempDir(), HandlerOptions{}, source.URL, sink.URL)).
+		Methods(http.MethodPost)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func mirror(t *testing.T, server *httptest.Server, branch, token string) (*http.Response, MirrorSummary) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/mirror/"+branch, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var summary MirrorSummary
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&summary); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		body, _ := io.ReadAll(resp.Body)
+		t.Logf("status %d, body %s", resp.StatusCode, string(body))
+	}
+	return resp, summary
+}
+
+func TestMirrorNoAuth(t *testing.T) {
+	repo := unusedRemote("main")
+	server := createTestServerWithMirrorHandler(t, repo, repo)
+
+	resp, _ := mirror(t, server, "main", "")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected status %d, got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+}
+
+func TestMirrorSourceToSink(t *testing.T) {
+	branch := "main"
+	source := setupLocalBareRemote(t)
+	sink := setupLocalBareRemote(t)
+	if _, err := Push(context.Background(), t.TempDir(), source, bytes.NewReader(testdata.FullBundle)); err != nil {
+		t.Fatal(err)
+	}
+
+	server := createTestServerWithMirrorHandler(t, source, sink)
+	// the token is relayed, but not checked by a file:// remote
+	resp, summary := mirror(t, server, branch, "not_used")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	expected := MirrorSummary{NewHead: "f8be008f3733c1a9b7962c1f5a50679266565e31", CommitsTransferred: 2}
+	if !reflect.DeepEqual(summary, expected) {
+		t.Errorf("expected summary %+v, got %+v", expected, summary)
+	}
+
+	// already up to date
+	resp, summary = mirror(t, server, branch, "not_used")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	expected = MirrorSummary{OldHead: expected.NewHead, NewHead: expected.NewHead}
+	if !reflect.DeepEqual(summary, expected) {
+		t.Errorf("expected summary %+v, got %+v", expected, summary)
+	}
+}
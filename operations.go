@@ -0,0 +1,89 @@
+package git_sync
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// Operations tracks in-flight git operations, so shutdown can wait for them to complete
+// instead of killing them mid-operation (possibly leaving a corrupt local repository or lock file).
+// Webhook deliveries are tracked too, so events are not dropped.
+// A nil *Operations does not track anything
+type Operations struct {
+	wg     sync.WaitGroup
+	active atomic.Int64
+
+	// cancelled on shutdown timeout
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewOperations() *Operations {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Operations{ctx: ctx, cancel: cancel}
+}
+
+// Start registers an operation. The returned context is cancelled when ctx is done, or when Shutdown times out.
+// done must be called when the operation completes
+func (o *Operations) Start(ctx context.Context) (_ context.Context, done func()) {
+	if o == nil {
+		return ctx, func() {}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(o.ctx, cancel)
+	o.wg.Add(1)
+	o.active.Add(1)
+	return ctx, func() {
+		stop()
+		cancel()
+		o.active.Add(-1)
+		o.wg.Done()
+	}
+}
+
+// Active returns the number of operations in flight
+func (o *Operations) Active() int {
+	if o == nil {
+		return 0
+	}
+	return int(o.active.Load())
+}
+
+// Shutdown waits for all operations to complete, or until ctx is done, after which the contexts
+// of the remaining operations are cancelled. Returns the number of operations still running when ctx was done.
+// No operations must be started while waiting, i.e. the HTTP server must be shut down first
+func (o *Operations) Shutdown(ctx context.Context) int {
+	if o == nil {
+		return 0
+	}
+
+	if o.Wait(ctx) {
+		return 0
+	}
+	running := o.Active()
+	o.cancel()
+	return running
+}
+
+// Wait waits for all operations to complete, or until ctx is done. Returns whether all completed,
+// e.g. to let cancelled operations clean up after Shutdown
+func (o *Operations) Wait(ctx context.Context) bool {
+	if o == nil {
+		return true
+	}
+
+	completed := make(chan struct{})
+	go func() {
+		o.wg.Wait()
+		close(completed)
+	}()
+
+	select {
+	case <-completed:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,78 @@
+package git_sync
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestOperationsShutdownWaitsForCompletion(t *testing.T) {
+	ops := NewOperations()
+	_, done := ops.Start(context.Background())
+	if ops.Active() != 1 {
+		t.Fatalf("expected 1 active operation, got %d", ops.Active())
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		done()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if running := ops.Shutdown(ctx); running != 0 {
+		t.Fatalf("expected no running operations, got %d", running)
+	}
+	if ops.Active() != 0 {
+		t.Fatalf("expected no active operations, got %d", ops.Active())
+	}
+}
+
+func TestOperationsShutdownTimeoutCancels(t *testing.T) {
+	ops := NewOperations()
+	opCtx, done := ops.Start(context.Background())
+	defer done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if running := ops.Shutdown(ctx); running != 1 {
+		t.Fatalf("expected 1 running operation, got %d", running)
+	}
+
+	select {
+	case <-opCtx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected operation context to be cancelled")
+	}
+}
+
+func TestOperationsWaitAfterCancel(t *testing.T) {
+	ops := NewOperations()
+	opCtx, done := ops.Start(context.Background())
+	// the operation cleans up after being cancelled
+	go func() {
+		<-opCtx.Done()
+		time.Sleep(10 * time.Millisecond)
+		done()
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if running := ops.Shutdown(ctx); running != 1 {
+		t.Fatalf("expected 1 running operation, got %d", running)
+	}
+	waitCtx, cancelWait := context.WithTimeout(context.Background(), time.Second)
+	defer cancelWait()
+	if !ops.Wait(waitCtx) {
+		t.Fatal("expected the cancelled operation to complete")
+	}
+}
+
+func TestOperationsNil(t *testing.T) {
+	var ops *Operations
+	ctx, done := ops.Start(context.Background())
+	defer done()
+	if ctx.Err() != nil || ops.Active() != 0 || ops.Shutdown(context.Background()) != 0 {
+		t.Fatal("expected nil operations to not track anything")
+	}
+}
@@ -0,0 +1,190 @@
+package git_sync
+
+import (
+	"log/slog"
+	"net/http"
+	"text/template"
+	"time"
+)
+
+// HandlerOptions configures the pull and push handlers
+type HandlerOptions struct {
+	// EnableCompression enables gzip/zstd compressed responses on pull (negotiated with Accept-Encoding)
+	// and decompression of gzip/zstd request bodies on push (declared with Content-Encoding)
+	EnableCompression bool
+
+	// MaxPushSize is the maximum size in bytes of pushed bundles, after decompression.
+	// Larger pushes are rejected with 413. Zero for no limit
+	MaxPushSize int64
+
+	// AuditProvenance includes the commits introduced by each push in the push audit log entry
+	AuditProvenance bool
+
+	// AuditMaxCommits caps the number of commits recorded in the push audit log entry
+	AuditMaxCommits int
+
+	// MaxRetries is the number of retries of syncing with and pushing to the remote after a transient error
+	MaxRetries int
+
+	// RetryBackoff is the wait before the first retry. It is doubled for each subsequent retry
+	RetryBackoff time.Duration
+
+	// Auth extracts the token for the remote repository from requests in AuthModePassthrough. Defaults to BearerAuth
+	Auth AuthExtractor
+
+	// AuthMode defines whether the inbound token is relayed to the remote (default), or the RemoteToken is used
+	AuthMode AuthMode
+
+	// RemoteToken is the token used to authenticate to the remote in AuthModeServer. Empty for anonymous access
+	RemoteToken string
+
+	// RemoteTokenFile replaces RemoteToken with the token of the file, so rotated tokens are used. Optional
+	RemoteTokenFile *TokenFile
+
+	// ResetOnRewrite resets the local clone when the remote branch history was rewritten (force-pushed),
+	// and marks the response with 'X-Git-Rewritten: true'. Otherwise such requests fail with 409
+	ResetOnRewrite bool
+
+	// BranchFromBundle allows pushes without the 'branch' query parameter.
+	// The branch is then derived from the single branch head of the pushed bundle
+	BranchFromBundle bool
+
+	// AllowForcePush allows pushes with 'force=true', overwriting diverged history of the remote branch.
+	// Such pushes must provide the expected remote head in the 'X-Git-Expected-Head' header
+	AllowForcePush bool
+
+	// Identity is the author/committer of commits created by git. Defaults to DefaultIdentity
+	Identity Identity
+
+	// Proxy for the remote repositories. Zero to use the environment (HTTPS_PROXY etc.)
+	Proxy Proxy
+
+	// CloneAllBranches clones all branches of the remote repositories, so bundles may start from
+	// commits of other branches. Costs disk and time to fetch the other branches
+	CloneAllBranches bool
+
+	// AllowLFSPointers allows pulls of branches using Git LFS, with only the pointer files in the bundles.
+	// Otherwise such pulls are rejected with 422
+	AllowLFSPointers bool
+
+	// CommandTimeout is the maximum duration of git commands, which are killed when exceeded.
+	// 0 for DefaultCommandTimeout
+	CommandTimeout time.Duration
+
+	// MaxCloneAge is the maximum age of local clones, which are cloned again when older. Zero for no limit
+	MaxCloneAge time.Duration
+
+	// BundleBackend creates pulled bundles and packfiles with the git binary or go-git, where go-git supports
+	// the options. Empty for BundleBackendCLI
+	BundleBackend BundleBackend
+
+	// DeterministicBundles repacks pulled bundles, so the same content yields the same bytes,
+	// and responds with a strong ETag. Costs CPU to recompress all objects of each bundle
+	DeterministicBundles bool
+
+	// AllowRefMismatch allows pushes of bundles with a single head of another ref than the branch,
+	// which is then applied to the branch. Otherwise such pushes are rejected with 400
+	AllowRefMismatch bool
+
+	// MaxBundleAge rejects pushed bundles with 422, when the commit time of the head is older. Zero for no limit
+	MaxBundleAge time.Duration
+
+	// TagConflict is how tags of pushed bundles are handled, that exist in the remote with another target.
+	// Empty for TagConflictFail, which rejects such pushes with 409
+	TagConflict TagConflict
+
+	// MergeMode is how pushed bundles are applied to the branch. Empty for MergeModeFastForward,
+	// which rejects bundles diverging from the branch with 409
+	MergeMode MergeMode
+
+	// MergeMessage is the message of merge commits of MergeModeMerge. Empty for DefaultMergeMessage
+	MergeMessage string
+
+	// Operations tracks the git operations of the handlers, for graceful shutdown. Optional
+	Operations *Operations
+
+	// Limiter limits the concurrent git operations of the handlers. Requests over the limit get 503. Optional
+	Limiter *Limiter
+
+	// Webhook receives an event for each successful pull, push and mirror. Optional
+	Webhook *Webhook
+
+	// BundleFilename is the template of the filename of pulled bundles, see ParseBundleFilenameTemplate.
+	// Defaults to DefaultBundleFilenameTemplate. Not used when pulling all branches
+	BundleFilename *template.Template
+
+	// StreamTimeout is the write deadline of a pulled bundle, set when the bundle is written,
+	// so the WriteTimeout of the server does not cut off large bundles. Zero for no deadline
+	StreamTimeout time.Duration
+
+	// Cursors remembers the last head served by incremental pulls. Incremental pulls are rejected if nil
+	Cursors *CursorStore
+
+	// AllowedRepos limits the repositories requests may use. Others are rejected with 403. Empty allows any
+	AllowedRepos RepoAllowlist
+
+	// Repos is the registry of configured repositories, where successful operations are recorded. Optional
+	Repos *RepoRegistry
+
+	// MetricRepoLabel is how the repository_url label of the operation metrics is set. Empty for MetricRepoLabelURL
+	MetricRepoLabel MetricRepoLabel
+}
+
+// extractor of the token for the remote repository. In AuthModeServer the token of the registered repository
+// is preferred over the RemoteToken
+func (opts HandlerOptions) authExtractor(repoURL string) AuthExtractor {
+	if opts.AuthMode == AuthModeServer {
+		if token, ok := opts.Repos.Token(repoURL); ok {
+			return StaticToken(token)
+		}
+		if opts.RemoteTokenFile != nil {
+			return opts.RemoteTokenFile
+		}
+		return StaticToken(opts.RemoteToken)
+	}
+	if opts.Auth == nil {
+		return BearerAuth{}
+	}
+	return opts.Auth
+}
+
+// replace the write deadline of the server with StreamTimeout, before writing a bundle
+func (opts HandlerOptions) setStreamDeadline(log *slog.Logger, w http.ResponseWriter) {
+	var deadline time.Time
+	if opts.StreamTimeout > 0 {
+		deadline = time.Now().Add(opts.StreamTimeout)
+	}
+	if err := http.NewResponseController(w).SetWriteDeadline(deadline); err != nil {
+		log.Debug("failed to set write deadline of bundle", "err", err)
+	}
+}
+
+func (opts HandlerOptions) syncer(tempDir string) Syncer {
+	return Syncer{
+		TempDir:              tempDir,
+		MaxRetries:           opts.MaxRetries,
+		RetryBackoff:         opts.RetryBackoff,
+		ResetOnRewrite:       opts.ResetOnRewrite,
+		Identity:             opts.Identity,
+		MaxBundleAge:         opts.MaxBundleAge,
+		TagConflict:          opts.TagConflict,
+		MergeMode:            opts.MergeMode,
+		MergeMessage:         opts.MergeMessage,
+		AllowRefMismatch:     opts.AllowRefMismatch,
+		DeterministicBundles: opts.DeterministicBundles,
+		Proxy:                opts.Proxy,
+		CloneAllBranches:     opts.CloneAllBranches,
+		AllowLFSPointers:     opts.AllowLFSPointers,
+		CommandTimeout:       opts.CommandTimeout,
+		MaxCloneAge:          opts.MaxCloneAge,
+		BundleBackend:        opts.BundleBackend,
+		ListCommits:          opts.auditListCommits()}
+}
+
+// the commits listed by pushes for the audit log entry, when AuditProvenance
+func (opts HandlerOptions) auditListCommits() int {
+	if !opts.AuditProvenance {
+		return 0
+	}
+	return opts.AuditMaxCommits
+}
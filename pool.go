@@ -0,0 +1,29 @@
+package git_sync
+
+import "sync"
+
+// runLimited calls fn for each index in [0, n), with at most concurrency calls running at a time.
+// The rest are queued in order. Blocks until all calls returned
+func runLimited(concurrency, n int, fn func(i int)) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for range min(concurrency, n) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				fn(i)
+			}
+		}()
+	}
+
+	for i := range n {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+}
@@ -0,0 +1,57 @@
+package git_sync
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunLimited(t *testing.T) {
+	tcs := map[string]struct {
+		concurrency, n int
+		expectedMax    int32
+	}{
+		"serial":          {1, 5, 1},
+		"invalid":         {0, 3, 1},
+		"limited":         {2, 6, 2},
+		"more than items": {10, 3, 3},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			var active, maxActive atomic.Int32
+			var mu sync.Mutex
+			var order []int
+			runLimited(tc.concurrency, tc.n, func(i int) {
+				n := active.Add(1)
+				defer active.Add(-1)
+				for {
+					m := maxActive.Load()
+					if n <= m || maxActive.CompareAndSwap(m, n) {
+						break
+					}
+				}
+
+				mu.Lock()
+				order = append(order, i)
+				mu.Unlock()
+				time.Sleep(10 * time.Millisecond)
+			})
+
+			if len(order) != tc.n {
+				t.Fatalf("expected %d calls, got %v", tc.n, order)
+			}
+			if maxActive.Load() != tc.expectedMax {
+				t.Errorf("expected at most %d concurrent calls, got %d", tc.expectedMax, maxActive.Load())
+			}
+			if tc.expectedMax == 1 {
+				for i, v := range order {
+					if v != i {
+						t.Fatalf("expected calls in order, got %v", order)
+					}
+				}
+			}
+		})
+	}
+}
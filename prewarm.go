@@ -0,0 +1,151 @@
+package git_sync
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var metricPrewarmLastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "git_sync_prewarm_last_success_timestamp",
+	Help: "Unix time of the last successful prewarm sync of the local clone of the repository and branch"}, []string{"repository_url", "branch"})
+
+// max time between checks for repositories to prewarm
+const prewarmCheckPeriod = time.Minute
+
+// Prewarmer keeps the local clones of repositories warm, by syncing them with the remotes in the background,
+// so pulls are incremental rather than full clones
+type Prewarmer struct {
+	syncer   Syncer
+	repos    []RemoteRepo
+	interval time.Duration
+	// max repositories synced at a time
+	concurrency int
+	// current token of a repository, see SetTokens
+	tokens func(repoURL string) string
+
+	// last sync attempt of each repository
+	lastRun map[RemoteRepo]time.Time
+
+	// repositories synced successfully at least once, see Pending
+	mu     sync.RWMutex
+	warmed map[RemoteRepo]bool
+}
+
+// NewPrewarmer syncs each of the repositories every interval, with at most concurrency syncs running at a time
+// (the rest are queued). A concurrency less than 1 is 1
+func NewPrewarmer(syncer Syncer, repos []RemoteRepo, interval time.Duration, concurrency int) *Prewarmer {
+	return &Prewarmer{syncer: syncer, repos: repos, interval: interval, concurrency: max(concurrency, 1),
+		lastRun: make(map[RemoteRepo]time.Time), warmed: make(map[RemoteRepo]bool)}
+}
+
+// SetTokens replaces the token of each repository with the current token returned by tokens when synced,
+// so rotated token files are used
+func (p *Prewarmer) SetTokens(tokens func(repoURL string) string) {
+	p.tokens = tokens
+}
+
+// Pending is the number of repositories not yet synced successfully
+func (p *Prewarmer) Pending() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	pending := 0
+	for _, repo := range p.repos {
+		if !p.warmed[repo] {
+			pending++
+		}
+	}
+	return pending
+}
+
+// Run syncs the repositories, starting immediately, until ctx is done
+func (p *Prewarmer) Run(ctx context.Context) {
+	ticker := time.NewTicker(min(p.interval, prewarmCheckPeriod))
+	defer ticker.Stop()
+
+	p.refresh(ctx, time.Now())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			p.refresh(ctx, now)
+		}
+	}
+}
+
+// sync each repository whose interval has elapsed, see Syncer.SyncAll. A repository locked by another
+// operation is skipped, since the operation syncs it anyway
+func (p *Prewarmer) refresh(ctx context.Context, now time.Time) {
+	var due []RemoteRepo
+	for _, repo := range p.repos {
+		if now.Sub(p.lastRun[repo]) >= p.interval {
+			due = append(due, repo)
+		}
+	}
+	if len(due) == 0 {
+		return
+	}
+
+	synced := make([]RemoteRepo, len(due))
+	for i, repo := range due {
+		if p.tokens != nil {
+			repo.Token = p.tokens(repo.URL)
+		}
+		synced[i] = repo
+	}
+	for i, err := range p.syncer.SyncAll(ctx, synced, p.concurrency) {
+		repo := due[i]
+		log := LoggerFromContext(ctx).With("op", "Prewarmer.refresh", "repo.url", repo.URL, "repo.branch", repo.Branch)
+		switch {
+		case errors.Is(err, errWorkDirInUse):
+			log.Debug("local clone in use, skipping prewarm")
+			continue
+		case ctx.Err() != nil:
+			return
+		}
+		p.lastRun[repo] = now
+		if err != nil {
+			log.Warn("prewarm failed", "err", err)
+			continue
+		}
+		metricPrewarmLastSuccess.WithLabelValues(repo.URL, repo.Branch).SetToCurrentTime()
+		p.mu.Lock()
+		p.warmed[repo] = true
+		p.mu.Unlock()
+		log.Debug("prewarmed local clone")
+	}
+}
+
+// Readiness of the server, as returned by GET /readyz
+type Readiness struct {
+	Ready bool `json:"ready"`
+
+	// Pending is the number of repositories not yet prewarmed
+	Pending int `json:"pending,omitempty"`
+}
+
+// ReadinessHandler responds with the Readiness as JSON, with 503 until each repository of the prewarmer was
+// synced successfully once, so no traffic is sent before the first (slow) clones. Always ready for a nil prewarmer
+func ReadinessHandler(p *Prewarmer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		readiness := Readiness{Ready: true}
+		if p != nil {
+			readiness.Pending = p.Pending()
+			readiness.Ready = readiness.Pending == 0
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !readiness.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(readiness); err != nil {
+			LoggerFromContext(r.Context()).Error("failed to write readiness", "op", "ReadinessHandler", "err", err)
+		}
+	})
+}
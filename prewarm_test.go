@@ -0,0 +1,128 @@
+package git_sync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bredtape/git_sync/testdata"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPrewarmRefresh(t *testing.T) {
+	repo := setupLocalBareRemote(t)
+	ctx := context.Background()
+	if _, err := Push(ctx, t.TempDir(), repo, bytes.NewReader(testdata.FullBundle)); err != nil {
+		t.Fatal(err)
+	}
+
+	s := Syncer{TempDir: t.TempDir()}
+	p := NewPrewarmer(s, []RemoteRepo{repo}, time.Hour, 1)
+
+	// in use by another operation
+	unlock := workDirLocks.Lock(s.workDir(repo))
+	p.refresh(ctx, time.Now())
+	unlock()
+	if _, ok := p.lastRun[repo]; ok {
+		t.Fatal("expected a locked repository to be skipped")
+	}
+
+	now := time.Now()
+	p.refresh(ctx, now)
+	g, err := s.newGIT(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := g.ExistsLocal(); err != nil || !exists {
+		t.Fatalf("expected a local clone, got %v", err)
+	}
+	if testutil.ToFloat64(metricPrewarmLastSuccess.WithLabelValues(repo.URL, repo.Branch)) == 0 {
+		t.Error("expected the last success to be recorded")
+	}
+
+	p.refresh(ctx, now.Add(30*time.Minute))
+	if !p.lastRun[repo].Equal(now) {
+		t.Errorf("expected the repository to be skipped within the interval, got last run %s", p.lastRun[repo])
+	}
+	p.refresh(ctx, now.Add(time.Hour))
+	if !p.lastRun[repo].Equal(now.Add(time.Hour)) {
+		t.Errorf("expected the repository to be synced after the interval, got last run %s", p.lastRun[repo])
+	}
+}
+
+func TestKeyedMutex(t *testing.T) {
+	k := &keyedMutex{locks: make(map[string]*keyedLock)}
+
+	unlock := k.Lock("a")
+	if _, ok := k.TryLock("a"); ok {
+		t.Fatal("expected a held key not to be locked again")
+	}
+	unlockB, ok := k.TryLock("b")
+	if !ok {
+		t.Fatal("expected another key to be locked")
+	}
+	unlockB()
+	unlock()
+
+	if len(k.locks) != 0 {
+		t.Errorf("expected unused locks to be removed, got %v", k.locks)
+	}
+	if unlock, ok := k.TryLock("a"); !ok {
+		t.Error("expected an unlocked key to be locked")
+	} else {
+		unlock()
+	}
+}
+
+func TestReadinessHandler(t *testing.T) {
+	repo := setupLocalBareRemote(t)
+	ctx := context.Background()
+	if _, err := Push(ctx, t.TempDir(), repo, bytes.NewReader(testdata.FullBundle)); err != nil {
+		t.Fatal(err)
+	}
+	p := NewPrewarmer(Syncer{TempDir: t.TempDir()}, []RemoteRepo{repo}, time.Hour, 1)
+
+	readiness := func(p *Prewarmer) (int, Readiness) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		ReadinessHandler(p).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		var actual Readiness
+		if err := json.NewDecoder(w.Body).Decode(&actual); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, actual
+	}
+
+	if code, actual := readiness(nil); code != http.StatusOK || !actual.Ready {
+		t.Errorf("expected ready without a prewarmer, got %d %+v", code, actual)
+	}
+	if code, actual := readiness(p); code != http.StatusServiceUnavailable || actual != (Readiness{Pending: 1}) {
+		t.Errorf("expected not ready before the first prewarm, got %d %+v", code, actual)
+	}
+	p.refresh(ctx, time.Now())
+	if code, actual := readiness(p); code != http.StatusOK || actual != (Readiness{Ready: true}) {
+		t.Errorf("expected ready after the first prewarm, got %d %+v", code, actual)
+	}
+}
+
+func TestPrewarmRefreshConcurrency(t *testing.T) {
+	ctx := context.Background()
+	var repos []RemoteRepo
+	for range 3 {
+		repo := setupLocalBareRemote(t)
+		if _, err := Push(ctx, t.TempDir(), repo, bytes.NewReader(testdata.FullBundle)); err != nil {
+			t.Fatal(err)
+		}
+		repos = append(repos, repo)
+	}
+
+	p := NewPrewarmer(Syncer{TempDir: t.TempDir()}, repos, time.Hour, 2)
+	p.refresh(ctx, time.Now())
+	if actual := p.Pending(); actual != 0 {
+		t.Errorf("expected every repository to be prewarmed, got %d pending", actual)
+	}
+}
@@ -0,0 +1,25 @@
+package git_sync
+
+// Provider administers repositories of a git hosting service, e.g. Gogs (see GogsAdmin).
+// The repositories are owned by the user the provider is authenticated as
+type Provider interface {
+	// CreateAccessToken creates a new access token of the user, e.g. to pull and push
+	CreateAccessToken() (string, error)
+	// CreateRepo creates an empty repository with the name, and returns its clone URL
+	CreateRepo(name string) (string, error)
+	// RepoExists returns whether the repository with the name exists
+	RepoExists(name string) (bool, error)
+}
+
+// CreateRandomRepo creates a repository with a random name with the provider, with a new access token
+func CreateRandomRepo(p Provider, branch string) (RemoteRepo, error) {
+	token, err := p.CreateAccessToken()
+	if err != nil {
+		return RemoteRepo{}, err
+	}
+	url, err := p.CreateRepo(generateRandomString())
+	if err != nil {
+		return RemoteRepo{}, err
+	}
+	return RemoteRepo{URL: url, Branch: branch, Token: token}, nil
+}
@@ -0,0 +1,34 @@
+//go:build integration
+
+package git_sync
+
+import (
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestProviderRepoExists(t *testing.T) {
+	provider := newTestProvider()
+	repo, err := CreateRandomRepo(provider, "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := strings.TrimSuffix(path.Base(repo.URL), ".git")
+
+	exists, err := provider.RepoExists(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		t.Errorf("expected repository %s to exist", name)
+	}
+
+	exists, err = provider.RepoExists(name + "_not")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Errorf("expected repository %s_not to not exist", name)
+	}
+}
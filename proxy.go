@@ -0,0 +1,71 @@
+package git_sync
+
+import (
+	"net/url"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/pkg/errors"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// Proxy for HTTP(S) remote repositories, used by both git commands and go-git (clone, pull and push).
+// The zero value uses the environment of the process (HTTPS_PROXY etc.) as is
+type Proxy struct {
+	HTTPProxy, HTTPSProxy string
+	// NoProxy is a comma-separated list of hosts, domains (e.g. .example.com) and CIDRs to access directly
+	NoProxy string
+}
+
+func (p Proxy) IsZero() bool {
+	return p == Proxy{}
+}
+
+// Validate that the proxies are URLs
+func (p Proxy) Validate() error {
+	for name, proxy := range map[string]string{"http proxy": p.HTTPProxy, "https proxy": p.HTTPSProxy} {
+		if proxy == "" {
+			continue
+		}
+		u, err := url.Parse(proxy)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return errors.Errorf("invalid %s '%s', expected a URL like http://proxy:3128", name, proxy)
+		}
+	}
+	return nil
+}
+
+// environment for git commands. Both cases, since git (curl) only reads the lowercase http_proxy
+func (p Proxy) env() []string {
+	if p.IsZero() {
+		return nil
+	}
+	var env []string
+	for _, name := range []string{"http_proxy", "HTTP_PROXY"} {
+		env = append(env, name+"="+p.HTTPProxy)
+	}
+	for _, name := range []string{"https_proxy", "HTTPS_PROXY"} {
+		env = append(env, name+"="+p.HTTPSProxy)
+	}
+	for _, name := range []string{"no_proxy", "NO_PROXY"} {
+		env = append(env, name+"="+p.NoProxy)
+	}
+	return env
+}
+
+// options for go-git to access the repository. Empty for a direct connection,
+// when no proxy is configured for the scheme or the host matches NoProxy
+func (p Proxy) options(repoURL string) transport.ProxyOptions {
+	if p.IsZero() {
+		return transport.ProxyOptions{}
+	}
+	u, err := url.Parse(repoURL)
+	if err != nil {
+		return transport.ProxyOptions{}
+	}
+	cfg := httpproxy.Config{HTTPProxy: p.HTTPProxy, HTTPSProxy: p.HTTPSProxy, NoProxy: p.NoProxy}
+	proxy, err := cfg.ProxyFunc()(u)
+	if err != nil || proxy == nil {
+		return transport.ProxyOptions{}
+	}
+	return transport.ProxyOptions{URL: proxy.String()}
+}
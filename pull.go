@@ -1,14 +1,22 @@
 package git_sync
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -21,197 +29,821 @@ var (
 
 	metricOpsError = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "git_sync_ops_error_total",
-		Help: "Total number of git sync operations attempted, that resulted in some error"}, []string{"op", "repository_url"})
+		Help: "Total number of git sync operations attempted, that resulted in some error, by reason (auth, not_found, empty, conflict, timeout, bad_request or internal)"}, []string{"op", "repository_url", "reason"})
+
+	metricRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "git_sync_retries_total",
+		Help: "Total number of retries of remote operations, after a transient error"}, []string{"op"})
+
+	metricClientCancelled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "git_sync_client_cancelled_total",
+		Help: "Total number of operations cancelled, since the client disconnected before the response was written"}, []string{"op", "repository_url"})
+
+	metricBundleCreateFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "git_sync_bundle_create_failures_total",
+		Help: "Total number of failures to create a bundle, by cause (empty, git_missing, disk, killed or other)"}, []string{"cause"})
 )
 
 type GitPullHandler struct {
 	tempDir string
+	opts    HandlerOptions
 }
 
-func NewGitPullHandler(tempDir string) *GitPullHandler {
-	return &GitPullHandler{tempDir: tempDir}
+func NewGitPullHandler(tempDir string, opts HandlerOptions) *GitPullHandler {
+	return &GitPullHandler{tempDir: tempDir, opts: opts}
 }
 
 func (h *GitPullHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
-	log := slog.With("op", "GitPullHandler.ServeHTTP")
+	log := LoggerFromContext(r.Context()).With("op", "GitPullHandler.ServeHTTP")
 
-	remoteRepo, err := extractArgs(r)
+	auth := h.opts.authExtractor(r.URL.Query().Get("repository"))
+	remoteRepo, err := extractArgs(r, auth, h.opts.AllowedRepos)
+	if errors.Is(err, ErrNoAuth) {
+		// public repositories can be pulled without a token
+		remoteRepo, err = extractArgs(r, StaticToken(""), h.opts.AllowedRepos)
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeArgsError(w, auth, err)
 		return
 	}
+	remoteRepo.TempDir = h.opts.Repos.TempDir(remoteRepo.URL)
 	log = log.With("repo.url", remoteRepo.URL, "repo.branch", remoteRepo.Branch)
 
-	opt := BundleOptions{}
-	sinceRaw := r.URL.Query().Get("since")
-	if sinceRaw != "" {
-		d, err := time.ParseDuration(sinceRaw)
+	var opt BundleOptions
+	if r.Method == http.MethodPost {
+		opt, err = bundleOptionsFromBody(r.Body)
+	} else {
+		opt, err = bundleOptionsFromQuery(r.URL.Query())
+	}
+	if err != nil {
+		log.Error("invalid bundle options", "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if opt.Since != 0 {
+		log = log.With("since", opt.Since)
+	}
+	if !opt.After.IsZero() {
+		log = log.With("after", opt.After)
+	}
+	if opt.From != "" || opt.To != "" {
+		log = log.With("from", opt.From, "to", opt.To)
+	}
+	if opt.MaxCommits != 0 {
+		log = log.With("maxCommits", opt.MaxCommits)
+	}
+
+	args := pullArgs{remoteRepo: remoteRepo, opt: opt, url: r.URL, head: r.Method == http.MethodHead}
+
+	chunkByRaw := r.URL.Query().Get("chunk-by")
+	if chunkByRaw != "" {
+		d, err := parseDuration(chunkByRaw)
 		if err != nil {
-			log.Error("invalid since duration", "err", err)
-			http.Error(w, fmt.Sprintf("Invalid since duration '%s'", sinceRaw), http.StatusBadRequest)
+			log.Error("invalid chunk-by duration", "err", err)
+			http.Error(w, fmt.Sprintf("Invalid chunk-by duration '%s', expected e.g. 12h, 7d or 2w", chunkByRaw), http.StatusBadRequest)
 			return
 		}
 		if d < time.Second {
-			log.Error("since duration too short", "duration", d)
-			http.Error(w, "Since duration must be at least 1 second", http.StatusBadRequest)
+			log.Error("chunk-by duration too short", "duration", d)
+			http.Error(w, "Chunk-by duration must be at least 1 second", http.StatusBadRequest)
+			return
+		}
+		if opt.HasAny() || opt.To != "" {
+			log.Error("chunk-by combined with bundle options")
+			http.Error(w, "Chunk-by cannot be combined with since, after, from, to or max-commits", http.StatusBadRequest)
 			return
 		}
 
-		opt.Since = d
-		log = log.With("since", d)
-	}
+		if r.URL.Query().Get("format") != "" {
+			log.Error("chunk-by combined with format")
+			http.Error(w, "Chunk-by cannot be combined with format", http.StatusBadRequest)
+			return
+		}
 
-	afterRaw := r.URL.Query().Get("after")
-	if afterRaw != "" {
-		t, err := time.Parse(time.RFC3339, afterRaw)
+		args.chunkBy = d
+		log = log.With("chunkBy", d)
+	} else {
+		args.format, args.contentType, err = selectFormat(r.URL.Query().Get("format"), r.Header.Get("Accept"))
 		if err != nil {
-			log.Error("invalid after time", "err", err)
-			http.Error(w, fmt.Sprintf("Invalid after time '%s'", afterRaw), http.StatusBadRequest)
+			log.Debug("unsupported format", "format", r.URL.Query().Get("format"), "accept", r.Header.Get("Accept"))
+			http.Error(w, fmt.Sprintf("Unsupported format, expected %s (format=%s) or %s (format=%s)",
+				contentTypeGitBundle, formatBundle, contentTypeGitPackfile, formatPackfile), http.StatusNotAcceptable)
+			return
+		}
+		if args.format != formatBundle {
+			log = log.With("format", args.format)
+		}
+	}
+
+	cursor := r.URL.Query().Get("cursor")
+	if raw := r.URL.Query().Get("chunk-size"); raw != "" {
+		size, err := strconv.Atoi(raw)
+		if err != nil || size <= 0 {
+			http.Error(w, fmt.Sprintf("Invalid chunk-size '%s', expected a positive number of commits", raw), http.StatusBadRequest)
+			return
+		}
+		if opt.HasAny() || opt.To != "" || args.chunkBy != 0 {
+			http.Error(w, "Chunk-size cannot be combined with since, after, from, to, max-commits or chunk-by", http.StatusBadRequest)
 			return
 		}
-		if t.IsZero() {
-			log.Error("zero after time")
-			http.Error(w, "After time must be non-zero", http.StatusBadRequest)
+		if cursor != "" && !isCommitID(cursor) {
+			http.Error(w, fmt.Sprintf("Invalid cursor '%s', expected a commit ID", cursor), http.StatusBadRequest)
 			return
 		}
+		args.chunkSize, args.cursor = size, cursor
+		log = log.With("chunkSize", size, "cursor", cursor)
+	} else if cursor != "" {
+		http.Error(w, "Cursor requires chunk-size", http.StatusBadRequest)
+		return
+	}
+
+	if raw := r.URL.Query().Get("incremental"); raw != "" {
+		incremental, err := strconv.ParseBool(raw)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid incremental '%s', expected true or false", raw), http.StatusBadRequest)
+			return
+		}
+		if incremental {
+			if h.opts.Cursors == nil {
+				http.Error(w, "Incremental pulls are not enabled", http.StatusBadRequest)
+				return
+			}
+			if opt.HasAny() || opt.To != "" || args.chunkBy != 0 || args.chunkSize != 0 {
+				http.Error(w, "Incremental cannot be combined with since, after, from, to, max-commits, chunk-by or chunk-size", http.StatusBadRequest)
+				return
+			}
+			if remoteRepo.Branch == AllBranches {
+				http.Error(w, "Incremental is not supported for all branches", http.StatusBadRequest)
+				return
+			}
+			if id := r.URL.Query().Get("client-id"); id != "" && !isValidRequestID(id) {
+				http.Error(w, "Invalid client-id, expected at most 64 letters, digits, '-' or '_'", http.StatusBadRequest)
+				return
+			}
+			args.client = h.opts.clientID(r)
+			if args.client == "" {
+				http.Error(w, "Incremental requires a token, also with a client-id", http.StatusBadRequest)
+				return
+			}
+			log = log.With("client", args.client)
+		}
+	}
+
+	repoLabel := h.opts.metricRepo(remoteRepo.URL)
+	metricOps.WithLabelValues("pull", repoLabel).Inc()
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	w = rec
+	mErr := &opsError{op: "pull", repoURL: repoLabel, rec: rec}
+	defer mErr.record()
+
+	if h.opts.EnableCompression {
+		args.encoding = selectEncoding(r.Header.Get("Accept-Encoding"))
+	}
 
-		opt.After = t
-		log = log.With("after", t)
+	release, err := h.opts.Limiter.Acquire(r.Context(), remoteRepo.URL)
+	if err != nil {
+		log.Warn("pull rejected", "err", err)
+		mErr.Inc()
+		h.opts.Limiter.writeError(w, err)
+		return
 	}
+	defer release()
 
-	metricOps.WithLabelValues("pull", remoteRepo.URL).Inc()
-	mErr := metricOpsError.WithLabelValues("pull", remoteRepo.URL)
+	ctx, done := h.opts.Operations.Start(r.Context())
+	defer done()
 
-	success := h.pull(log, remoteRepo, opt, w)
+	success := h.pull(ctx, log, args, w, r)
 	if !success {
+		if err := r.Context().Err(); err != nil {
+			// the git commands of the pull were killed
+			log.Info("pull cancelled, the client disconnected", "err", err)
+			metricClientCancelled.WithLabelValues("pull", repoLabel).Inc()
+			return
+		}
 		mErr.Inc()
 	}
 }
 
-func (h *GitPullHandler) pull(log *slog.Logger, remoteRepo RemoteRepo, opt BundleOptions, w http.ResponseWriter) (success bool) {
-	git, err := NewGIT(h.tempDir, remoteRepo)
+// counts a failed operation in metricOpsError when the handler returns, with the reason derived from
+// the status of the response, since that is where the handlers classify errors
+type opsError struct {
+	op, repoURL string
+	rec         *statusRecorder
+	failed      bool
+}
+
+// mark the operation as failed
+func (e *opsError) Inc() {
+	e.failed = true
+}
+
+func (e *opsError) record() {
+	if e.failed {
+		metricOpsError.WithLabelValues(e.op, e.repoURL, errorReason(e.rec.status)).Inc()
+	}
+}
+
+// category of a failed operation by the status of the response
+func errorReason(status int) string {
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusBadGateway:
+		// 502 when the remote rejects the token of the server
+		return "auth"
+	case http.StatusNotFound:
+		return "not_found"
+	case http.StatusNoContent:
+		// nothing to bundle, e.g. no new commits or the branch does not exist
+		return "empty"
+	case http.StatusConflict, http.StatusPreconditionFailed:
+		return "conflict"
+	case http.StatusRequestTimeout, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		// 503 when the concurrency limit is reached or the remote is unavailable
+		return "timeout"
+	}
+	if status >= 400 && status < 500 {
+		return "bad_request"
+	}
+	// including a failure to write a successful response
+	return "internal"
+}
+
+// weak ETag of the head, since the bytes of a bundle of the head depend on the options and the encoding
+func headETag(head plumbing.Hash) string {
+	return fmt.Sprintf(`W/"%s"`, head)
+}
+
+// whether the If-None-Match header has the ETag, by weak comparison
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// strong ETag of the bundle bytes, for the encoding of the response
+func bundleETag(bundle []byte, encoding string) string {
+	sum := sha256.Sum256(bundle)
+	if encoding == "" {
+		return fmt.Sprintf(`"%s"`, hex.EncodeToString(sum[:]))
+	}
+	return fmt.Sprintf(`"%s-%s"`, hex.EncodeToString(sum[:]), encoding)
+}
+
+// PullOptionsBody is the JSON body of a POST pull, as an alternative to the query parameters. Only the options
+// of the query parameters are supported. Options selecting commits or objects otherwise (see unsupportedPullOptions)
+// are rejected, since bundles are created with a single head of the branch, and no filter or path limits
+type PullOptionsBody struct {
+	// Since is the lookback duration, e.g. 1h30m
+	Since string     `json:"since,omitempty"`
+	After *time.Time `json:"after,omitempty"`
+	From  string     `json:"from,omitempty"`
+	To    string     `json:"to,omitempty"`
+	// MaxCommits limits the bundle to the newest commits
+	MaxCommits *int `json:"max-commits,omitempty"`
+}
+
+// parse and validate bundle options from the query parameters since, after, from, to and max-commits
+func bundleOptionsFromQuery(q url.Values) (BundleOptions, error) {
+	body := PullOptionsBody{Since: q.Get("since"), From: q.Get("from"), To: q.Get("to")}
+	if raw := q.Get("after"); raw != "" {
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return BundleOptions{}, fmt.Errorf("Invalid after time '%s'", raw)
+		}
+		body.After = &t
+	}
+	if raw := q.Get("max-commits"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return BundleOptions{}, fmt.Errorf("Invalid max-commits '%s'", raw)
+		}
+		body.MaxCommits = &n
+	}
+	return body.bundleOptions()
+}
+
+// options of a POST pull body, that are not supported by PullOptionsBody
+var unsupportedPullOptions = []string{"until", "excludes", "filter", "tags", "paths"}
+
+// parse and validate bundle options from a JSON body. An empty body is a full bundle
+func bundleOptionsFromBody(r io.Reader) (BundleOptions, error) {
+	data, err := io.ReadAll(r)
 	if err != nil {
-		log.Error("failed to create git", "err", err)
-		http.Error(w, "internal error", http.StatusInternalServerError)
-		return
+		return BundleOptions{}, fmt.Errorf("Failed to read bundle options body: %v", err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err == nil {
+		for _, name := range unsupportedPullOptions {
+			if _, ok := fields[name]; ok {
+				return BundleOptions{}, fmt.Errorf("Bundle option '%s' is not supported", name)
+			}
+		}
+	}
+
+	var body PullOptionsBody
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		return BundleOptions{}, fmt.Errorf("Invalid bundle options body: %v", err)
+	}
+	return body.bundleOptions()
+}
+
+// durationUnits are the units of parseDuration larger than hours
+var durationUnits = map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour}
+
+// parse a duration like time.ParseDuration, with the additional units d (24h) and w (7d), e.g. 1w2d12h
+func parseDuration(s string) (time.Duration, error) {
+	rest, sign := s, time.Duration(1)
+	if r, ok := strings.CutPrefix(rest, "-"); ok {
+		rest, sign = r, -1
+	} else {
+		rest = strings.TrimPrefix(rest, "+")
+	}
+	if rest == "" {
+		return 0, fmt.Errorf("invalid duration '%s'", s)
+	}
+
+	var total time.Duration
+	for rest != "" {
+		// each term is a number followed by a unit
+		i := strings.IndexFunc(rest, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+		if i <= 0 {
+			return 0, fmt.Errorf("invalid duration '%s'", s)
+		}
+		j := strings.IndexFunc(rest[i:], func(r rune) bool { return (r >= '0' && r <= '9') || r == '.' })
+		if j < 0 {
+			j = len(rest) - i
+		}
+		number, unit := rest[:i], rest[i:i+j]
+		rest = rest[i+j:]
+
+		if size, ok := durationUnits[unit]; ok {
+			n, err := strconv.ParseFloat(number, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration '%s'", s)
+			}
+			total += time.Duration(n * float64(size))
+			continue
+		}
+		d, err := time.ParseDuration(number + unit)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration '%s'", s)
+		}
+		total += d
 	}
+	return sign * total, nil
+}
 
-	// Clone to local
-	worktree, err := git.SyncRepoToLocalTemp()
+// minimum lookback of since, and of after relative to now. git resolves both to whole seconds,
+// so an after less than a second ago would match commits in the current second, unlike since
+const minLookback = time.Second
+
+func (body PullOptionsBody) bundleOptions() (BundleOptions, error) {
+	opt := BundleOptions{From: body.From, To: body.To}
+	if body.Since != "" {
+		d, err := parseDuration(body.Since)
+		if err != nil {
+			return BundleOptions{}, fmt.Errorf("Invalid since duration '%s', expected e.g. 1h30m, 7d or 2w", body.Since)
+		}
+		if d < minLookback {
+			return BundleOptions{}, errors.New("Since duration must be at least 1 second")
+		}
+		opt.Since = d
+	}
+	if body.After != nil {
+		if body.After.IsZero() {
+			return BundleOptions{}, errors.New("After time must be non-zero")
+		}
+		after := body.After.Truncate(time.Second)
+		if ago := time.Since(after); ago < 0 {
+			return BundleOptions{}, errors.New("After time must not be in the future")
+		} else if ago < minLookback {
+			return BundleOptions{}, errors.New("After time must be at least 1 second in the past")
+		}
+		opt.After = after
+	}
+	if body.MaxCommits != nil {
+		if *body.MaxCommits < 1 {
+			return BundleOptions{}, errors.New("Max-commits must be at least 1")
+		}
+		opt.MaxCommits = *body.MaxCommits
+	}
+	if err := opt.Validate(); err != nil {
+		return BundleOptions{}, fmt.Errorf("Invalid bundle options: %v", err)
+	}
+	return opt, nil
+}
+
+// parsed arguments for a pull
+type pullArgs struct {
+	remoteRepo RemoteRepo
+	opt        BundleOptions
+
+	// encoding of the response. Empty for no compression
+	encoding string
+
+	// when set, respond with a manifest of chunks instead of a bundle
+	chunkBy time.Duration
+
+	// format and Content-Type of the response, see selectFormat. Not used with chunkBy
+	format, contentType string
+
+	// client of an incremental pull, see HandlerOptions.clientID. Empty if not incremental
+	client string
+
+	// when set, respond with the bundle of the next (at most) chunkSize commits after cursor (empty for
+	// the oldest commit), and the cursor of the following chunk in X-Git-Next-Cursor
+	chunkSize int
+	cursor    string
+
+	// the request URL, used as base for the chunk URLs
+	url *url.URL
+
+	// only respond with the head of the branch (HEAD request), without creating a bundle
+	head bool
+}
+
+// ChunkManifest lists a sequence of partial bundles, that applied in order reconstructs the full history
+type ChunkManifest struct {
+	Head   string  `json:"head"`
+	Chunks []Chunk `json:"chunks"`
+}
+
+type Chunk struct {
+	// From commit ID (exclusive). Empty for the first chunk
+	From string `json:"from,omitempty"`
+	// To commit ID (inclusive)
+	To string `json:"to"`
+	// URL to pull the chunk from (relative to the server)
+	URL string `json:"url"`
+}
+
+func (h *GitPullHandler) pull(ctx context.Context, log *slog.Logger, args pullArgs, w http.ResponseWriter, r *http.Request) (success bool) {
+	opt := args.opt
+	if args.head {
+		return h.writeHead(ctx, log, args, w)
+	}
+	if args.chunkBy != 0 {
+		return h.writeChunkManifest(ctx, log, args, w)
+	}
+
+	syncer := h.opts.syncer(h.tempDir)
+	if args.chunkSize != 0 {
+		chunk, more, err := syncer.NextChunk(ctx, args.remoteRepo, args.cursor, args.chunkSize)
+		if err != nil {
+			if r.Context().Err() != nil {
+				return
+			}
+			h.writeError(log, w, err, BundleOptions{From: args.cursor})
+			return
+		}
+		opt = chunk
+		next := ""
+		if more {
+			next = chunk.To
+		}
+		// empty when the chunk ends at the head
+		w.Header().Set("X-Git-Next-Cursor", next)
+	}
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && args.client == "" && !opt.HasAny() && opt.To == "" {
+		// the client has a full bundle of the head (the ETag of a HEAD request), which is read from the remote
+		// without syncing the local clone. Other ETags, e.g. of deterministic bundles, are checked once created
+		if result, err := syncer.Head(ctx, args.remoteRepo); err == nil && etagMatches(ifNoneMatch, headETag(result.Head)) {
+			w.Header().Set("ETag", headETag(result.Head))
+			w.WriteHeader(http.StatusNotModified)
+			log.Debug("not modified", "head", result.Head, "syncMode", result.SyncMode)
+			return true
+		}
+	}
+	pull := syncer.Pull
+	if args.format == formatPackfile {
+		pull = syncer.PullPack
+	}
+	if args.client != "" {
+		// continue from the last head served to the client, or a full bundle
+		opt.From = h.opts.Cursors.Get(args.remoteRepo, args.client)
+	}
+	result, err := pull(ctx, args.remoteRepo, opt)
+	if args.client != "" && opt.From != "" && errors.Is(err, ErrCommitNotFound) {
+		log.Warn("last served head not found, e.g. after a rewrite. Pulling a full bundle", "from", opt.From)
+		opt.From = ""
+		result, err = pull(ctx, args.remoteRepo, opt)
+	}
 	if err != nil {
-		log.Error("sync to local failed", "err", err)
-		if errors.Is(err, ErrAuthFailed) {
-			http.Error(w, "authentication required", http.StatusUnauthorized)
+		if r.Context().Err() != nil {
+			// no one to respond to
 			return
 		}
-		http.Error(w, fmt.Sprintf("failed to sync repository: %v", err), http.StatusInternalServerError)
+		h.writeError(log, w, err, opt)
 		return
 	}
 
-	if worktree == nil {
-		log.Debug("remote repository does not exist")
-		http.Error(w, "remote repository does not exist", http.StatusNotFound)
-		return
+	if result.Rewritten {
+		// clients holding the old history must re-clone from the full bundle
+		w.Header().Set("X-Git-Rewritten", "true")
+	}
+	w.Header().Set("X-Git-IsPartial", fmt.Sprintf("%t", opt.HasAny()))
+	w.Header().Set("X-Git-Sync-Mode", string(result.SyncMode))
+	w.Header().Set("X-Git-Hash-Algorithm", result.Info.HashAlgorithm)
+	filename := ""
+	if args.remoteRepo.Branch == AllBranches {
+		// a head per branch, only listed in the bundle header
+		filename = fmt.Sprintf("git_all_%s.bundle", createHeadsHash(result.Info.Heads))
+	} else {
+		head := result.Info.Heads[0]
+		w.Header().Set("X-Git-Head", head.CommitID)
+		if result.Oldest != "" {
+			w.Header().Set("X-Git-Oldest", result.Oldest)
+		}
+		hash := createHash(head, opt)
+		var err error
+		filename, err = h.opts.bundleFilename(args.remoteRepo, head, hash, time.Now())
+		if err != nil {
+			log.Error("failed to create bundle filename, using the default", "err", err)
+			filename = fmt.Sprintf("git_%s_%s.bundle", head.CommitID, hash)
+		}
 	}
 
-	exists, err := git.hasLocalBranch()
-	if err != nil {
-		log.Error("failed to check if branch exists", "err", err)
-		http.Error(w, fmt.Sprintf("failed to check if branch exists: %v", err), http.StatusInternalServerError)
-		return
+	body := result.Bundle
+	if args.format == formatPackfile {
+		body = result.Pack
+		filename = strings.TrimSuffix(filename, ".bundle") + ".pack"
 	}
 
-	if !exists {
-		log.Debug("branch not found")
-		w.WriteHeader(http.StatusNoContent)
-		w.Write([]byte("branch not found"))
+	// Write the bundle (or pack) to the response
+	w.Header().Set("Content-Type", args.contentType)
+	w.Header().Add("Vary", "Accept")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+	if h.opts.DeterministicBundles && args.format == formatBundle {
+		// the same content yields the same bytes, so the ETag is strong
+		w.Header().Set("ETag", bundleETag(result.Bundle, args.encoding))
+	}
+	h.opts.setStreamDeadline(log, w)
+	status := http.StatusOK
+	if args.encoding == "" && w.Header().Get("ETag") != "" {
+		// the same bytes for the strong ETag, so an interrupted download can be resumed with Range and If-Range
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		http.ServeContent(rec, r, filename, time.Time{}, bytes.NewReader(body))
+		status = rec.status
+		if r.Context().Err() != nil {
+			return
+		}
+	} else if err := writeCompressed(w, args.encoding, body); err != nil {
+		if r.Context().Err() == nil {
+			log.Error("failed to write bundle", "err", err, "encoding", args.encoding, "format", args.format)
+		}
 		return
 	}
+	log.Debug("bundle created", "encoding", args.encoding, "syncMode", result.SyncMode)
 
-	hasCommits, err := git.hasLocalCommits()
-	if err != nil {
-		log.Error("failed to check if branch has commits", "err", err)
-		http.Error(w, fmt.Sprintf("failed to check if branch has commits: %v", err), http.StatusInternalServerError)
-		return
+	if args.client != "" {
+		h.advanceCursor(log, w, status, args, result.Info.Heads[0].CommitID)
 	}
 
-	if !hasCommits {
-		log.Debug("no commits")
-		w.WriteHeader(http.StatusNoContent)
-		w.Write([]byte("no commits"))
+	event := Event{Op: "pull", Repository: args.remoteRepo.URL, Branch: args.remoteRepo.Branch, Commits: result.Commits, Timestamp: time.Now().UTC()}
+	if args.remoteRepo.Branch != AllBranches {
+		event.Head = result.Info.Heads[0].CommitID
+	}
+	h.opts.markSynced("pull", args.remoteRepo.URL, args.remoteRepo.Branch, time.Now())
+	h.opts.Webhook.Send(h.opts.Operations, log, event)
+	return true
+}
+
+// advance the cursor of the client of an incremental pull to head, once the complete bundle was written and
+// flushed to the client. Otherwise the client would never get the commits of the bundle
+func (h *GitPullHandler) advanceCursor(log *slog.Logger, w http.ResponseWriter, status int, args pullArgs, head string) {
+	if status != http.StatusOK {
+		// e.g. a range of the bundle
+		log.Debug("bundle not served in full, the cursor is not advanced", "status", status)
+		return
+	}
+	if err := http.NewResponseController(w).Flush(); err != nil {
+		log.Warn("failed to flush bundle, the cursor is not advanced", "err", err)
 		return
 	}
+	if err := h.opts.Cursors.Set(args.remoteRepo, args.client, head); err != nil {
+		log.Error("failed to save cursor", "err", err)
+	}
+}
 
-	bundleData, err := git.CreateBundleFromLocal(opt)
+// respond to a HEAD request with the headers of the head of the branch, without creating a bundle.
+// The bundle options are ignored
+func (h *GitPullHandler) writeHead(ctx context.Context, log *slog.Logger, args pullArgs, w http.ResponseWriter) (success bool) {
+	result, err := h.opts.syncer(h.tempDir).Head(ctx, args.remoteRepo)
 	if err != nil {
-		if cmdErr, ok := err.(*CommandError); ok {
-			if opt.HasAny() && strings.Contains(cmdErr.StdErr, "Refusing to create empty bundle") {
-				log.Debug("no new commits since", "since", opt.Since)
-				http.Error(w, fmt.Sprintf("no new commits since %v", time.Now().Add(-opt.Since)), http.StatusNoContent)
-				return
-			}
-			log.Error("bundle failed", "err", cmdErr.Err, "stderr", cmdErr.StdErr)
-		}
-		http.Error(w, fmt.Sprintf("Failed to create bundle: %v", err), http.StatusInternalServerError)
+		h.writeError(log, w, err, args.opt)
 		return
 	}
 
-	heads, err := git.GetBundleListHeads(bundleData)
+	if result.Rewritten {
+		w.Header().Set("X-Git-Rewritten", "true")
+	}
+	w.Header().Set("X-Git-Sync-Mode", string(result.SyncMode))
+	w.Header().Set("X-Git-Hash-Algorithm", result.HashAlgorithm)
+	w.Header().Set("X-Git-Head", result.Head.String())
+	w.Header().Set("ETag", headETag(result.Head))
+	w.WriteHeader(http.StatusOK)
+	log.Debug("head resolved", "head", result.Head, "syncMode", result.SyncMode)
+	return true
+}
+
+func (h *GitPullHandler) writeChunkManifest(ctx context.Context, log *slog.Logger, args pullArgs, w http.ResponseWriter) (success bool) {
+	chunks, err := h.opts.syncer(h.tempDir).Chunks(ctx, args.remoteRepo, args.chunkBy)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get bundle info: %v", err), http.StatusInternalServerError)
+		h.writeError(log, w, err, args.opt)
 		return
 	}
 
-	if len(heads) != 1 {
-		http.Error(w, fmt.Sprintf("Expected exactly one head, got %v", heads), http.StatusInternalServerError)
+	manifest := ChunkManifest{Chunks: []Chunk{}}
+	for _, c := range chunks {
+		q := url.Values{}
+		q.Set("repository", args.remoteRepo.URL)
+		q.Set("branch", args.remoteRepo.Branch)
+		if c.From != "" {
+			q.Set("from", c.From)
+		}
+		q.Set("to", c.To)
+		u := url.URL{Path: args.url.Path, RawQuery: q.Encode()}
+		manifest.Chunks = append(manifest.Chunks, Chunk{From: c.From, To: c.To, URL: u.String()})
+		manifest.Head = c.To
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(manifest); err != nil {
+		log.Error("failed to write chunk manifest", "err", err)
 		return
 	}
+	log.Debug("chunk manifest created", "chunks", len(manifest.Chunks))
+	return true
+}
 
-	commitID := heads[0].CommitID
-	w.Header().Set("X-Git-Head", commitID)
-	w.Header().Set("X-Git-IsPartial", fmt.Sprintf("%t", opt.HasAny()))
-	hash := createHash(heads[0], opt)
+// write error response for a failed pull
+func (h *GitPullHandler) writeError(log *slog.Logger, w http.ResponseWriter, err error, opt BundleOptions) {
+	switch {
+	case errors.Is(err, ErrAuthFailed):
+		log.Error("sync to local failed", "err", err)
+		h.opts.writeRemoteAuthError(w)
+	case errors.Is(err, ErrRepositoryNotFound):
+		log.Debug("remote repository does not exist")
+		http.Error(w, "remote repository does not exist", http.StatusNotFound)
+	case errors.Is(err, ErrRewritten):
+		log.Warn("remote branch history was rewritten", "err", err)
+		http.Error(w, "the history of the branch in the remote repository was rewritten (force-pushed) since the last sync", http.StatusConflict)
+	case errors.Is(err, ErrBranchNotFound), errors.Is(err, ErrNoCommits):
+		log.Debug(err.Error())
+		w.WriteHeader(http.StatusNoContent)
+		w.Write([]byte(err.Error()))
+	case errors.Is(err, ErrBranchNotCommit):
+		log.Warn("branch does not point to a commit", "err", err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	case errors.Is(err, ErrCommitNotFound):
+		log.Debug("commit not found", "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrAllBranchesUnsupported):
+		log.Debug("unsupported for all branches", "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrLFSPointers):
+		log.Debug("branch uses Git LFS", "err", err)
+		http.Error(w, fmt.Sprintf("%v. The server must be configured with allow-lfs-pointers to pull it anyway, and the LFS objects transferred separately", err), http.StatusUnprocessableEntity)
+	case errors.Is(err, ErrEmptyBundle):
+		msg := emptyBundleMessage(opt, time.Now())
+		log.Debug(msg)
+		http.Error(w, msg, http.StatusNoContent)
+	case errors.Is(err, ErrNoBundleHeads):
+		// e.g. a corrupt bundle. Nothing to serve, rather than a server error
+		log.Warn("created bundle has no heads")
+		http.Error(w, "no commits to bundle: the created bundle has no heads", http.StatusNoContent)
+	case errors.Is(err, ErrMultipleBundleHeads):
+		log.Error("created bundle has multiple heads", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	case isRemoteUnavailable(err):
+		log.Warn("remote repository unavailable", "err", err)
+		writeRemoteUnavailableError(w, err)
+	default:
+		var cmdErr *CommandError
+		if errors.As(err, &cmdErr) {
+			log.Error("pull failed", "err", err, "stderr", cmdErr.StdErr)
+		} else {
+			log.Error("pull failed", "err", err)
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
 
-	// Write the bundle to the response
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=git_%s_%s.bundle", commitID, hash))
-	w.Write(bundleData)
-	log.Debug("bundle created")
-	return true
+// describe the boundary of the bundle options, that no commits matched
+func emptyBundleMessage(opt BundleOptions, now time.Time) string {
+	switch {
+	case opt.Since != 0:
+		return fmt.Sprintf("no new commits since %s (%v ago)", now.Add(-opt.Since).UTC().Format(time.RFC3339), opt.Since)
+	case !opt.After.IsZero():
+		return fmt.Sprintf("no new commits after %s", opt.After.Format(time.RFC3339))
+	case opt.From != "":
+		return fmt.Sprintf("no new commits after commit %s", opt.From)
+	default:
+		return "no new commits"
+	}
+}
+
+var errNoBranch = errors.New("no 'branch' specified")
+
+// ErrInvalidBranch is returned for a branch name that git would reject, or that could be taken as an option
+var ErrInvalidBranch = errors.New("invalid branch name")
+
+// validate the branch name by the ref name rules of git (see git check-ref-format --branch), before it is
+// passed to git commands. AllBranches is valid
+func validateBranch(branch string) error {
+	if branch == AllBranches {
+		return nil
+	}
+	// a leading '-' would be taken as an option by git
+	if strings.HasPrefix(branch, "-") || branch == "HEAD" ||
+		plumbing.NewBranchReferenceName(branch).Validate() != nil {
+		return errors.Wrapf(ErrInvalidBranch, "'%s'", branch)
+	}
+	return nil
 }
 
-func extractArgs(r *http.Request) (RemoteRepo, error) {
+// extract repository and branch from the query, and the remote token with auth.
+// Returns ErrNoAuth (wrapped) if no token is found, ErrInvalidBranch (wrapped) for an invalid branch name,
+// and errNoBranch if only the branch is missing
+func extractArgs(r *http.Request, auth AuthExtractor, allowed RepoAllowlist) (RemoteRepo, error) {
 	args := RemoteRepo{
 		URL:    r.URL.Query().Get("repository"),
 		Branch: r.URL.Query().Get("branch")}
+	if args.Branch == "" {
+		// e.g. /pull/{branch}
+		args.Branch = mux.Vars(r)["branch"]
+	}
 	if args.URL == "" {
 		return args, errors.New("no 'repository' specified")
 	}
-	if args.Branch == "" {
-		return args, errors.New("no 'branch' specified")
+	if !allowed.Allows(args.URL) {
+		return args, ErrRepoNotAllowed
+	}
+	if args.Branch != "" {
+		if err := validateBranch(args.Branch); err != nil {
+			return args, err
+		}
 	}
 
-	token, err := extractAuthToken(r)
+	token, err := auth.ExtractToken(r)
+	if err != nil {
+		return args, err
+	}
 	args.Token = token
-	return args, err
-}
 
-func extractAuthToken(r *http.Request) (string, error) {
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		return "", fmt.Errorf("no Authorization header")
+	if args.Branch == "" {
+		return args, errNoBranch
 	}
+	return args, nil
+}
 
-	if !strings.HasPrefix(authHeader, "Bearer ") {
-		return "", fmt.Errorf("invalid Authorization header")
+// write error response for extractArgs. Missing credentials are 401 with the challenge of the extractor,
+// a repository that is not allowed 403, and other invalid requests 400
+func writeArgsError(w http.ResponseWriter, auth AuthExtractor, err error) {
+	if errors.Is(err, ErrNoAuth) {
+		writeUnauthorized(w, auth, err.Error())
+		return
 	}
-
-	return strings.TrimPrefix(authHeader, "Bearer "), nil
+	if errors.Is(err, ErrRepoNotAllowed) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
 }
 
+// hash of the head and the options of a bundle. The options are in canonical form, so equal options
+// yield the same hash, e.g. the same instant in another time zone or without the monotonic clock
 func createHash(head Head, opt BundleOptions) string {
-	h := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%s", head.CommitID, opt.After, opt.Since)))
+	var after string
+	if !opt.After.IsZero() {
+		after = opt.After.UTC().Format(time.RFC3339Nano)
+	}
+	key := fmt.Sprintf("%s|%s|%d", head.CommitID, after, int64(opt.Since/time.Second))
+	if opt.From != "" {
+		key += "|" + opt.From
+	}
+	if opt.MaxCommits != 0 {
+		key += fmt.Sprintf("|max-commits=%d", opt.MaxCommits)
+	}
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+// hash of the heads of a bundle of all branches
+func createHeadsHash(heads []Head) string {
+	var key strings.Builder
+	for _, head := range heads {
+		fmt.Fprintf(&key, "%s %s\n", head.CommitID, head.Ref)
+	}
+	h := sha256.Sum256([]byte(key.String()))
 	return hex.EncodeToString(h[:])
 }
@@ -0,0 +1,451 @@
+//go:build integration
+
+package git_sync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bredtape/git_sync/testdata"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/gorilla/mux"
+)
+
+// tests assumes that integrationtest/gogs-dev is running. Run with: go test -tags integration ./...
+
+func TestPullRemoteRepoDoesNotExist(t *testing.T) {
+	slog.SetLogLoggerLevel(slog.LevelDebug)
+
+	branch := "main"
+	provider := newTestProvider()
+	repo, err := CreateRandomRepo(provider, branch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo.URL += "_not"
+
+	t.Logf("non-existing repo, cloneURL=%s, branch=%s", repo.URL, repo.Branch)
+
+	client, serverURL := createTestServerWithPullHandler(t)
+
+	req := createPullHTTPRequest(t, serverURL, repo, 0, time.Time{})
+	t.Logf("Requesting %s", req.URL.String())
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedStatus := http.StatusNotFound
+	if resp.StatusCode != expectedStatus {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("expected status %d, got status=%d, body='%s'", expectedStatus, resp.StatusCode, string(body))
+	}
+}
+
+func TestPullFullBundleEmptyRepo(t *testing.T) {
+	slog.SetLogLoggerLevel(slog.LevelDebug)
+
+	branch := "main"
+	provider := newTestProvider()
+	repo, err := CreateRandomRepo(provider, branch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("Created repository, cloneURL=%s, branch=%s", repo.URL, repo.Branch)
+	client, serverURL := createTestServerWithPullHandler(t)
+	req := createPullHTTPRequest(t, serverURL, repo, 0, time.Time{})
+	t.Logf("Requesting %s", req.URL.String())
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusNoContent {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("expected status 204, got status=%d, body='%s'", resp.StatusCode, string(body))
+	}
+}
+
+func TestPullFullBundleRepoHasCommits(t *testing.T) {
+	slog.SetLogLoggerLevel(slog.LevelDebug)
+
+	branch := "main"
+	provider := newTestProvider()
+	repo, err := CreateRandomRepo(provider, branch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("Created repository, cloneURL=%s, branch=%s", repo.URL, repo.Branch)
+
+	{
+		// add commits. Note that the TempDir returns a new directory each time
+		tempDir := t.TempDir()
+		t.Logf("using tempDir=%s", tempDir)
+		g, err := NewGIT(tempDir, repo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		worktree, err := g.initLocal()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		filename := filepath.Join(g.workDir, "example.txt")
+		err = os.WriteFile(filename, []byte("hello world! "+generateRandomString()), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = worktree.Add("example.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = worktree.Commit("Initial commit", &git.CommitOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = g.PushLocalToRemote()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Logf("pushed commits to remote repository")
+	}
+
+	client, serverURL := createTestServerWithPullHandler(t)
+
+	// pull full bundle
+	{
+		req := createPullHTTPRequest(t, serverURL, repo, 0, time.Time{})
+		t.Logf("Requesting %s", req.URL.String())
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			t.Fatalf("expected status 200, got %d, body %s", resp.StatusCode, string(body))
+		}
+
+		head := resp.Header.Get("X-Git-Head")
+		if strings.TrimSpace(head) == "" {
+			t.Error("X-Git-Head")
+		}
+		expectedSize := len("e36545a9cf4dfa8485ed103e500770f5ac9a28fe")
+		if len(head) != expectedSize {
+			t.Errorf("X-Git-Head should be %d characters long, but was '%s'", expectedSize, head)
+		}
+
+		isPartial := resp.Header.Get("X-Git-IsPartial")
+		if strings.TrimSpace(isPartial) != "false" {
+			t.Errorf("X-Git-IsPartial should be false, but is %s", isPartial)
+		}
+
+		if mode := resp.Header.Get("X-Git-Sync-Mode"); mode != string(SyncModeClone) {
+			t.Errorf("X-Git-Sync-Mode should be %s for the first pull, but is %s", SyncModeClone, mode)
+		}
+	}
+
+	// pull partial with 'since' parameter
+	{
+		req := createPullHTTPRequest(t, serverURL, repo, time.Hour, time.Time{})
+		t.Logf("Requesting %s", req.URL.String())
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			t.Fatalf("expected status 200, got %d, body %s", resp.StatusCode, string(body))
+		}
+
+		head := resp.Header.Get("X-Git-Head")
+		if strings.TrimSpace(head) == "" {
+			t.Error("X-Git-Head")
+		}
+		if mode := resp.Header.Get("X-Git-Sync-Mode"); mode != string(SyncModePull) {
+			t.Errorf("X-Git-Sync-Mode should be %s for the second pull, but is %s", SyncModePull, mode)
+		}
+		expectedSize := len("e36545a9cf4dfa8485ed103e500770f5ac9a28fe")
+		if len(head) != expectedSize {
+			t.Errorf("X-Git-Head should be %d characters long, but was '%s'", expectedSize, head)
+		}
+
+		isPartial := resp.Header.Get("X-Git-IsPartial")
+		if strings.TrimSpace(isPartial) != "true" {
+			t.Errorf("X-Git-IsPartial should be true, but is %s", isPartial)
+		}
+	}
+
+	// pull with 'since' parameter
+	{
+		t.Logf("sleeping for 2 seconds, because 'since' minimum value is 1s")
+		time.Sleep(2 * time.Second)
+		req := createPullHTTPRequest(t, serverURL, repo, time.Second, time.Time{})
+		t.Logf("Requesting %s", req.URL.String())
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusNoContent {
+			body, _ := io.ReadAll(resp.Body)
+			t.Fatalf("expected status 204, got %d, body %s", resp.StatusCode, string(body))
+		}
+	}
+
+	// pull with 'after' parameter
+	{
+		t.Logf("sleeping for 2 seconds, because 'after' minimum value is 1s")
+		time.Sleep(2 * time.Second)
+		req := createPullHTTPRequest(t, serverURL, repo, 0, time.Now().Add(-time.Second))
+		t.Logf("Requesting %s", req.URL.String())
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusNoContent {
+			body, _ := io.ReadAll(resp.Body)
+			t.Fatalf("expected status 204, got %d, body %s", resp.StatusCode, string(body))
+		}
+	}
+
+	// pull with incorrect token
+	{
+		repo.Token = "incorrect"
+		req := createPullHTTPRequest(t, serverURL, repo, 0, time.Time{})
+		t.Logf("pull with incorrect token %s. But this does not fail. Pull does not require auth here", req.URL.String())
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		expectedStatus := http.StatusOK
+		if resp.StatusCode != expectedStatus {
+			body, _ := io.ReadAll(resp.Body)
+			t.Fatalf("expected status %d, got %d, body %s", expectedStatus, resp.StatusCode, string(body))
+		}
+	}
+}
+
+func TestPullForcePushedSource(t *testing.T) {
+	slog.SetLogLoggerLevel(slog.LevelDebug)
+
+	tcs := map[string]struct {
+		resetOnRewrite bool
+		expectedStatus int
+	}{
+		"reset":  {true, http.StatusOK},
+		"reject": {false, http.StatusConflict},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			branch := "main"
+			provider := newTestProvider()
+			repo, err := CreateRandomRepo(provider, branch)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = Push(context.Background(), t.TempDir(), repo, bytes.NewReader(testdata.FullBundle))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			h := NewGitPullHandler(t.TempDir(), HandlerOptions{ResetOnRewrite: tc.resetOnRewrite})
+			server := httptest.NewServer(h)
+			t.Cleanup(server.Close)
+
+			// sync the local clone with the original history
+			resp, err := server.Client().Do(createPullHTTPRequest(t, server.URL, repo, 0, time.Time{}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+			}
+
+			newHead := forcePushNewHistory(t, repo)
+
+			resp, err = server.Client().Do(createPullHTTPRequest(t, server.URL, repo, 0, time.Time{}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tc.expectedStatus {
+				body, _ := io.ReadAll(resp.Body)
+				t.Fatalf("expected status %d, got %d, body %s", tc.expectedStatus, resp.StatusCode, string(body))
+			}
+			if !tc.resetOnRewrite {
+				return
+			}
+
+			if resp.Header.Get("X-Git-Rewritten") != "true" {
+				t.Error("expected X-Git-Rewritten header")
+			}
+			if resp.Header.Get("X-Git-Head") != newHead.String() {
+				t.Errorf("expected head %s, got %s", newHead, resp.Header.Get("X-Git-Head"))
+			}
+		})
+	}
+}
+
+// replace the history of the branch in the remote repository with a single unrelated commit
+func forcePushNewHistory(t *testing.T, repo RemoteRepo) plumbing.Hash {
+	t.Helper()
+
+	dir := t.TempDir()
+	local, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = local.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, plumbing.NewBranchReferenceName(repo.Branch)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := local.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "rewritten.txt"), []byte("rewritten"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Add("rewritten.txt"); err != nil {
+		t.Fatal(err)
+	}
+	head, err := w.Commit("rewritten history", &git.CommitOptions{
+		Author: &object.Signature{Name: "sync", Email: "sync@domain.com", When: time.Now()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = local.CreateRemote(&config.RemoteConfig{Name: remoteName, URLs: []string{repo.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refSpec := fmt.Sprintf("+refs/heads/%s:refs/heads/%s", repo.Branch, repo.Branch)
+	err = local.Push(&git.PushOptions{
+		RemoteName: remoteName,
+		RefSpecs:   []config.RefSpec{config.RefSpec(refSpec)},
+		Auth:       &githttp.BasicAuth{Username: "not_used", Password: repo.Token}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return head
+}
+
+func createPullHTTPRequest(t *testing.T, serverURL string, repo RemoteRepo, since time.Duration, after time.Time) *http.Request {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, serverURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+repo.Token)
+	q := req.URL.Query()
+	q.Add("repository", repo.URL)
+	q.Add("branch", repo.Branch)
+	if since.Seconds() > 0 {
+		q.Add("since", since.String())
+	}
+	if !after.IsZero() {
+		q.Add("after", after.UTC().Format(time.RFC3339))
+	}
+	req.URL.RawQuery = q.Encode()
+	return req
+}
+
+func TestPullPostOptionsBody(t *testing.T) {
+	branch := "main"
+	provider := newTestProvider()
+	repo, err := CreateRandomRepo(provider, branch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Push(context.Background(), t.TempDir(), repo, bytes.NewReader(testdata.FullBundle)); err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	router.Handle("/pull/{branch}", NewGitPullHandler(t.TempDir(), HandlerOptions{}))
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	body := `{"from": "ea29764e79de2eaaddbeabd9ee967852912cb52e", "to": "f8be008f3733c1a9b7962c1f5a50679266565e31"}`
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/pull/"+branch+"?repository="+url.QueryEscape(repo.URL), strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+repo.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d, body %s", resp.StatusCode, string(data))
+	}
+
+	// the same partial bundle as the last commit in the test data
+	info, err := ParseBundleHeader(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := ParseBundleHeader(testdata.LastBundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.RequiresRef != expected.RequiresRef || info.Heads[0] != expected.Heads[0] {
+		t.Errorf("expected bundle %+v, got %+v", expected, info)
+	}
+	if resp.Header.Get("X-Git-IsPartial") != "true" {
+		t.Errorf("expected partial bundle, got X-Git-IsPartial %s", resp.Header.Get("X-Git-IsPartial"))
+	}
+}
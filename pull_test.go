@@ -1,24 +1,32 @@
 package git_sync
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
+	"net/http/cgi"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
-	"github.com/go-git/go-git/v5"
+	"github.com/bredtape/git_sync/testdata"
+	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
-// tests assumes that integrationtest/gogs-dev is running
-
 func createTestServerWithPullHandler(t *testing.T) (*http.Client, string) {
-	h := NewGitPullHandler(t.TempDir())
+	h := NewGitPullHandler(t.TempDir(), HandlerOptions{EnableCompression: true})
 	mux := mux.NewRouter()
 	mux.Handle("/pull", h)
 	server := httptest.NewServer(mux)
@@ -30,252 +38,601 @@ func createTestServerWithPullHandler(t *testing.T) (*http.Client, string) {
 	return server.Client(), server.URL + "/pull"
 }
 
-func TestPullRemoteRepoDoesNotExist(t *testing.T) {
-	slog.SetLogLoggerLevel(slog.LevelDebug)
-
-	branch := "main"
-	gogsAdmin := NewGogsAdmin(user, password, baseURL)
-	repo, err := gogsAdmin.CreateRandomRepo(branch)
+func TestEmptyBundleMessage(t *testing.T) {
+	now := time.Date(2025, 2, 13, 10, 0, 0, 0, time.UTC)
+	after, err := time.Parse(time.RFC3339, "2025-02-13T11:00:00+02:00")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	repo.URL += "_not"
+	tcs := map[string]struct {
+		opt      BundleOptions
+		expected string
+	}{
+		"since": {BundleOptions{Since: time.Hour}, "no new commits since 2025-02-13T09:00:00Z (1h0m0s ago)"},
+		"after": {BundleOptions{After: after}, "no new commits after 2025-02-13T11:00:00+02:00"},
+		"from":  {BundleOptions{From: "f8be008f3733c1a9b7962c1f5a50679266565e31"}, "no new commits after commit f8be008f3733c1a9b7962c1f5a50679266565e31"},
+	}
 
-	t.Logf("non-existing repo, cloneURL=%s, branch=%s", repo.URL, repo.Branch)
+	for name, tc := range tcs {
+		actual := emptyBundleMessage(tc.opt, now)
+		if actual != tc.expected {
+			t.Errorf("%s: expected '%s', got '%s'", name, tc.expected, actual)
+		}
+	}
+}
 
-	client, serverURL := createTestServerWithPullHandler(t)
+func TestBundleOptionsFromBody(t *testing.T) {
+	after := time.Date(2025, 2, 13, 11, 0, 0, 0, time.UTC)
+	recent := time.Now().Add(-2 * time.Second)
+	tcs := map[string]struct {
+		body     string
+		expected BundleOptions
+		err      bool
+	}{
+		"empty":                {body: "", expected: BundleOptions{}},
+		"since":                {body: `{"since": "1h30m"}`, expected: BundleOptions{Since: 90 * time.Minute}},
+		"after":                {body: `{"after": "2025-02-13T13:00:00+02:00"}`, expected: BundleOptions{After: after}},
+		"from and to":          {body: `{"from": "ea29764e79de2eaaddbeabd9ee967852912cb52e", "to": "f8be008f3733c1a9b7962c1f5a50679266565e31"}`, expected: BundleOptions{From: "ea29764e79de2eaaddbeabd9ee967852912cb52e", To: "f8be008f3733c1a9b7962c1f5a50679266565e31"}},
+		"conflicting":          {body: `{"since": "1h", "from": "ea29764e79de2eaaddbeabd9ee967852912cb52e"}`, err: true},
+		"since and after":      {body: `{"since": "1h", "after": "2025-02-13T13:00:00+02:00"}`, err: true},
+		"since too short":      {body: `{"since": "1ms"}`, err: true},
+		"since days":           {body: `{"since": "7d"}`, expected: BundleOptions{Since: 7 * 24 * time.Hour}},
+		"unknown option":       {body: `{"exclude": ["dev"]}`, err: true},
+		"unsupported option":   {body: `{"since": "1h", "paths": ["docs"]}`, err: true},
+		"invalid json":         {body: `{"since": `, err: true},
+		"from not commit":      {body: `{"from": "main"}`, err: true},
+		"max-commits":          {body: `{"since": "1h", "max-commits": 10}`, expected: BundleOptions{Since: time.Hour, MaxCommits: 10}},
+		"max-commits zero":     {body: `{"max-commits": 0}`, err: true},
+		"max-commits and from": {body: `{"from": "ea29764e79de2eaaddbeabd9ee967852912cb52e", "max-commits": 10}`, err: true},
+		"after fraction":       {body: `{"after": "2025-02-13T13:00:00.750+02:00"}`, expected: BundleOptions{After: after}},
+		"after barely past":    {body: fmt.Sprintf(`{"after": "%s"}`, time.Now().Add(-time.Millisecond).Format(time.RFC3339Nano)), err: true},
+		"after in the future":  {body: fmt.Sprintf(`{"after": "%s"}`, time.Now().Add(time.Hour).Format(time.RFC3339)), err: true},
+		"after 2s ago":         {body: fmt.Sprintf(`{"after": "%s"}`, recent.Format(time.RFC3339Nano)), expected: BundleOptions{After: recent.Truncate(time.Second)}},
+	}
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			opt, err := bundleOptionsFromBody(strings.NewReader(tc.body))
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected error, got options %+v", opt)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !opt.After.Equal(tc.expected.After) {
+				t.Errorf("expected after %v, got %v", tc.expected.After, opt.After)
+			}
+			opt.After, tc.expected.After = time.Time{}, time.Time{}
+			if opt != tc.expected {
+				t.Errorf("expected options %+v, got %+v", tc.expected, opt)
+			}
+		})
+	}
+}
 
-	req := createPullHTTPRequest(t, serverURL, repo, 0, time.Time{})
-	t.Logf("Requesting %s", req.URL.String())
+func TestParseDuration(t *testing.T) {
+	tcs := map[string]time.Duration{
+		"1h30m":  90 * time.Minute,
+		"7d":     7 * 24 * time.Hour,
+		"2w":     14 * 24 * time.Hour,
+		"1w2d3h": 9*24*time.Hour + 3*time.Hour,
+		"1.5d":   36 * time.Hour,
+		"12h1d":  36 * time.Hour,
+		"-1d":    -24 * time.Hour,
+	}
+	for s, expected := range tcs {
+		actual, err := parseDuration(s)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", s, err)
+		} else if actual != expected {
+			t.Errorf("%s: expected %s, got %s", s, expected, actual)
+		}
+	}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		t.Fatal(err)
+	for _, s := range []string{"", "d", "7", "7days", "1y", "1d-2h", "1..5d"} {
+		if d, err := parseDuration(s); err == nil {
+			t.Errorf("%s: expected error, got %s", s, d)
+		}
 	}
+}
 
-	expectedStatus := http.StatusNotFound
-	if resp.StatusCode != expectedStatus {
-		body, _ := io.ReadAll(resp.Body)
-		t.Fatalf("expected status %d, got status=%d, body='%s'", expectedStatus, resp.StatusCode, string(body))
+func TestPullBundleHeadsError(t *testing.T) {
+	h := NewGitPullHandler(t.TempDir(), HandlerOptions{})
+	tcs := map[string]struct {
+		err    error
+		status int
+	}{
+		"no heads":       {ErrNoBundleHeads, http.StatusNoContent},
+		"multiple heads": {errors.Wrap(ErrMultipleBundleHeads, "main"), http.StatusInternalServerError},
+	}
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.writeError(slog.Default(), rec, tc.err, BundleOptions{})
+			if rec.Code != tc.status {
+				t.Errorf("expected status %d, got %d", tc.status, rec.Code)
+			}
+		})
 	}
 }
 
-func TestPullFullBundleEmptyRepo(t *testing.T) {
-	slog.SetLogLoggerLevel(slog.LevelDebug)
+func TestCreateHashCanonical(t *testing.T) {
+	head := Head{CommitID: "f8be008f3733c1a9b7962c1f5a50679266565e31", Ref: "refs/heads/main"}
+	after := time.Date(2025, 2, 13, 8, 0, 0, 0, time.UTC)
+	zone := time.FixedZone("UTC+2", 2*60*60)
+	now := time.Now()
 
-	branch := "main"
-	gogsAdmin := NewGogsAdmin(user, password, baseURL)
-	repo, err := gogsAdmin.CreateRandomRepo(branch)
+	equivalent := map[string][2]BundleOptions{
+		"time zone":       {{After: after}, {After: after.In(zone)}},
+		"monotonic clock": {{After: now}, {After: now.Round(0)}},
+		"since":           {{Since: 90 * time.Minute}, {Since: 5400 * time.Second}},
+	}
+	for name, opts := range equivalent {
+		if createHash(head, opts[0]) != createHash(head, opts[1]) {
+			t.Errorf("%s: expected the same hash for %+v and %+v", name, opts[0], opts[1])
+		}
+	}
+
+	distinct := []BundleOptions{{}, {After: after}, {After: after.Add(time.Second)}, {Since: time.Hour}, {From: head.CommitID}, {MaxCommits: 1}}
+	seen := map[string]BundleOptions{}
+	for _, opt := range distinct {
+		hash := createHash(head, opt)
+		if other, ok := seen[hash]; ok {
+			t.Errorf("expected different hashes for %+v and %+v", opt, other)
+		}
+		seen[hash] = opt
+	}
+}
+
+func TestBundleETag(t *testing.T) {
+	etag := bundleETag(testdata.FullBundle, "")
+	if etag != bundleETag(bytes.Clone(testdata.FullBundle), "") {
+		t.Error("expected the same ETag for the same bytes")
+	}
+	if !strings.HasPrefix(etag, `"`) || strings.HasPrefix(etag, `W/`) {
+		t.Errorf("expected strong ETag, got %s", etag)
+	}
+	if gz := bundleETag(testdata.FullBundle, "gzip"); gz == etag || !strings.HasSuffix(gz, `-gzip"`) {
+		t.Errorf("expected ETag per encoding, got %s and %s", etag, gz)
+	}
+	if etag == bundleETag(testdata.LastBundle, "") {
+		t.Error("expected different ETags for different bundles")
+	}
+}
+
+// serve a bare repository with a single commit over smart HTTP, without auth. Requests with credentials are rejected.
+// Returns the clone URL and the head
+func createPublicRepo(t *testing.T, branch string) (string, plumbing.Hash) {
+	t.Helper()
+
+	g := newLocalGIT(t, branch)
+	worktree, err := g.initLocal()
 	if err != nil {
 		t.Fatal(err)
 	}
+	head := commitAt(t, g, worktree, time.Date(2025, 2, 13, 0, 0, 0, 0, time.UTC))
+	repoURL, _ := servePublicRepo(t, g)
+	return repoURL, head
+}
 
-	t.Logf("Created repository, cloneURL=%s, branch=%s", repo.URL, repo.Branch)
-	client, serverURL := createTestServerWithPullHandler(t)
-	req := createPullHTTPRequest(t, serverURL, repo, 0, time.Time{})
-	t.Logf("Requesting %s", req.URL.String())
+// serve a bare clone of the local repository over http, named "public", rejecting requests with credentials.
+// Returns the URL and the path of the bare clone, to push further commits to
+func servePublicRepo(t *testing.T, g *GIT) (string, string) {
+	t.Helper()
+
+	root := t.TempDir()
+	bare := filepath.Join(root, "public.git")
+	out, err := exec.Command("git", "clone", "--bare", g.workDir, bare).CombinedOutput()
+	if err != nil {
+		t.Fatalf("failed to create bare repository: %v: %s", err, out)
+	}
 
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &cgi.Handler{
+		Path: gitPath,
+		Args: []string{"http-backend"},
+		Env:  []string{"GIT_PROJECT_ROOT=" + root, "GIT_HTTP_EXPORT_ALL=1"}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			http.Error(w, "credentials not expected", http.StatusForbidden)
+			return
+		}
+		backend.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	return server.URL + "/public.git", bare
+}
+
+func TestPullPublicRepoAnonymously(t *testing.T) {
+	branch := "main"
+	repoURL, head := createPublicRepo(t, branch)
+
+	client, serverURL := createTestServerWithPullHandler(t)
+	req, err := http.NewRequest(http.MethodGet, serverURL+"?"+url.Values{"repository": {repoURL}, "branch": {branch}}.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
 	resp, err := client.Do(req)
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusNoContent {
+	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		t.Fatalf("expected status 204, got status=%d, body='%s'", resp.StatusCode, string(body))
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, resp.StatusCode, body)
+	}
+	if actual := resp.Header.Get("X-Git-Head"); actual != head.String() {
+		t.Errorf("expected head %s, got %s", head, actual)
+	}
+	if actual := resp.Header.Get("X-Git-Sync-Mode"); actual != string(SyncModeClone) {
+		t.Errorf("expected sync mode %s, got %s", SyncModeClone, actual)
+	}
+	if actual := resp.Header.Get("X-Git-Hash-Algorithm"); actual != "sha1" {
+		t.Errorf("expected hash algorithm sha1, got %s", actual)
+	}
+}
+
+func TestPullSinceAndAfter(t *testing.T) {
+	client, serverURL := createTestServerWithPullHandler(t)
+	q := url.Values{"repository": {"https://host/owner/repo.git"}, "branch": {"main"}, "since": {"1h"}, "after": {"2025-02-13T08:00:00Z"}}
+	resp, err := client.Get(serverURL + "?" + q.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusBadRequest, resp.StatusCode, body)
+	}
+	if !strings.Contains(string(body), "mutually exclusive") {
+		t.Errorf("expected the error to explain since and after are mutually exclusive, got %s", body)
 	}
 }
 
-func TestPullFullBundleRepoHasCommits(t *testing.T) {
-	slog.SetLogLoggerLevel(slog.LevelDebug)
+func TestPullClientCancelled(t *testing.T) {
+	branch := "main"
+	repoURL, _ := createPublicRepo(t, branch)
+	h := NewGitPullHandler(t.TempDir(), HandlerOptions{})
+
+	cancelled := testutil.ToFloat64(metricClientCancelled.WithLabelValues("pull", repoURL))
+	failed := testutil.CollectAndCount(metricOpsError)
+
+	// the client disconnected before the bundle was created
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := httptest.NewRequest(http.MethodGet, "/pull?"+url.Values{"repository": {repoURL}, "branch": {branch}}.Encode(), nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if w.Body.Len() != 0 {
+		t.Errorf("expected no response, got %d: %s", w.Code, w.Body)
+	}
+	if actual := testutil.ToFloat64(metricClientCancelled.WithLabelValues("pull", repoURL)); actual != cancelled+1 {
+		t.Errorf("expected the pull to be counted as cancelled, got %v", actual-cancelled)
+	}
+	if actual := testutil.CollectAndCount(metricOpsError); actual != failed {
+		t.Errorf("expected the pull to not be counted as failed")
+	}
+}
 
+func TestPullContentLength(t *testing.T) {
 	branch := "main"
-	gogsAdmin := NewGogsAdmin(user, password, baseURL)
-	repo, err := gogsAdmin.CreateRandomRepo(branch)
+	repoURL, _ := createPublicRepo(t, branch)
+
+	client, serverURL := createTestServerWithPullHandler(t)
+	req, err := http.NewRequest(http.MethodGet, serverURL+"?"+url.Values{"repository": {repoURL}, "branch": {branch}}.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// otherwise the transport asks for gzip
+	req.Header.Set("Accept-Encoding", encodingIdentity)
+	resp, err := client.Do(req)
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, resp.StatusCode, body)
+	}
+	if actual := resp.Header.Get("Content-Length"); actual != strconv.Itoa(len(body)) {
+		t.Errorf("expected Content-Length %d, got '%s'", len(body), actual)
+	}
+}
 
-	t.Logf("Created repository, cloneURL=%s, branch=%s", repo.URL, repo.Branch)
+func TestPullRange(t *testing.T) {
+	branch := "main"
+	repoURL, _ := createPublicRepo(t, branch)
 
-	{
-		// add commits. Note that the TempDir returns a new directory each time
-		tempDir := t.TempDir()
-		t.Logf("using tempDir=%s", tempDir)
-		g, err := NewGIT(tempDir, repo)
-		if err != nil {
-			t.Fatal(err)
-		}
-		worktree, err := g.initLocal()
+	server := httptest.NewServer(NewGitPullHandler(t.TempDir(), HandlerOptions{DeterministicBundles: true}))
+	t.Cleanup(server.Close)
+	get := func(header http.Header) (*http.Response, []byte) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, server.URL+"?"+url.Values{"repository": {repoURL}, "branch": {branch}}.Encode(), nil)
 		if err != nil {
 			t.Fatal(err)
 		}
-
-		filename := filepath.Join(g.workDir, "example.txt")
-		err = os.WriteFile(filename, []byte("hello world! "+generateRandomString()), 0644)
+		req.Header = header
+		req.Header.Set("Accept-Encoding", encodingIdentity)
+		resp, err := server.Client().Do(req)
 		if err != nil {
 			t.Fatal(err)
 		}
-
-		_, err = worktree.Add("example.txt")
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
 		if err != nil {
 			t.Fatal(err)
 		}
+		return resp, body
+	}
 
-		_, err = worktree.Commit("Initial commit", &git.CommitOptions{})
-		if err != nil {
-			t.Fatal(err)
-		}
+	resp, full := get(http.Header{})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, resp.StatusCode, full)
+	}
+	etag := resp.Header.Get("ETag")
 
-		err = g.PushLocalToRemote()
-		if err != nil {
-			t.Fatal(err)
-		}
+	// resume an interrupted download
+	resp, body := get(http.Header{"Range": {"bytes=10-99"}, "If-Range": {etag}})
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusPartialContent, resp.StatusCode, body)
+	}
+	if !bytes.Equal(body, full[10:100]) {
+		t.Error("expected the range of the bundle")
+	}
+	if expected := fmt.Sprintf("bytes 10-99/%d", len(full)); resp.Header.Get("Content-Range") != expected {
+		t.Errorf("expected Content-Range '%s', got '%s'", expected, resp.Header.Get("Content-Range"))
+	}
 
-		t.Logf("pushed commits to remote repository")
+	// the bundle has changed since
+	resp, body = get(http.Header{"Range": {"bytes=10-99"}, "If-Range": {`"other"`}})
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, full) {
+		t.Errorf("expected the full bundle, when If-Range does not match, got status %d", resp.StatusCode)
 	}
+}
 
+func TestPullHead(t *testing.T) {
+	branch := "main"
+	repoURL, head := createPublicRepo(t, branch)
 	client, serverURL := createTestServerWithPullHandler(t)
 
-	// pull full bundle
-	{
-		req := createPullHTTPRequest(t, serverURL, repo, 0, time.Time{})
-		t.Logf("Requesting %s", req.URL.String())
-
-		resp, err := client.Do(req)
+	for b, expected := range map[string]int{branch: http.StatusOK, "other": http.StatusNoContent} {
+		resp, err := client.Head(serverURL + "?" + url.Values{"repository": {repoURL}, "branch": {b}}.Encode())
 		if err != nil {
 			t.Fatal(err)
 		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK {
-			body, _ := io.ReadAll(resp.Body)
-			t.Fatalf("expected status 200, got %d, body %s", resp.StatusCode, string(body))
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Fatalf("branch %s: expected status %d, got %d", b, expected, resp.StatusCode)
 		}
-
-		head := resp.Header.Get("X-Git-Head")
-		if strings.TrimSpace(head) == "" {
-			t.Error("X-Git-Head")
+		if expected != http.StatusOK {
+			continue
 		}
-		expectedSize := len("e36545a9cf4dfa8485ed103e500770f5ac9a28fe")
-		if len(head) != expectedSize {
-			t.Errorf("X-Git-Head should be %d characters long, but was '%s'", expectedSize, head)
+		if actual := resp.Header.Get("X-Git-Head"); actual != head.String() {
+			t.Errorf("expected head %s, got %s", head, actual)
 		}
-
-		isPartial := resp.Header.Get("X-Git-IsPartial")
-		if strings.TrimSpace(isPartial) != "false" {
-			t.Errorf("X-Git-IsPartial should be false, but is %s", isPartial)
+		if actual := resp.Header.Get("ETag"); actual != `W/"`+head.String()+`"` {
+			t.Errorf("expected weak ETag of the head, got %s", actual)
+		}
+		if actual := resp.Header.Get("Content-Disposition"); actual != "" {
+			t.Errorf("expected no bundle, got Content-Disposition %s", actual)
 		}
 	}
+}
 
-	// pull partial with 'since' parameter
-	{
-		req := createPullHTTPRequest(t, serverURL, repo, time.Hour, time.Time{})
-		t.Logf("Requesting %s", req.URL.String())
-
-		resp, err := client.Do(req)
+// a client with the full bundle of the head (the ETag of a HEAD request) gets 304 without a sync
+func TestPullIfNoneMatchHead(t *testing.T) {
+	branch := "main"
+	repoURL, head := createPublicRepo(t, branch)
+	tempDir := t.TempDir()
+	server := httptest.NewServer(NewGitPullHandler(tempDir, HandlerOptions{}))
+	t.Cleanup(server.Close)
+
+	// in order, since the other ETag clones the repository
+	for _, tc := range []struct {
+		etag     string
+		expected int
+	}{{`W/"` + head.String() + `"`, http.StatusNotModified}, {`W/"other"`, http.StatusOK}} {
+		etag, expected := tc.etag, tc.expected
+		req, err := http.NewRequest(http.MethodGet, server.URL+"?"+url.Values{"repository": {repoURL}, "branch": {branch}}.Encode(), nil)
 		if err != nil {
 			t.Fatal(err)
 		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK {
-			body, _ := io.ReadAll(resp.Body)
-			t.Fatalf("expected status 200, got %d, body %s", resp.StatusCode, string(body))
-		}
-
-		head := resp.Header.Get("X-Git-Head")
-		if strings.TrimSpace(head) == "" {
-			t.Error("X-Git-Head")
+		req.Header.Set("If-None-Match", etag)
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
 		}
-		expectedSize := len("e36545a9cf4dfa8485ed103e500770f5ac9a28fe")
-		if len(head) != expectedSize {
-			t.Errorf("X-Git-Head should be %d characters long, but was '%s'", expectedSize, head)
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Errorf("If-None-Match %s: expected status %d, got %d", etag, expected, resp.StatusCode)
 		}
-
-		isPartial := resp.Header.Get("X-Git-IsPartial")
-		if strings.TrimSpace(isPartial) != "true" {
-			t.Errorf("X-Git-IsPartial should be true, but is %s", isPartial)
+		if expected != http.StatusNotModified {
+			continue
 		}
-	}
-
-	// pull with 'since' parameter
-	{
-		t.Logf("sleeping for 2 seconds, because 'since' minimum value is 1s")
-		time.Sleep(2 * time.Second)
-		req := createPullHTTPRequest(t, serverURL, repo, time.Second, time.Time{})
-		t.Logf("Requesting %s", req.URL.String())
-
-		resp, err := client.Do(req)
+		entries, err := os.ReadDir(tempDir)
 		if err != nil {
 			t.Fatal(err)
 		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != http.StatusNoContent {
-			body, _ := io.ReadAll(resp.Body)
-			t.Fatalf("expected status 204, got %d, body %s", resp.StatusCode, string(body))
+		if len(entries) != 0 {
+			t.Errorf("expected no local clone, but temp dir has %d entries", len(entries))
 		}
 	}
+}
 
-	// pull with 'after' parameter
-	{
-		t.Logf("sleeping for 2 seconds, because 'after' minimum value is 1s")
-		time.Sleep(2 * time.Second)
-		req := createPullHTTPRequest(t, serverURL, repo, 0, time.Now().Add(-time.Second))
-		t.Logf("Requesting %s", req.URL.String())
+func TestPullBranchNotInRemote(t *testing.T) {
+	repoURL, _ := createPublicRepo(t, "main")
 
+	client, serverURL := createTestServerWithPullHandler(t)
+	// twice, to check that the failed clone leaves nothing behind
+	for range 2 {
+		req, err := http.NewRequest(http.MethodGet, serverURL+"?"+url.Values{"repository": {repoURL}, "branch": {"develop"}}.Encode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
 		resp, err := client.Do(req)
 		if err != nil {
 			t.Fatal(err)
 		}
-		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
 
 		if resp.StatusCode != http.StatusNoContent {
-			body, _ := io.ReadAll(resp.Body)
-			t.Fatalf("expected status 204, got %d, body %s", resp.StatusCode, string(body))
+			t.Fatalf("expected status %d, got %d: %s", http.StatusNoContent, resp.StatusCode, body)
 		}
 	}
 
-	// pull with incorrect token
-	{
-		repo.Token = "incorrect"
-		req := createPullHTTPRequest(t, serverURL, repo, 0, time.Time{})
-		t.Logf("pull with incorrect token %s. But this does not fail. Pull does not require auth here", req.URL.String())
+	if actual := testutil.ToFloat64(metricOpsError.WithLabelValues("pull", repoURL, "empty")); actual != 2 {
+		t.Errorf("expected 2 empty errors, got %v", actual)
+	}
+}
 
-		resp, err := client.Do(req)
-		if err != nil {
-			t.Fatal(err)
+func TestErrorReason(t *testing.T) {
+	tcs := map[int]string{
+		http.StatusOK:                  "internal",
+		http.StatusNoContent:           "empty",
+		http.StatusBadRequest:          "bad_request",
+		http.StatusUnauthorized:        "auth",
+		http.StatusNotFound:            "not_found",
+		http.StatusNotAcceptable:       "bad_request",
+		http.StatusConflict:            "conflict",
+		http.StatusUnprocessableEntity: "bad_request",
+		http.StatusInternalServerError: "internal",
+		http.StatusBadGateway:          "auth",
+		http.StatusServiceUnavailable:  "timeout"}
+	for status, expected := range tcs {
+		if actual := errorReason(status); actual != expected {
+			t.Errorf("expected reason %s for status %d, got %s", expected, status, actual)
 		}
-		defer resp.Body.Close()
+	}
+}
 
-		expectedStatus := http.StatusOK
-		if resp.StatusCode != expectedStatus {
-			body, _ := io.ReadAll(resp.Body)
-			t.Fatalf("expected status %d, got %d, body %s", expectedStatus, resp.StatusCode, string(body))
-		}
+// the write deadline of the server expires during the git work, but the bundle is written with its own
+func TestPullStreamTimeoutReplacesWriteTimeout(t *testing.T) {
+	branch := "main"
+	repoURL, head := createPublicRepo(t, branch)
+
+	for name, timeout := range map[string]time.Duration{"no deadline": 0, "deadline": time.Minute} {
+		t.Run(name, func(t *testing.T) {
+			h := NewGitPullHandler(t.TempDir(), HandlerOptions{StreamTimeout: timeout})
+			server := httptest.NewUnstartedServer(AccessLog(h))
+			server.Config.WriteTimeout = time.Nanosecond
+			server.Start()
+			t.Cleanup(server.Close)
+
+			resp, err := server.Client().Get(server.URL + "?" + url.Values{"repository": {repoURL}, "branch": {branch}}.Encode())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status %d, got %d: %s", http.StatusOK, resp.StatusCode, body)
+			}
+			if actual := resp.Header.Get("X-Git-Head"); actual != head.String() {
+				t.Errorf("expected head %s, got %s", head, actual)
+			}
+			if _, err := ParseBundleHeader(body); err != nil {
+				t.Errorf("expected a bundle, got %v", err)
+			}
+		})
 	}
 }
 
-func createPullHTTPRequest(t *testing.T, serverURL string, repo RemoteRepo, since time.Duration, after time.Time) *http.Request {
-	t.Helper()
+func TestPullRemoteUnavailable(t *testing.T) {
+	client, serverURL := createTestServerWithPullHandler(t)
+	req, err := http.NewRequest(http.MethodGet, serverURL+"?"+url.Values{"repository": {unreachableRepoURL(t)}, "branch": {"main"}}.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
 
-	req, err := http.NewRequest(http.MethodGet, serverURL, nil)
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d, got %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+	if actual := resp.Header.Get("Retry-After"); actual != "30" {
+		t.Errorf("expected Retry-After 30, got '%s'", actual)
+	}
+}
+
+func TestPullChunkSize(t *testing.T) {
+	g := newLocalGIT(t, "main")
+	worktree, err := g.initLocal()
 	if err != nil {
 		t.Fatal(err)
 	}
+	base := time.Date(2025, 2, 13, 0, 0, 0, 0, time.UTC)
+	var commits []plumbing.Hash
+	for i := range 3 {
+		commits = append(commits, commitAt(t, g, worktree, base.Add(time.Duration(i)*time.Hour)))
+	}
+	repoURL, _ := servePublicRepo(t, g)
+	h := NewGitPullHandler(t.TempDir(), HandlerOptions{})
+
+	pull := func(query url.Values) *httptest.ResponseRecorder {
+		t.Helper()
+		query.Set("repository", repoURL)
+		query.Set("branch", "main")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/pull?"+query.Encode(), nil))
+		return w
+	}
 
-	req.Header.Set("Authorization", "Bearer "+repo.Token)
-	q := req.URL.Query()
-	q.Add("repository", repo.URL)
-	q.Add("branch", repo.Branch)
-	if since.Seconds() > 0 {
-		q.Add("since", since.String())
+	// the history in chunks of 2 commits, following the cursors
+	expected := []struct{ head, next plumbing.Hash }{{commits[1], commits[1]}, {commits[2], plumbing.ZeroHash}}
+	cursor := ""
+	for i, e := range expected {
+		w := pull(url.Values{"chunk-size": {"2"}, "cursor": {cursor}})
+		if w.Code != http.StatusOK {
+			t.Fatalf("chunk %d: expected status %d, got %d: %s", i, http.StatusOK, w.Code, w.Body)
+		}
+		if actual := w.Header().Get("X-Git-Head"); actual != e.head.String() {
+			t.Errorf("chunk %d: expected head %s, got %s", i, e.head, actual)
+		}
+		cursor = w.Header().Get("X-Git-Next-Cursor")
+		if (e.next.IsZero() && cursor != "") || (!e.next.IsZero() && cursor != e.next.String()) {
+			t.Errorf("chunk %d: expected next cursor %s, got '%s'", i, e.next, cursor)
+		}
+		info, err := ParseBundleHeader(w.Body.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 && (len(info.Prerequisites) != 1 || info.Prerequisites[0] != expected[i-1].head.String()) {
+			t.Errorf("chunk %d: expected prerequisite %s, got %v", i, expected[i-1].head, info.Prerequisites)
+		}
 	}
-	if !after.IsZero() {
-		q.Add("after", after.UTC().Format(time.RFC3339))
+
+	if w := pull(url.Values{"chunk-size": {"2"}, "cursor": {commits[2].String()}}); w.Code != http.StatusNoContent {
+		t.Errorf("expected status %d after the head, got %d", http.StatusNoContent, w.Code)
+	}
+	for name, query := range map[string]url.Values{
+		"cursor without chunk-size": {"cursor": {commits[0].String()}},
+		"unknown cursor":            {"chunk-size": {"2"}, "cursor": {"f8be008f3733c1a9b7962c1f5a50679266565e31"}},
+		"invalid chunk-size":        {"chunk-size": {"0"}},
+		"with since":                {"chunk-size": {"2"}, "since": {"1h"}}} {
+		if w := pull(query); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d, got %d", name, http.StatusBadRequest, w.Code)
+		}
 	}
-	req.URL.RawQuery = q.Encode()
-	return req
 }
@@ -1,21 +1,40 @@
 package git_sync
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log/slog"
+	"mime"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/pkg/errors"
 )
 
+// max number of commits listed in the dry-run summary
+const dryRunMaxCommits = 100
+
+// header with the expected head of the remote branch for force pushes. Empty if the branch has no commits
+const headerExpectedHead = "X-Git-Expected-Head"
+
+const (
+	contentTypeOctetStream = "application/octet-stream"
+	contentTypeGitBundle   = "application/x-git-bundle"
+)
+
 type GitPushHandler struct {
 	tempDir string
+	opts    HandlerOptions
 }
 
-func NewGitPushHandler(tempDir string) *GitPushHandler {
-	return &GitPushHandler{tempDir: tempDir}
+func NewGitPushHandler(tempDir string, opts HandlerOptions) *GitPushHandler {
+	return &GitPushHandler{tempDir: tempDir, opts: opts}
 }
 
 // TODO: Consider when to remove local repo. Which errors should trigger the removal?
@@ -23,74 +42,433 @@ func NewGitPushHandler(tempDir string) *GitPushHandler {
 func (h *GitPushHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
-	remoteRepo, err := extractArgs(r)
+	auth := h.opts.authExtractor(r.URL.Query().Get("repository"))
+	remoteRepo, err := extractArgs(r, auth, h.opts.AllowedRepos)
+	if errors.Is(err, errNoBranch) && h.opts.BranchFromBundle {
+		// derived from the bundle
+		err = nil
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeArgsError(w, auth, err)
 		return
 	}
-	log := slog.With("op", "GitPushHandler.ServeHTTP", "repo.url", remoteRepo.URL, "repo.branch", remoteRepo.Branch)
+	remoteRepo.TempDir = h.opts.Repos.TempDir(remoteRepo.URL)
+	log := LoggerFromContext(r.Context()).With("op", "GitPushHandler.ServeHTTP", "repo.url", remoteRepo.URL)
+	if remoteRepo.Branch != "" {
+		log = log.With("repo.branch", remoteRepo.Branch)
+	}
 
-	metricOps.WithLabelValues("push", remoteRepo.URL).Inc()
-	mErr := metricOpsError.WithLabelValues("push", remoteRepo.URL)
+	dryRun := false
+	if raw := r.URL.Query().Get("dry-run"); raw != "" {
+		dryRun, err = strconv.ParseBool(raw)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid dry-run '%s', expected true or false", raw), http.StatusBadRequest)
+			return
+		}
+		log = log.With("dryRun", dryRun)
+	}
 
-	success := h.push(log, remoteRepo, r.Body, w)
+	var mode pushMode
+	mode.dryRun = dryRun
+	if raw := r.URL.Query().Get("force"); raw != "" {
+		mode.force, err = strconv.ParseBool(raw)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid force '%s', expected true or false", raw), http.StatusBadRequest)
+			return
+		}
+	}
+	if mode.force {
+		if !h.opts.AllowForcePush {
+			http.Error(w, "force push is not allowed", http.StatusForbidden)
+			return
+		}
+		if dryRun {
+			http.Error(w, "force push does not support dry-run", http.StatusBadRequest)
+			return
+		}
+		// an empty header must not disable the lease, so a branch without commits is the zero ID
+		expected := strings.TrimSpace(r.Header.Get(headerExpectedHead))
+		if expected == "" {
+			http.Error(w, fmt.Sprintf("force push requires the '%s' header, with the zero ID (%s) if the branch has no commits", headerExpectedHead, plumbing.ZeroHash), http.StatusPreconditionRequired)
+			return
+		}
+		if !isCommitID(expected) {
+			http.Error(w, fmt.Sprintf("Invalid %s '%s', expected a commit ID", headerExpectedHead, expected), http.StatusBadRequest)
+			return
+		}
+		mode.expectedHead = plumbing.NewHash(expected)
+		log = log.With("force", true, "expectedHead", mode.expectedHead.String())
+	}
+	if raw := r.URL.Query().Get("ref"); raw != "" {
+		ref := raw
+		if !strings.HasPrefix(ref, "refs/") {
+			ref = plumbing.NewBranchReferenceName(ref).String()
+		}
+		if err := plumbing.ReferenceName(ref).Validate(); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid ref '%s'", raw), http.StatusBadRequest)
+			return
+		}
+		if remoteRepo.Branch == "" || remoteRepo.Branch == AllBranches {
+			http.Error(w, "ref requires a single branch to push to", http.StatusBadRequest)
+			return
+		}
+		mode.bundleRef = ref
+		log = log.With("bundleRef", ref)
+	}
+
+	if ct := r.Header.Get("Content-Type"); !isBundleContentType(ct) {
+		log.Debug("unsupported content type", "contentType", ct)
+		http.Error(w, fmt.Sprintf("Unsupported Content-Type '%s', expected %s or %s", ct, contentTypeOctetStream, contentTypeGitBundle), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	repoLabel := h.opts.metricRepo(remoteRepo.URL)
+	metricOps.WithLabelValues("push", repoLabel).Inc()
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	w = rec
+	mErr := &opsError{op: "push", repoURL: repoLabel, rec: rec}
+	defer mErr.record()
+
+	body, err := h.opts.bundleBody(r)
+	if err != nil {
+		log.Error("failed to decompress body", "err", err)
+		mErr.Inc()
+		writeBundleBodyError(w, err)
+		return
+	}
+	defer body.Close()
+
+	release, err := h.opts.Limiter.Acquire(r.Context(), remoteRepo.URL)
+	if err != nil {
+		log.Warn("push rejected", "err", err)
+		mErr.Inc()
+		h.opts.Limiter.writeError(w, err)
+		return
+	}
+	defer release()
+
+	ctx, done := h.opts.Operations.Start(r.Context())
+	defer done()
+
+	success := h.push(ctx, log, remoteRepo, body, mode, w)
 	if !success {
 		mErr.Inc()
 	}
 }
 
-func (h *GitPushHandler) push(log *slog.Logger, remoteRepo RemoteRepo, bundleData io.Reader, w http.ResponseWriter) (success bool) {
-	git, err := NewGIT(h.tempDir, remoteRepo)
+func (h *GitPushHandler) syncer(mode pushMode) Syncer {
+	s := h.opts.syncer(h.tempDir)
+	s.BundleRef = mode.bundleRef
+	return s
+}
+
+// how a bundle is pushed
+type pushMode struct {
+	dryRun bool
+	// force push, if the remote branch is at expectedHead
+	force        bool
+	expectedHead plumbing.Hash
+	// head of the bundle to push to the branch, when the names differ. See Syncer.BundleRef
+	bundleRef string
+}
+
+// derive the branch from the single branch head of the bundle
+func branchFromBundle(bundleData []byte) (string, error) {
+	info, err := ParseBundleHeader(bundleData)
 	if err != nil {
-		log.Error("failed to create git", "err", err)
-		http.Error(w, "internal error", http.StatusInternalServerError)
-		return
+		return "", errors.Wrap(err, "failed to parse bundle")
+	}
+	// tags are pushed along, so they do not count
+	refs := bundleBranchRefs(info)
+	if len(refs) != 1 {
+		return "", fmt.Errorf("expected exactly one head in bundle to derive the branch from, got %d", len(refs))
+	}
+	branch, ok := strings.CutPrefix(refs[0], "refs/heads/")
+	if !ok || branch == "" {
+		return "", fmt.Errorf("head ref '%s' of bundle is not a branch", refs[0])
+	}
+	if err := validateBranch(branch); err != nil || branch == AllBranches {
+		return "", fmt.Errorf("head ref '%s' of bundle is not a valid branch", refs[0])
+	}
+	return branch, nil
+}
+
+// the bundle of the request body, decompressed according to Content-Encoding when compression is enabled.
+// Returns ErrUnsupportedEncoding (wrapped) for other encodings. Reading more than MaxPushSize (after
+// decompression) fails with ErrBundleTooLarge
+func (opts HandlerOptions) bundleBody(r *http.Request) (io.ReadCloser, error) {
+	contentEncoding := r.Header.Get("Content-Encoding")
+	if opts.EnableCompression {
+		body, err := decompressBody(contentEncoding, limitBody(r.Body, opts.MaxPushSize))
+		if err != nil {
+			return nil, err
+		}
+		return limitBody(body, opts.MaxPushSize), nil
+	}
+	if !isIdentityEncoding(contentEncoding) {
+		return nil, errors.Wrapf(ErrUnsupportedEncoding, "'%s', compression is disabled", contentEncoding)
+	}
+	return limitBody(r.Body, opts.MaxPushSize), nil
+}
+
+// write error response for bundleBody
+func writeBundleBodyError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	switch {
+	case errors.Is(err, ErrUnsupportedEncoding):
+		status = http.StatusUnsupportedMediaType
+	case errors.Is(err, ErrBundleTooLarge):
+		status = http.StatusRequestEntityTooLarge
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// limitBody fails reads with ErrBundleTooLarge, once more than max bytes are read. Zero for no limit
+func limitBody(body io.ReadCloser, max int64) io.ReadCloser {
+	if max <= 0 {
+		return body
+	}
+	return &limitedBody{ReadCloser: body, remaining: max}
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, ErrBundleTooLarge
+	}
+	// read one byte more than allowed, to detect bodies over the limit
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
 	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n, ErrBundleTooLarge
+	}
+	return n, err
+}
 
-	// Clone to local
-	worktree, err := git.SyncRepoToLocalTemp()
+// whether the Content-Type of a push is a bundle. Unset is allowed for compatibility
+func isBundleContentType(contentType string) bool {
+	if strings.TrimSpace(contentType) == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
 	if err != nil {
-		log.Error("sync to local failed", "err", err)
-		if errors.Is(err, ErrAuthFailed) {
-			http.Error(w, "authentication required", http.StatusUnauthorized)
+		return false
+	}
+	return mediaType == contentTypeOctetStream || mediaType == contentTypeGitBundle
+}
+
+func (h *GitPushHandler) push(ctx context.Context, log *slog.Logger, remoteRepo RemoteRepo, bundleData io.Reader, mode pushMode, w http.ResponseWriter) (success bool) {
+	bundle, err := io.ReadAll(bundleData)
+	if errors.Is(err, ErrBundleTooLarge) {
+		log.Warn("bundle rejected", "err", err)
+		writeBundleBodyError(w, err)
+		return
+	}
+	if err != nil {
+		log.Error("failed to read bundle", "err", err)
+		http.Error(w, "failed to read bundle", http.StatusBadRequest)
+		return
+	}
+
+	if remoteRepo.Branch == "" {
+		remoteRepo.Branch, err = branchFromBundle(bundle)
+		if err != nil {
+			log.Debug("failed to derive branch from bundle", "err", err)
+			http.Error(w, fmt.Sprintf("no 'branch' specified, and %v", err), http.StatusBadRequest)
 			return
 		}
-		http.Error(w, fmt.Sprintf("failed to sync repository: %v", err), http.StatusInternalServerError)
+		log = log.With("repo.branch", remoteRepo.Branch)
+	}
+
+	if mode.dryRun {
+		return h.dryRun(ctx, log, remoteRepo, bundle, mode, w)
+	}
+
+	syncer := h.syncer(mode)
+	var result PushResult
+	if mode.force {
+		result, err = syncer.ForcePush(ctx, remoteRepo, bytes.NewReader(bundle), mode.expectedHead)
+	} else {
+		result, err = syncer.Push(ctx, remoteRepo, bytes.NewReader(bundle))
+	}
+	if err != nil {
+		h.writeError(log, w, remoteRepo, err)
 		return
 	}
 
-	if worktree == nil {
-		log.Debug("remote repository does not exist")
-		http.Error(w, fmt.Sprintf("remote repository (%s) does not exist", git.remoteRepo.URL), http.StatusNotFound)
+	h.audit(log, remoteRepo, result)
+
+	summary := PushSummary{CommitsAdded: result.CommitsAdded, Heads: result.Heads,
+		TagsPushed: result.TagsPushed, TagsSkipped: result.TagsSkipped}
+	if remoteRepo.Branch != AllBranches {
+		summary.NewHead = result.NewHead.String()
+	}
+	if result.OldHead != plumbing.ZeroHash {
+		summary.OldHead = result.OldHead.String()
+	}
+
+	if result.Rewritten {
+		w.Header().Set("X-Git-Rewritten", "true")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(summary); err != nil {
+		log.Error("failed to write push summary", "err", err)
 		return
 	}
+	log.Debug("bundle pushed successfully")
+	h.opts.markSynced("push", remoteRepo.URL, remoteRepo.Branch, time.Now())
+
+	h.opts.Webhook.Send(h.opts.Operations, log, Event{Op: "push", Repository: remoteRepo.URL, Branch: remoteRepo.Branch, Head: summary.NewHead,
+		Commits: result.CommitsAdded, Timestamp: time.Now().UTC()})
+	return true
+}
+
+// PushSummary is the response of a successful push
+type PushSummary struct {
+	// OldHead is the head of the branch before the push. Empty if the branch had no commits
+	OldHead string `json:"old_head,omitempty"`
+	// NewHead is the head of the branch after the push. Empty when pushing all branches
+	NewHead string `json:"new_head,omitempty"`
+	// CommitsAdded is the number of commits added by the push. Zero if already up to date
+	CommitsAdded int `json:"commits_added"`
+	// Heads of all branches after the push. Only when pushing all branches
+	Heads []Head `json:"heads,omitempty"`
+	// TagsPushed are the tags of the bundle pushed to the remote
+	TagsPushed []string `json:"tags_pushed,omitempty"`
+	// TagsSkipped are the tags of the bundle not pushed, since they exist in the remote with another target
+	TagsSkipped []string `json:"tags_skipped,omitempty"`
+}
+
+// MissingPrerequisitesResponse is the 409 response of a push, when the repository lacks the prerequisites of the bundle
+type MissingPrerequisitesResponse struct {
+	Error string `json:"error"`
+	// MissingPrerequisites are the commit IDs the bundle requires, but the repository lacks
+	MissingPrerequisites []string `json:"missing_prerequisites"`
+}
 
-	err = git.ApplyBundleToLocal(bundleData)
+// DryRunSummary is the response of a dry-run push
+type DryRunSummary struct {
+	// OldHead is the current head of the branch. Empty if the branch has no commits
+	OldHead string `json:"old_head,omitempty"`
+	// NewHead is the head of the branch after the push
+	NewHead string `json:"new_head"`
+	// Commits the push would add (newest first)
+	Commits          []CommitInfo `json:"commits"`
+	CommitsTruncated bool         `json:"commits_truncated"`
+	// TagsPushed and TagsSkipped are as for PushSummary
+	TagsPushed  []string `json:"tags_pushed,omitempty"`
+	TagsSkipped []string `json:"tags_skipped,omitempty"`
+}
+
+// verify that the bundle would apply, without pushing to the remote
+func (h *GitPushHandler) dryRun(ctx context.Context, log *slog.Logger, remoteRepo RemoteRepo, bundle []byte, mode pushMode, w http.ResponseWriter) (success bool) {
+	result, err := h.syncer(mode).DryRunPush(ctx, remoteRepo, bytes.NewReader(bundle), dryRunMaxCommits)
 	if err != nil {
-		if cmdErr, ok := err.(*CommandError); ok {
-			log.Error("failed to apply bundle", "err", cmdErr, "message", cmdErr.Message, "stderr", cmdErr.StdErr)
-			if strings.Contains(cmdErr.StdErr, "Repository lacks these prerequisite commits") {
-				http.Error(w, "failed to apply bundle, some prerequisites are missing. You must provide a bundle that overlaps with commits in the remote repository", http.StatusConflict)
-				return
-			}
-		}
-		http.Error(w, fmt.Sprintf("failed to apply bundle: %v", err), http.StatusInternalServerError)
+		h.writeError(log, w, remoteRepo, err)
 		return
 	}
 
-	err = git.PushLocalToRemote()
-	if err != nil {
-		log.Error("failed to push local to remote", "err", err)
-		if errors.Is(err, ErrAuthFailed) {
-			http.Error(w, "authentication required", http.StatusUnauthorized)
-			return
-		}
-		http.Error(w, fmt.Sprintf("failed to apply bundle: %v", err), http.StatusInternalServerError)
+	summary := DryRunSummary{
+		NewHead:          result.NewHead.String(),
+		Commits:          result.Commits,
+		CommitsTruncated: result.CommitsTruncated,
+		TagsPushed:       result.TagsPushed,
+		TagsSkipped:      result.TagsSkipped}
+	if summary.Commits == nil {
+		summary.Commits = []CommitInfo{}
+	}
+	if result.OldHead != plumbing.ZeroHash {
+		summary.OldHead = result.OldHead.String()
+	}
+
+	if result.Rewritten {
+		w.Header().Set("X-Git-Rewritten", "true")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(summary); err != nil {
+		log.Error("failed to write dry-run summary", "err", err)
 		return
 	}
+	log.Debug("dry-run push succeeded", "old_head", summary.OldHead, "new_head", summary.NewHead, "commits", len(summary.Commits))
+	return true
+}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Bundle successfully pushed"))
-	log.Debug("bundle pushed successfully")
-	return success
+// write error response for a failed push
+func (h *GitPushHandler) writeError(log *slog.Logger, w http.ResponseWriter, remoteRepo RemoteRepo, err error) {
+	var cmdErr *CommandError
+	if errors.As(err, &cmdErr) {
+		log.Error("push failed", "err", err, "stderr", cmdErr.StdErr)
+	} else {
+		log.Error("push failed", "err", err)
+	}
+
+	switch {
+	case errors.Is(err, ErrAuthFailed):
+		h.opts.writeRemoteAuthError(w)
+	case errors.Is(err, ErrRepositoryNotFound):
+		http.Error(w, fmt.Sprintf("remote repository (%s) does not exist", remoteRepo.URL), http.StatusNotFound)
+	case errors.Is(err, ErrRewritten):
+		http.Error(w, "the history of the branch in the remote repository was rewritten (force-pushed) since the last sync", http.StatusConflict)
+	case errors.Is(err, ErrLeaseMismatch):
+		http.Error(w, fmt.Sprintf("force push rejected, the branch in the remote repository is not at the head in the '%s' header", headerExpectedHead), http.StatusConflict)
+	case errors.Is(err, ErrNotFastForward):
+		http.Error(w, "failed to apply bundle, it does not fast-forward the branch in the remote repository", http.StatusConflict)
+	case errors.Is(err, ErrMergeConflict):
+		http.Error(w, "failed to merge bundle, it conflicts with the branch in the remote repository", http.StatusConflict)
+	case errors.Is(err, ErrPushRejected):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrAtomicPushUnsupported):
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+	case errors.Is(err, ErrTagConflict):
+		http.Error(w, fmt.Sprintf("bundle rejected: %v", err), http.StatusConflict)
+	case errors.Is(err, ErrHashAlgorithmMismatch):
+		http.Error(w, fmt.Sprintf("bundle rejected: %v", err), http.StatusBadRequest)
+	case errors.Is(err, ErrRefMismatch):
+		http.Error(w, fmt.Sprintf("bundle rejected for branch %s: %v", remoteRepo.Branch, err), http.StatusBadRequest)
+	case errors.Is(err, ErrAllBranchesUnsupported):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrBundleTooOld):
+		http.Error(w, fmt.Sprintf("bundle rejected: %v", err), http.StatusUnprocessableEntity)
+	case errors.Is(err, ErrMissingPrerequisites):
+		resp := MissingPrerequisitesResponse{
+			Error:                "failed to apply bundle, some prerequisites are missing. You must provide a bundle that overlaps with commits in the remote repository",
+			MissingPrerequisites: []string{}}
+		if cmdErr != nil {
+			resp.MissingPrerequisites = append(resp.MissingPrerequisites, ParseMissingPrerequisites(cmdErr.StdErr)...)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Error("failed to write missing prerequisites", "err", err)
+		}
+	case isRemoteUnavailable(err):
+		writeRemoteUnavailableError(w, err)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// log audit entry for a push with the old and new head, and optionally the commits introduced
+func (h *GitPushHandler) audit(log *slog.Logger, remoteRepo RemoteRepo, result PushResult) {
+	args := []any{"old_head", result.OldHead.String(), "new_head", result.NewHead.String(), "commits_added", result.CommitsAdded}
+	if result.Rewritten {
+		args = append(args, "rewritten", true)
+	}
+	if result.Heads != nil {
+		args = append(args, "heads", result.Heads)
+	}
+	// commits are listed from the single branch, by Syncer.Push while the local clone is locked
+	if h.opts.AuditProvenance && remoteRepo.Branch != AllBranches {
+		args = append(args, "commits", result.Commits, "commits_truncated", result.CommitsTruncated)
+	}
+	log.Info("push audit", args...)
 }
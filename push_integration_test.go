@@ -0,0 +1,414 @@
+//go:build integration
+
+package git_sync
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bredtape/git_sync/testdata"
+	"github.com/pkg/errors"
+)
+
+// tests assumes that integrationtest/gogs-dev is running. Run with: go test -tags integration ./...
+
+func TestPushFullBundleExistingRepo(t *testing.T) {
+	slog.SetLogLoggerLevel(slog.LevelDebug)
+
+	branch := "main"
+	provider := newTestProvider()
+	repo, err := CreateRandomRepo(provider, branch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("Created repository, cloneURL=%s, branch=%s", repo.URL, repo.Branch)
+
+	client, serverURL := createTestServerWithPushHandler(t)
+
+	// full bundle
+	{
+		req := createPushHTTPRequest(t, serverURL, repo, testdata.FullBundle)
+		t.Logf("pushing full bundle to %s", req.URL.String())
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expectedStatus := http.StatusOK
+		if resp.StatusCode != expectedStatus {
+			body, _ := io.ReadAll(resp.Body)
+			t.Fatalf("expected status %d, got %d, body: %s", expectedStatus, resp.StatusCode, string(body))
+		}
+
+		expected := PushSummary{NewHead: "f8be008f3733c1a9b7962c1f5a50679266565e31", CommitsAdded: 2}
+		assertPushSummary(t, resp, expected)
+	}
+
+	{
+		req := createPushHTTPRequest(t, serverURL, repo, testdata.LastBundle)
+		t.Logf("pushing partial bundle (that already should have been pushed) to %s", req.URL.String())
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expectedStatus := http.StatusOK
+		if resp.StatusCode != expectedStatus {
+			body, _ := io.ReadAll(resp.Body)
+			t.Fatalf("expected status %d, got %d, body: %s", expectedStatus, resp.StatusCode, string(body))
+		}
+
+		// no-op
+		head := "f8be008f3733c1a9b7962c1f5a50679266565e31"
+		assertPushSummary(t, resp, PushSummary{OldHead: head, NewHead: head, CommitsAdded: 0})
+	}
+}
+
+func TestPushGzipCompressedBundle(t *testing.T) {
+	slog.SetLogLoggerLevel(slog.LevelDebug)
+
+	branch := "main"
+	provider := newTestProvider()
+	repo, err := CreateRandomRepo(provider, branch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("Created repository, cloneURL=%s, branch=%s", repo.URL, repo.Branch)
+	client, serverURL := createTestServerWithPushHandler(t)
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(testdata.FullBundle); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := createPushHTTPRequest(t, serverURL, repo, buf.Bytes())
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	expectedStatus := http.StatusOK
+	if resp.StatusCode != expectedStatus {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("expected status %d, got %d, body: %s", expectedStatus, resp.StatusCode, string(body))
+	}
+	assertPushSummary(t, resp, PushSummary{NewHead: "f8be008f3733c1a9b7962c1f5a50679266565e31", CommitsAdded: 2})
+}
+
+func TestPushPartialBundleMissingHistoryToExistingRepo(t *testing.T) {
+	slog.SetLogLoggerLevel(slog.LevelDebug)
+
+	branch := "main"
+	provider := newTestProvider()
+	repo, err := CreateRandomRepo(provider, branch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("Created repository, cloneURL=%s, branch=%s", repo.URL, repo.Branch)
+
+	client, serverURL := createTestServerWithPushHandler(t)
+	req := createPushHTTPRequest(t, serverURL, repo, testdata.LastBundle)
+	t.Logf("pushing partial bundle (that already should have been pushed) to %s", req.URL.String())
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedStatus := http.StatusConflict
+	if resp.StatusCode != expectedStatus {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("expected status %d, got %d, body: %s", expectedStatus, resp.StatusCode, string(body))
+	}
+
+	var actual MissingPrerequisitesResponse
+	if err := json.NewDecoder(resp.Body).Decode(&actual); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"ea29764e79de2eaaddbeabd9ee967852912cb52e"}
+	if !slices.Equal(actual.MissingPrerequisites, expected) {
+		t.Errorf("expected missing prerequisites %v, got %v", expected, actual.MissingPrerequisites)
+	}
+}
+
+func TestPushFullBundleExistingRepoTokenIncorrect(t *testing.T) {
+	slog.SetLogLoggerLevel(slog.LevelDebug)
+
+	branch := "main"
+	provider := newTestProvider()
+	repo, err := CreateRandomRepo(provider, branch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.Token = "incorrect"
+
+	t.Logf("Created repository, cloneURL=%s, branch=%s", repo.URL, repo.Branch)
+
+	client, serverURL := createTestServerWithPushHandler(t)
+
+	// full bundle
+	{
+		req := createPushHTTPRequest(t, serverURL, repo, testdata.FullBundle)
+		t.Logf("pushing full bundle to %s", req.URL.String())
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expectedStatus := http.StatusUnauthorized
+		if resp.StatusCode != expectedStatus {
+			body, _ := io.ReadAll(resp.Body)
+			t.Fatalf("expected status %d, got %d, body: %s", expectedStatus, resp.StatusCode, string(body))
+		}
+	}
+}
+
+func TestPushAuthModes(t *testing.T) {
+	slog.SetLogLoggerLevel(slog.LevelDebug)
+
+	tcs := []struct {
+		name           string
+		mode           AuthMode
+		inboundToken   string // empty to use the repo token
+		remoteToken    string // empty to use the repo token
+		expectedStatus int
+	}{
+		{"passthrough correct", AuthModePassthrough, "", "", http.StatusOK},
+		{"passthrough incorrect", AuthModePassthrough, "incorrect", "", http.StatusUnauthorized},
+		{"server correct", AuthModeServer, "secret", "", http.StatusOK},
+		{"server incorrect inbound", AuthModeServer, "incorrect", "", http.StatusUnauthorized},
+		{"server incorrect remote", AuthModeServer, "secret", "incorrect", http.StatusBadGateway},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			branch := "main"
+			provider := newTestProvider()
+			repo, err := CreateRandomRepo(provider, branch)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			opts := HandlerOptions{AuthMode: tc.mode, RemoteToken: repo.Token}
+			if tc.remoteToken != "" {
+				opts.RemoteToken = tc.remoteToken
+			}
+			if tc.inboundToken != "" {
+				repo.Token = tc.inboundToken
+			}
+
+			var h http.Handler = NewGitPushHandler(t.TempDir(), opts)
+			if tc.mode == AuthModeServer {
+				h = RequireToken("secret", BearerAuth{}, h)
+			}
+			server := httptest.NewServer(h)
+			t.Cleanup(server.Close)
+
+			req := createPushHTTPRequest(t, server.URL, repo, testdata.FullBundle)
+			resp, err := server.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.StatusCode != tc.expectedStatus {
+				body, _ := io.ReadAll(resp.Body)
+				t.Fatalf("expected status %d, got %d, body: %s", tc.expectedStatus, resp.StatusCode, string(body))
+			}
+		})
+	}
+}
+
+func TestPushDryRunDoesNotPush(t *testing.T) {
+	slog.SetLogLoggerLevel(slog.LevelDebug)
+
+	branch := "main"
+	provider := newTestProvider()
+	repo, err := CreateRandomRepo(provider, branch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("Created repository, cloneURL=%s, branch=%s", repo.URL, repo.Branch)
+	client, serverURL := createTestServerWithPushHandler(t)
+
+	req := createPushHTTPRequest(t, serverURL, repo, testdata.FullBundle)
+	q := req.URL.Query()
+	q.Set("dry-run", "true")
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("expected status %d, got %d, body %s", http.StatusOK, resp.StatusCode, string(body))
+	}
+
+	var summary DryRunSummary
+	if err := json.NewDecoder(resp.Body).Decode(&summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.OldHead != "" || summary.NewHead != "f8be008f3733c1a9b7962c1f5a50679266565e31" || len(summary.Commits) != 2 {
+		t.Errorf("unexpected dry-run summary %+v", summary)
+	}
+
+	// nothing pushed
+	_, err = Pull(context.Background(), t.TempDir(), repo, BundleOptions{})
+	if !errors.Is(err, ErrBranchNotFound) && !errors.Is(err, ErrNoCommits) {
+		t.Fatalf("expected no commits in remote after dry-run, got %v", err)
+	}
+
+	// a real push with the same handler is unaffected by the dry-run
+	resp, err = client.Do(createPushHTTPRequest(t, serverURL, repo, testdata.FullBundle))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("expected status %d, got %d, body %s", http.StatusOK, resp.StatusCode, string(body))
+	}
+}
+
+func TestPushForceWithLease(t *testing.T) {
+	slog.SetLogLoggerLevel(slog.LevelDebug)
+
+	branch := "main"
+	provider := newTestProvider()
+	repo, err := CreateRandomRepo(provider, branch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("Created repository, cloneURL=%s, branch=%s", repo.URL, repo.Branch)
+	server := httptest.NewServer(NewGitPushHandler(t.TempDir(), HandlerOptions{AllowForcePush: true}))
+	defer server.Close()
+
+	resp, err := server.Client().Do(createPushHTTPRequest(t, server.URL, repo, testdata.FullBundle))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	// the remote history diverges from the bundle
+	rewrittenHead := forcePushNewHistory(t, repo)
+
+	forcePush := func(expectedHead string) *http.Response {
+		req := createPushHTTPRequest(t, server.URL, repo, testdata.FullBundle)
+		req.URL.RawQuery += "&force=true"
+		req.Header.Set(headerExpectedHead, expectedHead)
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	// lease on the stale head
+	resp = forcePush("f8be008f3733c1a9b7962c1f5a50679266565e31")
+	if resp.StatusCode != http.StatusConflict {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("expected status %d, got %d, body %s", http.StatusConflict, resp.StatusCode, string(body))
+	}
+
+	resp = forcePush(rewrittenHead.String())
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("expected status %d, got %d, body %s", http.StatusOK, resp.StatusCode, string(body))
+	}
+	assertPushSummary(t, resp, PushSummary{
+		OldHead:      rewrittenHead.String(),
+		NewHead:      "f8be008f3733c1a9b7962c1f5a50679266565e31",
+		CommitsAdded: 2})
+}
+
+func TestPushBundleTooOld(t *testing.T) {
+	branch := "main"
+	provider := newTestProvider()
+	repo, err := CreateRandomRepo(provider, branch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the commits of the test data are older than an hour
+	server := httptest.NewServer(NewGitPushHandler(t.TempDir(), HandlerOptions{MaxBundleAge: time.Hour}))
+	defer server.Close()
+
+	resp, err := server.Client().Do(createPushHTTPRequest(t, server.URL, repo, testdata.FullBundle))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("expected status %d, got %d, body %s", http.StatusUnprocessableEntity, resp.StatusCode, string(body))
+	}
+
+	// nothing pushed
+	_, err = Pull(context.Background(), t.TempDir(), repo, BundleOptions{})
+	if !errors.Is(err, ErrBranchNotFound) && !errors.Is(err, ErrNoCommits) {
+		t.Fatalf("expected no commits in remote after rejected push, got %v", err)
+	}
+}
+
+func TestPushBranchFromBundle(t *testing.T) {
+	slog.SetLogLoggerLevel(slog.LevelDebug)
+
+	branch := "main"
+	provider := newTestProvider()
+	repo, err := CreateRandomRepo(provider, branch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("Created repository, cloneURL=%s, branch=%s", repo.URL, repo.Branch)
+	server := httptest.NewServer(NewGitPushHandler(t.TempDir(), HandlerOptions{BranchFromBundle: true}))
+	t.Cleanup(server.Close)
+
+	// no branch in the query
+	req := createPushHTTPRequest(t, server.URL, RemoteRepo{URL: repo.URL, Token: repo.Token}, testdata.FullBundle)
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("expected status %d, got %d, body: %s", http.StatusOK, resp.StatusCode, string(body))
+	}
+
+	pulled, err := Pull(context.Background(), t.TempDir(), repo, BundleOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pulled.Info.Heads[0].CommitID != "f8be008f3733c1a9b7962c1f5a50679266565e31" {
+		t.Errorf("expected bundle routed to branch %s, got head %v", branch, pulled.Info.Heads)
+	}
+}
@@ -2,18 +2,27 @@ package git_sync
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
 	"io"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
+	"github.com/bredtape/git_sync/client"
 	"github.com/bredtape/git_sync/testdata"
+	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
 )
 
-// tests assumes that integrationtest/gogs-dev is running
-
 /*
 To create a complete bundle:
 # git bundle create full.bundle main
@@ -21,124 +30,174 @@ To create a partial bundle with the last n=1 commit:
 # git bundle create last.bundle main~1..main
 */
 
-func createTestServerWithPushHandler(t *testing.T) (*http.Client, string) {
-	h := NewGitPushHandler(t.TempDir())
-	mux := mux.NewRouter()
-	mux.Handle("/push", h)
-	server := httptest.NewServer(mux)
+func TestVerifyBundleInScratchLeavesLocalUntouched(t *testing.T) {
+	slog.SetLogLoggerLevel(slog.LevelDebug)
 
-	t.Cleanup(func() {
-		server.Close()
-	})
+	repo := setupLocalBareRemote(t)
 
-	return server.Client(), server.URL + "/push"
-}
+	g, err := NewGIT(t.TempDir(), repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = g.SyncRepoToLocalTemp()
+	if err != nil {
+		t.Fatal(err)
+	}
 
-func TestPushFullBundleExistingRepo(t *testing.T) {
-	slog.SetLogLoggerLevel(slog.LevelDebug)
+	// partial bundle, with prerequisites missing in the empty repo
+	err = g.VerifyBundleInScratch(bytes.NewReader(testdata.LastBundle))
+	if err == nil {
+		t.Fatal("expected partial bundle to fail verification")
+	}
 
-	branch := "main"
-	gogsAdmin := NewGogsAdmin(user, password, baseURL)
-	repo, err := gogsAdmin.CreateRandomRepo(branch)
+	// full bundle verifies, but must not be applied either
+	err = g.VerifyBundleInScratch(bytes.NewReader(testdata.FullBundle))
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	t.Logf("Created repository, cloneURL=%s, branch=%s", repo.URL, repo.Branch)
-
-	client, serverURL := createTestServerWithPushHandler(t)
+	hasCommits, err := g.hasLocalCommits()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hasCommits {
+		t.Fatal("expected local repo to be untouched by verification")
+	}
+}
 
-	// full bundle
-	{
-		req := createPushHTTPRequest(t, serverURL, repo, testdata.FullBundle)
-		t.Logf("pushing full bundle to %s", req.URL.String())
+func TestPushContentType(t *testing.T) {
+	tcs := map[string]bool{
+		"":                                 true,
+		"application/octet-stream":         true,
+		"application/x-git-bundle":         true,
+		"Application/Octet-Stream; q=1":    true,
+		"application/json":                 false,
+		"text/plain; charset=utf-8":        false,
+		"multipart/form-data; boundary=xx": false,
+	}
 
-		resp, err := client.Do(req)
-		if err != nil {
-			t.Fatal(err)
+	for contentType, accepted := range tcs {
+		if actual := isBundleContentType(contentType); actual != accepted {
+			t.Errorf("content type '%s': expected accepted=%t, got %t", contentType, accepted, actual)
 		}
+	}
+}
 
-		expectedStatus := http.StatusOK
-		if resp.StatusCode != expectedStatus {
-			body, _ := io.ReadAll(resp.Body)
-			t.Fatalf("expected status %d, got %d, body: %s", expectedStatus, resp.StatusCode, string(body))
-		}
+func TestPushJSONContentTypeRejectedBeforeGit(t *testing.T) {
+	repo := unusedRemote("main")
+	req := createPushHTTPRequest(t, "/push", repo, []byte(`{"bundle": "not"}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	rec := httptest.NewRecorder()
+	NewGitPushHandler(t.TempDir(), HandlerOptions{}).ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected status %d, got %d, body %s", http.StatusUnsupportedMediaType, rec.Code, rec.Body.String())
 	}
+}
 
-	{
-		req := createPushHTTPRequest(t, serverURL, repo, testdata.LastBundle)
-		t.Logf("pushing partial bundle (that already should have been pushed) to %s", req.URL.String())
+func TestPushForceRejectedBeforeGit(t *testing.T) {
+	repo := unusedRemote("main")
+	noHead, emptyHead, invalidHead := plumbing.ZeroHash.String(), "", "main"
+
+	tcs := map[string]struct {
+		allow bool
+		query string
+		// header omitted if nil
+		expectedHead   *string
+		expectedStatus int
+	}{
+		"not allowed":      {allow: false, query: "force=true", expectedHead: &noHead, expectedStatus: http.StatusForbidden},
+		"no expected head": {allow: true, query: "force=true", expectedStatus: http.StatusPreconditionRequired},
+		"empty head":       {allow: true, query: "force=true", expectedHead: &emptyHead, expectedStatus: http.StatusPreconditionRequired},
+		"invalid head":     {allow: true, query: "force=true", expectedHead: &invalidHead, expectedStatus: http.StatusBadRequest},
+		"invalid force":    {allow: true, query: "force=yes", expectedHead: &noHead, expectedStatus: http.StatusBadRequest},
+		"with dry-run":     {allow: true, query: "force=true&dry-run=true", expectedHead: &noHead, expectedStatus: http.StatusBadRequest},
+	}
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			req := createPushHTTPRequest(t, "/push", repo, testdata.FullBundle)
+			req.URL.RawQuery += "&" + tc.query
+			if tc.expectedHead != nil {
+				req.Header.Set(headerExpectedHead, *tc.expectedHead)
+			}
+
+			rec := httptest.NewRecorder()
+			NewGitPushHandler(t.TempDir(), HandlerOptions{AllowForcePush: tc.allow}).ServeHTTP(rec, req)
+			if rec.Code != tc.expectedStatus {
+				t.Fatalf("expected status %d, got %d, body %s", tc.expectedStatus, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
 
-		resp, err := client.Do(req)
-		if err != nil {
-			t.Fatal(err)
-		}
+func TestPushRefMismatchRejectedBeforeGit(t *testing.T) {
+	repo := unusedRemote("feature-x")
 
-		expectedStatus := http.StatusOK
-		if resp.StatusCode != expectedStatus {
-			body, _ := io.ReadAll(resp.Body)
-			t.Fatalf("expected status %d, got %d, body: %s", expectedStatus, resp.StatusCode, string(body))
+	rec := httptest.NewRecorder()
+	NewGitPushHandler(t.TempDir(), HandlerOptions{}).ServeHTTP(rec, createPushHTTPRequest(t, "/push", repo, testdata.FullBundle))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d, body %s", http.StatusBadRequest, rec.Code, rec.Body.String())
+	}
+	for _, ref := range []string{"refs/heads/feature-x", "refs/heads/main"} {
+		if !strings.Contains(rec.Body.String(), ref) {
+			t.Errorf("expected '%s' in body %s", ref, rec.Body.String())
 		}
 	}
 }
 
-func TestPushPartialBundleMissingHistoryToExistingRepo(t *testing.T) {
-	slog.SetLogLoggerLevel(slog.LevelDebug)
-
-	branch := "main"
-	gogsAdmin := NewGogsAdmin(user, password, baseURL)
-	repo, err := gogsAdmin.CreateRandomRepo(branch)
-	if err != nil {
+// the size limit applies to the decompressed body, so a small body of highly compressible data is rejected
+func TestPushMaxSize(t *testing.T) {
+	var compressed bytes.Buffer
+	gw := gzip.NewWriter(&compressed)
+	if _, err := gw.Write(make([]byte, 8<<20)); err != nil {
 		t.Fatal(err)
 	}
-
-	t.Logf("Created repository, cloneURL=%s, branch=%s", repo.URL, repo.Branch)
-
-	client, serverURL := createTestServerWithPushHandler(t)
-	req := createPushHTTPRequest(t, serverURL, repo, testdata.LastBundle)
-	t.Logf("pushing partial bundle (that already should have been pushed) to %s", req.URL.String())
-
-	resp, err := client.Do(req)
-	if err != nil {
+	if err := gw.Close(); err != nil {
 		t.Fatal(err)
 	}
 
-	expectedStatus := http.StatusConflict
-	if resp.StatusCode != expectedStatus {
-		body, _ := io.ReadAll(resp.Body)
-		t.Fatalf("expected status %d, got %d, body: %s", expectedStatus, resp.StatusCode, string(body))
+	tcs := map[string]struct {
+		body           []byte
+		encoding       string
+		maxSize        int64
+		expectedStatus int
+	}{
+		"compressed over limit": {body: compressed.Bytes(), encoding: encodingGzip, maxSize: 1 << 20, expectedStatus: http.StatusRequestEntityTooLarge},
+		"over limit":            {body: testdata.FullBundle, maxSize: int64(len(testdata.FullBundle)) - 1, expectedStatus: http.StatusRequestEntityTooLarge},
+		"at limit":              {body: testdata.FullBundle, maxSize: int64(len(testdata.FullBundle)), expectedStatus: http.StatusOK},
+	}
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			req := createPushHTTPRequest(t, "/push", setupLocalBareRemote(t), tc.body)
+			req.Header.Set("Content-Encoding", tc.encoding)
+
+			rec := httptest.NewRecorder()
+			NewGitPushHandler(t.TempDir(), HandlerOptions{AuthMode: AuthModeServer, EnableCompression: true, MaxPushSize: tc.maxSize}).ServeHTTP(rec, req)
+			if rec.Code != tc.expectedStatus {
+				t.Fatalf("expected status %d, got %d, body %s", tc.expectedStatus, rec.Code, rec.Body.String())
+			}
+		})
 	}
 }
 
-func TestPushFullBundleExistingRepoTokenIncorrect(t *testing.T) {
-	slog.SetLogLoggerLevel(slog.LevelDebug)
-
-	branch := "main"
-	gogsAdmin := NewGogsAdmin(user, password, baseURL)
-	repo, err := gogsAdmin.CreateRandomRepo(branch)
+func TestBranchFromBundle(t *testing.T) {
+	branch, err := branchFromBundle(testdata.FullBundle)
 	if err != nil {
 		t.Fatal(err)
 	}
-	repo.Token = "incorrect"
-
-	t.Logf("Created repository, cloneURL=%s, branch=%s", repo.URL, repo.Branch)
-
-	client, serverURL := createTestServerWithPushHandler(t)
-
-	// full bundle
-	{
-		req := createPushHTTPRequest(t, serverURL, repo, testdata.FullBundle)
-		t.Logf("pushing full bundle to %s", req.URL.String())
-
-		resp, err := client.Do(req)
-		if err != nil {
-			t.Fatal(err)
-		}
+	if branch != "main" {
+		t.Errorf("expected branch main, got %s", branch)
+	}
 
-		expectedStatus := http.StatusUnauthorized
-		if resp.StatusCode != expectedStatus {
-			body, _ := io.ReadAll(resp.Body)
-			t.Fatalf("expected status %d, got %d, body: %s", expectedStatus, resp.StatusCode, string(body))
+	tcs := map[string]string{
+		"tag":        "# v2 git bundle\nf8be008f3733c1a9b7962c1f5a50679266565e31 refs/tags/v1\n\n",
+		"two heads":  "# v2 git bundle\nf8be008f3733c1a9b7962c1f5a50679266565e31 refs/heads/main\nea29764e79de2eaaddbeabd9ee967852912cb52e refs/heads/dev\n\n",
+		"not bundle": "not a bundle",
+	}
+	for name, header := range tcs {
+		_, err := branchFromBundle([]byte(header))
+		if err == nil {
+			t.Errorf("%s: expected error", name)
 		}
 	}
 }
@@ -154,7 +213,185 @@ func createPushHTTPRequest(t *testing.T, serverURL string, repo RemoteRepo, bund
 	req.Header.Set("Authorization", "Bearer "+repo.Token)
 	q := req.URL.Query()
 	q.Add("repository", repo.URL)
-	q.Add("branch", repo.Branch)
+	if repo.Branch != "" {
+		q.Add("branch", repo.Branch)
+	}
 	req.URL.RawQuery = q.Encode()
 	return req
 }
+
+func createTestServerWithPushHandler(t *testing.T) (*http.Client, string) {
+	h := NewGitPushHandler(t.TempDir(), HandlerOptions{EnableCompression: true})
+	mux := mux.NewRouter()
+	mux.Handle("/push", h)
+	server := httptest.NewServer(mux)
+
+	t.Cleanup(func() {
+		server.Close()
+	})
+
+	return server.Client(), server.URL + "/push"
+}
+
+func assertPushSummary(t *testing.T, resp *http.Response, expected PushSummary) {
+	t.Helper()
+
+	var actual PushSummary
+	if err := json.NewDecoder(resp.Body).Decode(&actual); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected push summary %+v, got %+v", expected, actual)
+	}
+}
+
+// the first push to a freshly created repository, without any branches
+func TestPushToEmptyRemote(t *testing.T) {
+	head := "f8be008f3733c1a9b7962c1f5a50679266565e31"
+	for name, branch := range map[string]string{"default branch": "main", "other branch": "develop"} {
+		t.Run(name, func(t *testing.T) {
+			repo := setupLocalBareRemote(t)
+			repo.Branch = branch
+			repo.Token = "not_used"
+			client, serverURL := createTestServerWithPushHandler(t)
+
+			// the bundle is of main
+			req := createPushHTTPRequest(t, serverURL, repo, testdata.FullBundle)
+			req.URL.RawQuery += "&ref=main"
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+			}
+			assertPushSummary(t, resp, PushSummary{NewHead: head, CommitsAdded: 2})
+
+			bare := strings.TrimPrefix(repo.URL, "file://")
+			out, err := exec.Command("git", "-C", bare, "for-each-ref", "--format=%(refname) %(objectname)", "refs/heads").Output()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected := "refs/heads/" + branch + " " + head; strings.TrimSpace(string(out)) != expected {
+				t.Errorf("expected only '%s' in the remote, got '%s'", expected, out)
+			}
+		})
+	}
+}
+
+// a partial bundle cannot be the first push, since the remote has none of its prerequisites
+func TestPushPartialBundleToEmptyRemote(t *testing.T) {
+	repo := setupLocalBareRemote(t)
+	_, serverURL := createTestServerWithPushHandler(t)
+	c := client.New(strings.TrimSuffix(serverURL, "/push"), "not_used")
+
+	_, err := c.Push(context.Background(), repo.URL, repo.Branch, bytes.NewReader(testdata.LastBundle))
+	var statusErr *client.StatusError
+	if !errors.Is(err, client.ErrConflict) || !errors.As(err, &statusErr) {
+		t.Fatalf("expected conflict, got %v", err)
+	}
+	info, err := ParseBundleHeader(testdata.LastBundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(statusErr.MissingPrerequisites, info.Prerequisites) {
+		t.Errorf("expected missing prerequisites %v, got %v", info.Prerequisites, statusErr.MissingPrerequisites)
+	}
+
+	// the remote is still empty, and the full bundle can be pushed
+	result, err := c.Push(context.Background(), repo.URL, repo.Branch, bytes.NewReader(testdata.FullBundle))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.OldHead != "" || result.NewHead != "f8be008f3733c1a9b7962c1f5a50679266565e31" {
+		t.Errorf("unexpected push result %+v", result)
+	}
+}
+
+// a sha256 bundle cannot be applied to a sha1 repository
+func TestPushHashAlgorithmMismatch(t *testing.T) {
+	dir := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "--quiet", "--object-format=sha256", "--initial-branch=main", dir},
+		{"-C", dir, "-c", "user.name=test", "-c", "user.email=test@localhost", "commit", "--quiet", "--allow-empty", "-m", "first"},
+		{"-C", dir, "bundle", "create", "--quiet", "sha256.bundle", "main"},
+	} {
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v failed: %v: %s", args, err, out)
+		}
+	}
+	bundle, err := os.ReadFile(filepath.Join(dir, "sha256.bundle"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := setupLocalBareRemote(t)
+	repo.Token = "not_used"
+	client, serverURL := createTestServerWithPushHandler(t)
+	resp, err := client.Do(createPushHTTPRequest(t, serverURL, repo, bundle))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "sha256") {
+		t.Errorf("expected status %d mentioning sha256, got %d: %s", http.StatusBadRequest, resp.StatusCode, body)
+	}
+}
+
+// the commits of the audit log entry are listed by the push, while the local clone is locked
+func TestPushAuditProvenance(t *testing.T) {
+	var buf bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	defer slog.SetDefault(defaultLogger)
+
+	tcs := map[string]struct {
+		maxCommits        int
+		expectedCommits   int
+		expectedTruncated bool
+	}{
+		"all":       {maxCommits: 10, expectedCommits: 2},
+		"truncated": {maxCommits: 1, expectedCommits: 1, expectedTruncated: true},
+	}
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			buf.Reset()
+			repo := setupLocalBareRemote(t)
+			repo.Token = "not_used"
+			h := NewGitPushHandler(t.TempDir(), HandlerOptions{AuditProvenance: true, AuditMaxCommits: tc.maxCommits})
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, createPushHTTPRequest(t, "/push", repo, testdata.FullBundle))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected status %d, got %d, body %s", http.StatusOK, rec.Code, rec.Body.String())
+			}
+
+			type auditEntry struct {
+				Msg              string       `json:"msg"`
+				Commits          []CommitInfo `json:"commits"`
+				CommitsTruncated bool         `json:"commits_truncated"`
+			}
+			var entry auditEntry
+			for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+				var e auditEntry
+				if err := json.Unmarshal([]byte(line), &e); err != nil {
+					t.Fatal(err)
+				}
+				if e.Msg == "push audit" {
+					entry = e
+				}
+			}
+			if entry.Msg != "push audit" {
+				t.Fatalf("expected a push audit entry, got %s", buf.String())
+			}
+			if len(entry.Commits) != tc.expectedCommits || entry.CommitsTruncated != tc.expectedTruncated {
+				t.Errorf("expected %d commits (truncated %t), got %+v (truncated %t)", tc.expectedCommits, tc.expectedTruncated, entry.Commits, entry.CommitsTruncated)
+			}
+			if len(entry.Commits) > 0 && entry.Commits[0].ID != "f8be008f3733c1a9b7962c1f5a50679266565e31" {
+				t.Errorf("expected the newest commit first, got %+v", entry.Commits)
+			}
+		})
+	}
+}
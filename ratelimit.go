@@ -0,0 +1,133 @@
+package git_sync
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var metricRateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "git_sync_rate_limited_total",
+	Help: "Number of requests rejected by the rate limit, by fingerprint of the validated token of the client ('anonymous' for clients identified by IP)"},
+	[]string{"token"})
+
+// ErrRateLimited is returned when a client exceeds its rate limit
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+// how often buckets of idle clients are removed
+const rateLimiterSweepInterval = time.Minute
+
+// RateLimiter limits the request rate of each client with a token bucket, refilled at rate tokens
+// per second up to burst. A nil *RateLimiter does not limit
+type RateLimiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter allows rate requests per second for each client, with bursts of up to burst requests.
+// A burst less than 1 is 1
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:    rate,
+		burst:   float64(max(burst, 1)),
+		now:     time.Now,
+		buckets: make(map[string]*tokenBucket)}
+}
+
+// take a token from the bucket of the client. If none is left, returns false and
+// how long until the next token is available
+func (l *RateLimiter) allow(client string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// remove the buckets that would be full by now, which are the same as no bucket
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimiterSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// RateLimit is middleware limiting the requests of each client, identified by the token of the
+// request (extracted by auth) or otherwise by the remote IP. Requests over the limit get 429 with Retry-After.
+// Each token gets a bucket and a label of metricRateLimited, so auth must only be given when the token was
+// validated before, e.g. by RequireTokens. With a nil auth, clients are identified by IP only
+func RateLimit(l *RateLimiter, auth AuthExtractor, next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, fingerprint := "ip:"+remoteIP(r), "anonymous"
+		if auth != nil {
+			if token, err := auth.ExtractToken(r); err == nil && token != "" {
+				fingerprint = tokenFingerprint(token)
+				client = "token:" + fingerprint
+			}
+		}
+
+		ok, wait := l.allow(client)
+		if !ok {
+			metricRateLimited.WithLabelValues(fingerprint).Inc()
+			LoggerFromContext(r.Context()).Debug("rate limited", "op", "RateLimit", "client", fingerprint, "retryAfter", wait)
+			w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(wait.Seconds())))))
+			http.Error(w, ErrRateLimited.Error(), http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// identifies a token by a hash, so the token itself is never stored or exposed
+func tokenFingerprint(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:16])
+}
+
+// the IP of the remote address of the request, without the port
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,110 @@
+package git_sync
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRateLimiterRefills(t *testing.T) {
+	now := time.Date(2025, 2, 13, 8, 0, 0, 0, time.UTC)
+	l := NewRateLimiter(2, 2)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("a"); !ok {
+			t.Fatalf("expected request %d within the burst to be allowed", i)
+		}
+	}
+	ok, wait := l.allow("a")
+	if ok || wait != 500*time.Millisecond {
+		t.Fatalf("expected to be limited for 500ms, got %v, %s", ok, wait)
+	}
+	if ok, _ := l.allow("b"); !ok {
+		t.Error("expected another client not to be limited")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := l.allow("a"); !ok {
+		t.Error("expected a token after 500ms")
+	}
+
+	now = now.Add(time.Hour)
+	l.allow("a")
+	if len(l.buckets) != 1 {
+		t.Errorf("expected the bucket of the idle client to be removed, got %d buckets", len(l.buckets))
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	l := NewRateLimiter(0.5, 1)
+	h := RateLimit(l, BearerAuth{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	fingerprint := tokenFingerprint("secret")
+	before := testutil.ToFloat64(metricRateLimited.WithLabelValues(fingerprint))
+
+	request := func(token, remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/pull", nil)
+		r.RemoteAddr = remoteAddr
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := request("secret", "10.0.0.1:1234"); w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	// same token from another address
+	w := request("secret", "10.0.0.2:1234")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "2" {
+		t.Errorf("expected 429 with Retry-After 2, got %d with %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if actual := testutil.ToFloat64(metricRateLimited.WithLabelValues(fingerprint)) - before; actual != 1 {
+		t.Errorf("expected 1 rate limited request of the token, got %v", actual)
+	}
+
+	// without a token, by IP
+	if w := request("", "10.0.0.1:1234"); w.Code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if w := request("", "10.0.0.1:5678"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status %d for the same IP, got %d", http.StatusTooManyRequests, w.Code)
+	}
+	if w := request("", "10.0.0.3:1234"); w.Code != http.StatusOK {
+		t.Errorf("expected status %d for another IP, got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestRateLimitMiddlewareByIPWithoutAuth(t *testing.T) {
+	l := NewRateLimiter(0.5, 1)
+	h := RateLimit(l, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	before := testutil.ToFloat64(metricRateLimited.WithLabelValues("anonymous"))
+
+	request := func(token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/pull", nil)
+		r.RemoteAddr = "10.0.0.4:1234"
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := request("a"); w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	// unvalidated tokens neither get a bucket nor a label of their own
+	if w := request("b"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status %d for another token from the same IP, got %d", http.StatusTooManyRequests, w.Code)
+	}
+	if len(l.buckets) != 1 {
+		t.Errorf("expected 1 bucket, got %d", len(l.buckets))
+	}
+	if actual := testutil.ToFloat64(metricRateLimited.WithLabelValues("anonymous")) - before; actual != 1 {
+		t.Errorf("expected 1 rate limited anonymous request, got %v", actual)
+	}
+}
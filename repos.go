@@ -0,0 +1,213 @@
+package git_sync
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var metricLastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "git_sync_last_success_timestamp_seconds",
+	Help: "Unix time of the last successful operation (pull or push) on the repository and branch"}, []string{"op", "repository_url", "branch"})
+
+// RegisteredRepo is a configured repository of a multi-repo setup
+type RegisteredRepo struct {
+	URL    string
+	Branch string
+	// Pull and Push are whether the repository is pulled from (source) and/or pushed to (sink)
+	Pull, Push bool
+	// TempDir of the local clones of the repository. Optional, defaults to the temp dir of the handlers
+	TempDir string
+	// Token for the repository in AuthModeServer and for prewarming. Optional, defaults to the remote token
+	// of the handlers
+	Token string
+	// TokenFile replaces Token with the token of the file, so rotated tokens are used. Optional
+	TokenFile *TokenFile
+}
+
+// RepoStatus describes a registered repository, as listed by GET /repos
+type RepoStatus struct {
+	Name string `json:"name"`
+	// URL without credentials
+	URL    string `json:"url"`
+	Branch string `json:"branch"`
+	Pull   bool   `json:"pull"`
+	Push   bool   `json:"push"`
+	// LastSync is the last successful pull, push or mirror of the branch by this instance. Omitted if none since start
+	LastSync *time.Time `json:"last_sync,omitempty"`
+	// LastPull and LastPush are the last successful pull and push (including mirrors) of the branch. Omitted if none
+	LastPull *time.Time `json:"last_pull,omitempty"`
+	LastPush *time.Time `json:"last_push,omitempty"`
+}
+
+// RepoRegistry holds the configured repositories, and when each was last synced. A nil *RepoRegistry is empty
+type RepoRegistry struct {
+	repos []RegisteredRepo
+
+	mu       sync.Mutex
+	lastSync map[RemoteRepo]syncTimes
+}
+
+// last successful operations on a branch
+type syncTimes struct {
+	last, pull, push time.Time
+}
+
+func NewRepoRegistry(repos []RegisteredRepo) *RepoRegistry {
+	return &RepoRegistry{repos: repos, lastSync: make(map[RemoteRepo]syncTimes)}
+}
+
+// MarkSynced records a successful operation (pull or push) on the branch of the repository, if registered.
+// For AllBranches, every registered branch of the repository is marked
+func (r *RepoRegistry) MarkSynced(op, repoURL, branch string, t time.Time) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, repo := range r.repos {
+		if repo.URL == repoURL && (branch == AllBranches || branch == repo.Branch) {
+			key := RemoteRepo{URL: repo.URL, Branch: repo.Branch}
+			times := r.lastSync[key]
+			times.last = t
+			switch op {
+			case "pull":
+				times.pull = t
+			case "push":
+				times.push = t
+			}
+			r.lastSync[key] = times
+		}
+	}
+}
+
+// Registered returns whether the repository URL is registered, for any branch
+func (r *RepoRegistry) Registered(repoURL string) bool {
+	if r == nil {
+		return false
+	}
+	for _, repo := range r.repos {
+		if repo.URL == repoURL {
+			return true
+		}
+	}
+	return false
+}
+
+// RegisteredBranch returns whether the branch of the repository URL is registered. AllBranches is registered
+// when any branch of the repository is
+func (r *RepoRegistry) RegisteredBranch(repoURL, branch string) bool {
+	if r == nil {
+		return false
+	}
+	for _, repo := range r.repos {
+		if repo.URL == repoURL && (branch == AllBranches || branch == repo.Branch) {
+			return true
+		}
+	}
+	return false
+}
+
+// Name returns the name of the registered repository URL, e.g. "repo" for "https://host/owner/repo.git",
+// or empty string if not registered. When other registered repositories have the same name
+// (e.g. https://host/a/repo.git and https://host/b/repo.git), the name is suffixed with a hash of the URL
+func (r *RepoRegistry) Name(repoURL string) string {
+	if !r.Registered(repoURL) {
+		return ""
+	}
+	name := repoName(repoURL)
+	for _, repo := range r.repos {
+		if repo.URL != repoURL && repoName(repo.URL) == name {
+			sum := sha256.Sum256([]byte(repoURL))
+			return name + "-" + hex.EncodeToString(sum[:4])
+		}
+	}
+	return name
+}
+
+// TempDir returns the temp dir configured for the repository URL, or empty string if none
+func (r *RepoRegistry) TempDir(repoURL string) string {
+	if r == nil {
+		return ""
+	}
+	for _, repo := range r.repos {
+		if repo.URL == repoURL && repo.TempDir != "" {
+			return repo.TempDir
+		}
+	}
+	return ""
+}
+
+// Token returns the current token configured for the repository URL, and whether one is configured
+func (r *RepoRegistry) Token(repoURL string) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+	for _, repo := range r.repos {
+		if repo.URL != repoURL {
+			continue
+		}
+		if repo.TokenFile != nil {
+			return repo.TokenFile.Token(), true
+		}
+		if repo.Token != "" {
+			return repo.Token, true
+		}
+	}
+	return "", false
+}
+
+// List the registered repositories, in the configured order
+func (r *RepoRegistry) List() []RepoStatus {
+	result := []RepoStatus{}
+	if r == nil {
+		return result
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, repo := range r.repos {
+		status := RepoStatus{
+			Name:   r.Name(repo.URL),
+			URL:    stripCredentials(repo.URL),
+			Branch: repo.Branch,
+			Pull:   repo.Pull,
+			Push:   repo.Push}
+		if times, ok := r.lastSync[RemoteRepo{URL: repo.URL, Branch: repo.Branch}]; ok {
+			status.LastSync = &times.last
+			if !times.pull.IsZero() {
+				status.LastPull = &times.pull
+			}
+			if !times.push.IsZero() {
+				status.LastPush = &times.push
+			}
+		}
+		result = append(result, status)
+	}
+	return result
+}
+
+// ServeHTTP lists the registered repositories as JSON
+func (r *RepoRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(r.List()); err != nil {
+		LoggerFromContext(req.Context()).Error("failed to write repositories", "op", "RepoRegistry.ServeHTTP", "err", err)
+	}
+}
+
+// the URL without user info, e.g. a token as https://token@host/owner/repo.git
+func stripCredentials(remoteURL string) string {
+	u, err := url.Parse(remoteURL)
+	if err != nil {
+		// may contain credentials, so do not echo it
+		return ""
+	}
+	u.User = nil
+	return u.String()
+}
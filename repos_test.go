@@ -0,0 +1,105 @@
+package git_sync
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRepoRegistryList(t *testing.T) {
+	r := NewRepoRegistry([]RegisteredRepo{
+		{URL: "https://token@host/owner/a.git", Branch: "main", Pull: true},
+		{URL: "https://token@host/owner/a.git", Branch: "dev", Pull: true, Push: true},
+		{URL: "https://host/owner/b.git", Branch: "main", Push: true}})
+
+	synced := time.Date(2025, 2, 13, 8, 0, 0, 0, time.UTC)
+	r.MarkSynced("push", "https://host/owner/b.git", "main", synced)
+	r.MarkSynced("push", "https://host/owner/b.git", "dev", synced.Add(time.Hour))
+	r.MarkSynced("push", "https://host/owner/unknown.git", "main", synced)
+
+	repos := r.List()
+	if len(repos) != 3 {
+		t.Fatalf("expected 3 repositories, got %+v", repos)
+	}
+	a := repos[1]
+	if a.Name != "a" || a.URL != "https://host/owner/a.git" || a.Branch != "dev" || !a.Pull || !a.Push || a.LastSync != nil {
+		t.Errorf("unexpected status of a, got %+v", a)
+	}
+	b := repos[2]
+	if b.Pull || !b.Push || b.LastSync == nil || !b.LastSync.Equal(synced) || b.LastPush == nil || !b.LastPush.Equal(synced) || b.LastPull != nil {
+		t.Errorf("expected b pushed at %s, got %+v", synced, b)
+	}
+
+	r.MarkSynced("pull", "https://token@host/owner/a.git", AllBranches, synced)
+	for _, repo := range r.List()[:2] {
+		if repo.LastSync == nil {
+			t.Errorf("expected all branches of a to be synced, got %+v", repo)
+		}
+	}
+}
+
+func TestRepoRegistryMarkedByPull(t *testing.T) {
+	branch := "main"
+	repoURL, _ := createPublicRepo(t, branch)
+	registry := NewRepoRegistry([]RegisteredRepo{{URL: repoURL, Branch: branch, Pull: true}})
+
+	pull := httptest.NewServer(NewGitPullHandler(t.TempDir(), HandlerOptions{Repos: registry}))
+	t.Cleanup(pull.Close)
+	resp, err := pull.Client().Get(pull.URL + "?" + url.Values{"repository": {repoURL}, "branch": {branch}}.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	repos := httptest.NewServer(registry)
+	t.Cleanup(repos.Close)
+	resp, err = repos.Client().Get(repos.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var list []RepoStatus
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].LastSync == nil || list[0].LastPull == nil {
+		t.Errorf("expected the repository to be synced, got %+v", list)
+	}
+	if value := testutil.ToFloat64(metricLastSuccess.WithLabelValues("pull", repoURL, branch)); value != float64(list[0].LastPull.Unix()) {
+		t.Errorf("expected last success metric %d, got %v", list[0].LastPull.Unix(), value)
+	}
+}
+
+func TestPullUsesRegisteredTempDir(t *testing.T) {
+	branch := "main"
+	repoURL, _ := createPublicRepo(t, branch)
+	tempDir, repoTempDir := t.TempDir(), t.TempDir()
+	registry := NewRepoRegistry([]RegisteredRepo{{URL: repoURL, Branch: branch, Pull: true, TempDir: repoTempDir}})
+
+	pull := httptest.NewServer(NewGitPullHandler(tempDir, HandlerOptions{Repos: registry}))
+	t.Cleanup(pull.Close)
+	resp, err := pull.Client().Get(pull.URL + "?" + url.Values{"repository": {repoURL}, "branch": {branch}}.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	if _, err := os.Stat(getWorkDir(repoTempDir, repoURL, branch)); err != nil {
+		t.Errorf("expected the local clone in the temp dir of the repository: %v", err)
+	}
+	if _, err := os.Stat(getWorkDir(tempDir, repoURL, branch)); !os.IsNotExist(err) {
+		t.Errorf("expected no local clone in the default temp dir, got %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package git_sync
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/pkg/errors"
+)
+
+// clients are asked to retry after this, when the remote repository is unavailable
+const remoteUnavailableRetryAfter = 30 * time.Second
+
+// stderr of git commands failing to reach the remote, that may go away by retrying
+var transientStdErrs = []string{
+	"Could not resolve host",
+	"Failed to connect",
+	"Connection refused",
+	"Connection reset",
+	"Connection timed out",
+	"Operation timed out",
+	"RPC failed",
+	"early EOF",
+	"The requested URL returned error: 5",
+}
+
+// whether the error may go away by retrying: the remote could not be reached, the connection broke or
+// the remote responded with a server error (5xx) or 429. Other errors, e.g. authentication or a rejected push,
+// are returned as is
+func isTransientError(err error) bool {
+	if isRemoteUnavailable(err) {
+		return true
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	var httpErr *githttp.Err
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode() >= http.StatusInternalServerError || httpErr.StatusCode() == http.StatusTooManyRequests
+	}
+	var cmdErr *CommandError
+	if errors.As(err, &cmdErr) && !cmdErr.Timeout {
+		for _, s := range transientStdErrs {
+			if strings.Contains(cmdErr.StdErr, s) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// go-git wraps transport errors without Unwrap
+	var unexpected *plumbing.UnexpectedError
+	if errors.As(err, &unexpected) {
+		return isTransientError(unexpected.Err)
+	}
+	return false
+}
+
+// whether the remote repository could not be reached, e.g. connection refused, DNS failure, timeout,
+// or the remote responded 502, 503 or 504. Unlike other transient errors, these are not bugs in git-sync
+func isRemoteUnavailable(err error) bool {
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var httpErr *githttp.Err
+	switch {
+	case errors.As(err, &opErr), errors.As(err, &dnsErr):
+		return true
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return true
+	case errors.As(err, &httpErr):
+		switch httpErr.StatusCode() {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+
+	// go-git wraps transport errors without Unwrap
+	var unexpected *plumbing.UnexpectedError
+	if errors.As(err, &unexpected) {
+		return isRemoteUnavailable(unexpected.Err)
+	}
+	var permanent *plumbing.PermanentError
+	if errors.As(err, &permanent) {
+		return isRemoteUnavailable(permanent.Err)
+	}
+	return false
+}
+
+// respond 503 when the remote repository is unavailable, with a hint to retry later
+func writeRemoteUnavailableError(w http.ResponseWriter, err error) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(remoteUnavailableRetryAfter.Seconds())))
+	http.Error(w, fmt.Sprintf("the remote repository is unavailable: %v", err), http.StatusServiceUnavailable)
+}
+
+// retry calls fn until it succeeds, fails with an error that is not transient (see isTransientError) or
+// maxRetries is exhausted. The wait between attempts starts at backoff and is doubled for each retry.
+// When ctx is done while waiting, the last error is returned
+func retry(ctx context.Context, log *slog.Logger, op string, maxRetries int, backoff time.Duration, fn func() error) error {
+	err := fn()
+	for attempt := 1; attempt <= maxRetries && err != nil && isTransientError(err); attempt++ {
+		wait := backoff << (attempt - 1)
+		log.Warn("transient error, retrying", "retry.op", op, "attempt", attempt, "wait", wait, "err", err)
+		metricRetries.WithLabelValues(op).Inc()
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		err = fn()
+	}
+	return err
+}
@@ -0,0 +1,170 @@
+package git_sync
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/pkg/errors"
+)
+
+func TestRetryTransientError(t *testing.T) {
+	calls := 0
+	err := retry(context.Background(), slog.Default(), "test", 3, time.Millisecond, func() error {
+		calls++
+		if calls < 3 {
+			return &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Errorf("expected 3 calls, got %d", calls)
+	}
+}
+
+func TestRetryExhausted(t *testing.T) {
+	calls := 0
+	err := retry(context.Background(), slog.Default(), "test", 2, time.Millisecond, func() error {
+		calls++
+		return &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if calls != 3 {
+		t.Errorf("expected 3 calls (1 + 2 retries), got %d", calls)
+	}
+}
+
+func TestRetryPermanentErrorFailsFast(t *testing.T) {
+	for _, permanent := range []error{ErrAuthFailed, transport.ErrRepositoryNotFound} {
+		calls := 0
+		err := retry(context.Background(), slog.Default(), "test", 3, time.Millisecond, func() error {
+			calls++
+			return errors.Wrap(permanent, "wrapped")
+		})
+		if !errors.Is(err, permanent) {
+			t.Errorf("expected %v, got %v", permanent, err)
+		}
+		if calls != 1 {
+			t.Errorf("expected 1 call for %v, got %d", permanent, calls)
+		}
+	}
+}
+
+func TestRetryUnknownErrorFailsFast(t *testing.T) {
+	calls := 0
+	err := retry(context.Background(), slog.Default(), "test", 3, time.Millisecond, func() error {
+		calls++
+		return errors.New("failed to write object")
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if calls != 1 {
+		t.Errorf("expected 1 call for an error not known to be transient, got %d", calls)
+	}
+}
+
+func TestRetryStopsWhenContextDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	start := time.Now()
+	err := retry(ctx, slog.Default(), "test", 3, time.Hour, func() error {
+		calls++
+		cancel()
+		return errors.Wrap(io.ErrUnexpectedEOF, "fetch")
+	})
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected the last error, got %v", err)
+	}
+	if calls != 1 || time.Since(start) > time.Minute {
+		t.Errorf("expected no retry once the context is done, got %d calls", calls)
+	}
+}
+
+func TestIsTransientError(t *testing.T) {
+	tcs := map[string]struct {
+		err      error
+		expected bool
+	}{
+		"connection reset": {errors.Wrap(syscall.ECONNRESET, "read"), true},
+		"unexpected EOF":   {io.ErrUnexpectedEOF, true},
+		"remote 500":       {githttp.NewErr(&http.Response{StatusCode: http.StatusInternalServerError}), true},
+		"remote 429":       {githttp.NewErr(&http.Response{StatusCode: http.StatusTooManyRequests}), true},
+		"remote 403":       {githttp.NewErr(&http.Response{StatusCode: http.StatusForbidden}), false},
+		"git unreachable":  {&CommandError{ExitCode: 128, StdErr: "fatal: unable to access 'https://host/repo.git/': Could not resolve host: host"}, true},
+		"git rejected":     {&CommandError{ExitCode: 1, StdErr: "! [rejected] main -> main (non-fast-forward)"}, false},
+		"auth failed":      {ErrAuthFailed, false},
+		"unknown":          {errors.New("internal"), false},
+	}
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			if actual := isTransientError(tc.err); actual != tc.expected {
+				t.Errorf("expected %v, got %v for %v", tc.expected, actual, tc.err)
+			}
+		})
+	}
+}
+
+// URL of a repository on a port where nothing listens
+func unreachableRepoURL(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return "http://" + addr + "/repo.git"
+}
+
+func TestIsRemoteUnavailable(t *testing.T) {
+	respond := func(status int) string {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, http.StatusText(status), status)
+		}))
+		t.Cleanup(server.Close)
+		return server.URL + "/repo.git"
+	}
+
+	tcs := map[string]struct {
+		url      string
+		expected bool
+	}{
+		"connection refused": {unreachableRepoURL(t), true},
+		"remote 503":         {respond(http.StatusServiceUnavailable), true},
+		"remote 502":         {respond(http.StatusBadGateway), true},
+		"remote 500":         {respond(http.StatusInternalServerError), false},
+	}
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			g, err := NewGIT(t.TempDir(), RemoteRepo{URL: tc.url, Branch: "main"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _, err = g.SyncRepoToLocalTemp()
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if actual := isRemoteUnavailable(err); actual != tc.expected {
+				t.Errorf("expected %v, got %v for %v", tc.expected, actual, err)
+			}
+		})
+	}
+
+	if isRemoteUnavailable(errors.New("internal")) {
+		t.Error("expected internal error not to be classified as remote unavailable")
+	}
+}
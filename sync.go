@@ -0,0 +1,983 @@
+package git_sync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var (
+	ErrRepositoryNotFound   = errors.New("remote repository does not exist")
+	ErrBranchNotFound       = errors.New("branch not found")
+	ErrNoCommits            = errors.New("no commits")
+	ErrCommitNotFound       = errors.New("commit not found")
+	ErrEmptyBundle          = errors.New("no commits matching the bundle options")
+	ErrMissingPrerequisites = errors.New("bundle prerequisites are missing in the repository")
+	ErrBundleTooOld         = errors.New("bundle is older than the maximum age")
+	ErrRefMismatch          = errors.New("bundle head does not match the branch")
+	ErrNoBundleHeads        = errors.New("bundle has no heads")
+	ErrMultipleBundleHeads  = errors.New("bundle has multiple heads")
+	// ErrHashAlgorithmMismatch is returned when a pushed bundle uses another hash algorithm than the repository,
+	// e.g. a sha256 bundle for a sha1 repository
+	ErrHashAlgorithmMismatch = errors.New("bundle hash algorithm does not match the repository")
+
+	// ErrLFSPointers is returned by a pull of a branch using Git LFS, unless allowed with Syncer.AllowLFSPointers
+	ErrLFSPointers = errors.New("branch uses Git LFS, so the bundle would only have the pointer files")
+)
+
+// Syncer pulls bundles from and pushes bundles to remote repositories,
+// through local clones kept in TempDir
+type Syncer struct {
+	TempDir string
+
+	// MaxRetries is the number of retries of syncing with and pushing to the remote after a transient error
+	MaxRetries int
+
+	// RetryBackoff is the wait before the first retry. It is doubled for each subsequent retry
+	RetryBackoff time.Duration
+
+	// ResetOnRewrite resets the local clone to the remote, when the remote branch history was rewritten
+	// (force-pushed). Otherwise ErrRewritten is returned, until the local clone is removed
+	ResetOnRewrite bool
+
+	// Identity is the author/committer of commits created by git, e.g. merges. Defaults to DefaultIdentity
+	Identity Identity
+
+	// AllowRefMismatch allows pushed bundles with a single head of another ref than the branch,
+	// which is then applied to the branch. Otherwise such pushes fail with ErrRefMismatch
+	AllowRefMismatch bool
+
+	// DeterministicBundles repacks pulled bundles, so the same content yields the same bytes. See GIT.SetDeterministicBundles
+	DeterministicBundles bool
+
+	// MaxBundleAge rejects pushed bundles with ErrBundleTooOld, when the commit time of the head is older. Zero for no limit
+	MaxBundleAge time.Duration
+
+	// BundleRef is the head of pushed bundles to apply to the branch, when their names differ, e.g. refs/heads/feature
+	// (or feature) pushed to main. An explicit mapping, so AllowRefMismatch is not required. Empty to match by name
+	BundleRef string
+
+	// Proxy for the remote repositories. Zero to use the environment
+	Proxy Proxy
+
+	// CloneAllBranches clones all branches of the remotes, not only the branch, so commits of other branches
+	// are available, e.g. as 'from' of a bundle. See GIT.SetCloneAllBranches
+	CloneAllBranches bool
+
+	// AllowLFSPointers allows pulls of branches using Git LFS, with only the pointer files in the bundles.
+	// Otherwise such pulls fail with ErrLFSPointers
+	AllowLFSPointers bool
+
+	// CommandTimeout is the maximum duration of git commands. 0 for DefaultCommandTimeout. See GIT.SetCommandTimeout
+	CommandTimeout time.Duration
+
+	// MaxCloneAge re-clones local clones older than it. Zero for no limit. See GIT.SetMaxCloneAge
+	MaxCloneAge time.Duration
+
+	// BundleBackend creates bundles and packfiles with the git binary or go-git. Empty for BundleBackendCLI
+	BundleBackend BundleBackend
+
+	// TagConflict is how tags of pushed bundles are handled, that exist in the remote with another target.
+	// Empty for TagConflictFail
+	TagConflict TagConflict
+
+	// MergeMode is how pushed bundles are applied to the branch. Empty for MergeModeFastForward
+	MergeMode MergeMode
+
+	// MergeMessage is the message of merge commits of MergeModeMerge. Empty for DefaultMergeMessage
+	MergeMessage string
+
+	// ListCommits is the maximum number of commits added by a push of a single branch, that are listed in
+	// PushResult.Commits, e.g. for an audit log. Zero to not list commits
+	ListCommits int
+}
+
+// GIT for the repository, with the identity of the syncer
+func (s Syncer) newGIT(repo RemoteRepo) (*GIT, error) {
+	git, err := NewGIT(s.TempDir, repo)
+	if err != nil {
+		return nil, err
+	}
+	git.SetIdentity(s.Identity)
+	git.SetDeterministicBundles(s.DeterministicBundles)
+	git.SetProxy(s.Proxy)
+	git.SetCloneAllBranches(s.CloneAllBranches)
+	git.SetCommandTimeout(s.CommandTimeout)
+	git.SetMaxCloneAge(s.MaxCloneAge)
+	git.SetBundleBackend(s.BundleBackend)
+	git.SetMergeMode(s.MergeMode, s.MergeMessage)
+	return git, nil
+}
+
+// lock the local clone of the repository for an operation, waiting for other operations on it.
+// The returned func unlocks it
+func (s Syncer) lockWorkDir(repo RemoteRepo) func() {
+	return workDirLocks.Lock(s.workDir(repo))
+}
+
+// the work dir of the local clone of the repository
+func (s Syncer) workDir(repo RemoteRepo) string {
+	return getWorkDir(repoTempDir(s.TempDir, repo), repo.URL, repo.Branch)
+}
+
+// PullResult is the bundle created by a pull
+type PullResult struct {
+	Info   BundleInfo
+	Bundle []byte
+
+	// Rewritten is true if the remote branch history was rewritten since the last sync,
+	// and the local clone was reset. Clients holding the old history cannot apply the bundle
+	Rewritten bool
+
+	// Oldest is the oldest commit in the bundle, when limited by MaxCommits
+	Oldest string
+
+	// Commits is the number of commits in the bundle
+	Commits int
+
+	// Pack is the objects of the bundle as a packfile. Only set by PullPack
+	Pack []byte
+
+	// SyncMode is whether the local clone was cloned or pulled before creating the bundle
+	SyncMode SyncMode
+}
+
+// PushResult describes the branch before and after a push
+type PushResult struct {
+	// OldHead is the head of the branch before the push. Zero if the branch had no commits
+	OldHead plumbing.Hash
+	NewHead plumbing.Hash
+
+	// CommitsAdded is the number of commits the push added to the branch. Zero if already up to date
+	CommitsAdded int
+
+	// Heads of all branches after the push, when pushing AllBranches. OldHead and NewHead are then zero
+	Heads []Head
+
+	// Rewritten is true if the remote branch history was rewritten since the last sync,
+	// and the local clone was reset before applying the bundle
+	Rewritten bool
+
+	// TagsPushed and TagsSkipped are the tags of the bundle pushed to the remote, and those skipped since
+	// they exist in the remote with another target (TagConflictSkip). Tags already in the remote are in neither
+	TagsPushed, TagsSkipped []string
+
+	// Commits added by the push (newest first), at most Syncer.ListCommits, or for a dry-run the requested max
+	Commits []CommitInfo
+
+	// CommitsTruncated is true if the push added more commits than listed
+	CommitsTruncated bool
+}
+
+// Pull syncs the remote repository to a local clone in tempDir, and creates a bundle of the branch with the options.
+// See Syncer.Pull
+func Pull(ctx context.Context, tempDir string, repo RemoteRepo, opt BundleOptions) (PullResult, error) {
+	return Syncer{TempDir: tempDir}.Pull(ctx, repo, opt)
+}
+
+// Push syncs the remote repository to a local clone in tempDir, applies the bundle and pushes to the remote.
+// See Syncer.Push
+func Push(ctx context.Context, tempDir string, repo RemoteRepo, bundle io.Reader) (PushResult, error) {
+	return Syncer{TempDir: tempDir}.Push(ctx, repo, bundle)
+}
+
+// Pull syncs the remote repository to the local clone, and creates a bundle of the branch with the options.
+// The bundle has exactly one head, or a head per branch for AllBranches.
+//
+// Returns ErrAuthFailed, ErrRepositoryNotFound, ErrRewritten, ErrBranchNotFound, ErrNoCommits, ErrBranchNotCommit,
+// ErrCommitNotFound (from/to), ErrEmptyBundle (when options are set, but no commits match), ErrLFSPointers,
+// ErrNoBundleHeads, ErrMultipleBundleHeads or ErrAllBranchesUnsupported (options with AllBranches) for the respective conditions
+func (s Syncer) Pull(ctx context.Context, repo RemoteRepo, opt BundleOptions) (PullResult, error) {
+	if err := opt.Validate(); err != nil {
+		return PullResult{}, err
+	}
+	defer s.lockWorkDir(repo)()
+	return s.pull(ctx, repo, opt)
+}
+
+// Pull with the work dir locked by the caller
+func (s Syncer) pull(ctx context.Context, repo RemoteRepo, opt BundleOptions) (PullResult, error) {
+	if repo.Branch == AllBranches {
+		return s.pullAllBranches(ctx, repo, opt)
+	}
+
+	git, synced, err := s.syncBranch(ctx, repo)
+	if err != nil {
+		return PullResult{}, err
+	}
+	// snapshot of the head, so the bundle has exactly this head, even if the local clone is refreshed meanwhile
+	head, err := git.getLocalHead()
+	if err != nil {
+		return PullResult{}, errors.Wrap(err, "failed to get local head")
+	}
+
+	if !s.AllowLFSPointers {
+		lfs, err := git.UsesLFS(head)
+		if err != nil {
+			return PullResult{}, err
+		}
+		if lfs {
+			return PullResult{}, errors.Wrapf(ErrLFSPointers, "branch %s in repository %s", repo.Branch, repo.URL)
+		}
+	}
+
+	for _, id := range []string{opt.From, opt.To} {
+		if id == "" {
+			continue
+		}
+		exists, err := git.HasLocalCommit(id)
+		if err != nil {
+			return PullResult{}, errors.Wrap(err, "failed to check if commit exists")
+		}
+		if !exists {
+			return PullResult{}, errors.Wrapf(ErrCommitNotFound, "commit %s", id)
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return PullResult{}, err
+	}
+
+	bundleData, info, err := s.createBundle(ctx, git, head, opt)
+	if err != nil {
+		return PullResult{}, err
+	}
+	if err := checkBundleHeads(info, repo.Branch); err != nil {
+		return PullResult{}, err
+	}
+
+	result := PullResult{Info: info, Bundle: bundleData, Rewritten: synced.rewritten, SyncMode: synced.mode}
+	result.Commits, err = git.CountBundledCommits(info)
+	if err != nil {
+		return PullResult{}, errors.Wrap(err, "failed to count commits of bundle")
+	}
+	if opt.MaxCommits != 0 {
+		// the client continues from the oldest commit
+		result.Oldest, err = git.OldestBundledCommit(head, opt)
+		if err != nil {
+			return PullResult{}, errors.Wrap(err, "failed to get oldest commit of bundle")
+		}
+	}
+	return result, nil
+}
+
+// HeadResult is the head of a branch, see Syncer.Head
+type HeadResult struct {
+	Head plumbing.Hash
+	// HashAlgorithm of the repository, e.g. sha1 or sha256
+	HashAlgorithm string
+	// Rewritten and SyncMode are as for PullResult
+	Rewritten bool
+	SyncMode  SyncMode
+}
+
+// Head returns the head of the branch without creating a bundle. The head is read from the remote
+// (SyncModeRemote), falling back to syncing the local clone if the refs of the remote cannot be read,
+// e.g. for sha256 repositories. Rewritten is only reported when synced.
+//
+// Returns ErrAuthFailed, ErrRepositoryNotFound, ErrRewritten, ErrBranchNotFound, ErrNoCommits, ErrBranchNotCommit
+// or ErrAllBranchesUnsupported for the respective conditions
+func (s Syncer) Head(ctx context.Context, repo RemoteRepo) (HeadResult, error) {
+	if repo.Branch == AllBranches {
+		return HeadResult{}, errors.Wrap(ErrAllBranchesUnsupported, "head")
+	}
+	log := LoggerFromContext(ctx).With("op", "Syncer.Head", "repo.url", repo.URL, "repo.branch", repo.Branch)
+
+	remote, err := s.newGIT(repo)
+	if err != nil {
+		return HeadResult{}, err
+	}
+	head, err := remote.RemoteHead(ctx)
+	switch {
+	case err == nil:
+		// go-git only reads the refs of sha1 repositories
+		return HeadResult{Head: head, HashAlgorithm: "sha1", SyncMode: SyncModeRemote}, nil
+	case errors.Is(err, ErrAuthFailed), errors.Is(err, ErrRepositoryNotFound), errors.Is(err, ErrBranchNotFound),
+		errors.Is(err, ErrNoCommits):
+		return HeadResult{}, err
+	}
+	log.Debug("failed to read head from the remote, syncing the local clone", "err", err)
+
+	defer s.lockWorkDir(repo)()
+
+	git, synced, err := s.syncBranch(ctx, repo)
+	if err != nil {
+		return HeadResult{}, err
+	}
+	head, err = git.getLocalHead()
+	if err != nil {
+		return HeadResult{}, errors.Wrap(err, "failed to get local head")
+	}
+	format, err := git.ObjectFormat()
+	if err != nil {
+		return HeadResult{}, err
+	}
+	return HeadResult{Head: head, HashAlgorithm: format, Rewritten: synced.rewritten, SyncMode: synced.mode}, nil
+}
+
+// check the number of heads of a pulled bundle: exactly one for a branch, and any number for AllBranches.
+// Returns ErrNoBundleHeads or ErrMultipleBundleHeads otherwise
+func checkBundleHeads(info BundleInfo, branch string) error {
+	switch {
+	case len(info.Heads) == 0:
+		return ErrNoBundleHeads
+	case len(info.Heads) > 1 && branch != AllBranches:
+		return errors.Wrapf(ErrMultipleBundleHeads, "expected exactly one head for branch %s, got %v", branch, info.Heads)
+	}
+	return nil
+}
+
+// create a bundle of the local clone with the options, in a span
+func (s Syncer) createBundle(ctx context.Context, git *GIT, head plumbing.Hash, opt BundleOptions) (bundleData []byte, info BundleInfo, err error) {
+	_, span := startSpan(ctx, "git.bundle.create", git.remoteRepo)
+	defer func() {
+		span.SetAttributes(attribute.Int("bundle.bytes", len(bundleData)))
+		if len(info.Heads) == 1 {
+			span.SetAttributes(attribute.String("git.head", info.Heads[0].CommitID))
+		}
+		endSpan(span, err)
+	}()
+
+	bundleData, err = git.CreateBundleAt(ctx, head, opt)
+	if err != nil {
+		if cmdErr, ok := err.(*CommandError); ok {
+			if opt.HasAny() && strings.Contains(cmdErr.StdErr, "Refusing to create empty bundle") {
+				return nil, BundleInfo{}, ErrEmptyBundle
+			}
+		}
+		return nil, BundleInfo{}, errors.Wrap(err, "failed to create bundle")
+	}
+
+	info, err = ParseBundleHeader(bundleData)
+	if err != nil {
+		return nil, BundleInfo{}, errors.Wrap(err, "failed to get bundle info")
+	}
+	return bundleData, info, nil
+}
+
+// PullPack is Pull, with the objects of the bundle as a packfile in the result. See GIT.CreatePack.
+// Returns ErrAllBranchesUnsupported for AllBranches, otherwise the errors of Pull
+func (s Syncer) PullPack(ctx context.Context, repo RemoteRepo, opt BundleOptions) (PullResult, error) {
+	if repo.Branch == AllBranches {
+		return PullResult{}, errors.Wrap(ErrAllBranchesUnsupported, "packfile")
+	}
+	if err := opt.Validate(); err != nil {
+		return PullResult{}, err
+	}
+	// the pack is of the same objects as the bundle, so the local clone must not be refreshed in between
+	defer s.lockWorkDir(repo)()
+	result, err := s.pull(ctx, repo, opt)
+	if err != nil {
+		return PullResult{}, err
+	}
+
+	git, err := s.newGIT(repo)
+	if err != nil {
+		return PullResult{}, err
+	}
+	result.Pack, err = git.CreatePack(ctx, result.Info)
+	if err != nil {
+		return PullResult{}, errors.Wrap(err, "failed to create pack")
+	}
+	return result, nil
+}
+
+// Chunks syncs the remote repository to the local clone, and splits the history of the branch
+// into chunks. See GIT.GetChunks
+func (s Syncer) Chunks(ctx context.Context, repo RemoteRepo, window time.Duration) ([]BundleOptions, error) {
+	if repo.Branch == AllBranches {
+		return nil, errors.Wrap(ErrAllBranchesUnsupported, "chunks")
+	}
+	defer s.lockWorkDir(repo)()
+	git, _, err := s.syncBranch(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	chunks, err := git.GetChunks(window)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to split history into chunks")
+	}
+	return chunks, nil
+}
+
+// NextChunk syncs the remote repository to the local clone, and returns the options of the bundle of the
+// next (at most) size commits after cursor, and whether more commits follow. See GIT.GetChunkAfter
+func (s Syncer) NextChunk(ctx context.Context, repo RemoteRepo, cursor string, size int) (BundleOptions, bool, error) {
+	if repo.Branch == AllBranches {
+		return BundleOptions{}, false, errors.Wrap(ErrAllBranchesUnsupported, "chunk")
+	}
+	defer s.lockWorkDir(repo)()
+	git, _, err := s.syncBranch(ctx, repo)
+	if err != nil {
+		return BundleOptions{}, false, err
+	}
+	return git.GetChunkAfter(cursor, size)
+}
+
+// Push syncs the remote repository to the local clone, applies the bundle and pushes to the remote.
+// The bundle is verified in a scratch clone first, so a bad bundle does not pollute the local clone.
+// For AllBranches, every branch in the bundle is fast-forwarded, the bundle is not verified, and its age is that of
+// the newest head.
+// An empty remote (e.g. freshly created, without branches) gets the branch created by the push of a full bundle.
+// Tags of the bundle are pushed after the branch, by TagConflict. Tags are ignored for AllBranches.
+//
+// Returns ErrAuthFailed, ErrRepositoryNotFound, ErrRewritten, ErrNotFastForward, ErrMissingPrerequisites,
+// ErrBundleTooOld, ErrRefMismatch or ErrTagConflict for the respective conditions
+func (s Syncer) Push(ctx context.Context, repo RemoteRepo, bundle io.Reader) (PushResult, error) {
+	log := LoggerFromContext(ctx).With("op", "Syncer.Push", "repo.url", repo.URL, "repo.branch", repo.Branch)
+	defer s.lockWorkDir(repo)()
+
+	git, err := s.newGIT(repo)
+	if err != nil {
+		return PushResult{}, err
+	}
+
+	bundleData, err := io.ReadAll(bundle)
+	if err != nil {
+		return PushResult{}, errors.Wrap(err, "failed to read bundle")
+	}
+	if repo.Branch == AllBranches {
+		return s.pushAllBranches(ctx, repo, bundleData)
+	}
+	if err := s.selectBundleRef(git, bundleData); err != nil {
+		return PushResult{}, err
+	}
+
+	synced, err := s.syncRepo(ctx, log, git)
+	if err != nil {
+		return PushResult{}, err
+	}
+
+	oldHead, err := git.getLocalHead()
+	if err != nil {
+		return PushResult{}, errors.Wrap(err, "failed to get local head")
+	}
+
+	if err := ctx.Err(); err != nil {
+		return PushResult{}, err
+	}
+
+	if err := checkBundleApplies(git, bundleData); err != nil {
+		return PushResult{}, err
+	}
+
+	inspection, err := git.InspectBundleInScratch(bytes.NewReader(bundleData), 0)
+	if err != nil {
+		return PushResult{}, errors.Wrap(mapPrerequisitesError(err), "failed to verify bundle")
+	}
+	if err := s.checkBundleAge(inspection); err != nil {
+		return PushResult{}, err
+	}
+	tags, err := s.planTags(ctx, git, bundleData)
+	if err != nil {
+		return PushResult{}, err
+	}
+
+	_, span := startSpan(ctx, "git.bundle.apply", repo, attribute.Int("bundle.bytes", len(bundleData)))
+	err = git.ApplyBundleToLocal(bytes.NewReader(bundleData))
+	endSpan(span, err)
+	if err != nil {
+		return PushResult{}, errors.Wrap(mapPrerequisitesError(err), "failed to apply bundle")
+	}
+
+	newHead, err := git.getLocalHead()
+	if err != nil {
+		return PushResult{}, errors.Wrap(err, "failed to get local head")
+	}
+
+	_, span = startSpan(ctx, "git.push", repo, headAttributes(oldHead, newHead)...)
+	err = retry(ctx, log, "push", s.MaxRetries, s.RetryBackoff, git.PushLocalToRemote)
+	if err == nil {
+		err = s.pushTags(ctx, log, git, bundleData, tags)
+	}
+	endSpan(span, err)
+	if err != nil {
+		return PushResult{}, err
+	}
+
+	added, err := git.CountLocalCommits(oldHead, newHead)
+	if err != nil {
+		return PushResult{}, errors.Wrap(err, "failed to count commits added")
+	}
+	result := PushResult{OldHead: oldHead, NewHead: newHead, CommitsAdded: added, Rewritten: synced.rewritten,
+		TagsPushed: tags.pushed, TagsSkipped: tags.skipped}
+	s.listCommits(log, git, &result)
+	return result, nil
+}
+
+// ForcePush syncs the remote repository to the local clone, resets the branch to the bundle and force pushes
+// to the remote, overwriting diverged history. Like "git push --force-with-lease", the push is rejected with
+// ErrLeaseMismatch unless the remote branch is at expectedHead (zero if the branch has no commits).
+// Tags of the bundle are pushed after the branch, by TagConflict.
+//
+// Returns ErrAuthFailed, ErrRepositoryNotFound, ErrLeaseMismatch, ErrMissingPrerequisites, ErrBundleTooOld,
+// ErrRefMismatch or ErrTagConflict for the respective conditions
+func (s Syncer) ForcePush(ctx context.Context, repo RemoteRepo, bundle io.Reader, expectedHead plumbing.Hash) (PushResult, error) {
+	if repo.Branch == AllBranches {
+		return PushResult{}, errors.Wrap(ErrAllBranchesUnsupported, "force push")
+	}
+	log := LoggerFromContext(ctx).With("op", "Syncer.ForcePush", "repo.url", repo.URL, "repo.branch", repo.Branch)
+	defer s.lockWorkDir(repo)()
+
+	git, err := s.newGIT(repo)
+	if err != nil {
+		return PushResult{}, err
+	}
+
+	bundleData, err := io.ReadAll(bundle)
+	if err != nil {
+		return PushResult{}, errors.Wrap(err, "failed to read bundle")
+	}
+	if err := s.selectBundleRef(git, bundleData); err != nil {
+		return PushResult{}, err
+	}
+
+	// the lease guards against overwriting unexpected history, so a stale local clone is always reset
+	s.ResetOnRewrite = true
+	synced, err := s.syncRepo(ctx, log, git)
+	if err != nil {
+		return PushResult{}, err
+	}
+
+	oldHead, err := git.getLocalHead()
+	if err != nil {
+		return PushResult{}, errors.Wrap(err, "failed to get local head")
+	}
+	if oldHead != expectedHead {
+		return PushResult{}, errors.Wrapf(ErrLeaseMismatch, "expected %s, got %s", expectedHead, oldHead)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return PushResult{}, err
+	}
+
+	if err := checkBundleApplies(git, bundleData); err != nil {
+		return PushResult{}, err
+	}
+	if err := s.checkNewestBundleHeadAge(git, bundleData); err != nil {
+		return PushResult{}, err
+	}
+	tags, err := s.planTags(ctx, git, bundleData)
+	if err != nil {
+		return PushResult{}, err
+	}
+
+	_, span := startSpan(ctx, "git.bundle.apply", repo, attribute.Int("bundle.bytes", len(bundleData)))
+	err = git.ResetLocalToBundle(bytes.NewReader(bundleData))
+	endSpan(span, err)
+	if err != nil {
+		return PushResult{}, errors.Wrap(mapPrerequisitesError(err), "failed to apply bundle")
+	}
+
+	newHead, err := git.getLocalHead()
+	if err != nil {
+		return PushResult{}, errors.Wrap(err, "failed to get local head")
+	}
+
+	_, span = startSpan(ctx, "git.push", repo, append(headAttributes(oldHead, newHead), attribute.Bool("git.force", true))...)
+	err = retry(ctx, log, "push", s.MaxRetries, s.RetryBackoff, func() error {
+		return git.ForcePushLocalToRemote(expectedHead)
+	})
+	endSpan(span, err)
+	if err != nil {
+		// the local branch no longer matches the remote. Clone again on the next sync
+		if rmErr := git.RemoveLocal(); rmErr != nil {
+			log.Error("failed to remove local repository after failed force push", "err", rmErr)
+		}
+		return PushResult{}, err
+	}
+	if err := s.pushTags(ctx, log, git, bundleData, tags); err != nil {
+		return PushResult{}, err
+	}
+
+	added, err := git.CountLocalCommits(oldHead, newHead)
+	if err != nil {
+		return PushResult{}, errors.Wrap(err, "failed to count commits added")
+	}
+	result := PushResult{OldHead: oldHead, NewHead: newHead, CommitsAdded: added, Rewritten: synced.rewritten,
+		TagsPushed: tags.pushed, TagsSkipped: tags.skipped}
+	s.listCommits(log, git, &result)
+	return result, nil
+}
+
+// MirrorResult describes a mirror from a source to a sink repository
+type MirrorResult struct {
+	// the push to the sink
+	PushResult
+	// SourceRewritten is true if the history of the source branch was rewritten and the local clone reset
+	SourceRewritten bool
+}
+
+// Mirror syncs the branch of the source repository to the local clone, and pushes it to the same branch
+// of the sink repository. The bundle is transferred in memory.
+//
+// Errors are wrapped with whether the source or the sink failed. See Pull and Push for the possible errors
+func (s Syncer) Mirror(ctx context.Context, source, sink RemoteRepo) (MirrorResult, error) {
+	pulled, err := s.Pull(ctx, source, BundleOptions{})
+	if err != nil {
+		return MirrorResult{}, errors.Wrapf(err, "failed to pull from source %s", source.URL)
+	}
+
+	pushed, err := s.Push(ctx, sink, bytes.NewReader(pulled.Bundle))
+	if err != nil {
+		return MirrorResult{}, errors.Wrapf(err, "failed to push to sink %s", sink.URL)
+	}
+	return MirrorResult{PushResult: pushed, SourceRewritten: pulled.Rewritten}, nil
+}
+
+// DryRunResult describes what a push would change
+type DryRunResult struct {
+	PushResult
+}
+
+// DryRunPush syncs the remote repository to the local clone, and verifies that the bundle would apply,
+// without pushing to the remote. The bundle is only applied in a scratch clone, so the local clone is
+// not modified. At most maxCommits of the commits the push would add are listed.
+//
+// Returns the same errors as Push
+func (s Syncer) DryRunPush(ctx context.Context, repo RemoteRepo, bundle io.Reader, maxCommits int) (DryRunResult, error) {
+	if repo.Branch == AllBranches {
+		return DryRunResult{}, errors.Wrap(ErrAllBranchesUnsupported, "dry-run push")
+	}
+	log := LoggerFromContext(ctx).With("op", "Syncer.DryRunPush", "repo.url", repo.URL, "repo.branch", repo.Branch)
+	defer s.lockWorkDir(repo)()
+
+	git, err := s.newGIT(repo)
+	if err != nil {
+		return DryRunResult{}, err
+	}
+
+	bundleData, err := io.ReadAll(bundle)
+	if err != nil {
+		return DryRunResult{}, errors.Wrap(err, "failed to read bundle")
+	}
+	if err := s.selectBundleRef(git, bundleData); err != nil {
+		return DryRunResult{}, err
+	}
+
+	synced, err := s.syncRepo(ctx, log, git)
+	if err != nil {
+		return DryRunResult{}, err
+	}
+
+	oldHead, err := git.getLocalHead()
+	if err != nil {
+		return DryRunResult{}, errors.Wrap(err, "failed to get local head")
+	}
+
+	if err := ctx.Err(); err != nil {
+		return DryRunResult{}, err
+	}
+
+	if err := checkBundleApplies(git, bundleData); err != nil {
+		return DryRunResult{}, err
+	}
+
+	// list one more, to detect truncation
+	inspection, err := git.InspectBundleInScratch(bytes.NewReader(bundleData), maxCommits+1)
+	if err != nil {
+		return DryRunResult{}, errors.Wrap(mapPrerequisitesError(err), "failed to verify bundle")
+	}
+	if err := s.checkBundleAge(inspection); err != nil {
+		return DryRunResult{}, err
+	}
+	tags, err := s.planTags(ctx, git, bundleData)
+	if err != nil {
+		return DryRunResult{}, err
+	}
+
+	result := DryRunResult{PushResult{OldHead: oldHead, NewHead: inspection.Head, Rewritten: synced.rewritten,
+		TagsPushed: tags.pushed, TagsSkipped: tags.skipped, Commits: inspection.Commits}}
+	if len(inspection.Commits) > maxCommits {
+		result.Commits = inspection.Commits[:maxCommits]
+		result.CommitsTruncated = true
+	}
+	return result, nil
+}
+
+// list at most ListCommits of the commits added by the push in the result. Must be called while the work dir is
+// locked, since a concurrent sync may reset or remove the local clone. The push is done, so a failure is only logged
+func (s Syncer) listCommits(log *slog.Logger, git *GIT, result *PushResult) {
+	if s.ListCommits <= 0 {
+		return
+	}
+	// one extra, to detect if the list is truncated
+	commits, err := git.GetLocalCommits(result.OldHead, result.NewHead, s.ListCommits+1)
+	if err != nil {
+		log.Error("failed to list commits added", "err", err)
+		return
+	}
+	if len(commits) > s.ListCommits {
+		commits, result.CommitsTruncated = commits[:s.ListCommits], true
+	}
+	result.Commits = commits
+}
+
+// check that the bundle can be applied to the local clone, by its hash algorithm and prerequisites.
+// Fails fast with the missing prerequisites, before anything is applied
+func checkBundleApplies(git *GIT, bundle []byte) error {
+	if err := checkHashAlgorithm(git, bundle); err != nil {
+		return err
+	}
+	_, err := git.VerifyBundleAgainstLocal(bundle)
+	return err
+}
+
+// reject a bundle of another hash algorithm than the local clone, which git fails to apply with an opaque error
+func checkHashAlgorithm(git *GIT, bundle []byte) error {
+	info, err := ParseBundleHeader(bundle)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse bundle")
+	}
+	format, err := git.ObjectFormat()
+	if err != nil {
+		return err
+	}
+	if info.HashAlgorithm != format {
+		return errors.Wrapf(ErrHashAlgorithmMismatch, "the bundle uses %s, the repository uses %s", info.HashAlgorithm, format)
+	}
+	return nil
+}
+
+// select the ref of the bundle that is applied to the branch. Unless AllowRefMismatch,
+// the bundle must have the branch as its single head, besides tags
+func (s Syncer) selectBundleRef(git *GIT, bundle []byte) error {
+	info, err := ParseBundleHeader(bundle)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse bundle")
+	}
+	var ref string
+	if s.BundleRef != "" {
+		ref, err = bundleRefMapped(info, s.BundleRef, git.remoteRepo.Branch)
+	} else {
+		ref, err = bundleRefForBranch(info, git.remoteRepo.Branch, s.AllowRefMismatch)
+	}
+	if err != nil {
+		return err
+	}
+	if ref != "" {
+		git.SetBundleRef(ref)
+	}
+	return nil
+}
+
+// the ref of the bundle that is applied to the branch, when it is not the branch itself. Unless allowMismatch,
+// the bundle must have the branch as its single head. Returns ErrRefMismatch (wrapped) if no ref applies
+func bundleRefForBranch(info BundleInfo, branch string, allowMismatch bool) (string, error) {
+	branchRef := plumbing.NewBranchReferenceName(branch).String()
+	refs := bundleBranchRefs(info)
+	if len(refs) == 1 && refs[0] == branchRef {
+		return "", nil
+	}
+
+	if !allowMismatch {
+		return "", errors.Wrapf(ErrRefMismatch, "expected the single head %s, got [%s]", branchRef, strings.Join(refs, ", "))
+	}
+	if slices.Contains(refs, branchRef) {
+		return "", nil
+	}
+	if len(refs) != 1 {
+		return "", errors.Wrapf(ErrRefMismatch, "expected %s or a single head to apply, got [%s]", branchRef, strings.Join(refs, ", "))
+	}
+	return refs[0], nil
+}
+
+// the head of the bundle to apply to the branch, by an explicit mapping. A short name is a branch.
+// Returns ErrRefMismatch (wrapped) if the bundle does not have the head
+func bundleRefMapped(info BundleInfo, bundleRef, branch string) (string, error) {
+	if !strings.HasPrefix(bundleRef, "refs/") {
+		bundleRef = plumbing.NewBranchReferenceName(bundleRef).String()
+	}
+	refs := bundleBranchRefs(info)
+	if !slices.Contains(refs, bundleRef) {
+		return "", errors.Wrapf(ErrRefMismatch, "expected the head %s, got [%s]", bundleRef, strings.Join(refs, ", "))
+	}
+	if bundleRef == plumbing.NewBranchReferenceName(branch).String() {
+		return "", nil
+	}
+	return bundleRef, nil
+}
+
+// reject bundles with a head older than MaxBundleAge, e.g. replays
+func (s Syncer) checkBundleAge(inspection BundleInspection) error {
+	if s.MaxBundleAge <= 0 {
+		return nil
+	}
+	if age := time.Since(inspection.HeadTime); age > s.MaxBundleAge {
+		return errors.Wrapf(ErrBundleTooOld, "head %s was committed %s ago (at %s), maximum is %s",
+			inspection.Head, age.Round(time.Second), inspection.HeadTime.UTC().Format(time.RFC3339), s.MaxBundleAge)
+	}
+	return nil
+}
+
+// checkBundleAge for pushes that do not inspect the bundle otherwise (force and all branches),
+// by the newest head of the bundle. The bundle is only inspected when MaxBundleAge is set
+func (s Syncer) checkNewestBundleHeadAge(git *GIT, bundle []byte) error {
+	if s.MaxBundleAge <= 0 {
+		return nil
+	}
+	inspection, err := git.InspectNewestBundleHead(bytes.NewReader(bundle))
+	if err != nil {
+		return errors.Wrap(mapPrerequisitesError(err), "failed to inspect bundle")
+	}
+	return s.checkBundleAge(inspection)
+}
+
+// errWorkDirInUse is returned by SyncAll for a repository locked by another operation
+var errWorkDirInUse = errors.New("local clone in use by another operation")
+
+// SyncAll syncs the local clones of the repositories with the remotes, with at most concurrency
+// syncs running at a time (the rest are queued). Intended for warming the local clones ahead of requests,
+// so a repository locked by another operation is skipped with errWorkDirInUse, since the operation syncs it anyway.
+// Returns the error of each repository, in the same order
+func (s Syncer) SyncAll(ctx context.Context, repos []RemoteRepo, concurrency int) []error {
+	errs := make([]error, len(repos))
+	runLimited(concurrency, len(repos), func(i int) {
+		repo := repos[i]
+		if err := ctx.Err(); err != nil {
+			errs[i] = err
+			return
+		}
+		log := LoggerFromContext(ctx).With("op", "Syncer.SyncAll", "repo.url", repo.URL, "repo.branch", repo.Branch)
+		unlock, ok := workDirLocks.TryLock(s.workDir(repo))
+		if !ok {
+			errs[i] = errWorkDirInUse
+			return
+		}
+		defer unlock()
+		errs[i] = s.syncLocked(ctx, log, repo)
+	})
+	return errs
+}
+
+// sync the local clone of the repository, which must be locked
+func (s Syncer) syncLocked(ctx context.Context, log *slog.Logger, repo RemoteRepo) error {
+	git, err := s.newGIT(repo)
+	if err != nil {
+		return err
+	}
+	_, err = s.syncRepo(ctx, log, git)
+	return err
+}
+
+// sync the remote repository to the local clone, and ensure the branch has commits
+func (s Syncer) syncBranch(ctx context.Context, repo RemoteRepo) (*GIT, syncResult, error) {
+	log := LoggerFromContext(ctx).With("op", "Syncer.syncBranch", "repo.url", repo.URL, "repo.branch", repo.Branch)
+
+	git, err := s.newGIT(repo)
+	if err != nil {
+		return nil, syncResult{}, err
+	}
+
+	synced, err := s.syncRepo(ctx, log, git)
+	if err != nil {
+		return nil, syncResult{}, err
+	}
+
+	exists, err := git.hasLocalBranch()
+	if err != nil {
+		return nil, syncResult{}, errors.Wrap(err, "failed to check if branch exists")
+	}
+	if !exists {
+		return nil, syncResult{}, ErrBranchNotFound
+	}
+
+	hasCommits, err := git.hasLocalCommits()
+	if err != nil {
+		return nil, syncResult{}, errors.Wrap(err, "failed to check if branch has commits")
+	}
+	if !hasCommits {
+		return nil, syncResult{}, ErrNoCommits
+	}
+	return git, synced, nil
+}
+
+// result of syncing the local clone with the remote
+type syncResult struct {
+	// rewritten is true if the remote history was rewritten, and the local clone reset
+	rewritten bool
+	mode      SyncMode
+}
+
+// sync the remote repository to the local clone, retrying transient errors.
+// If the remote history was rewritten, the local clone is reset when ResetOnRewrite is set,
+// otherwise ErrRewritten is returned
+func (s Syncer) syncRepo(ctx context.Context, log *slog.Logger, git *GIT) (result syncResult, err error) {
+	if err := ctx.Err(); err != nil {
+		return syncResult{}, err
+	}
+
+	_, span := startSpan(ctx, "git.sync", git.remoteRepo)
+	defer func() {
+		span.SetAttributes(attribute.String("git.sync_mode", string(result.mode)), attribute.Bool("git.rewritten", result.rewritten))
+		endSpan(span, err)
+	}()
+
+	// the work dir is locked by the caller, so no other operation holds the index.lock
+	removed, err := git.RemoveStaleIndexLock()
+	if err != nil {
+		return syncResult{}, err
+	}
+	if removed {
+		log.Warn("removed stale index.lock of local repository, left by an earlier operation")
+	}
+
+	var worktree *gogit.Worktree
+	sync := func() error {
+		var err error
+		worktree, result.mode, err = git.SyncRepoToLocalTemp()
+		return err
+	}
+	err = retry(ctx, log, "sync", s.MaxRetries, s.RetryBackoff, sync)
+
+	if errors.Is(err, ErrRewritten) && s.ResetOnRewrite {
+		log.Warn("remote branch history was rewritten, resetting local repository")
+		result = syncResult{rewritten: true, mode: SyncModeClone}
+		err = retry(ctx, log, "sync", s.MaxRetries, s.RetryBackoff, func() error {
+			var err error
+			worktree, err = git.ResetLocalToRemote()
+			return err
+		})
+	}
+	if err != nil {
+		if errors.Is(err, ErrAuthFailed) || errors.Is(err, ErrRewritten) || errors.Is(err, ErrBranchNotFound) {
+			return syncResult{}, err
+		}
+		return syncResult{}, errors.Wrap(err, "failed to sync repository")
+	}
+
+	if worktree == nil {
+		return syncResult{}, ErrRepositoryNotFound
+	}
+	workDirRepos.register(git.workDir, git.remoteRepo)
+	log.Debug("synced local repository", "syncMode", result.mode)
+	return result, nil
+}
+
+// span attributes of the heads before and after a push
+func headAttributes(oldHead, newHead plumbing.Hash) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("git.old_head", oldHead.String()),
+		attribute.String("git.new_head", newHead.String())}
+}
+
+// wrap CommandError with ErrMissingPrerequisites, when git reports missing prerequisite commits
+func mapPrerequisitesError(err error) error {
+	if cmdErr, ok := err.(*CommandError); ok {
+		if strings.Contains(cmdErr.StdErr, "Repository lacks these prerequisite commits") {
+			return fmt.Errorf("%w: %w", ErrMissingPrerequisites, cmdErr)
+		}
+	}
+	return err
+}
@@ -0,0 +1,816 @@
+package git_sync
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bredtape/git_sync/testdata"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/pkg/errors"
+)
+
+func TestParseBundleHeader(t *testing.T) {
+	full, err := ParseBundleHeader(testdata.FullBundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !full.IsComplete || full.RequiresRef != "" || full.HashAlgorithm != "sha1" || !full.IsOkay {
+		t.Errorf("unexpected info for full bundle: %+v", full)
+	}
+	if len(full.Heads) != 1 || full.Heads[0] != (Head{CommitID: "f8be008f3733c1a9b7962c1f5a50679266565e31", Ref: "refs/heads/main"}) {
+		t.Errorf("unexpected heads for full bundle: %v", full.Heads)
+	}
+	if full.ContainsRef != "f8be008f3733c1a9b7962c1f5a50679266565e31 refs/heads/main" {
+		t.Errorf("unexpected contains ref: %s", full.ContainsRef)
+	}
+
+	last, err := ParseBundleHeader(testdata.LastBundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.IsComplete || last.RequiresRef != "ea29764e79de2eaaddbeabd9ee967852912cb52e" {
+		t.Errorf("unexpected info for partial bundle: %+v", last)
+	}
+
+	_, err = ParseBundleHeader([]byte("not a bundle\n"))
+	if err == nil {
+		t.Error("expected error for invalid bundle")
+	}
+}
+
+func TestLibraryPushAndPull(t *testing.T) {
+	slog.SetLogLoggerLevel(slog.LevelDebug)
+
+	repo := setupLocalBareRemote(t)
+	ctx := context.Background()
+
+	_, err := Pull(ctx, t.TempDir(), repo, BundleOptions{})
+	if !errors.Is(err, ErrBranchNotFound) && !errors.Is(err, ErrNoCommits) {
+		t.Fatalf("expected no commits in empty repo, got %v", err)
+	}
+
+	result, err := Push(ctx, t.TempDir(), repo, bytes.NewReader(testdata.FullBundle))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.OldHead != plumbing.ZeroHash || result.NewHead.String() != "f8be008f3733c1a9b7962c1f5a50679266565e31" {
+		t.Errorf("unexpected push result %+v", result)
+	}
+
+	pulled, err := Pull(ctx, t.TempDir(), repo, BundleOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(pulled.Bundle, []byte("# v2 git bundle")) {
+		t.Error("expected bundle data")
+	}
+	if !pulled.Info.IsComplete || pulled.Info.Heads[0].CommitID != result.NewHead.String() {
+		t.Errorf("unexpected bundle info %+v", pulled.Info)
+	}
+
+	pulled, err = Pull(ctx, t.TempDir(), repo, BundleOptions{From: "ea29764e79de2eaaddbeabd9ee967852912cb52e"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pulled.Info.IsComplete || pulled.Info.RequiresRef != "ea29764e79de2eaaddbeabd9ee967852912cb52e" {
+		t.Errorf("expected partial bundle, got %+v", pulled.Info)
+	}
+}
+
+func TestLibraryPullRepoDoesNotExist(t *testing.T) {
+	slog.SetLogLoggerLevel(slog.LevelDebug)
+
+	repo := setupLocalBareRemote(t)
+	repo.URL += "_not"
+
+	_, err := Pull(context.Background(), t.TempDir(), repo, BundleOptions{})
+	if !errors.Is(err, ErrRepositoryNotFound) {
+		t.Fatalf("expected ErrRepositoryNotFound, got %v", err)
+	}
+}
+
+func TestSyncAllSerially(t *testing.T) {
+	slog.SetLogLoggerLevel(slog.LevelDebug)
+
+	var repos []RemoteRepo
+	for range 3 {
+		repos = append(repos, setupLocalBareRemote(t))
+	}
+
+	tempDir := t.TempDir()
+	s := Syncer{TempDir: tempDir}
+	for i, err := range s.SyncAll(context.Background(), repos, 1) {
+		if err != nil {
+			t.Fatalf("failed to sync %s: %v", repos[i].URL, err)
+		}
+	}
+
+	for _, repo := range repos {
+		g, err := NewGIT(tempDir, repo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exists, err := g.ExistsLocal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !exists {
+			t.Errorf("expected local clone of %s", repo.URL)
+		}
+	}
+}
+
+func TestCheckBundleAge(t *testing.T) {
+	inspection := BundleInspection{HeadTime: time.Now().Add(-2 * time.Hour)}
+
+	if err := (Syncer{}).checkBundleAge(inspection); err != nil {
+		t.Errorf("expected no limit, got %v", err)
+	}
+	if err := (Syncer{MaxBundleAge: 3 * time.Hour}).checkBundleAge(inspection); err != nil {
+		t.Errorf("expected bundle to be accepted, got %v", err)
+	}
+	if err := (Syncer{MaxBundleAge: time.Hour}).checkBundleAge(inspection); !errors.Is(err, ErrBundleTooOld) {
+		t.Errorf("expected ErrBundleTooOld, got %v", err)
+	}
+}
+
+func TestCheckBundleHeads(t *testing.T) {
+	main := Head{CommitID: "f8be008f3733c1a9b7962c1f5a50679266565e31", Ref: "refs/heads/main"}
+	feature := Head{CommitID: "ea29764e79de2eaaddbeabd9ee967852912cb52e", Ref: "refs/heads/feature-x"}
+
+	tcs := map[string]struct {
+		heads    []Head
+		branch   string
+		expected error
+	}{
+		"one head":                    {[]Head{main}, "main", nil},
+		"no heads":                    {nil, "main", ErrNoBundleHeads},
+		"no heads of all branches":    {nil, AllBranches, ErrNoBundleHeads},
+		"multiple heads":              {[]Head{main, feature}, "main", ErrMultipleBundleHeads},
+		"multiple heads all branches": {[]Head{main, feature}, AllBranches, nil},
+	}
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			err := checkBundleHeads(BundleInfo{Heads: tc.heads}, tc.branch)
+			if tc.expected == nil && err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if !errors.Is(err, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestSelectBundleRef(t *testing.T) {
+	main := "# v2 git bundle\nf8be008f3733c1a9b7962c1f5a50679266565e31 refs/heads/main\n\n"
+	feature := "# v2 git bundle\nf8be008f3733c1a9b7962c1f5a50679266565e31 refs/heads/feature-x\n\n"
+	both := "# v2 git bundle\nf8be008f3733c1a9b7962c1f5a50679266565e31 refs/heads/main\nea29764e79de2eaaddbeabd9ee967852912cb52e refs/heads/feature-x\n\n"
+
+	tcs := map[string]struct {
+		bundle      string
+		allow       bool
+		bundleRef   string
+		expectedRef string
+		err         bool
+	}{
+		"match":                   {bundle: main, expectedRef: "main"},
+		"mismatch":                {bundle: feature, err: true},
+		"multiple heads":          {bundle: both, err: true},
+		"mismatch allowed":        {bundle: feature, allow: true, expectedRef: "refs/heads/feature-x"},
+		"multiple heads allowed":  {bundle: both, allow: true, expectedRef: "main"},
+		"no match among multiple": {bundle: strings.Replace(both, "refs/heads/main", "refs/heads/dev", 1), allow: true, err: true},
+		"mapped":                  {bundle: feature, bundleRef: "feature-x", expectedRef: "refs/heads/feature-x"},
+		"mapped among multiple":   {bundle: both, bundleRef: "refs/heads/feature-x", expectedRef: "refs/heads/feature-x"},
+		"mapped to itself":        {bundle: both, bundleRef: "main", expectedRef: "main"},
+		"mapped ref missing":      {bundle: main, bundleRef: "feature-x", allow: true, err: true},
+	}
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			g := newLocalGIT(t, "main")
+
+			err := Syncer{AllowRefMismatch: tc.allow, BundleRef: tc.bundleRef}.selectBundleRef(g, []byte(tc.bundle))
+			if tc.err {
+				if !errors.Is(err, ErrRefMismatch) {
+					t.Fatalf("expected ErrRefMismatch, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if g.bundleRef() != tc.expectedRef {
+				t.Errorf("expected bundle ref %s, got %s", tc.expectedRef, g.bundleRef())
+			}
+		})
+	}
+}
+
+func TestLibraryPushAndPullAllBranches(t *testing.T) {
+	slog.SetLogLoggerLevel(slog.LevelDebug)
+
+	source := setupLocalBareRemote(t)
+	sink := setupLocalBareRemote(t)
+	ctx := context.Background()
+
+	if _, err := Push(ctx, t.TempDir(), source, bytes.NewReader(testdata.FullBundle)); err != nil {
+		t.Fatal(err)
+	}
+
+	source.Branch = AllBranches
+	pulled, err := Pull(ctx, t.TempDir(), source, BundleOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedHeads := []Head{{CommitID: "f8be008f3733c1a9b7962c1f5a50679266565e31", Ref: "refs/heads/main"}}
+	if !slices.Equal(pulled.Info.Heads, expectedHeads) {
+		t.Errorf("expected heads %v, got %v", expectedHeads, pulled.Info.Heads)
+	}
+
+	sink.Branch = AllBranches
+	pushed, err := Push(ctx, t.TempDir(), sink, bytes.NewReader(pulled.Bundle))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pushed.CommitsAdded != 2 || !slices.Equal(pushed.Heads, expectedHeads) {
+		t.Errorf("unexpected push result: %+v", pushed)
+	}
+}
+
+func TestPushAllBranchesAtomic(t *testing.T) {
+	source := setupLocalBareRemote(t)
+	sink := setupLocalBareRemote(t)
+	ctx := context.Background()
+
+	if _, err := Push(ctx, t.TempDir(), source, bytes.NewReader(testdata.FullBundle)); err != nil {
+		t.Fatal(err)
+	}
+	sourceDir := strings.TrimPrefix(source.URL, "file://")
+	if out, err := exec.Command("git", "-C", sourceDir, "branch", "feature", "main").CombinedOutput(); err != nil {
+		t.Fatalf("failed to create branch: %v: %s", err, out)
+	}
+	source.Branch = AllBranches
+	pulled, err := Pull(ctx, t.TempDir(), source, BundleOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pulled.Info.Heads) != 2 {
+		t.Fatalf("expected 2 heads, got %v", pulled.Info.Heads)
+	}
+
+	// the sink rejects one of the branches
+	sinkDir := strings.TrimPrefix(sink.URL, "file://")
+	hook := "#!/bin/sh\nif [ \"$1\" = refs/heads/feature ]; then echo rejected >&2; exit 1; fi\n"
+	if err := os.WriteFile(filepath.Join(sinkDir, "hooks", "update"), []byte(hook), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	sink.Branch = AllBranches
+	_, err = Push(ctx, t.TempDir(), sink, bytes.NewReader(pulled.Bundle))
+	if !errors.Is(err, ErrPushRejected) {
+		t.Fatalf("expected ErrPushRejected, got %v", err)
+	}
+	out, err := exec.Command("git", "-C", sinkDir, "for-each-ref", "refs/heads").CombinedOutput()
+	if err != nil {
+		t.Fatalf("failed to list branches: %v: %s", err, out)
+	}
+	if len(out) != 0 {
+		t.Errorf("expected no branch to be updated, got %s", out)
+	}
+
+	// a remote without atomic pushes is not pushed to at all
+	if out, err := exec.Command("git", "-C", sinkDir, "config", "receive.advertiseAtomic", "false").CombinedOutput(); err != nil {
+		t.Fatalf("failed to configure sink: %v: %s", err, out)
+	}
+	if err := os.Remove(filepath.Join(sinkDir, "hooks", "update")); err != nil {
+		t.Fatal(err)
+	}
+	_, err = Push(ctx, t.TempDir(), sink, bytes.NewReader(pulled.Bundle))
+	if !errors.Is(err, ErrAtomicPushUnsupported) {
+		t.Fatalf("expected ErrAtomicPushUnsupported, got %v", err)
+	}
+	out, err = exec.Command("git", "-C", sinkDir, "for-each-ref", "refs/heads").CombinedOutput()
+	if err != nil {
+		t.Fatalf("failed to list branches: %v: %s", err, out)
+	}
+	if len(out) != 0 {
+		t.Errorf("expected no branch to be updated without atomic pushes, got %s", out)
+	}
+}
+
+// a bundle from a commit of another branch, e.g. the parent of a merge, needs all branches in the local clone
+func TestPullFromCommitOfOtherBranch(t *testing.T) {
+	repo := setupLocalBareRemote(t)
+	ctx := context.Background()
+	if _, err := Push(ctx, t.TempDir(), repo, bytes.NewReader(testdata.FullBundle)); err != nil {
+		t.Fatal(err)
+	}
+
+	// a feature branch from the first commit of main, with a commit not on main
+	work := t.TempDir()
+	for _, args := range [][]string{
+		{"clone", "--quiet", repo.URL, work},
+		{"-C", work, "checkout", "--quiet", "-b", "feature", "HEAD~1"},
+		{"-C", work, "-c", "user.name=test", "-c", "user.email=test@localhost", "commit", "--quiet", "--allow-empty", "-m", "feature"},
+		{"-C", work, "push", "--quiet", "origin", "feature"},
+	} {
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+	}
+	out, err := exec.Command("git", "-C", work, "rev-parse", "feature").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opt := BundleOptions{From: strings.TrimSpace(string(out))}
+
+	_, err = Syncer{TempDir: t.TempDir()}.Pull(ctx, repo, opt)
+	if !errors.Is(err, ErrCommitNotFound) {
+		t.Fatalf("expected ErrCommitNotFound with a single branch clone, got %v", err)
+	}
+
+	s := Syncer{TempDir: t.TempDir(), CloneAllBranches: true}
+	result, err := s.Pull(ctx, repo, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Commits != 1 {
+		t.Errorf("expected the bundle to have 1 commit, got %d", result.Commits)
+	}
+
+	// an existing single branch clone fetches the other branches on the next sync
+	single := Syncer{TempDir: t.TempDir()}
+	if _, err := single.Pull(ctx, repo, BundleOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	single.CloneAllBranches = true
+	if _, err := single.Pull(ctx, repo, opt); err != nil {
+		t.Errorf("expected the commit of the other branch after switching to all branches, got %v", err)
+	}
+}
+
+func TestPullLFS(t *testing.T) {
+	repo := setupLocalBareRemote(t)
+	ctx := context.Background()
+	if _, err := Push(ctx, t.TempDir(), repo, bytes.NewReader(testdata.FullBundle)); err != nil {
+		t.Fatal(err)
+	}
+	s := Syncer{TempDir: t.TempDir()}
+	if _, err := s.Pull(ctx, repo, BundleOptions{}); err != nil {
+		t.Fatalf("expected a branch without LFS to be pulled, got %v", err)
+	}
+
+	// an LFS tracked file (the pointer file, as committed by git-lfs) in a sub directory
+	work := t.TempDir()
+	if out, err := exec.Command("git", "clone", "--quiet", repo.URL, work).CombinedOutput(); err != nil {
+		t.Fatalf("failed to clone: %v: %s", err, out)
+	}
+	files := map[string]string{
+		"assets/.gitattributes": "*.bin filter=lfs diff=lfs merge=lfs -text\n",
+		"assets/data.bin":       "version https://git-lfs.github.com/spec/v1\noid sha256:4d7a214614ab2935c943f9e0ff69d22eadbb8f32b1258daaa5e2ca24d17e2393\nsize 12345\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(work, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, args := range [][]string{
+		{"-C", work, "add", "."},
+		{"-C", work, "-c", "user.name=test", "-c", "user.email=test@localhost", "commit", "--quiet", "-m", "lfs"},
+		{"-C", work, "push", "--quiet", "origin", "main"},
+	} {
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+	}
+
+	if _, err := s.Pull(ctx, repo, BundleOptions{}); !errors.Is(err, ErrLFSPointers) {
+		t.Fatalf("expected ErrLFSPointers, got %v", err)
+	}
+	s.AllowLFSPointers = true
+	if _, err := s.Pull(ctx, repo, BundleOptions{}); err != nil {
+		t.Errorf("expected the pointer files to be pulled when allowed, got %v", err)
+	}
+}
+
+// every branch is checked when pulling all branches, not only the default branch
+func TestPullAllBranchesLFS(t *testing.T) {
+	repo := setupLocalBareRemote(t)
+	ctx := context.Background()
+	if _, err := Push(ctx, t.TempDir(), repo, bytes.NewReader(testdata.FullBundle)); err != nil {
+		t.Fatal(err)
+	}
+
+	// an LFS tracked file on a feature branch only
+	work := t.TempDir()
+	if out, err := exec.Command("git", "clone", "--quiet", repo.URL, work).CombinedOutput(); err != nil {
+		t.Fatalf("failed to clone: %v: %s", err, out)
+	}
+	if err := os.WriteFile(filepath.Join(work, ".gitattributes"), []byte("*.bin filter=lfs diff=lfs merge=lfs -text\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"-C", work, "checkout", "--quiet", "-b", "feature"},
+		{"-C", work, "add", "."},
+		{"-C", work, "-c", "user.name=test", "-c", "user.email=test@localhost", "commit", "--quiet", "-m", "lfs"},
+		{"-C", work, "push", "--quiet", "origin", "feature"},
+	} {
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+	}
+
+	all := RemoteRepo{URL: repo.URL, Branch: AllBranches}
+	s := Syncer{TempDir: t.TempDir()}
+	if _, err := s.Pull(ctx, repo, BundleOptions{}); err != nil {
+		t.Fatalf("expected the default branch without LFS to be pulled, got %v", err)
+	}
+	if _, err := s.Pull(ctx, all, BundleOptions{}); !errors.Is(err, ErrLFSPointers) {
+		t.Fatalf("expected ErrLFSPointers, got %v", err)
+	}
+	s.AllowLFSPointers = true
+	if _, err := s.Pull(ctx, all, BundleOptions{}); err != nil {
+		t.Errorf("expected the pointer files to be pulled when allowed, got %v", err)
+	}
+}
+
+func TestAllBranchesUnsupported(t *testing.T) {
+	s := Syncer{TempDir: t.TempDir()}
+	repo := RemoteRepo{URL: "http://localhost/not-used", Branch: AllBranches}
+	ctx := context.Background()
+
+	_, err := s.Pull(ctx, repo, BundleOptions{Since: time.Hour})
+	if !errors.Is(err, ErrAllBranchesUnsupported) {
+		t.Errorf("pull with options: expected ErrAllBranchesUnsupported, got %v", err)
+	}
+	_, err = s.Chunks(ctx, repo, time.Hour)
+	if !errors.Is(err, ErrAllBranchesUnsupported) {
+		t.Errorf("chunks: expected ErrAllBranchesUnsupported, got %v", err)
+	}
+	_, err = s.ForcePush(ctx, repo, bytes.NewReader(testdata.FullBundle), plumbing.ZeroHash)
+	if !errors.Is(err, ErrAllBranchesUnsupported) {
+		t.Errorf("force push: expected ErrAllBranchesUnsupported, got %v", err)
+	}
+	_, err = s.DryRunPush(ctx, repo, bytes.NewReader(testdata.FullBundle), 10)
+	if !errors.Is(err, ErrAllBranchesUnsupported) {
+		t.Errorf("dry-run push: expected ErrAllBranchesUnsupported, got %v", err)
+	}
+}
+
+// a bundle of the branch feature is pushed to main of the remote, and feature is not created
+func TestPushMappedBundleRef(t *testing.T) {
+	g := newLocalGIT(t, "main")
+	worktree, err := g.initLocal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2025, 2, 13, 0, 0, 0, 0, time.UTC)
+	commitAt(t, g, worktree, base)
+	_, bare := servePublicRepo(t, g)
+
+	if out, err := exec.Command("git", "-C", g.workDir, "checkout", "--quiet", "-b", "feature").CombinedOutput(); err != nil {
+		t.Fatalf("failed to create branch: %v: %s", err, out)
+	}
+	head := commitAt(t, g, worktree, base.Add(time.Hour))
+	bundle, err := exec.Command("git", "-C", g.workDir, "bundle", "create", "--quiet", "-", "main..feature").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remote := RemoteRepo{URL: "file://" + bare, Branch: "main"}
+	if _, err := (Syncer{TempDir: t.TempDir()}).Push(context.Background(), remote, bytes.NewReader(bundle)); !errors.Is(err, ErrRefMismatch) {
+		t.Fatalf("expected ErrRefMismatch without mapping, got %v", err)
+	}
+
+	result, err := Syncer{TempDir: t.TempDir(), BundleRef: "feature"}.Push(context.Background(), remote, bytes.NewReader(bundle))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.NewHead != head {
+		t.Errorf("expected new head %s, got %s", head, result.NewHead)
+	}
+
+	out, err := exec.Command("git", "-C", bare, "for-each-ref", "--format=%(refname) %(objectname)", "refs/heads").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "refs/heads/main " + head.String(); strings.TrimSpace(string(out)) != expected {
+		t.Errorf("expected only '%s' in the remote, got '%s'", expected, out)
+	}
+}
+
+func TestSyncBranchForcePushed(t *testing.T) {
+	repo := setupLocalBareRemote(t)
+	upstream, err := NewGIT(t.TempDir(), repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	worktree, _, err := upstream.SyncRepoToLocalTemp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2025, 2, 13, 0, 0, 0, 0, time.UTC)
+	commitAt(t, upstream, worktree, base)
+	if err := upstream.PushLocalToRemote(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	tempDir := t.TempDir()
+	if _, _, err := (Syncer{TempDir: tempDir}).syncBranch(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+
+	// replace the history of the remote with an unrelated commit
+	if err := upstream.RemoveLocal(); err != nil {
+		t.Fatal(err)
+	}
+	worktree, err = upstream.initLocal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewritten := commitAt(t, upstream, worktree, base.Add(time.Hour))
+	if out, err := exec.Command("git", "-C", upstream.workDir, "push", "--force", "--quiet", repo.URL, "main:main").CombinedOutput(); err != nil {
+		t.Fatalf("failed to force-push: %v: %s", err, out)
+	}
+
+	if _, _, err := (Syncer{TempDir: tempDir}).syncBranch(ctx, repo); !errors.Is(err, ErrRewritten) {
+		t.Fatalf("expected ErrRewritten without ResetOnRewrite, got %v", err)
+	}
+
+	git, result, err := (Syncer{TempDir: tempDir, ResetOnRewrite: true}).syncBranch(ctx, repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.rewritten || result.mode != SyncModeClone {
+		t.Errorf("expected a rewritten clone, got %+v", result)
+	}
+	head, err := git.getLocalHead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head != rewritten {
+		t.Errorf("expected head %s, got %s", rewritten, head)
+	}
+}
+
+func TestSyncRemovesStaleIndexLock(t *testing.T) {
+	repo := setupLocalBareRemote(t)
+	upstream, err := NewGIT(t.TempDir(), repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	worktree, _, err := upstream.SyncRepoToLocalTemp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitAt(t, upstream, worktree, time.Date(2025, 2, 13, 0, 0, 0, 0, time.UTC))
+	if err := upstream.PushLocalToRemote(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	s := Syncer{TempDir: t.TempDir()}
+	if _, _, err := s.syncBranch(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+
+	lock := filepath.Join(s.workDir(repo), ".git", "index.lock")
+	plant := func(age time.Duration) {
+		t.Helper()
+		if err := os.WriteFile(lock, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		when := time.Now().Add(-age)
+		if err := os.Chtimes(lock, when, when); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a recent lock may be held by another process
+	plant(0)
+	if _, _, err := s.syncBranch(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(lock); err != nil {
+		t.Errorf("expected a recent index.lock to be kept: %v", err)
+	}
+
+	plant(2 * staleLockAge)
+	if _, _, err := s.syncBranch(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(lock); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the stale index.lock to be removed, got %v", err)
+	}
+}
+
+// a bundle with the tag v1 moved to a new commit, and the new tag v2, pushed to a remote with v1 at the old commit
+func TestPushTagConflict(t *testing.T) {
+	g := newLocalGIT(t, "main")
+	worktree, err := g.initLocal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2025, 2, 13, 0, 0, 0, 0, time.UTC)
+	first := commitAt(t, g, worktree, base)
+	tag := func(args ...string) {
+		t.Helper()
+		if out, err := exec.Command("git", append([]string{"-C", g.workDir, "tag"}, args...)...).CombinedOutput(); err != nil {
+			t.Fatalf("failed to tag: %v: %s", err, out)
+		}
+	}
+	tag("v1")
+
+	policies := []TagConflict{TagConflictFail, TagConflictSkip, TagConflictForce}
+	remotes := make(map[TagConflict]string)
+	for _, policy := range policies {
+		bare := filepath.Join(t.TempDir(), "remote.git")
+		if out, err := exec.Command("git", "clone", "--bare", "--quiet", g.workDir, bare).CombinedOutput(); err != nil {
+			t.Fatalf("failed to create bare repository: %v: %s", err, out)
+		}
+		remotes[policy] = bare
+	}
+
+	head := commitAt(t, g, worktree, base.Add(time.Hour))
+	tag("--force", "v1")
+	tag("v2")
+	bundle, err := exec.Command("git", "-C", g.workDir, "bundle", "create", "--quiet", "-", "main", "v1", "v2").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the commits of the branch and tags in the remote
+	remoteRefs := func(bare string) map[string]string {
+		t.Helper()
+		out, err := exec.Command("git", "-C", bare, "for-each-ref", "--format=%(refname) %(objectname)").Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		refs := make(map[string]string)
+		for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+			ref, id, _ := strings.Cut(line, " ")
+			refs[ref] = id
+		}
+		return refs
+	}
+
+	for _, policy := range policies {
+		t.Run(string(policy), func(t *testing.T) {
+			bare := remotes[policy]
+			s := Syncer{TempDir: t.TempDir(), TagConflict: policy}
+			result, err := s.Push(context.Background(), RemoteRepo{URL: "file://" + bare, Branch: "main"}, bytes.NewReader(bundle))
+			refs := remoteRefs(bare)
+
+			switch policy {
+			case TagConflictFail:
+				if !errors.Is(err, ErrTagConflict) {
+					t.Fatalf("expected ErrTagConflict, got %v", err)
+				}
+				if refs["refs/heads/main"] != first.String() || refs["refs/tags/v1"] != first.String() || refs["refs/tags/v2"] != "" {
+					t.Errorf("expected nothing to be pushed, got %v", refs)
+				}
+			case TagConflictSkip:
+				if err != nil {
+					t.Fatal(err)
+				}
+				if refs["refs/heads/main"] != head.String() || refs["refs/tags/v1"] != first.String() || refs["refs/tags/v2"] != head.String() {
+					t.Errorf("expected main and v2 to be pushed, and v1 kept, got %v", refs)
+				}
+				if !slices.Equal(result.TagsPushed, []string{"v2"}) || !slices.Equal(result.TagsSkipped, []string{"v1"}) {
+					t.Errorf("expected v2 pushed and v1 skipped, got %+v", result)
+				}
+			case TagConflictForce:
+				if err != nil {
+					t.Fatal(err)
+				}
+				if refs["refs/heads/main"] != head.String() || refs["refs/tags/v1"] != head.String() || refs["refs/tags/v2"] != head.String() {
+					t.Errorf("expected main, v1 and v2 to be pushed, got %v", refs)
+				}
+				if !slices.Equal(result.TagsPushed, []string{"v1", "v2"}) || len(result.TagsSkipped) != 0 {
+					t.Errorf("expected v1 and v2 pushed, got %+v", result)
+				}
+			}
+		})
+	}
+}
+
+func TestParseTagConflict(t *testing.T) {
+	for _, s := range []string{"fail", "skip", "force"} {
+		if _, err := ParseTagConflict(s); err != nil {
+			t.Errorf("expected %s to be valid, got %v", s, err)
+		}
+	}
+	if _, err := ParseTagConflict("merge"); err == nil {
+		t.Error("expected an unsupported policy to be rejected")
+	}
+}
+
+func TestParseMergeMode(t *testing.T) {
+	for _, s := range []string{"ff-only", "merge"} {
+		if _, err := ParseMergeMode(s); err != nil {
+			t.Errorf("expected %s to be valid, got %v", s, err)
+		}
+	}
+	if _, err := ParseMergeMode("rebase"); err == nil {
+		t.Error("expected an unsupported merge mode to be rejected")
+	}
+}
+
+// force pushes and pushes of all branches do not inspect the bundle in a scratch clone like Push,
+// so their age is checked separately
+func TestPushMaxBundleAgeForceAndAllBranches(t *testing.T) {
+	g := newLocalGIT(t, "main")
+	worktree, err := g.initLocal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2025, 2, 13, 0, 0, 0, 0, time.UTC)
+	first := commitAt(t, g, worktree, base)
+	bare := filepath.Join(t.TempDir(), "remote.git")
+	if out, err := exec.Command("git", "clone", "--bare", "--quiet", g.workDir, bare).CombinedOutput(); err != nil {
+		t.Fatalf("failed to create bare repository: %v: %s", err, out)
+	}
+	commitAt(t, g, worktree, base.Add(time.Hour))
+	bundle, err := exec.Command("git", "-C", g.workDir, "bundle", "create", "--quiet", "-", "main").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	s := Syncer{TempDir: t.TempDir(), MaxBundleAge: time.Hour}
+	_, err = s.ForcePush(ctx, RemoteRepo{URL: "file://" + bare, Branch: "main"}, bytes.NewReader(bundle), first)
+	if !errors.Is(err, ErrBundleTooOld) {
+		t.Errorf("force push: expected ErrBundleTooOld, got %v", err)
+	}
+	_, err = s.Push(ctx, RemoteRepo{URL: "file://" + bare, Branch: AllBranches}, bytes.NewReader(bundle))
+	if !errors.Is(err, ErrBundleTooOld) {
+		t.Errorf("push of all branches: expected ErrBundleTooOld, got %v", err)
+	}
+
+	out, err := exec.Command("git", "-C", bare, "rev-parse", "main").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head := strings.TrimSpace(string(out)); head != first.String() {
+		t.Errorf("expected the remote to be kept at %s, got %s", first, head)
+	}
+
+	// accepted without the limit
+	s.MaxBundleAge = 0
+	if _, err := s.Push(ctx, RemoteRepo{URL: "file://" + bare, Branch: AllBranches}, bytes.NewReader(bundle)); err != nil {
+		t.Errorf("push of all branches: expected no limit, got %v", err)
+	}
+}
+
+func TestPullPackWaitsForLock(t *testing.T) {
+	repo := setupLocalBareRemote(t)
+	ctx := context.Background()
+	if _, err := Push(ctx, t.TempDir(), repo, bytes.NewReader(testdata.FullBundle)); err != nil {
+		t.Fatal(err)
+	}
+	s := Syncer{TempDir: t.TempDir()}
+
+	// in use by another operation
+	unlock := workDirLocks.Lock(s.workDir(repo))
+	type pullResult struct {
+		result PullResult
+		err    error
+	}
+	done := make(chan pullResult)
+	go func() {
+		result, err := s.PullPack(ctx, repo, BundleOptions{})
+		done <- pullResult{result, err}
+	}()
+	select {
+	case <-done:
+		t.Fatal("expected the pull to wait for the lock")
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+
+	actual := <-done
+	if actual.err != nil {
+		t.Fatal(actual.err)
+	}
+	if len(actual.result.Pack) == 0 || len(actual.result.Bundle) == 0 {
+		t.Errorf("expected both a bundle and a pack, got %d and %d bytes", len(actual.result.Bundle), len(actual.result.Pack))
+	}
+	if unlock, ok := workDirLocks.TryLock(s.workDir(repo)); !ok {
+		t.Error("expected the lock to be released")
+	} else {
+		unlock()
+	}
+}
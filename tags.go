@@ -0,0 +1,216 @@
+package git_sync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/pkg/errors"
+)
+
+// TagConflict is how tags of pushed bundles are handled, that exist in the remote with another target
+type TagConflict string
+
+const (
+	// TagConflictFail rejects the push with ErrTagConflict, before anything is pushed
+	TagConflictFail TagConflict = "fail"
+
+	// TagConflictSkip pushes the branch and the other tags, and keeps the conflicting tags of the remote
+	TagConflictSkip TagConflict = "skip"
+
+	// TagConflictForce overwrites the conflicting tags of the remote
+	TagConflictForce TagConflict = "force"
+)
+
+// ErrTagConflict is returned by a push of a bundle with a tag, that exists in the remote with another target
+var ErrTagConflict = errors.New("tag exists in the remote repository with another target")
+
+func ParseTagConflict(s string) (TagConflict, error) {
+	switch p := TagConflict(s); p {
+	case TagConflictFail, TagConflictSkip, TagConflictForce:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unsupported tag conflict policy '%s', expected %s, %s or %s", s, TagConflictFail, TagConflictSkip, TagConflictForce)
+	}
+}
+
+// the tags of the bundle
+func bundleTags(info BundleInfo) []Head {
+	var tags []Head
+	for _, head := range info.Heads {
+		if strings.HasPrefix(head.Ref, "refs/tags/") {
+			tags = append(tags, head)
+		}
+	}
+	return tags
+}
+
+// the heads of the bundle, that are not tags
+func bundleBranchRefs(info BundleInfo) []string {
+	refs := make([]string, 0, len(info.Heads))
+	for _, head := range info.Heads {
+		if !strings.HasPrefix(head.Ref, "refs/tags/") {
+			refs = append(refs, head.Ref)
+		}
+	}
+	return refs
+}
+
+// tagPush is the tags of a bundle to push to the remote
+type tagPush struct {
+	// refspecs of the tags that are missing in the remote, or differ and are forced
+	refSpecs []config.RefSpec
+	// pushed and skipped tags, by short name
+	pushed, skipped []string
+}
+
+// the tags of the bundle to push, by the policy (empty for TagConflictFail). Tags already in the remote with
+// the same target are neither pushed nor skipped. Returns ErrTagConflict (wrapped) for TagConflictFail
+func (g *GIT) planTagPush(ctx context.Context, tags []Head, policy TagConflict) (tagPush, error) {
+	var plan tagPush
+	if len(tags) == 0 {
+		return plan, nil
+	}
+	remoteTags, err := g.remoteTags(ctx)
+	if err != nil {
+		return plan, err
+	}
+
+	var conflicts []string
+	for _, tag := range tags {
+		name := plumbing.ReferenceName(tag.Ref)
+		current, exists := remoteTags[name]
+		if exists && current.String() == tag.CommitID {
+			continue
+		}
+		refSpec := config.RefSpec(fmt.Sprintf("%s:%s", name, name))
+		if exists {
+			switch policy {
+			case TagConflictSkip:
+				plan.skipped = append(plan.skipped, name.Short())
+				continue
+			case TagConflictForce:
+				refSpec = "+" + refSpec
+			default:
+				conflicts = append(conflicts, fmt.Sprintf("%s (remote %s, bundle %s)", name.Short(), current, tag.CommitID))
+				continue
+			}
+		}
+		plan.refSpecs = append(plan.refSpecs, refSpec)
+		plan.pushed = append(plan.pushed, name.Short())
+	}
+	if len(conflicts) > 0 {
+		return tagPush{}, errors.Wrapf(ErrTagConflict, "%s", strings.Join(conflicts, ", "))
+	}
+	return plan, nil
+}
+
+// the tags of the remote, like 'git ls-remote --tags'. Annotated tags are not peeled
+func (g *GIT) remoteTags(ctx context.Context) (map[plumbing.ReferenceName]plumbing.Hash, error) {
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{Name: remoteName, URLs: []string{g.remoteRepo.URL}})
+	refs, err := remote.ListContext(ctx, &git.ListOptions{
+		Auth:          g.getAuth(),
+		ProxyOptions:  g.proxyOptions(),
+		PeelingOption: git.IgnorePeeled})
+	if err != nil {
+		switch {
+		case errors.Is(err, transport.ErrEmptyRemoteRepository):
+			return nil, nil
+		case errors.Is(err, transport.ErrRepositoryNotFound):
+			return nil, ErrRepositoryNotFound
+		case errors.Is(err, transport.ErrAuthenticationRequired), errors.Is(err, transport.ErrAuthorizationFailed):
+			return nil, ErrAuthFailed
+		}
+		return nil, errors.Wrapf(err, "failed to list tags of repository %s", g.remoteRepo.URL)
+	}
+
+	tags := make(map[plumbing.ReferenceName]plumbing.Hash)
+	for _, ref := range refs {
+		if ref.Name().IsTag() && ref.Type() == plumbing.HashReference {
+			tags[ref.Name()] = ref.Hash()
+		}
+	}
+	return tags, nil
+}
+
+// fetch the tags of the bundle into the local repository, overwriting local tags of the same name
+func (g *GIT) fetchBundleTags(r io.Reader) error {
+	dir, err := g.getRandomTempDir()
+	if err != nil {
+		return errors.Wrap(err, "failed to create temp dir")
+	}
+	defer os.RemoveAll(dir)
+	tmpFile := filepath.Join(dir, "bundle")
+	if err := writeFile(tmpFile, r); err != nil {
+		return err
+	}
+
+	_, err = g.runGit(fmt.Sprintf("failed to fetch tags of bundle for repository %s", g.remoteRepo.URL),
+		"-C", g.workDir, "fetch", "--quiet", "--no-write-fetch-head", tmpFile, "+refs/tags/*:refs/tags/*")
+	return err
+}
+
+// push the local tags of the refspecs to the remote. A tag created in the remote meanwhile
+// with another target fails with ErrTagConflict, unless forced
+func (g *GIT) pushTagsToRemote(refSpecs []config.RefSpec) error {
+	if len(refSpecs) == 0 {
+		return nil
+	}
+	localRepo, err := git.PlainOpen(g.workDir)
+	if err != nil {
+		return err
+	}
+
+	err = localRepo.Push(&git.PushOptions{
+		RemoteName:   remoteName,
+		RemoteURL:    g.remoteRepo.URL,
+		RefSpecs:     refSpecs,
+		Auth:         g.getAuth(),
+		ProxyOptions: g.proxyOptions()})
+	if err != nil {
+		if errors.Is(err, git.NoErrAlreadyUpToDate) {
+			return nil
+		}
+		if errors.Is(err, transport.ErrAuthorizationFailed) || errors.Is(err, transport.ErrAuthenticationRequired) {
+			return ErrAuthFailed
+		}
+		// go-git reports an existing tag without a sentinel error
+		if strings.HasPrefix(err.Error(), git.ErrNonFastForwardUpdate.Error()) {
+			return fmt.Errorf("%w: %w", ErrTagConflict, err)
+		}
+		return errors.Wrapf(err, "failed to push tags of local repository %s", g.remoteRepo.URL)
+	}
+	return nil
+}
+
+// plan the push of the tags of the bundle by TagConflict, see GIT.planTagPush
+func (s Syncer) planTags(ctx context.Context, git *GIT, bundle []byte) (tagPush, error) {
+	info, err := ParseBundleHeader(bundle)
+	if err != nil {
+		return tagPush{}, errors.Wrap(err, "failed to parse bundle")
+	}
+	return git.planTagPush(ctx, bundleTags(info), s.TagConflict)
+}
+
+// fetch the tags of the plan from the bundle into the local clone, and push them to the remote
+func (s Syncer) pushTags(ctx context.Context, log *slog.Logger, git *GIT, bundle []byte, plan tagPush) error {
+	if len(plan.refSpecs) == 0 {
+		return nil
+	}
+	if err := git.fetchBundleTags(bytes.NewReader(bundle)); err != nil {
+		return err
+	}
+	return retry(ctx, log, "push", s.MaxRetries, s.RetryBackoff, func() error {
+		return git.pushTagsToRemote(plan.refSpecs)
+	})
+}
@@ -0,0 +1,96 @@
+package git_sync
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TokenFile is a token read from a file, e.g. a mounted secret, so the token is not exposed on the
+// command line or in the environment. Trailing newlines are trimmed. See Watch to pick up rotated tokens
+type TokenFile struct {
+	path string
+
+	mu      sync.RWMutex
+	token   string
+	modTime time.Time
+	size    int64
+}
+
+// NewTokenFile reads the token from the file at path. The token must not be empty
+func NewTokenFile(path string) (*TokenFile, error) {
+	f := &TokenFile{path: path}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Token is the last token read from the file
+func (f *TokenFile) Token() string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.token
+}
+
+// ExtractToken ignores the request, and returns the token of the file, like StaticToken
+func (f *TokenFile) ExtractToken(*http.Request) (string, error) {
+	return f.Token(), nil
+}
+
+// Watch re-reads the file at the interval, when its modification time or size changed, until ctx is done.
+// If the file cannot be read (e.g. while being replaced) or is empty, the previous token is kept
+func (f *TokenFile) Watch(ctx context.Context, interval time.Duration) {
+	log := LoggerFromContext(ctx).With("op", "TokenFile.Watch", "path", f.path)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(f.path)
+		if err != nil {
+			log.Warn("failed to stat token file, keeping the previous token", "err", err)
+			continue
+		}
+		f.mu.RLock()
+		changed := !info.ModTime().Equal(f.modTime) || info.Size() != f.size
+		f.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := f.reload(); err != nil {
+			log.Warn("failed to reload token file, keeping the previous token", "err", err)
+			continue
+		}
+		log.Info("token reloaded")
+	}
+}
+
+func (f *TokenFile) reload() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return errors.Wrap(err, "failed to read token file")
+	}
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return errors.Wrap(err, "failed to read token file")
+	}
+	token := strings.TrimRight(string(data), "\r\n")
+	if token == "" {
+		return errors.Errorf("token file %s is empty", f.path)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.token, f.modTime, f.size = token, info.ModTime(), info.Size()
+	return nil
+}
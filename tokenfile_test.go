@@ -0,0 +1,90 @@
+package git_sync
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTokenFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("first\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewTokenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := f.Token(); actual != "first" {
+		t.Fatalf("expected token 'first', got '%s'", actual)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go f.Watch(ctx, 10*time.Millisecond)
+
+	// an empty file, e.g. while the secret is replaced, keeps the token
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if actual := f.Token(); actual != "first" {
+		t.Fatalf("expected the previous token, got '%s'", actual)
+	}
+
+	if err := os.WriteFile(path, []byte("second\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for f.Token() != "second" {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the rotated token, got '%s'", f.Token())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTokenFileEmpty(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewTokenFile(path); err == nil {
+		t.Error("expected an empty token file to be rejected")
+	}
+	if _, err := NewTokenFile(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected a missing token file to be rejected")
+	}
+}
+
+func TestRequireTokenFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	// comma-separated like server-auth-token, e.g. while rotating
+	if err := os.WriteFile(path, []byte("secret, rotated ,\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewTokenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := RequireTokenFile(f, BearerAuth{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tcs := map[string]int{
+		"secret":            http.StatusOK,
+		"rotated":           http.StatusOK,
+		"secret, rotated ,": http.StatusUnauthorized,
+		"other":             http.StatusUnauthorized}
+	for token, expected := range tcs {
+		r := httptest.NewRequest(http.MethodGet, "/pull", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != expected {
+			t.Errorf("expected status %d for token %s, got %d", expected, token, w.Code)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package git_sync
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/bredtape/git_sync"
+
+// Trace is middleware starting a server span for each request, as a child of the trace context of
+// the 'traceparent' header, if any. Spans of the git operations of the request are children of this span.
+// The span is named after the route, when used with mux.Router.Use. A nil tp uses otel.GetTracerProvider(),
+// which is a no-op unless configured. Without this middleware, no spans are created
+func Trace(tp trace.TracerProvider) func(http.Handler) http.Handler {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	tracer := tp.Tracer(tracerName)
+	propagator := propagation.TraceContext{}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := r.URL.Path
+			if current := mux.CurrentRoute(r); current != nil {
+				if tmpl, err := current.GetPathTemplate(); err == nil {
+					route = tmpl
+				}
+			}
+
+			ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			ctx, span := tracer.Start(ctx, r.Method+" "+route,
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					attribute.String("http.request.method", r.Method),
+					attribute.String("http.route", route)))
+			defer span.End()
+
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r.WithContext(ctx))
+
+			span.SetAttributes(
+				attribute.Int("http.response.status_code", rec.status),
+				attribute.Int("http.response.body.size", rec.bytes))
+			if rec.status >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(rec.status))
+			}
+		})
+	}
+}
+
+// start a span of a git operation on the repository, as a child of the span in ctx.
+// Without a span in ctx (Trace not used), the span is a no-op
+func startSpan(ctx context.Context, name string, repo RemoteRepo, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	tracer := trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName)
+	return tracer.Start(ctx, name, trace.WithAttributes(append([]attribute.KeyValue{
+		attribute.String("repo.url", stripCredentials(repo.URL)),
+		attribute.String("repo.branch", repo.Branch)}, attrs...)...))
+}
+
+// end the span, recording the error if any
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,82 @@
+package git_sync
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracePull(t *testing.T) {
+	branch := "main"
+	repoURL, head := createPublicRepo(t, branch)
+
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	router := mux.NewRouter()
+	router.Handle("/pull", NewGitPullHandler(t.TempDir(), HandlerOptions{}))
+	router.Use(Trace(tp))
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/pull?"+url.Values{"repository": {repoURL}, "branch": {branch}}.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	root, ok := spans["GET /pull"]
+	if !ok {
+		t.Fatalf("expected a span of the handler, got %v", recorder.Ended())
+	}
+	if actual := root.SpanContext().TraceID().String(); actual != traceID {
+		t.Errorf("expected trace ID %s from traceparent, got %s", traceID, actual)
+	}
+	if actual := root.Parent().SpanID().String(); actual != "00f067aa0ba902b7" {
+		t.Errorf("expected parent span from traceparent, got %s", actual)
+	}
+
+	for _, name := range []string{"git.sync", "git.bundle.create"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("expected span %s", name)
+			continue
+		}
+		if span.Parent().SpanID() != root.SpanContext().SpanID() {
+			t.Errorf("expected span %s to be a child of the handler span", name)
+		}
+		if !hasAttribute(span, attribute.String("repo.branch", branch)) {
+			t.Errorf("expected span %s with the branch, got %v", name, span.Attributes())
+		}
+	}
+	if span, ok := spans["git.bundle.create"]; ok && !hasAttribute(span, attribute.String("git.head", head.String())) {
+		t.Errorf("expected head %s, got %v", head, span.Attributes())
+	}
+}
+
+func hasAttribute(span sdktrace.ReadOnlySpan, attr attribute.KeyValue) bool {
+	for _, a := range span.Attributes() {
+		if a == attr {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package git_sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// the bundle was rejected, as opposed to a failure to verify it
+var errInvalidBundle = errors.New("invalid bundle")
+
+// BundleVerification is the response of a verify
+type BundleVerification struct {
+	IsComplete bool `json:"is_complete"`
+	// ContainsRef is the first head, as '<commit ID> <ref>'
+	ContainsRef string `json:"contains_ref"`
+	// RequiresRef is the first prerequisite. Empty for a complete bundle
+	RequiresRef   string   `json:"requires_ref,omitempty"`
+	HashAlgorithm string   `json:"hash_algorithm"`
+	Heads         []Head   `json:"heads"`
+	Prerequisites []string `json:"prerequisites,omitempty"`
+	// PackVerified is whether git verified the objects of the bundle. Only complete bundles are verified,
+	// since the prerequisites of a partial bundle are not available
+	PackVerified bool `json:"pack_verified"`
+}
+
+// GitVerifyHandler inspects a bundle without applying it. No remote repository is involved
+type GitVerifyHandler struct {
+	tempDir string
+	opts    HandlerOptions
+}
+
+func NewGitVerifyHandler(tempDir string, opts HandlerOptions) *GitVerifyHandler {
+	return &GitVerifyHandler{tempDir: tempDir, opts: opts}
+}
+
+func (h *GitVerifyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	// optional, checks that a push to the branch would accept the bundle
+	branch := r.URL.Query().Get("branch")
+	log := LoggerFromContext(r.Context()).With("op", "GitVerifyHandler.ServeHTTP", "repo.branch", branch)
+
+	if ct := r.Header.Get("Content-Type"); !isBundleContentType(ct) {
+		log.Debug("unsupported content type", "contentType", ct)
+		http.Error(w, fmt.Sprintf("Unsupported Content-Type '%s', expected %s or %s", ct, contentTypeOctetStream, contentTypeGitBundle), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	metricOps.WithLabelValues("verify", "").Inc()
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	w = rec
+	mErr := &opsError{op: "verify", rec: rec}
+	defer mErr.record()
+
+	body, err := h.opts.bundleBody(r)
+	if err != nil {
+		log.Debug("failed to decompress body", "err", err)
+		mErr.Inc()
+		writeBundleBodyError(w, err)
+		return
+	}
+	defer body.Close()
+	bundle, err := io.ReadAll(body)
+	if errors.Is(err, ErrBundleTooLarge) {
+		log.Warn("bundle rejected", "err", err)
+		mErr.Inc()
+		writeBundleBodyError(w, err)
+		return
+	}
+	if err != nil {
+		log.Error("failed to read bundle", "err", err)
+		mErr.Inc()
+		http.Error(w, "failed to read bundle", http.StatusBadRequest)
+		return
+	}
+
+	release, err := h.opts.Limiter.Acquire(r.Context(), "")
+	if err != nil {
+		log.Warn("verify rejected", "err", err)
+		mErr.Inc()
+		h.opts.Limiter.writeError(w, err)
+		return
+	}
+	defer release()
+
+	_, done := h.opts.Operations.Start(r.Context())
+	defer done()
+
+	result, err := h.verify(bundle, branch)
+	if err != nil {
+		mErr.Inc()
+		var cmdErr *CommandError
+		switch {
+		case errors.Is(err, errInvalidBundle) && errors.As(err, &cmdErr):
+			log.Debug("bundle rejected by git", "err", err, "stderr", cmdErr.StdErr)
+			http.Error(w, fmt.Sprintf("invalid bundle: %s", cmdErr.StdErr), http.StatusBadRequest)
+		case errors.Is(err, errInvalidBundle):
+			log.Debug("invalid bundle", "err", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			log.Error("verify failed", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Error("failed to write verification", "err", err)
+	}
+}
+
+// parse and validate the bundle header, and verify the pack of complete bundles with git.
+// Returns errInvalidBundle (wrapped) if the bundle is rejected
+func (h *GitVerifyHandler) verify(bundle []byte, branch string) (BundleVerification, error) {
+	info, err := ParseBundleHeader(bundle)
+	if err == nil {
+		err = info.Validate()
+	}
+	if err == nil && branch != "" {
+		_, err = bundleRefForBranch(info, branch, h.opts.AllowRefMismatch)
+	}
+	if err != nil {
+		return BundleVerification{}, fmt.Errorf("%w: %w", errInvalidBundle, err)
+	}
+
+	result := BundleVerification{
+		IsComplete:    info.IsComplete,
+		ContainsRef:   info.ContainsRef,
+		RequiresRef:   info.RequiresRef,
+		HashAlgorithm: info.HashAlgorithm,
+		Heads:         info.Heads,
+		Prerequisites: info.Prerequisites}
+	if info.IsComplete {
+		if _, err := verifyBundle(h.tempDir, bundle, h.opts.CommandTimeout); err != nil {
+			var cmdErr *CommandError
+			if errors.As(err, &cmdErr) {
+				return BundleVerification{}, fmt.Errorf("%w: %w", errInvalidBundle, err)
+			}
+			return BundleVerification{}, err
+		}
+		result.PackVerified = true
+	}
+	return result, nil
+}
@@ -0,0 +1,180 @@
+package git_sync
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// full and partial bundle of a local repository with two commits on main
+func createTestBundles(t *testing.T) (full, partial []byte) {
+	t.Helper()
+	g := newLocalGIT(t, "main")
+	worktree, err := g.initLocal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2025, 2, 13, 0, 0, 0, 0, time.UTC)
+	commitAt(t, g, worktree, base)
+	commitAt(t, g, worktree, base.Add(time.Hour))
+
+	full, err = g.CreateBundleFromLocal(BundleOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	partial, err = g.CreateBundleFromLocal(BundleOptions{MaxCommits: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return full, partial
+}
+
+func verify(t *testing.T, query string, bundle []byte) (*http.Response, BundleVerification) {
+	t.Helper()
+	server := httptest.NewServer(NewGitVerifyHandler(t.TempDir(), HandlerOptions{}))
+	t.Cleanup(server.Close)
+
+	resp, err := http.Post(server.URL+"/verify"+query, contentTypeGitBundle, bytes.NewReader(bundle))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result BundleVerification
+	if resp.StatusCode == http.StatusOK {
+		if err := json.Unmarshal(body, &result); err != nil {
+			t.Fatalf("failed to decode %s: %v", body, err)
+		}
+	}
+	return resp, result
+}
+
+func TestVerifyCompleteBundle(t *testing.T) {
+	full, _ := createTestBundles(t)
+	resp, result := verify(t, "?branch=main", full)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if !result.IsComplete || !result.PackVerified || result.RequiresRef != "" || result.HashAlgorithm != "sha1" {
+		t.Errorf("unexpected verification %+v", result)
+	}
+	if len(result.Heads) != 1 || result.Heads[0].Ref != "refs/heads/main" {
+		t.Errorf("expected head of refs/heads/main, got %+v", result.Heads)
+	}
+}
+
+func TestVerifyPartialBundle(t *testing.T) {
+	_, partial := createTestBundles(t)
+	resp, result := verify(t, "", partial)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if result.IsComplete || result.PackVerified || result.RequiresRef == "" || len(result.Prerequisites) != 1 {
+		t.Errorf("unexpected verification %+v", result)
+	}
+}
+
+func TestVerifyInvalidBundle(t *testing.T) {
+	full, _ := createTestBundles(t)
+	tcs := map[string]struct {
+		query  string
+		bundle []byte
+	}{
+		"not a bundle":   {"", []byte("hello")},
+		"truncated pack": {"", full[:len(full)-10]},
+		"other branch":   {"?branch=dev", full},
+	}
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			resp, _ := verify(t, tc.query, tc.bundle)
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestVerifyBundlePartialMissingPrerequisites(t *testing.T) {
+	_, partial := createTestBundles(t)
+	_, err := VerifyBundle(t.TempDir(), partial)
+	if !errors.Is(err, ErrMissingPrerequisites) {
+		t.Errorf("expected ErrMissingPrerequisites, got %v", err)
+	}
+}
+
+func TestGetBundleInfo(t *testing.T) {
+	full, partial := createTestBundles(t)
+	// no local clone is needed
+	g := newLocalGIT(t, "main")
+
+	info, err := g.GetBundleInfo(full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsComplete || !info.IsOkay || !strings.HasSuffix(info.ContainsRef, " refs/heads/main") {
+		t.Errorf("expected complete, okay bundle of main, got %+v", info)
+	}
+
+	if _, err := g.GetBundleInfo(partial); !errors.Is(err, ErrMissingPrerequisites) {
+		t.Errorf("expected ErrMissingPrerequisites for a partial bundle, got %v", err)
+	}
+	// the objects are unpacked, not only the header verified
+	if _, err := g.GetBundleInfo(full[:len(full)-20]); err == nil {
+		t.Error("expected error for a truncated pack")
+	}
+}
+
+// the heads of the parsed header are the heads listed by git
+func TestGetBundleListHeads(t *testing.T) {
+	g := newLocalGIT(t, "main")
+	worktree, err := g.initLocal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2025, 2, 13, 0, 0, 0, 0, time.UTC)
+	commitAt(t, g, worktree, base)
+	if out, err := exec.Command("git", "-C", g.workDir, "branch", "dev").CombinedOutput(); err != nil {
+		t.Fatalf("failed to create branch: %v: %s", err, out)
+	}
+	commitAt(t, g, worktree, base.Add(time.Hour))
+
+	bundleFile := filepath.Join(t.TempDir(), "bundle")
+	if out, err := exec.Command("git", "-C", g.workDir, "bundle", "create", bundleFile, "--branches").CombinedOutput(); err != nil {
+		t.Fatalf("failed to create bundle: %v: %s", err, out)
+	}
+	out, err := exec.Command("git", "bundle", "list-heads", bundleFile).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := ParseBundleListHeadsOutput(string(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(bundleFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	heads, err := g.GetBundleListHeads(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(heads) != 2 || !reflect.DeepEqual(heads, expected) {
+		t.Errorf("expected heads %+v, got %+v", expected, heads)
+	}
+}
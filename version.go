@@ -0,0 +1,64 @@
+package git_sync
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Version, Commit and BuildDate of the build, injected with -ldflags, e.g.
+// -X github.com/bredtape/git_sync.Version=v1.2.3. Commit defaults to the VCS info embedded by go build, if any.
+// BuildDate is only set by -ldflags, since the VCS info only has the time of the commit
+var (
+	Version   = "dev"
+	Commit    = ""
+	BuildDate = ""
+)
+
+var metricBuildInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "git_sync_build_info",
+	Help: "Build of git_sync, with value 1 for the running version and commit"}, []string{"version", "commit"})
+
+// BuildInfo describes the running build, as returned by GET /version
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	// CommitDate is the time of the commit, from the embedded VCS info
+	CommitDate string `json:"commit_date,omitempty"`
+}
+
+// GetBuildInfo returns the injected build info, with Commit from the embedded VCS info if not injected
+func GetBuildInfo() BuildInfo {
+	info := BuildInfo{Version: Version, Commit: Commit, BuildDate: BuildDate}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = s.Value
+			case s.Key == "vcs.time":
+				info.CommitDate = s.Value
+			}
+		}
+	}
+	return info
+}
+
+// ExposeBuildInfo sets the git_sync_build_info metric of the running build
+func ExposeBuildInfo() {
+	info := GetBuildInfo()
+	metricBuildInfo.WithLabelValues(info.Version, info.Commit).Set(1)
+}
+
+// VersionHandler responds with the BuildInfo as JSON
+func VersionHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(GetBuildInfo()); err != nil {
+			LoggerFromContext(r.Context()).Error("failed to write version", "op", "VersionHandler", "err", err)
+		}
+	})
+}
@@ -0,0 +1,36 @@
+package git_sync
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestVersionHandler(t *testing.T) {
+	defer func(version, commit, buildDate string) {
+		Version, Commit, BuildDate = version, commit, buildDate
+	}(Version, Commit, BuildDate)
+	Version, Commit, BuildDate = "v1.2.3", "f8be008f3733c1a9b7962c1f5a50679266565e31", "2025-02-13T08:00:00Z"
+
+	w := httptest.NewRecorder()
+	VersionHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/version", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	var actual BuildInfo
+	if err := json.NewDecoder(w.Body).Decode(&actual); err != nil {
+		t.Fatal(err)
+	}
+	expected := BuildInfo{Version: "v1.2.3", Commit: "f8be008f3733c1a9b7962c1f5a50679266565e31", BuildDate: "2025-02-13T08:00:00Z"}
+	if actual != expected {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+
+	ExposeBuildInfo()
+	if value := testutil.ToFloat64(metricBuildInfo.WithLabelValues("v1.2.3", "f8be008f3733c1a9b7962c1f5a50679266565e31")); value != 1 {
+		t.Errorf("expected build info metric 1, got %v", value)
+	}
+}
@@ -0,0 +1,104 @@
+package git_sync
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var metricWebhookFailures = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "git_sync_webhook_failures_total",
+	Help: "Number of webhook events that could not be delivered"})
+
+// header with the HMAC-SHA256 of the event body, as 'sha256=<hex>', when the webhook has a secret
+const headerWebhookSignature = "X-Git-Sync-Signature"
+
+const webhookTimeout = 10 * time.Second
+
+// Event is posted to the webhook when a pull, push or mirror succeeds
+type Event struct {
+	// Op is pull, push or mirror
+	Op string `json:"op"`
+	// Repository is the URL of the repository. For a mirror, the sink
+	Repository string `json:"repository"`
+	Branch     string `json:"branch"`
+	// Head is the head of the branch. Empty when syncing all branches
+	Head string `json:"head,omitempty"`
+	// Commits is the number of commits in the pulled bundle, or added by the push or mirror
+	Commits   int       `json:"commits"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Webhook posts events as JSON to a URL. A nil *Webhook does nothing
+type Webhook struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+// NewWebhook posts events to the URL. If the secret is set, events are signed with it, in the X-Git-Sync-Signature header
+func NewWebhook(url, secret string) *Webhook {
+	return &Webhook{url: url, secret: []byte(secret), client: &http.Client{Timeout: webhookTimeout}}
+}
+
+// Send posts the event in the background. Failures are logged and counted, but do not fail the operation.
+// The delivery is registered with ops, so shutdown waits for it, and cancels it when timing out
+func (wh *Webhook) Send(ops *Operations, log *slog.Logger, event Event) {
+	if wh == nil {
+		return
+	}
+	// not the context of the request, which is cancelled once the response is written
+	ctx, done := ops.Start(context.Background())
+	go func() {
+		defer done()
+		if err := wh.post(ctx, event); err != nil {
+			log.Warn("failed to deliver webhook event", "err", err, "event.op", event.Op)
+			metricWebhookFailures.Inc()
+		}
+	}()
+}
+
+func (wh *Webhook) post(ctx context.Context, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal event")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "failed to create webhook request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(wh.secret) > 0 {
+		req.Header.Set(headerWebhookSignature, signPayload(wh.secret, body))
+	}
+
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to post webhook event")
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return nil
+}
+
+// HMAC-SHA256 of the body, as 'sha256=<hex>'
+func signPayload(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
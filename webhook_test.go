@@ -0,0 +1,172 @@
+package git_sync
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// webhook receiver responding with the status, passing each request and its body to the channels
+func createWebhookReceiver(t *testing.T, status int) (string, <-chan *http.Request, <-chan []byte) {
+	requests := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- r
+		bodies <- body
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL, requests, bodies
+}
+
+func TestWebhookSignsEvent(t *testing.T) {
+	receiverURL, requests, bodies := createWebhookReceiver(t, http.StatusNoContent)
+
+	event := Event{Op: "push", Repository: "http://localhost/repo.git", Branch: "main", Head: "abc", Commits: 2, Timestamp: time.Now().UTC()}
+	NewWebhook(receiverURL, "secret").Send(nil, slog.Default(), event)
+
+	var r *http.Request
+	var body []byte
+	select {
+	case r = <-requests:
+		body = <-bodies
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook event not received")
+	}
+
+	if actual := r.Header.Get("Content-Type"); actual != "application/json" {
+		t.Errorf("expected Content-Type application/json, got '%s'", actual)
+	}
+	if expected, actual := signPayload([]byte("secret"), body), r.Header.Get(headerWebhookSignature); actual != expected {
+		t.Errorf("expected signature '%s', got '%s'", expected, actual)
+	}
+	var actual Event
+	if err := json.Unmarshal(body, &actual); err != nil {
+		t.Fatal(err)
+	}
+	if !actual.Timestamp.Equal(event.Timestamp) {
+		t.Errorf("expected timestamp %v, got %v", event.Timestamp, actual.Timestamp)
+	}
+	actual.Timestamp = event.Timestamp
+	if actual != event {
+		t.Errorf("expected event %+v, got %+v", event, actual)
+	}
+}
+
+func TestWebhookFailureCounted(t *testing.T) {
+	receiverURL, requests, _ := createWebhookReceiver(t, http.StatusInternalServerError)
+
+	before := testutil.ToFloat64(metricWebhookFailures)
+	NewWebhook(receiverURL, "").Send(nil, slog.Default(), Event{Op: "pull"})
+
+	select {
+	case r := <-requests:
+		if actual := r.Header.Get(headerWebhookSignature); actual != "" {
+			t.Errorf("expected no signature without secret, got '%s'", actual)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook event not received")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(metricWebhookFailures) != before+1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected failure metric %v, got %v", before+1, testutil.ToFloat64(metricWebhookFailures))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebhookDeliveryTrackedByOperations(t *testing.T) {
+	release := make(chan struct{})
+	received := make(chan struct{}, 2)
+	// the body is read, so the server notices when the client cancels
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		received <- struct{}{}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(server.Close)
+	wh := NewWebhook(server.URL, "")
+
+	// shutdown waits for the delivery
+	ops := NewOperations()
+	wh.Send(ops, slog.Default(), Event{Op: "push"})
+	<-received
+	if actual := ops.Active(); actual != 1 {
+		t.Fatalf("expected the delivery to be tracked, got %d active", actual)
+	}
+	close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if running := ops.Shutdown(ctx); running != 0 {
+		t.Fatalf("expected the delivery to complete, got %d running", running)
+	}
+
+	// the delivery is cancelled when shutdown times out
+	ops = NewOperations()
+	before := testutil.ToFloat64(metricWebhookFailures)
+	blocked := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		received <- struct{}{}
+		<-r.Context().Done()
+	}))
+	t.Cleanup(blocked.Close)
+	NewWebhook(blocked.URL, "").Send(ops, slog.Default(), Event{Op: "push"})
+	<-received
+	expired, cancelExpired := context.WithCancel(context.Background())
+	cancelExpired()
+	if running := ops.Shutdown(expired); running != 1 {
+		t.Fatalf("expected the delivery to be running at shutdown, got %d", running)
+	}
+	if !ops.Wait(ctx) {
+		t.Fatal("expected the cancelled delivery to complete")
+	}
+	if actual := testutil.ToFloat64(metricWebhookFailures); actual != before+1 {
+		t.Errorf("expected the cancelled delivery to be counted as failed, got %v", actual-before)
+	}
+}
+
+func TestPullSendsWebhookEvent(t *testing.T) {
+	branch := "main"
+	repoURL, head := createPublicRepo(t, branch)
+	receiverURL, _, bodies := createWebhookReceiver(t, http.StatusOK)
+
+	h := NewGitPullHandler(t.TempDir(), HandlerOptions{Webhook: NewWebhook(receiverURL, "")})
+	server := httptest.NewServer(h)
+	t.Cleanup(server.Close)
+
+	resp, err := http.Get(server.URL + "?" + url.Values{"repository": {repoURL}, "branch": {branch}}.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	var event Event
+	select {
+	case body := <-bodies:
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook event not received")
+	}
+	if event.Op != "pull" || event.Repository != repoURL || event.Branch != branch || event.Head != head.String() || event.Commits != 1 {
+		t.Errorf("unexpected event %+v", event)
+	}
+}